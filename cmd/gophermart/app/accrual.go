@@ -37,7 +37,7 @@ func (srv *Server) RequestAccrual(ctx context.Context, order model.Order) (*mode
 		return nil, false
 	}
 
-	var newInfo model.Order
+	var bonusInfo model.OrderBonus
 	Sugar.Infoln("-----------NEW REQUEST---------------")
 	Sugar.Infoln(
 		"uri", request.RequestURI,
@@ -47,17 +47,25 @@ func (srv *Server) RequestAccrual(ctx context.Context, order model.Order) (*mode
 	Sugar.Infoln("response-from-accrual: ", string(dataResponse))
 
 	reader := io.NopCloser(bytes.NewReader(dataResponse))
-	if err := json.NewDecoder(reader).Decode(&newInfo); err != nil {
+	if err := json.NewDecoder(reader).Decode(&bonusInfo); err != nil {
 		Sugar.Infoln("Error to parse response body")
 		return nil, false
 	}
 
 	// анализируем ответы
 	if response.StatusCode == http.StatusOK {
+		if bonusInfo.Accrual.Raw != "" {
+			Sugar.Warnf("заказ %v: начисление %v округлено до %v",
+				order.ID, bonusInfo.Accrual.Raw, bonusInfo.Accrual.Amount)
+		}
 		// обновляем данные
-		newInfo.ID = order.ID
-		newInfo.Owner = order.Owner
-		newInfo.UploadDate = order.UploadDate
+		newInfo := model.Order{
+			ID:         order.ID,
+			Owner:      order.Owner,
+			UploadDate: order.UploadDate,
+			Status:     bonusInfo.Status,
+			Bonus:      bonusInfo.Accrual.Amount,
+		}
 		return &newInfo, true
 	} else if response.StatusCode == http.StatusNoContent {
 		// данных по заказу нет - можно не обновлять
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+// AddAdjustment записывает ручную корректировку баланса. Списание может
+// увести баланс в минус, например при возврате платежа
+func (srv *Server) AddAdjustment(ctx context.Context, adjustment *model.Adjustment) error {
+	err := retry.Do(func() error {
+		return srv.storage.AddAdjustment(ctx, adjustment)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+
+	if err != nil {
+		Sugar.Errorln(err)
+		return err
+	}
+
+	return nil
+}
+
+func (srv *Server) AllAdjustments(ctx context.Context, user *model.User) ([]*model.Adjustment, model.EndPointStatus, error) {
+	var err error
+	var adjustments []*model.Adjustment
+
+	err = retry.Do(func() error {
+		adjustments, err = srv.storage.GetAllAdjustments(ctx, user)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+
+	if err != nil {
+
+		Sugar.Errorln(err)
+
+		// connection problems
+		if errors.Is(err, storage.ErrTransient) {
+			return nil, model.ConnectionError, err
+		}
+
+		return nil, model.OtherError, err
+	}
+
+	if len(adjustments) == 0 {
+		return nil, model.AdjustmentsNoData, nil
+	}
+
+	return adjustments, model.AdjustmentsDataExists, nil
+}
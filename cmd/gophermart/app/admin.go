@@ -0,0 +1,310 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/validation"
+)
+
+// максимальное число пользователей в результате поиска
+const adminSearchLimit = 50
+
+func (srv *Server) AdminSearchUsers(w http.ResponseWriter, r *http.Request) {
+
+	loginPattern := validation.NormalizeLogin(r.URL.Query().Get("login"))
+	if loginPattern == "" {
+		http.Error(w, "неверный формат запроса: не указан логин для поиска", http.StatusBadRequest)
+		return
+	}
+
+	if !srv.auditAdminAction(w, r, model.AuditActionSearchUsers, loginPattern) {
+		return
+	}
+
+	users, err := srv.SearchUsers(r.Context(), loginPattern, adminSearchLimit)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// хеш пароля оператору не показываем
+	profiles := make([]model.UserProfile, 0, len(users))
+	for _, el := range users {
+		profiles = append(profiles, userProfile(el))
+	}
+
+	writeJSON(w, profiles)
+}
+
+func (srv *Server) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+
+	userInfo := srv.adminTargetUser(w, r, model.AuditActionViewUser)
+	if userInfo == nil {
+		return
+	}
+
+	writeJSON(w, userProfile(userInfo))
+}
+
+func (srv *Server) AdminGetOrders(w http.ResponseWriter, r *http.Request) {
+
+	userInfo := srv.adminTargetUser(w, r, model.AuditActionViewOrders)
+	if userInfo == nil {
+		return
+	}
+
+	orders, status, err := srv.OrderList(r.Context(), userInfo)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status == model.OrderListEmpty {
+		w.WriteHeader(http.StatusNoContent)
+		body := "отсутствуют данные по запросу"
+		io.WriteString(w, body)
+	} else if status == model.OrderListExists {
+		writeJSON(w, orders)
+	}
+}
+
+func (srv *Server) AdminGetWithdrawals(w http.ResponseWriter, r *http.Request) {
+
+	userInfo := srv.adminTargetUser(w, r, model.AuditActionViewWithdrawals)
+	if userInfo == nil {
+		return
+	}
+
+	withdrawals, status, err := srv.AllWithdrawals(r.Context(), userInfo)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status == model.WithdrawalsNoData {
+		w.WriteHeader(http.StatusNoContent)
+		body := "нет ни одного списания"
+		io.WriteString(w, body)
+	} else if status == model.WithdrawalsDataExists {
+		writeJSON(w, withdrawals)
+	}
+}
+
+func (srv *Server) AdminGetBalance(w http.ResponseWriter, r *http.Request) {
+
+	userInfo := srv.adminTargetUser(w, r, model.AuditActionViewBalance)
+	if userInfo == nil {
+		return
+	}
+
+	breakdown, err := srv.BalanceBreakdown(r.Context(), userInfo)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, breakdown)
+}
+
+func (srv *Server) AdminAddAdjustment(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Amount money.Amount `json:"amount"`
+		Reason string       `json:"reason"`
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Amount == 0 || request.Reason == "" {
+		http.Error(w, "неверный формат запроса: нужны ненулевая сумма и причина корректировки", http.StatusBadRequest)
+		return
+	}
+
+	userInfo := srv.adminTargetUser(w, r, model.AuditActionAdjustBalance)
+	if userInfo == nil {
+		return
+	}
+
+	admin, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+	adjustment := &model.Adjustment{
+		Amount:        request.Amount,
+		Reason:        request.Reason,
+		ProcessedDate: time.Now(),
+		Operator:      admin.Login,
+		User:          userInfo.Login,
+	}
+
+	err = srv.AddAdjustment(r.Context(), adjustment)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, adjustment)
+}
+
+func (srv *Server) AdminBlockUser(w http.ResponseWriter, r *http.Request) {
+	srv.adminSetBlocked(w, r, true)
+}
+
+func (srv *Server) AdminUnblockUser(w http.ResponseWriter, r *http.Request) {
+	srv.adminSetBlocked(w, r, false)
+}
+
+func (srv *Server) adminSetBlocked(w http.ResponseWriter, r *http.Request, blocked bool) {
+
+	action := model.AuditActionUnblockUser
+	if blocked {
+		action = model.AuditActionBlockUser
+	}
+
+	admin, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+	if blocked && strings.EqualFold(admin.Login, validation.NormalizeLogin(chi.URLParam(r, "login"))) {
+		http.Error(w, "нельзя заблокировать самого себя", http.StatusBadRequest)
+		return
+	}
+
+	userInfo := srv.adminTargetUser(w, r, action)
+	if userInfo == nil {
+		return
+	}
+
+	err := srv.SetUserBlocked(r.Context(), userInfo.Login, blocked)
+	// пользователь удалил аккаунт после поиска
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "пользователь не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userInfo.Blocked = blocked
+	writeJSON(w, userProfile(userInfo))
+}
+
+func (srv *Server) AdminRepollOrder(w http.ResponseWriter, r *http.Request) {
+
+	orderID := chi.URLParam(r, "number")
+
+	userInfo := srv.adminTargetUser(w, r, model.AuditActionRepollOrder)
+	if userInfo == nil {
+		return
+	}
+
+	order, err := srv.GetOrder(r.Context(), orderID)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if order == nil || order.Owner != userInfo.Login {
+		http.Error(w, "заказ не найден", http.StatusNotFound)
+		return
+	}
+
+	order, err = srv.RepollOrder(r.Context(), order)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if order == nil {
+		http.Error(w, "заказ уже опрашивается, повторите позже", http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, order)
+}
+
+// adminTargetUser записывает действие оператора в журнал аудита и находит
+// пользователя из адреса запроса. Если пользователь не найден или произошла
+// ошибка, ответ уже отправлен клиенту и возвращается nil
+func (srv *Server) adminTargetUser(w http.ResponseWriter, r *http.Request, action string) *model.User {
+
+	login := validation.NormalizeLogin(chi.URLParam(r, "login"))
+
+	target := login
+	if orderID := chi.URLParam(r, "number"); orderID != "" {
+		target = login + "/" + orderID
+	}
+	if !srv.auditAdminAction(w, r, action, target) {
+		return nil
+	}
+
+	userInfo, err := srv.GetUser(r.Context(), &model.User{Login: login})
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if userInfo == nil {
+		http.Error(w, "пользователь не найден", http.StatusNotFound)
+		return nil
+	}
+
+	return userInfo
+}
+
+// auditAdminAction записывает действие оператора в журнал аудита до его
+// выполнения. Без записи в журнале действие не выполняется
+func (srv *Server) auditAdminAction(w http.ResponseWriter, r *http.Request, action string, target string) bool {
+
+	admin, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+	reason, _ := r.Context().Value(ctxKey("auditReason")).(string)
+
+	err := srv.Audit(r.Context(), admin.Login, action, target, reason)
+	if err != nil {
+		http.Error(w, "не удалось записать действие в журнал аудита: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+func userProfile(userInfo *model.User) model.UserProfile {
+	return model.UserProfile{
+		Login:   userInfo.Login,
+		Role:    userInfo.Role,
+		Blocked: userInfo.Blocked,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(data)
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, body)
+}
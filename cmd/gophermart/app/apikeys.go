@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kvvPro/gophermart/cmd/gophermart/auth"
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+// время последнего использования ключа обновляется не чаще этого интервала,
+// чтобы не писать в базу на каждый запрос
+const apiKeyTouchInterval = time.Minute
+
+// CreateAPIKey создаёт ключ API пользователя. Сам ключ возвращается
+// только здесь, в базе хранится его хеш
+func (srv *Server) CreateAPIKey(ctx context.Context, login string, name string, scopes []string) (*model.APIKey, string, error) {
+	id, err := auth.NewSessionID()
+	if err != nil {
+		return nil, "", err
+	}
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiKey := &model.APIKey{
+		ID:        id,
+		Name:      name,
+		Prefix:    prefix,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		Hash:      hash,
+		User:      login,
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.AddAPIKey(ctx, apiKey)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, "", err
+	}
+
+	return apiKey, key, nil
+}
+
+func (srv *Server) APIKeys(ctx context.Context, login string) ([]*model.APIKey, error) {
+	var keys []*model.APIKey
+	var err error
+
+	err = retry.Do(func() error {
+		keys, err = srv.storage.GetAPIKeys(ctx, login)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey отзывает ключ. Возвращает false, если ключ не найден
+func (srv *Server) RevokeAPIKey(ctx context.Context, login string, id string) (bool, error) {
+	var revoked bool
+	var err error
+
+	err = retry.Do(func() error {
+		revoked, err = srv.storage.RevokeAPIKey(ctx, login, id)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+// CheckAPIKey находит действующий ключ API и отмечает его использование.
+// Возвращает nil, если ключ не найден или отозван
+func (srv *Server) CheckAPIKey(ctx context.Context, key string) (*model.APIKey, error) {
+	var apiKey *model.APIKey
+	var err error
+
+	err = retry.Do(func() error {
+		apiKey, err = srv.storage.GetAPIKeyByHash(ctx, auth.HashAPIKey(key))
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	if apiKey == nil || apiKey.RevokedAt != nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		// ошибка обновления времени использования не должна мешать запросу
+		if err := srv.storage.TouchAPIKey(ctx, apiKey.ID, now); err != nil {
+			Sugar.Errorf("не удалось обновить время использования ключа: %v", err.Error())
+		}
+		apiKey.LastUsedAt = &now
+	}
+
+	return apiKey, nil
+}
@@ -2,15 +2,27 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/kvvPro/gophermart/cmd/gophermart/auth"
 	"github.com/kvvPro/gophermart/cmd/gophermart/config"
+	"github.com/kvvPro/gophermart/internal/lockout"
 	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/oidc"
+	"github.com/kvvPro/gophermart/internal/password"
+	"github.com/kvvPro/gophermart/internal/sessioncache"
 	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/validation"
 
+	"github.com/kvvPro/gophermart/internal/storage/memory"
 	"github.com/kvvPro/gophermart/internal/storage/postgres"
+	"github.com/kvvPro/gophermart/internal/storage/sqlite"
 )
 
 type Server struct {
@@ -20,24 +32,255 @@ type Server struct {
 	storage                storage.Storage
 	ReadingAccrualInterval int
 	UpdateThreadCount      int
+	AccrualBatchSize       int
+	AccrualLeaseTime       time.Duration
+	RefreshTokenExp        time.Duration
+	passwordParams         password.Params
+	passwordPolicy         validation.Policy
+	authenticator          *auth.Authenticator
+	twoFactorIssuer        string
+	loginGuard             *lockout.Guard
+	sessionCache           *sessioncache.Cache
+	// workerID помечает заказы, взятые этим экземпляром в аренду
+	workerID string
+	// oidcProvider равен nil, если вход через внешнего провайдера не настроен
+	oidcProvider *oidc.Provider
+	// oidcReauthExp — насколько свежим должен быть вход через провайдера,
+	// чтобы пользователь без пароля подтвердил им операцию
+	oidcReauthExp time.Duration
+	// WithdrawalTwoFactorThreshold — списания больше этой суммы требуют
+	// свежего кода второго фактора, 0 - не требуют
+	WithdrawalTwoFactorThreshold money.Amount
 }
 
+const (
+	defaultRefreshTokenExp = 30 * 24 * time.Hour
+	defaultTwoFactorIssuer = "Gophermart"
+	defaultSessionCacheTTL = 10 * time.Second
+)
+
+// опрос системы начислений
+const (
+	defaultAccrualBatchSize  = 100
+	defaultUpdateThreadCount = 3
+	defaultAccrualLeaseTime  = time.Minute
+	// наибольшая пауза между опросами заказа, ещё не получившего окончательный статус
+	maxAccrualBackoff = 10 * time.Minute
+)
+
 func NewServer(ctx context.Context, configs *config.ServerFlags) (*Server, error) {
-	st, err := postgres.NewPSQLStorage(ctx, configs.DBConnection)
+	st, err := newStorage(ctx, configs)
 	if err != nil {
 		return nil, errors.New("cannot create storage for server" + err.Error())
 	}
 
+	authenticator, err := auth.New(auth.Config{
+		Keys:         configs.JWTKeys,
+		SigningKeyID: configs.JWTSigningKeyID,
+		Issuer:       configs.JWTIssuer,
+		Audience:     configs.JWTAudience,
+		TokenExp:     configs.JWTTokenExp,
+	})
+	if err != nil {
+		return nil, errors.New("cannot create authenticator for server: " + err.Error())
+	}
+	if len(configs.JWTKeys) == 0 {
+		Sugar.Warnln("ключи JWT не заданы, токены будут подписаны случайным ключом")
+	}
+
+	loginGuard, err := newLoginGuard(st, configs)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcProvider, err := newOIDCProvider(configs)
+	if err != nil {
+		return nil, err
+	}
+
+	// назначаем роль администратора пользователям из конфигурации
+	for _, login := range configs.AdminLogins {
+		if err := st.SetUserRole(ctx, login, model.RoleAdmin); err != nil {
+			Sugar.Warnf("не удалось назначить администратора %v: %v", login, err.Error())
+		}
+	}
+
+	refreshTokenExp := configs.RefreshTokenExp
+	if refreshTokenExp <= 0 {
+		refreshTokenExp = defaultRefreshTokenExp
+	}
+
+	sessionCacheTTL := configs.SessionCacheTTL
+	if sessionCacheTTL <= 0 {
+		sessionCacheTTL = defaultSessionCacheTTL
+	}
+
+	twoFactorIssuer := configs.TwoFactorIssuer
+	if twoFactorIssuer == "" {
+		twoFactorIssuer = defaultTwoFactorIssuer
+	}
+
+	accrualBatchSize := configs.AccrualBatchSize
+	if accrualBatchSize <= 0 {
+		accrualBatchSize = defaultAccrualBatchSize
+	}
+
+	updateThreadCount := configs.UpdateThreadCount
+	if updateThreadCount <= 0 {
+		updateThreadCount = defaultUpdateThreadCount
+	}
+
+	accrualLeaseTime := configs.AccrualLeaseTime
+	if accrualLeaseTime <= 0 {
+		accrualLeaseTime = defaultAccrualLeaseTime
+	}
+
+	workerID, err := newWorkerID()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Server{
-		storage:                st,
-		Address:                configs.Address,
-		DBConnection:           configs.DBConnection,
-		AccrualSystemAddress:   configs.AccrualSystemAddress,
-		ReadingAccrualInterval: configs.ReadingAccrualInterval,
-		UpdateThreadCount:      configs.UpdateThreadCount,
+		storage:                      st,
+		authenticator:                authenticator,
+		loginGuard:                   loginGuard,
+		sessionCache:                 sessioncache.New(sessionCacheTTL),
+		oidcProvider:                 oidcProvider,
+		oidcReauthExp:                defaultOIDCReauthExp,
+		Address:                      configs.Address,
+		DBConnection:                 configs.DBConnection,
+		AccrualSystemAddress:         configs.AccrualSystemAddress,
+		ReadingAccrualInterval:       configs.ReadingAccrualInterval,
+		UpdateThreadCount:            updateThreadCount,
+		AccrualBatchSize:             accrualBatchSize,
+		AccrualLeaseTime:             accrualLeaseTime,
+		workerID:                     workerID,
+		RefreshTokenExp:              refreshTokenExp,
+		twoFactorIssuer:              twoFactorIssuer,
+		WithdrawalTwoFactorThreshold: money.FromFloat(configs.WithdrawalTwoFactorThreshold),
+		passwordParams:               newPasswordParams(configs),
+		passwordPolicy:               newPasswordPolicy(configs),
 	}, nil
 }
 
+// newPasswordParams берёт параметры хеширования из конфигурации,
+// незаданные параметры заменяются значениями по умолчанию
+func newPasswordParams(configs *config.ServerFlags) password.Params {
+	params := password.DefaultParams
+	if configs.PasswordHashMemory > 0 {
+		params.Memory = configs.PasswordHashMemory
+	}
+	if configs.PasswordHashIterations > 0 {
+		params.Iterations = configs.PasswordHashIterations
+	}
+	if configs.PasswordHashThreads > 0 {
+		params.Parallelism = configs.PasswordHashThreads
+	}
+	return params
+}
+
+func newPasswordPolicy(configs *config.ServerFlags) validation.Policy {
+	policy := validation.DefaultPolicy
+	if configs.PasswordMinLength > 0 {
+		policy.PasswordMinLength = configs.PasswordMinLength
+	}
+	if configs.PasswordMinClasses > 0 {
+		policy.PasswordMinClasses = configs.PasswordMinClasses
+	}
+	return policy
+}
+
+func newOIDCProvider(configs *config.ServerFlags) (*oidc.Provider, error) {
+	if configs.OIDCIssuer == "" {
+		return nil, nil
+	}
+
+	provider, err := oidc.New(oidc.Config{
+		Issuer:       configs.OIDCIssuer,
+		ClientID:     configs.OIDCClientID,
+		ClientSecret: configs.OIDCClientSecret,
+		RedirectURL:  configs.OIDCRedirectURL,
+		Scopes:       configs.OIDCScopes,
+	})
+	if err != nil {
+		return nil, errors.New("cannot create oidc provider for server: " + err.Error())
+	}
+	return provider, nil
+}
+
+func newStorage(ctx context.Context, configs *config.ServerFlags) (storage.Storage, error) {
+	switch configs.StorageType {
+	case "", "db":
+		// вид базы определяется строкой подключения
+		if sqlite.IsURI(configs.DBConnection) {
+			if configs.DBAutoMigrate {
+				return sqlite.NewSQLiteStorage(ctx, configs.DBConnection)
+			}
+			return sqlite.Connect(ctx, configs.DBConnection)
+		}
+		dbConfig := postgres.Config{
+			MaxConns:         configs.DBMaxConns,
+			MinConns:         configs.DBMinConns,
+			MaxConnLifetime:  configs.DBMaxConnLifetime,
+			MaxConnIdleTime:  configs.DBMaxConnIdleTime,
+			StatementTimeout: configs.DBStatementTimeout,
+			QueryTimeout:     configs.DBQueryTimeout,
+		}
+		if configs.DBAutoMigrate {
+			return postgres.NewPSQLStorage(ctx, configs.DBConnection, dbConfig)
+		}
+		return postgres.Connect(ctx, configs.DBConnection, dbConfig)
+	case "memory":
+		// данные теряются при остановке, только для тестов и локального запуска
+		return memory.NewMemoryStorage(), nil
+	default:
+		return nil, errors.New("unknown storage: " + configs.StorageType)
+	}
+}
+
+func newLoginGuard(st storage.Storage, configs *config.ServerFlags) (*lockout.Guard, error) {
+	var store lockout.Store
+	switch configs.LoginAttemptsStore {
+	case "", "memory":
+		store = lockout.NewMemoryStore()
+	case "db":
+		// счётчики в базе общие для всех экземпляров сервиса
+		dbStore, ok := st.(lockout.Store)
+		if !ok {
+			return nil, errors.New("storage doesn't support login attempts counters")
+		}
+		store = dbStore
+	default:
+		return nil, errors.New("unknown login attempts store: " + configs.LoginAttemptsStore)
+	}
+
+	loginPolicy := lockout.Policy{
+		MaxFailures:  configs.LoginMaxFailures,
+		Window:       configs.LoginFailureWindow,
+		LockDuration: configs.LoginLockDuration,
+		DelayStep:    configs.LoginDelayStep,
+		MaxDelay:     configs.LoginMaxDelay,
+	}
+	ipPolicy := loginPolicy
+	ipPolicy.MaxFailures = configs.LoginIPMaxFailures
+
+	return lockout.NewGuard(store, loginPolicy, ipPolicy), nil
+}
+
+// newWorkerID возвращает имя экземпляра сервиса: имя хоста и случайный
+// суффикс, чтобы экземпляры на одном хосте различались
+func newWorkerID() (string, error) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gophermart"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return host + "-" + hex.EncodeToString(suffix), nil
+}
+
 func (srv *Server) quit(ctx context.Context) {
 	Sugar.Infoln("закрытие пула соединений")
 	srv.storage.Quit(ctx)
@@ -56,7 +299,7 @@ func (srv *Server) AsyncUpdate(ctx context.Context, wg *sync.WaitGroup) {
 	chOrdersForUpdate := make(chan model.Order, 10)
 
 	// запускаем горутины для получения инфы из внешней системы
-	for i := 0; i < 3; i++ {
+	for i := 0; i < srv.UpdateThreadCount; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -79,17 +322,22 @@ func (srv *Server) AsyncUpdate(ctx context.Context, wg *sync.WaitGroup) {
 			return
 		}
 
-		// сначал получим все заказы для обновления
-		// это заказы в статусах PROCESSING и NEW
+		// берём в аренду пакет заказов в статусах NEW и PROCESSING,
+		// другие экземпляры сервиса эти заказы пока не получат
 		orders, err := srv.GetOrdersForUpdate(ctx)
 		if err != nil {
 			Sugar.Errorln(err)
 			continue
 		}
-		// запрашиваем статусы у внещней системы
-		if len(orders) > 0 {
-			for _, el := range orders {
-				chOrders <- el
+		// запрашиваем статусы у внещней системы. При остановке потоки
+		// запросов больше не читают канал - оставшиеся заказы вернутся
+		// в очередь после окончания аренды
+		for _, el := range orders {
+			select {
+			case chOrders <- el:
+			case <-ctx.Done():
+				Sugar.Infoln("остановка асинхронного обновления")
+				return
 			}
 		}
 	}
@@ -107,8 +355,15 @@ func (srv *Server) threadToGetInfoFromAccrual(ctx context.Context,
 				return
 			}
 			updatedOrder, needToUpdate := srv.RequestAccrual(ctx, order)
+			// ответа нет - аренда истечёт, и заказ снова попадёт в очередь
 			if needToUpdate {
-				chOrdersForUpdate <- *updatedOrder
+				updatedOrder.RetryAfter = srv.nextAccrualDelay(updatedOrder.Status, order.Attempts)
+				select {
+				case chOrdersForUpdate <- *updatedOrder:
+				case <-ctx.Done():
+					Sugar.Infoln("остановка асинхронного обновления")
+					return
+				}
 			}
 		case <-ctx.Done():
 			Sugar.Infoln("остановка асинхронного обновления")
@@ -132,13 +387,36 @@ func (srv *Server) threadToUpdateOrders(ctx context.Context,
 				return
 			}
 			ordersForUpdate = append(ordersForUpdate, order)
-			length := len(ordersForUpdate)
-			if length > 0 {
-				_ = srv.UpdateOrders(ctx, ordersForUpdate)
+			// забираем уже готовые заказы, чтобы сохранить их одним пакетом
+			ordersForUpdate = drainOrders(chOrdersForUpdate, ordersForUpdate, srv.AccrualBatchSize)
+			// не обновлённые заказы вернутся в очередь после окончания аренды
+			changed, err := srv.UpdateOrders(ctx, srv.workerID, ordersForUpdate)
+			if err == nil {
+				for _, el := range changed {
+					Sugar.Infof("заказ %v: статус %v, начислено %v", el.ID, el.Status, el.Bonus)
+				}
 			}
+			ordersForUpdate = ordersForUpdate[:0]
 		case <-ctx.Done():
 			Sugar.Infoln("остановка асинхронного обновления")
 			return
 		}
 	}
 }
+
+// drainOrders добавляет к пакету заказы, уже ожидающие в канале,
+// пока в пакете не станет limit заказов
+func drainOrders(chOrders chan model.Order, orders []model.Order, limit int) []model.Order {
+	for len(orders) < limit {
+		select {
+		case order, opened := <-chOrders:
+			if !opened {
+				return orders
+			}
+			orders = append(orders, order)
+		default:
+			return orders
+		}
+	}
+	return orders
+}
@@ -2,10 +2,13 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"strconv"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,7 +20,11 @@ import (
 
 	"github.com/kvvPro/gophermart/cmd/gophermart/config"
 	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/oidc/oidctest"
+	"github.com/kvvPro/gophermart/internal/storage/memory"
 	"github.com/kvvPro/gophermart/internal/storage/postgres"
+	"github.com/kvvPro/gophermart/internal/totp"
 )
 
 func TestNewServer(t *testing.T) {
@@ -82,12 +89,16 @@ func TestNewServer(t *testing.T) {
 	}
 
 	t.Logf("container run on %v:%v", ip, mappedPort.Port())
-	st, err := postgres.NewPSQLStorage(ctx, dbConn)
+	st, err := postgres.NewPSQLStorage(ctx, dbConn, postgres.Config{})
 	if err != nil {
 		t.Errorf(errors.New("cannot create storage for server" + err.Error()).Error())
 		return
 	}
 
+	// локальный провайдер OpenID Connect вместо настоящего
+	issuer := oidctest.NewIssuer()
+	defer issuer.Close()
+
 	type args struct {
 		ctx     context.Context
 		configs *config.ServerFlags
@@ -102,9 +113,14 @@ func TestNewServer(t *testing.T) {
 			&config.ServerFlags{
 				Address:                "localhost:8080",
 				DBConnection:           dbConn,
+				DBAutoMigrate:          true,
 				AccrualSystemAddress:   "-",
 				ReadingAccrualInterval: 5,
 				UpdateThreadCount:      2,
+				OIDCIssuer:             issuer.URL(),
+				OIDCClientID:           oidctest.ClientID,
+				OIDCClientSecret:       oidctest.ClientSecret,
+				OIDCRedirectURL:        "http://localhost:8080/api/user/oidc/callback",
 			},
 		},
 		want: &Server{
@@ -183,10 +199,10 @@ func TestNewServer(t *testing.T) {
 		{
 			name:     "reg_user1",
 			login:    "user1",
-			password: "1",
+			password: "password1",
 			want: &model.User{
 				Login:    "user1",
-				Password: "1",
+				Password: "password1",
 			},
 			wantErr:    false,
 			wantStatus: http.StatusOK,
@@ -194,10 +210,10 @@ func TestNewServer(t *testing.T) {
 		{
 			name:     "reg_user2",
 			login:    "user2",
-			password: "2",
+			password: "password2",
 			want: &model.User{
 				Login:    "user2",
-				Password: "2",
+				Password: "password2",
 			},
 			wantErr:    false,
 			wantStatus: http.StatusOK,
@@ -205,11 +221,35 @@ func TestNewServer(t *testing.T) {
 		{
 			name:       "reg_user_double",
 			login:      "user2",
-			password:   "21",
+			password:   "password21",
+			want:       nil,
+			wantErr:    true,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "reg_user_double_case_insensitive",
+			login:      "USER2",
+			password:   "password21",
 			want:       nil,
 			wantErr:    true,
 			wantStatus: http.StatusConflict,
 		},
+		{
+			name:       "reg_user_invalid_login",
+			login:      "u!",
+			password:   "password21",
+			want:       nil,
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "reg_user_weak_password",
+			login:      "user4",
+			password:   "1",
+			want:       nil,
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, user := range users {
@@ -250,10 +290,10 @@ func TestNewServer(t *testing.T) {
 		{
 			name:     "auth_user1",
 			login:    "user1",
-			password: "1",
+			password: "password1",
 			want: &model.User{
 				Login:    "user1",
-				Password: "1",
+				Password: "password1",
 			},
 			wantErr:    false,
 			wantStatus: http.StatusOK,
@@ -261,7 +301,7 @@ func TestNewServer(t *testing.T) {
 		{
 			name:       "auth_user2",
 			login:      "user2",
-			password:   "2",
+			password:   "password2",
 			want:       nil,
 			wantErr:    true,
 			wantStatus: http.StatusUnauthorized,
@@ -269,7 +309,7 @@ func TestNewServer(t *testing.T) {
 		{
 			name:       "auth_user2_fail",
 			login:      "user2",
-			password:   "4",
+			password:   "password4",
 			want:       nil,
 			wantErr:    true,
 			wantStatus: http.StatusUnauthorized,
@@ -437,24 +477,24 @@ func TestNewServer(t *testing.T) {
 	getBalance := []struct {
 		name          string
 		token         string
-		wantBalance   float64
-		wantWithdrawn float64
+		wantBalance   money.Amount
+		wantWithdrawn money.Amount
 		wantErr       bool
 		wantStatus    int
 	}{
 		{
 			name:          "balance_user1",
 			token:         user1Token,
-			wantBalance:   0.0,
-			wantWithdrawn: 0.0,
+			wantBalance:   0,
+			wantWithdrawn: 0,
 			wantErr:       false,
 			wantStatus:    http.StatusOK,
 		},
 		{
 			name:          "balance_user2",
 			token:         user2Token,
-			wantBalance:   100.0,
-			wantWithdrawn: 0.0,
+			wantBalance:   100 * money.Scale,
+			wantWithdrawn: 0,
 			wantErr:       false,
 			wantStatus:    http.StatusOK,
 		},
@@ -503,7 +543,7 @@ func TestNewServer(t *testing.T) {
 			token: user2Token,
 			withdraw: &model.Withdrawal{
 				OrderID: "1000000000009",
-				Sum:     20,
+				Sum:     20 * money.Scale,
 			},
 			wantErr:    false,
 			wantStatus: http.StatusOK,
@@ -513,7 +553,7 @@ func TestNewServer(t *testing.T) {
 			token: user2Token,
 			withdraw: &model.Withdrawal{
 				OrderID: "1000000000009",
-				Sum:     100000,
+				Sum:     100000 * money.Scale,
 			},
 			wantErr:    true,
 			wantStatus: http.StatusPaymentRequired,
@@ -523,7 +563,7 @@ func TestNewServer(t *testing.T) {
 			token: user1Token,
 			withdraw: &model.Withdrawal{
 				OrderID: "333333333",
-				Sum:     1,
+				Sum:     1 * money.Scale,
 			},
 			wantErr:    true,
 			wantStatus: http.StatusUnprocessableEntity,
@@ -533,7 +573,7 @@ func TestNewServer(t *testing.T) {
 			token: "-",
 			withdraw: &model.Withdrawal{
 				OrderID: "1000000000009",
-				Sum:     100000,
+				Sum:     100000 * money.Scale,
 			},
 			wantErr:    true,
 			wantStatus: http.StatusUnauthorized,
@@ -544,7 +584,7 @@ func TestNewServer(t *testing.T) {
 		t.Run(el.name, func(t *testing.T) {
 			body := []byte(`{
 				"order": "` + el.withdraw.OrderID + `",
-				"sum": ` + strconv.FormatFloat(float64(el.withdraw.Sum), 'f', 2, 32) + `
+				"sum": ` + el.withdraw.Sum.String() + `
 			}`)
 			response, err := client.SetBaseURL("http://"+newSrv.Address).
 				R().SetHeader("Content-Type", "application/json").
@@ -573,7 +613,7 @@ func TestNewServer(t *testing.T) {
 			token: user2Token,
 			withdraw: &model.Withdrawal{
 				OrderID:       "1000000000009",
-				Sum:           20,
+				Sum:           20 * money.Scale,
 				ProcessedDate: time.Date(2023, time.September, 5, 20, 59, 37, 716467000, time.Local),
 				//"2023-09-05T20:59:37.716467+00"
 			},
@@ -591,7 +631,7 @@ func TestNewServer(t *testing.T) {
 			token: "-",
 			withdraw: &model.Withdrawal{
 				OrderID: "1000000000009",
-				Sum:     100000,
+				Sum:     100000 * money.Scale,
 			},
 			wantErr:    true,
 			wantStatus: http.StatusUnauthorized,
@@ -627,6 +667,543 @@ func TestNewServer(t *testing.T) {
 		})
 	}
 
+	// одновременные списания не уводят баланс в минус
+	t.Run("concurrent_withdrawals", func(t *testing.T) {
+		if err := newSrv.storage.AddUser(ctx, &model.User{Login: "user6", Password: "-"}); err != nil {
+			t.Fatal(err)
+		}
+		err := newSrv.storage.AddAdjustment(ctx, &model.Adjustment{
+			User:          "user6",
+			Amount:        100 * money.Scale,
+			Reason:        "concurrency test",
+			Operator:      "test",
+			ProcessedDate: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// каждое списание по отдельности проходит, все вместе - нет
+		const count = 10
+		statuses := make([]model.EndPointStatus, count)
+		wgWithdraw := &sync.WaitGroup{}
+		for i := 0; i < count; i++ {
+			wgWithdraw.Add(1)
+			go func(i int) {
+				defer wgWithdraw.Done()
+				statuses[i], _ = newSrv.RequestWithdrawal(ctx, &model.Withdrawal{
+					OrderID:       fmt.Sprintf("60000000000%02d", i),
+					Sum:           30 * money.Scale,
+					ProcessedDate: time.Now(),
+					User:          "user6",
+				})
+			}(i)
+		}
+		wgWithdraw.Wait()
+
+		accepted := 0
+		for _, el := range statuses {
+			switch el {
+			case model.WithdrawalAccepted:
+				accepted++
+			case model.WithdrawalNotEnoughBonuses:
+			default:
+				t.Errorf("unexpected withdrawal status %v", el)
+			}
+		}
+		if accepted != 3 {
+			t.Errorf("accepted withdrawals actual: %v expected: %v", accepted, 3)
+		}
+
+		balance, err := newSrv.storage.GetBalance(ctx, &model.User{Login: "user6"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Current != 10*money.Scale || balance.Withdrawn != 90*money.Scale {
+			t.Errorf("balance after concurrent withdrawals: %+v", balance)
+		}
+
+		// по одному заказу проходит только одно списание
+		for i := 0; i < count; i++ {
+			statuses[i] = model.OtherError
+			wgWithdraw.Add(1)
+			go func(i int) {
+				defer wgWithdraw.Done()
+				statuses[i], _ = newSrv.RequestWithdrawal(ctx, &model.Withdrawal{
+					OrderID:       "6000000000100",
+					Sum:           1 * money.Scale,
+					ProcessedDate: time.Now(),
+					User:          "user6",
+				})
+			}(i)
+		}
+		wgWithdraw.Wait()
+
+		accepted = 0
+		for _, el := range statuses {
+			switch el {
+			case model.WithdrawalAccepted:
+				accepted++
+			case model.WithdrawalAlreadyRequested:
+			default:
+				t.Errorf("unexpected withdrawal status %v", el)
+			}
+		}
+		if accepted != 1 {
+			t.Errorf("accepted withdrawals of one order actual: %v expected: %v", accepted, 1)
+		}
+	})
+
+	// refresh token and logout
+	t.Run("refresh_and_logout", func(t *testing.T) {
+		response, err := client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"login": "user1", "password": "password1"}`)).Post("/api/user/login")
+		if err != nil {
+			t.Fatalf("error from response %v %v: %v", "POST", "/api/user/login", err.Error())
+		}
+		refreshToken := response.Header().Get("X-Refresh-Token")
+		if refreshToken == "" {
+			t.Fatalf("refresh token not found")
+		}
+
+		refresh := func(token string) *resty.Response {
+			response, err := client.SetBaseURL("http://"+newSrv.Address).
+				R().SetHeader("Content-Type", "application/json").
+				SetBody([]byte(`{"refresh_token": "` + token + `"}`)).Post("/api/user/token/refresh")
+			if err != nil {
+				t.Fatalf("error from response %v %v: %v", "POST", "/api/user/token/refresh", err.Error())
+			}
+			return response
+		}
+
+		response = refresh(refreshToken)
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("another response status code actual: %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		accessToken := response.Header().Get("Authorization")
+		newRefreshToken := response.Header().Get("X-Refresh-Token")
+
+		// повторное использование старого токена отзывает сеанс
+		if response = refresh(refreshToken); response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("reused refresh token: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+		if response = refresh(newRefreshToken); response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("refresh token of revoked session: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", accessToken).Get("/api/user/balance")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("access token of revoked session: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+
+		// logout
+		logoutToken, err := getUserToken(client, newSrv, "user1", "password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", logoutToken).Post("/api/user/logout")
+		if response.StatusCode() != http.StatusOK {
+			t.Errorf("logout: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", logoutToken).Get("/api/user/balance")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("access token after logout: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+	})
+
+	// session listing and remote sign-out
+	t.Run("sessions", func(t *testing.T) {
+		login := func(userAgent string) string {
+			response, err := client.SetBaseURL("http://"+newSrv.Address).
+				R().SetHeader("Content-Type", "application/json").
+				SetHeader("User-Agent", userAgent).
+				SetBody([]byte(`{"login": "user2", "password": "password2"}`)).Post("/api/user/login")
+			if err != nil {
+				t.Fatalf("error from response %v %v: %v", "POST", "/api/user/login", err.Error())
+			}
+			return response.Header().Get("Authorization")
+		}
+		phoneToken := login("phone")
+		laptopToken := login("laptop")
+
+		response, _ := client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", laptopToken).Get("/api/user/sessions")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("sessions: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		var sessions []model.Session
+		if err := json.Unmarshal(response.Body(), &sessions); err != nil {
+			t.Fatal(err)
+		}
+		phoneSessionID := ""
+		for _, el := range sessions {
+			if el.UserAgent == "phone" {
+				phoneSessionID = el.ID
+			}
+		}
+		if phoneSessionID == "" {
+			t.Fatalf("phone session not found: %v", string(response.Body()))
+		}
+
+		// токен телефона попадает в кэш сеансов
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", phoneToken).Get("/api/user/balance")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("balance from phone: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", laptopToken).Delete("/api/user/sessions/" + phoneSessionID)
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("remote sign-out: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", phoneToken).Get("/api/user/balance")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("signed out session: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+	})
+
+	// change password and delete account
+	t.Run("change_password_and_delete", func(t *testing.T) {
+		response, err := client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"login": "user3", "password": "password3"}`)).Post("/api/user/register")
+		if err != nil || response.StatusCode() != http.StatusOK {
+			t.Fatalf("can't register user3: %v %v", err, string(response.Body()))
+		}
+		oldToken := response.Header().Get("Authorization")
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetHeader("Authorization", oldToken).
+			SetBody([]byte(`{"current_password": "wrong", "new_password": "password33"}`)).Put("/api/user/password")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("change password with wrong current: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetHeader("Authorization", oldToken).
+			SetBody([]byte(`{"current_password": "password3", "new_password": "password33"}`)).Put("/api/user/password")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("change password: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		newToken := response.Header().Get("Authorization")
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", oldToken).Get("/api/user/balance")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("old session after password change: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetHeader("Authorization", newToken).
+			SetBody([]byte(`{"password": "password33"}`)).Delete("/api/user")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("delete account: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"login": "user3", "password": "password33"}`)).Post("/api/user/login")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("login after delete: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+	})
+
+	// two-factor authentication
+	t.Run("two_factor", func(t *testing.T) {
+		response, err := client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"login": "user5", "password": "password5"}`)).Post("/api/user/register")
+		if err != nil || response.StatusCode() != http.StatusOK {
+			t.Fatalf("can't register user5: %v %v", err, string(response.Body()))
+		}
+		userToken := response.Header().Get("Authorization")
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", userToken).Post("/api/user/2fa/enroll")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("enroll 2fa: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		var enrollment TwoFactorEnrollment
+		if err := json.Unmarshal(response.Body(), &enrollment); err != nil {
+			t.Fatal(err)
+		}
+
+		code, _ := totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", userToken).
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"code": "` + code + `"}`)).Post("/api/user/2fa/confirm")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("confirm 2fa: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"login": "user5", "password": "password5"}`)).Post("/api/user/login")
+		if response.StatusCode() != http.StatusAccepted || response.Header().Get("Authorization") != "" {
+			t.Fatalf("login with 2fa: actual status %v expected: %v", response.StatusCode(), http.StatusAccepted)
+		}
+		var challenge struct {
+			ChallengeToken string `json:"challenge_token"`
+		}
+		if err := json.Unmarshal(response.Body(), &challenge); err != nil {
+			t.Fatal(err)
+		}
+
+		// код, уже использованный для подтверждения, повторно не принимается
+		loginStep := func(code string) *resty.Response {
+			response, _ := client.SetBaseURL("http://"+newSrv.Address).
+				R().SetHeader("Content-Type", "application/json").
+				SetBody([]byte(`{"challenge_token": "` + challenge.ChallengeToken + `", "code": "` + code + `"}`)).
+				Post("/api/user/login/2fa")
+			return response
+		}
+		if response = loginStep(code); response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("reused 2fa code: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+		if response = loginStep(enrollment.RecoveryCodes[0]); response.StatusCode() != http.StatusOK {
+			t.Fatalf("login with recovery code: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		if response = loginStep(enrollment.RecoveryCodes[0]); response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("reused recovery code: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", userToken).
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"password": "password5", "code": "` + enrollment.RecoveryCodes[1] + `"}`)).
+			Post("/api/user/2fa/disable")
+		if response.StatusCode() != http.StatusOK {
+			t.Errorf("disable 2fa: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+	})
+
+	// api keys
+	t.Run("api_keys", func(t *testing.T) {
+		userToken, err := getUserToken(client, newSrv, "user2", "password2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _ := client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", userToken).
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"name": "pos", "scopes": ["orders:write"]}`)).Post("/api/user/api-keys")
+		if response.StatusCode() != http.StatusCreated {
+			t.Fatalf("create api key: actual status %v expected: %v", response.StatusCode(), http.StatusCreated)
+		}
+		var created struct {
+			ID  string `json:"id"`
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(response.Body(), &created); err != nil || created.Key == "" {
+			t.Fatalf("create api key: unexpected body %v", string(response.Body()))
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("X-API-Key", created.Key).Post("/api/user/orders")
+		if response.StatusCode() == http.StatusUnauthorized || response.StatusCode() == http.StatusForbidden {
+			t.Errorf("api key with scope: actual status %v", response.StatusCode())
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("X-API-Key", created.Key).Get("/api/user/balance")
+		if response.StatusCode() != http.StatusForbidden {
+			t.Errorf("api key without scope: actual status %v expected: %v", response.StatusCode(), http.StatusForbidden)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("X-API-Key", created.Key).Get("/api/user/api-keys")
+		if response.StatusCode() != http.StatusForbidden {
+			t.Errorf("api key management by api key: actual status %v expected: %v", response.StatusCode(), http.StatusForbidden)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", userToken).Delete("/api/user/api-keys/" + created.ID)
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("revoke api key: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("X-API-Key", created.Key).Get("/api/user/orders")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("revoked api key: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+	})
+
+	// вход через внешнего провайдера
+	t.Run("oidc", func(t *testing.T) {
+		// клиент проходит перенаправления на провайдера и обратно
+		oidcLogin := func() *resty.Response {
+			response, err := resty.New().SetBaseURL("http://" + newSrv.Address).R().Get("/api/user/oidc/login")
+			if err != nil {
+				t.Fatalf("error from response %v %v: %v", "GET", "/api/user/oidc/login", err.Error())
+			}
+			return response
+		}
+
+		// логин user1 занят локальным пользователем - привязка по имени не выполняется
+		issuer.SetUser(oidctest.User{Subject: "sso-1", Email: "user1@example.com", EmailVerified: true, PreferredUsername: "user1"})
+		response := oidcLogin()
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("oidc login: actual status %v expected: %v, body %v", response.StatusCode(), http.StatusOK, string(response.Body()))
+		}
+		token := response.Header().Get("Authorization")
+		userInfo, err := newSrv.authenticator.GetUserInfo(strings.TrimPrefix(token, "Bearer "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userInfo.Login != "user1-2" {
+			t.Errorf("oidc login: actual login %v expected: %v", userInfo.Login, "user1-2")
+		}
+
+		// повторный вход попадает в ту же учётную запись
+		response = oidcLogin()
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("second oidc login: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		userInfo, _ = newSrv.authenticator.GetUserInfo(strings.TrimPrefix(response.Header().Get("Authorization"), "Bearer "))
+		if userInfo == nil || userInfo.Login != "user1-2" {
+			t.Errorf("second oidc login: actual user %v expected: %v", userInfo, "user1-2")
+		}
+
+		// state одноразовый
+		response, _ = resty.New().SetBaseURL("http://" + newSrv.Address).
+			R().Get("/api/user/oidc/callback?state=unknown&code=unknown")
+		if response.StatusCode() != http.StatusUnauthorized {
+			t.Errorf("oidc callback with unknown state: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+		}
+	})
+
+	// admin routes
+	t.Run("admin_role", func(t *testing.T) {
+		userToken, err := getUserToken(client, newSrv, "user2", "password2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _ := client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", userToken).Get("/api/admin/users/user1")
+		if response.StatusCode() != http.StatusForbidden {
+			t.Errorf("admin route as user: actual status %v expected: %v", response.StatusCode(), http.StatusForbidden)
+		}
+
+		if err := newSrv.storage.SetUserRole(ctx, "user2", model.RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		adminToken, err := getUserToken(client, newSrv, "user2", "password2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).Get("/api/admin/users/user1")
+		if response.StatusCode() != http.StatusBadRequest {
+			t.Errorf("admin route without reason: actual status %v expected: %v", response.StatusCode(), http.StatusBadRequest)
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 1").Get("/api/admin/users/user1")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("admin route as admin: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		if strings.Contains(string(response.Body()), "password") {
+			t.Errorf("admin user info contains password: %v", string(response.Body()))
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 1").Get("/api/admin/users?login=USER")
+		if response.StatusCode() != http.StatusOK || !strings.Contains(string(response.Body()), `"user1"`) {
+			t.Errorf("admin search: actual status %v body %v", response.StatusCode(), string(response.Body()))
+		}
+
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 1").Get("/api/admin/users/user1/balance")
+		if response.StatusCode() != http.StatusOK {
+			t.Errorf("admin balance: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+
+		// заблокированный пользователь не может войти
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 2").Post("/api/admin/users/user1/block")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("admin block: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"login": "user1", "password": "password1"}`)).Post("/api/user/login")
+		if response.StatusCode() != http.StatusForbidden {
+			t.Errorf("login of blocked user: actual status %v expected: %v", response.StatusCode(), http.StatusForbidden)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 2").Post("/api/admin/users/user1/unblock")
+		if response.StatusCode() != http.StatusOK {
+			t.Fatalf("admin unblock: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		user1Token, err := getUserToken(client, newSrv, "user1", "password1")
+		if err != nil {
+			t.Errorf("login of unblocked user: %v", err)
+		}
+
+		// ручная корректировка баланса видна пользователю
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 3").
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"amount": 10}`)).Post("/api/admin/users/user1/adjustments")
+		if response.StatusCode() != http.StatusBadRequest {
+			t.Errorf("adjustment without reason: actual status %v expected: %v", response.StatusCode(), http.StatusBadRequest)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 3").
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"amount": 10, "reason": "goodwill"}`)).Post("/api/admin/users/user1/adjustments")
+		if response.StatusCode() != http.StatusOK {
+			t.Errorf("adjustment: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", user1Token).Get("/api/user/adjustments")
+		if response.StatusCode() != http.StatusOK || !strings.Contains(string(response.Body()), "goodwill") {
+			t.Errorf("user adjustments: actual status %v body %v", response.StatusCode(), string(response.Body()))
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 3").Get("/api/admin/users/user1/balance")
+		if response.StatusCode() != http.StatusOK || !strings.Contains(string(response.Body()), `"adjustment":10`) {
+			t.Errorf("admin balance after adjustment: actual status %v body %v", response.StatusCode(), string(response.Body()))
+		}
+
+		// понижение роли действует сразу, без ожидания истечения токена
+		if err := newSrv.storage.SetUserRole(ctx, "user2", model.RoleUser); err != nil {
+			t.Fatal(err)
+		}
+		response, _ = client.SetBaseURL("http://"+newSrv.Address).
+			R().SetHeader("Authorization", adminToken).
+			SetHeader("X-Audit-Reason", "ticket 1").Get("/api/admin/users/user1/orders")
+		if response.StatusCode() != http.StatusForbidden {
+			t.Errorf("admin route after demotion: actual status %v expected: %v", response.StatusCode(), http.StatusForbidden)
+		}
+	})
+
+	// журнал баллов сходится с заказами, списаниями и корректировками
+	t.Run("ledger_reconcile", func(t *testing.T) {
+		drifts, err := st.Reconcile(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, el := range drifts {
+			t.Errorf("ledger drift: %+v", el)
+		}
+	})
+
 	timeout, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	if err := httpSrv.Shutdown(timeout); err != nil {
@@ -638,6 +1215,207 @@ func TestNewServer(t *testing.T) {
 	}
 }
 
+// TestWithdrawTwoFactorLockout проверяет, что подбор кода второго фактора
+// при списании блокируется так же, как подбор пароля при входе
+func TestWithdrawTwoFactorLockout(t *testing.T) {
+	ctx := context.Background()
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Sync()
+	Sugar = *logger.Sugar()
+
+	configs := &config.ServerFlags{
+		Address:                      "localhost:8091",
+		StorageType:                  "memory",
+		AccrualSystemAddress:         "-",
+		ReadingAccrualInterval:       5,
+		UpdateThreadCount:            1,
+		LoginMaxFailures:             3,
+		LoginFailureWindow:           time.Minute,
+		LoginLockDuration:            time.Minute,
+		WithdrawalTwoFactorThreshold: 1,
+	}
+	newSrv, err := NewServer(ctx, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	httpSrv := newSrv.StartServer(ctx, wg, configs)
+	defer httpSrv.Shutdown(ctx)
+	<-time.After(100 * time.Millisecond)
+
+	client := resty.New().SetBaseURL("http://" + newSrv.Address)
+	response, err := client.R().SetHeader("Content-Type", "application/json").
+		SetBody([]byte(`{"login": "user1", "password": "password1"}`)).Post("/api/user/register")
+	if err != nil || response.StatusCode() != http.StatusOK {
+		t.Fatalf("can't register user1: %v %v", err, string(response.Body()))
+	}
+	userToken := response.Header().Get("Authorization")
+
+	response, _ = client.R().SetHeader("Authorization", userToken).Post("/api/user/2fa/enroll")
+	var enrollment TwoFactorEnrollment
+	if err := json.Unmarshal(response.Body(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+	response, _ = client.R().SetHeader("Authorization", userToken).
+		SetHeader("Content-Type", "application/json").
+		SetBody([]byte(`{"code": "` + code + `"}`)).Post("/api/user/2fa/confirm")
+	if response.StatusCode() != http.StatusOK {
+		t.Fatalf("confirm 2fa: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+	}
+
+	withdraw := func(code string) int {
+		response, _ := client.R().SetHeader("Authorization", userToken).
+			SetHeader("Content-Type", "application/json").
+			SetHeader("X-TOTP-Code", code).
+			SetBody([]byte(`{"order": "2377225624", "sum": 10}`)).Post("/api/user/balance/withdraw")
+		return response.StatusCode()
+	}
+	for i := 0; i < configs.LoginMaxFailures; i++ {
+		if status := withdraw("000000"); status != http.StatusForbidden {
+			t.Errorf("withdraw with wrong code %v: actual status %v expected: %v", i+1, status, http.StatusForbidden)
+		}
+	}
+	// после блокировки не принимается даже верный код
+	nextCode, _ := totp.Code(enrollment.Secret, totp.Counter(time.Now())+1)
+	if status := withdraw(nextCode); status != http.StatusTooManyRequests {
+		t.Errorf("withdraw after lockout: actual status %v expected: %v", status, http.StatusTooManyRequests)
+	}
+	response, _ = client.R().SetHeader("Content-Type", "application/json").
+		SetBody([]byte(`{"login": "user1", "password": "password1"}`)).Post("/api/user/login")
+	if response.StatusCode() != http.StatusTooManyRequests {
+		t.Errorf("login after lockout: actual status %v expected: %v", response.StatusCode(), http.StatusTooManyRequests)
+	}
+}
+
+// TestOIDCUserWithoutPassword проверяет вход через провайдера в том же
+// браузере и операции пользователя, у которого нет пароля
+func TestOIDCUserWithoutPassword(t *testing.T) {
+	ctx := context.Background()
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Sync()
+	Sugar = *logger.Sugar()
+
+	issuer := oidctest.NewIssuer()
+	defer issuer.Close()
+	issuer.SetUser(oidctest.User{Subject: "sso-2", Email: "anna@example.com", EmailVerified: true, PreferredUsername: "anna"})
+
+	configs := &config.ServerFlags{
+		Address:                "localhost:8092",
+		StorageType:            "memory",
+		AccrualSystemAddress:   "-",
+		ReadingAccrualInterval: 5,
+		UpdateThreadCount:      1,
+		OIDCIssuer:             issuer.URL(),
+		OIDCClientID:           oidctest.ClientID,
+		OIDCClientSecret:       oidctest.ClientSecret,
+		OIDCRedirectURL:        "http://localhost:8092/api/user/oidc/callback",
+	}
+	newSrv, err := NewServer(ctx, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	httpSrv := newSrv.StartServer(ctx, wg, configs)
+	defer httpSrv.Shutdown(ctx)
+	<-time.After(100 * time.Millisecond)
+
+	client := resty.New().SetBaseURL("http://" + newSrv.Address)
+
+	// ссылку на провайдера, выданную одному браузеру, нельзя завершить в другом
+	response, _ := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy()).
+		SetBaseURL("http://" + newSrv.Address).R().Get("/api/user/oidc/login")
+	authURL := response.Header().Get("Location")
+	if response.StatusCode() != http.StatusFound || authURL == "" {
+		t.Fatalf("oidc login: actual status %v expected: %v", response.StatusCode(), http.StatusFound)
+	}
+	response, _ = resty.New().R().Get(authURL)
+	if response.StatusCode() != http.StatusUnauthorized {
+		t.Errorf("oidc callback in another browser: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+	}
+
+	response, _ = client.R().Get("/api/user/oidc/login")
+	if response.StatusCode() != http.StatusOK {
+		t.Fatalf("oidc login: actual status %v expected: %v, body %v", response.StatusCode(), http.StatusOK, string(response.Body()))
+	}
+	userToken := response.Header().Get("Authorization")
+
+	changePassword := func(token string, current string) *resty.Response {
+		response, _ := client.R().SetHeader("Authorization", token).
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"current_password": "` + current + `", "new_password": "anna-password1"}`)).
+			Put("/api/user/password")
+		return response
+	}
+	deleteAccount := func(token string, password string) *resty.Response {
+		response, _ := client.R().SetHeader("Authorization", token).
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(`{"password": "` + password + `"}`)).Delete("/api/user")
+		return response
+	}
+
+	// пароля нет, поэтому подходит только недавний вход через провайдера
+	newSrv.oidcReauthExp = 0
+	if response = changePassword(userToken, ""); response.StatusCode() != http.StatusUnauthorized {
+		t.Errorf("change password after stale sso login: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+	}
+	if response = deleteAccount(userToken, "!"); response.StatusCode() != http.StatusUnauthorized {
+		t.Errorf("delete account after stale sso login: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+	}
+	newSrv.oidcReauthExp = defaultOIDCReauthExp
+
+	response = changePassword(userToken, "")
+	if response.StatusCode() != http.StatusOK {
+		t.Fatalf("set first password: actual status %v expected: %v, body %v", response.StatusCode(), http.StatusOK, string(response.Body()))
+	}
+	userToken = response.Header().Get("Authorization")
+	if token, _ := getUserToken(client, newSrv, "anna", "anna-password1"); token == "" {
+		t.Error("login with first password failed")
+	}
+
+	// после того как пароль задан, операции требуют его
+	if response = deleteAccount(userToken, ""); response.StatusCode() != http.StatusUnauthorized {
+		t.Errorf("delete account without password: actual status %v expected: %v", response.StatusCode(), http.StatusUnauthorized)
+	}
+	if response = deleteAccount(userToken, "anna-password1"); response.StatusCode() != http.StatusOK {
+		t.Errorf("delete account: actual status %v expected: %v", response.StatusCode(), http.StatusOK)
+	}
+}
+
+// TestRequestAccrualRounding проверяет, что начисление с лишними знаками
+// после запятой округляется, а не оставляет заказ без обработки
+func TestRequestAccrualRounding(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Sync()
+	Sugar = *logger.Sugar()
+
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"order": "12345678903", "status": "PROCESSED", "accrual": 729.985}`)
+	}))
+	defer accrual.Close()
+
+	srv := &Server{AccrualSystemAddress: accrual.URL}
+	order, ok := srv.RequestAccrual(context.Background(), model.Order{ID: "12345678903", Owner: "user1"})
+	if !ok {
+		t.Fatal("RequestAccrual() rejected too precise accrual")
+	}
+	if order.Status != model.OrderStatusProcessed || order.Bonus != 72999 || order.Owner != "user1" {
+		t.Errorf("RequestAccrual() = %+v", order)
+	}
+}
+
 func getUserToken(client *resty.Client, newSrv *Server, login string, password string) (string, error) {
 	reqBody := []byte(`
 				{
@@ -653,3 +1431,150 @@ func getUserToken(client *resty.Client, newSrv *Server, login string, password s
 	}
 	return response.Header().Get("Authorization"), nil
 }
+
+// TestPasswordConfirmationLockout проверяет, что подбор текущего пароля
+// при смене пароля и удалении аккаунта блокируется так же, как при входе
+func TestPasswordConfirmationLockout(t *testing.T) {
+	ctx := context.Background()
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Sync()
+	Sugar = *logger.Sugar()
+
+	configs := &config.ServerFlags{
+		Address:                "localhost:8093",
+		StorageType:            "memory",
+		AccrualSystemAddress:   "-",
+		ReadingAccrualInterval: 5,
+		UpdateThreadCount:      1,
+		LoginMaxFailures:       3,
+		LoginIPMaxFailures:     100,
+		LoginFailureWindow:     time.Minute,
+		LoginLockDuration:      time.Minute,
+	}
+	newSrv, err := NewServer(ctx, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	httpSrv := newSrv.StartServer(ctx, wg, configs)
+	defer httpSrv.Shutdown(ctx)
+	<-time.After(100 * time.Millisecond)
+
+	client := resty.New().SetBaseURL("http://" + newSrv.Address)
+
+	tests := []struct {
+		name    string
+		login   string
+		confirm func(token string, password string) int
+	}{
+		{
+			name:  "change_password",
+			login: "user1",
+			confirm: func(token string, password string) int {
+				response, _ := client.R().SetHeader("Authorization", token).
+					SetHeader("Content-Type", "application/json").
+					SetBody([]byte(`{"current_password": "` + password + `", "new_password": "new-password1"}`)).
+					Put("/api/user/password")
+				return response.StatusCode()
+			},
+		},
+		{
+			name:  "delete_account",
+			login: "user2",
+			confirm: func(token string, password string) int {
+				response, _ := client.R().SetHeader("Authorization", token).
+					SetHeader("Content-Type", "application/json").
+					SetBody([]byte(`{"password": "` + password + `"}`)).
+					Delete("/api/user")
+				return response.StatusCode()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.R().SetHeader("Content-Type", "application/json").
+				SetBody([]byte(`{"login": "` + tt.login + `", "password": "password1"}`)).Post("/api/user/register")
+			if err != nil || response.StatusCode() != http.StatusOK {
+				t.Fatalf("can't register %v: %v %v", tt.login, err, string(response.Body()))
+			}
+			userToken := response.Header().Get("Authorization")
+
+			for i := 0; i < configs.LoginMaxFailures; i++ {
+				if status := tt.confirm(userToken, "wrong-password"); status != http.StatusUnauthorized {
+					t.Errorf("wrong password %v: actual status %v expected: %v", i+1, status, http.StatusUnauthorized)
+				}
+			}
+			// после блокировки не принимается даже верный пароль
+			if status := tt.confirm(userToken, "password1"); status != http.StatusTooManyRequests {
+				t.Errorf("password after lockout: actual status %v expected: %v", status, http.StatusTooManyRequests)
+			}
+			response, _ = client.R().SetHeader("Content-Type", "application/json").
+				SetBody([]byte(`{"login": "` + tt.login + `", "password": "password1"}`)).Post("/api/user/login")
+			if response.StatusCode() != http.StatusTooManyRequests {
+				t.Errorf("login after lockout: actual status %v expected: %v", response.StatusCode(), http.StatusTooManyRequests)
+			}
+		})
+	}
+}
+
+// TestAsyncUpdateStops проверяет, что опрос системы начислений завершается
+// при остановке, даже если арендованный пакет больше буфера очереди
+func TestAsyncUpdateStops(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Sync()
+	Sugar = *logger.Sugar()
+
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-time.After(50 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer accrual.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := memory.NewMemoryStorage()
+	if err := st.AddUser(ctx, &model.User{Login: "user1", Password: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := st.UploadOrder(ctx, fmt.Sprint(1000+i), &model.User{Login: "user1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := &Server{
+		storage:                st,
+		AccrualSystemAddress:   accrual.URL,
+		ReadingAccrualInterval: 1,
+		UpdateThreadCount:      1,
+		AccrualBatchSize:       100,
+		AccrualLeaseTime:       time.Minute,
+		workerID:               "test",
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go srv.AsyncUpdate(ctx, wg)
+
+	// ждём, пока пакет будет арендован и заполнит очередь
+	<-time.After(1500 * time.Millisecond)
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("AsyncUpdate() didn't stop after cancel")
+	}
+}
@@ -0,0 +1,41 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+// Audit записывает действие в журнал аудита
+func (srv *Server) Audit(ctx context.Context, actor string, action string, target string, reason string) error {
+	record := &model.AuditRecord{
+		CreatedAt: time.Now(),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+	}
+
+	err := retry.Do(func() error {
+		return srv.storage.AddAuditRecord(ctx, record)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+
+	if err != nil {
+		Sugar.Errorln(err)
+		return err
+	}
+
+	return nil
+}
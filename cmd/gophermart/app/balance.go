@@ -5,10 +5,10 @@ import (
 	"errors"
 	"time"
 
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
 	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
 )
 
 func (srv *Server) GetBalance(ctx context.Context, userInfo *model.User) (*model.Balance, error) {
@@ -20,11 +20,7 @@ func (srv *Server) GetBalance(ctx context.Context, userInfo *model.User) (*model
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -40,3 +36,56 @@ func (srv *Server) GetBalance(ctx context.Context, userInfo *model.User) (*model
 
 	return balance, nil
 }
+
+// BalanceBreakdown раскладывает баланс пользователя по видам операций журнала.
+// Итог берётся из сохранённого баланса счёта, а не пересчитывается, чтобы
+// оператор видел то же, что и пользователь
+func (srv *Server) BalanceBreakdown(ctx context.Context, userInfo *model.User) (*model.BalanceBreakdown, error) {
+	var err error
+	var totals map[string]money.Amount
+
+	err = retry.Do(func() error {
+		totals, err = srv.storage.GetLedgerTotals(ctx, userInfo)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	balance, err := srv.GetBalance(ctx, userInfo)
+	if err != nil {
+		return nil, err
+	}
+	orders, _, err := srv.OrderList(ctx, userInfo)
+	if err != nil {
+		return nil, err
+	}
+	withdrawals, _, err := srv.AllWithdrawals(ctx, userInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := &model.BalanceBreakdown{
+		Accrued:         totals[model.LedgerAccrual],
+		Adjusted:        totals[model.LedgerAdjustment],
+		Withdrawn:       balance.Withdrawn,
+		Current:         balance.Current,
+		Ledger:          totals,
+		OrdersByStatus:  map[string]int{},
+		WithdrawalCount: len(withdrawals),
+	}
+	for _, el := range orders {
+		breakdown.OrdersByStatus[el.Status]++
+	}
+
+	return breakdown, nil
+}
@@ -3,25 +3,30 @@ package app
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/kvvPro/gophermart/cmd/gophermart/auth"
 	"github.com/kvvPro/gophermart/internal/luhn"
 	"github.com/kvvPro/gophermart/internal/model"
-
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/validation"
 )
 
 type ctxKey string
 
 func (srv *Server) PingHandle(w http.ResponseWriter, r *http.Request) {
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
 	err := srv.Ping(ctx)
@@ -38,6 +43,18 @@ func (srv *Server) PingHandle(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, body)
 }
 
+func (srv *Server) JWKSHandle(w http.ResponseWriter, r *http.Request) {
+
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(srv.authenticator.JWKS())
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, body)
+}
+
 func (srv *Server) Register(w http.ResponseWriter, r *http.Request) {
 
 	var user model.User
@@ -56,17 +73,27 @@ func (srv *Server) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// нормализуем и проверяем логин и пароль
+	login, plain, validationErrs := validation.ValidateCredentials(user.Login, user.Password, srv.passwordPolicy)
+	if validationErrs != nil {
+		Sugar.Errorf("неверный формат запроса: %v", validationErrs.Error())
+		writeValidationErrors(w, validationErrs)
+		return
+	}
+	user.Login = login
+	user.Password = plain
+	user.Role = model.RoleUser
+
 	err = srv.AddUser(r.Context(), &user)
 	if err != nil {
-		var pgErr *pgconn.PgError
 		// check that user already exists (duplicated login)
-		if errors.As(err, &pgErr) && pgerrcode.UniqueViolation == pgErr.Code {
+		if errors.Is(err, storage.ErrDuplicateLogin) {
 			Sugar.Errorf("логин уже занят: %v", err.Error())
 			http.Error(w, "логин уже занят: "+err.Error(), http.StatusConflict)
 			return
 		}
 		// connection problems
-		if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
+		if errors.Is(err, storage.ErrTransient) {
 			Sugar.Errorf("внутренняя ошибка сервера: %v", err.Error())
 			http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -76,15 +103,15 @@ func (srv *Server) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// generate auth token
-	token, err := auth.BuildJWTString(user.Login)
+	// generate auth tokens
+	token, refreshToken, err := srv.StartSession(r.Context(), &user, r.UserAgent(), clientIP(r))
 	if err != nil {
 		Sugar.Errorf("ошибка при генерации токена: %v", err.Error())
 		http.Error(w, "ошибка при генерации токена: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Add("Authorization", "Bearer "+token)
+	setTokenHeaders(w, token, refreshToken)
 
 	body := "OK!"
 	io.WriteString(w, body)
@@ -109,14 +136,28 @@ func (srv *Server) Auth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user.Login = validation.NormalizeLogin(user.Login)
+	user.Password = validation.NormalizePassword(user.Password)
+
+	// проверим, не заблокирован ли вход после неудачных попыток
+	ip := clientIP(r)
+	retryAfter, err := srv.LoginLocked(r.Context(), user.Login, ip)
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "слишком много неудачных попыток входа", http.StatusTooManyRequests)
+		return
+	}
+
 	userInfo, err := srv.GetUser(r.Context(), &user)
 	// authentication failed, password is invalid
 	// or login wasn't found
 	if err != nil {
-		var pgErr *pgconn.PgError
-
 		// connection problems
-		if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
+		if errors.Is(err, storage.ErrTransient) {
 			Sugar.Error(err.Error())
 			http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -129,24 +170,707 @@ func (srv *Server) Auth(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// проверим пароль пользователя
-	if userInfo == nil || userInfo.Password != user.Password {
+	if !srv.CheckPassword(r.Context(), userInfo, user.Password) {
+		srv.LoginFailed(r.Context(), user.Login, ip)
 		http.Error(w, "неверная пара логин/пароль: ", http.StatusUnauthorized)
 		return
 	}
 
-	// get token
-	token, err := auth.BuildJWTString(userInfo.Login)
+	if userInfo.Blocked {
+		http.Error(w, "аккаунт заблокирован", http.StatusForbidden)
+		return
+	}
+
+	// при включённом втором факторе вместо токенов выдаём токен второго шага,
+	// счётчик неудачных попыток сбросится только после проверки кода
+	twoFactorEnabled, err := srv.TwoFactorEnabled(r.Context(), userInfo.Login)
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if twoFactorEnabled {
+		srv.writeChallenge(w, userInfo.Login)
+		return
+	}
+	srv.LoginSucceeded(r.Context(), user.Login)
+
+	// get tokens
+	token, refreshToken, err := srv.StartSession(r.Context(), userInfo, r.UserAgent(), clientIP(r))
 	if err != nil {
 		Sugar.Errorf("ошибка при генерации токена: %v", err.Error())
 		http.Error(w, "ошибка при генерации токена: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Add("Authorization", "Bearer "+token)
+	setTokenHeaders(w, token, refreshToken)
+
+	body := "OK!"
+	io.WriteString(w, body)
+	w.WriteHeader(http.StatusOK)
+}
+
+// AuthTwoFactor — второй шаг входа: проверяет код второго фактора
+// и выдаёт токены
+func (srv *Server) AuthTwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	login, err := srv.authenticator.ParseChallengeToken(request.ChallengeToken)
+	if err != nil {
+		http.Error(w, "токен второго шага недействителен: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// подбор кода ограничивается так же, как подбор пароля
+	if srv.twoFactorLocked(w, r, login) {
+		return
+	}
+
+	valid, err := srv.CheckTwoFactor(r.Context(), login, request.Code)
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		srv.LoginFailed(r.Context(), login, clientIP(r))
+		http.Error(w, "неверный код", http.StatusUnauthorized)
+		return
+	}
+	srv.LoginSucceeded(r.Context(), login)
+
+	userInfo, err := srv.GetUser(r.Context(), &model.User{Login: login})
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if userInfo == nil || userInfo.Blocked {
+		http.Error(w, "аккаунт недоступен", http.StatusForbidden)
+		return
+	}
+
+	token, refreshToken, err := srv.StartSession(r.Context(), userInfo, r.UserAgent(), clientIP(r))
+	if err != nil {
+		Sugar.Errorf("ошибка при генерации токена: %v", err.Error())
+		http.Error(w, "ошибка при генерации токена: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setTokenHeaders(w, token, refreshToken)
+
+	body := "OK!"
+	io.WriteString(w, body)
+}
+
+// OIDCLoginHandle перенаправляет пользователя на страницу входа внешнего провайдера
+func (srv *Server) OIDCLoginHandle(w http.ResponseWriter, r *http.Request) {
+
+	authURL, stateInfo, err := srv.StartOIDCLogin(r.Context())
+	if err != nil {
+		Sugar.Errorf("не удалось начать вход через провайдера: %v", err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// без этой cookie ответ провайдера не примется: чужая ссылка с кодом
+	// не войдёт в аккаунт атакующего из браузера жертвы. SameSite=Lax, так как
+	// провайдер возвращает пользователя переходом с другого сайта
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateInfo.State + "." + stateInfo.Nonce,
+		Path:     "/api/user/oidc",
+		MaxAge:   int(oidcStateExp.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandle принимает пользователя, вернувшегося от внешнего
+// провайдера с кодом авторизации, и выдаёт токены
+func (srv *Server) OIDCCallbackHandle(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "провайдер отклонил вход: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+	if query.Get("state") == "" || query.Get("code") == "" {
+		http.Error(w, "неверный формат запроса: нужны параметры state и code", http.StatusBadRequest)
+		return
+	}
+
+	// state одноразовый, поэтому cookie больше не нужна
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/user/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// вход должен завершаться в том же браузере, где начался
+	var nonce string
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+		state, cookieNonce, _ := strings.Cut(cookie.Value, ".")
+		if subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) == 1 {
+			nonce = cookieNonce
+		}
+	}
+	if nonce == "" {
+		http.Error(w, "вход через провайдера начат в другом браузере или устарел", http.StatusUnauthorized)
+		return
+	}
+
+	userInfo, status, err := srv.FinishOIDCLogin(r.Context(), query.Get("state"), nonce, query.Get("code"))
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch status {
+	case model.OIDCStateInvalid:
+		http.Error(w, "вход через провайдера не начат или устарел", http.StatusUnauthorized)
+		return
+	case model.OIDCTokenInvalid:
+		http.Error(w, "провайдер не подтвердил вход", http.StatusUnauthorized)
+		return
+	}
+
+	if userInfo.Blocked {
+		http.Error(w, "аккаунт заблокирован", http.StatusForbidden)
+		return
+	}
+
+	// второй фактор, включённый у нас, требуется и при входе через провайдера
+	twoFactorEnabled, err := srv.TwoFactorEnabled(r.Context(), userInfo.Login)
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if twoFactorEnabled {
+		srv.writeChallenge(w, userInfo.Login)
+		return
+	}
+
+	token, refreshToken, err := srv.StartSession(r.Context(), userInfo, r.UserAgent(), clientIP(r))
+	if err != nil {
+		Sugar.Errorf("ошибка при генерации токена: %v", err.Error())
+		http.Error(w, "ошибка при генерации токена: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setTokenHeaders(w, token, refreshToken)
+
+	body := "OK!"
+	io.WriteString(w, body)
+}
+
+// twoFactorLocked отвечает клиенту 429 и возвращает true, если вход login
+// заблокирован после неудачных попыток. Коды второго фактора и пароль,
+// которым подтверждают действия в аккаунте, проверяются с тем же счётчиком
+// по логину и IP-адресу, что и пароль при входе, где бы их ни вводили
+func (srv *Server) twoFactorLocked(w http.ResponseWriter, r *http.Request, login string) bool {
+	retryAfter, err := srv.LoginLocked(r.Context(), login, clientIP(r))
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "слишком много неудачных попыток входа", http.StatusTooManyRequests)
+		return true
+	}
+	return false
+}
+
+// writeChallenge отвечает клиенту, что для входа нужен код второго фактора
+func (srv *Server) writeChallenge(w http.ResponseWriter, login string) {
+	challenge, err := srv.authenticator.BuildChallengeToken(login)
+	if err != nil {
+		Sugar.Errorf("ошибка при генерации токена: %v", err.Error())
+		http.Error(w, "ошибка при генерации токена: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ChallengeToken string `json:"challenge_token"`
+		ExpiresIn      int    `json:"expires_in"`
+	}{challenge, int(auth.ChallengeTokenExp.Seconds())}
+
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(response)
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, body)
+}
+
+func (srv *Server) EnrollTwoFactorHandle(w http.ResponseWriter, r *http.Request) {
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	enrollment, err := srv.EnrollTwoFactor(r.Context(), userInfo.Login)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enrollment == nil {
+		http.Error(w, "второй фактор уже подключён", http.StatusConflict)
+		return
+	}
+
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(enrollment)
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, body)
+}
+
+func (srv *Server) ConfirmTwoFactorHandle(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if srv.twoFactorLocked(w, r, userInfo.Login) {
+		return
+	}
+
+	confirmed, err := srv.ConfirmTwoFactor(r.Context(), userInfo.Login, request.Code)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !confirmed {
+		srv.LoginFailed(r.Context(), userInfo.Login, clientIP(r))
+		http.Error(w, "неверный код", http.StatusUnauthorized)
+		return
+	}
+	srv.LoginSucceeded(r.Context(), userInfo.Login)
+
+	w.WriteHeader(http.StatusOK)
+	body := "второй фактор подключён"
+	io.WriteString(w, body)
+}
+
+func (srv *Server) DisableTwoFactorHandle(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if srv.twoFactorLocked(w, r, userInfo.Login) {
+		return
+	}
+
+	sessionID, _ := r.Context().Value(ctxKey("sessionID")).(string)
+	disabled, err := srv.DisableTwoFactor(r.Context(), userInfo.Login, sessionID,
+		validation.NormalizePassword(request.Password), request.Code)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !disabled {
+		srv.LoginFailed(r.Context(), userInfo.Login, clientIP(r))
+		http.Error(w, "неверный пароль или код, без пароля нужен недавний вход через провайдера", http.StatusUnauthorized)
+		return
+	}
+	srv.LoginSucceeded(r.Context(), userInfo.Login)
+
+	w.WriteHeader(http.StatusOK)
+	body := "второй фактор отключён"
+	io.WriteString(w, body)
+}
+
+func (srv *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.RefreshToken == "" {
+		http.Error(w, "неверный формат запроса: не указан токен обновления", http.StatusBadRequest)
+		return
+	}
+
+	token, refreshToken, status, err := srv.RefreshSession(r.Context(), request.RefreshToken)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status == model.RefreshTokenInvalid || status == model.RefreshTokenReused {
+		http.Error(w, "токен обновления недействителен", http.StatusUnauthorized)
+		return
+	}
+
+	setTokenHeaders(w, token, refreshToken)
 
 	body := "OK!"
 	io.WriteString(w, body)
+}
+
+func (srv *Server) LogoutHandle(w http.ResponseWriter, r *http.Request) {
+
+	sessionID, _ := r.Context().Value(ctxKey("sessionID")).(string)
+
+	err := srv.Logout(r.Context(), sessionID)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body := "сеанс завершён"
+	io.WriteString(w, body)
+}
+
+func (srv *Server) ChangePasswordHandle(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.CurrentPassword = validation.NormalizePassword(request.CurrentPassword)
+	request.NewPassword = validation.NormalizePassword(request.NewPassword)
+	if validationErrs := validation.ValidatePassword(request.NewPassword, userInfo.Login, srv.passwordPolicy); validationErrs != nil {
+		// ошибки относятся к полю нового пароля
+		for i := range validationErrs.Errors {
+			validationErrs.Errors[i].Field = "new_password"
+		}
+		Sugar.Errorf("неверный формат запроса: %v", validationErrs.Error())
+		writeValidationErrors(w, validationErrs)
+		return
+	}
+
+	if srv.twoFactorLocked(w, r, userInfo.Login) {
+		return
+	}
+
+	sessionID, _ := r.Context().Value(ctxKey("sessionID")).(string)
+	changed, err := srv.ChangePassword(r.Context(), userInfo.Login, sessionID, request.CurrentPassword, request.NewPassword)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		srv.LoginFailed(r.Context(), userInfo.Login, clientIP(r))
+		http.Error(w, "неверный текущий пароль, без пароля нужен недавний вход через провайдера", http.StatusUnauthorized)
+		return
+	}
+	srv.LoginSucceeded(r.Context(), userInfo.Login)
+
+	// все сеансы завершены - выдаём новые токены для текущего клиента
+	token, refreshToken, err := srv.StartSession(r.Context(), userInfo, r.UserAgent(), clientIP(r))
+	if err != nil {
+		Sugar.Errorf("ошибка при генерации токена: %v", err.Error())
+		http.Error(w, "ошибка при генерации токена: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setTokenHeaders(w, token, refreshToken)
+
+	body := "пароль изменён"
+	io.WriteString(w, body)
+}
+
+func (srv *Server) DeleteAccountHandle(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Password string `json:"password"`
+	}
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if srv.twoFactorLocked(w, r, userInfo.Login) {
+		return
+	}
+
+	sessionID, _ := r.Context().Value(ctxKey("sessionID")).(string)
+	deleted, err := srv.DeleteAccount(r.Context(), userInfo.Login, sessionID, validation.NormalizePassword(request.Password))
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		srv.LoginFailed(r.Context(), userInfo.Login, clientIP(r))
+		http.Error(w, "неверный пароль, без пароля нужен недавний вход через провайдера", http.StatusUnauthorized)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
+	body := "аккаунт удалён"
+	io.WriteString(w, body)
+}
+
+func (srv *Server) CreateAPIKeyHandle(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader := io.NopCloser(bytes.NewReader(data))
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		Sugar.Errorf("неверный формат запроса: %v", err.Error())
+		http.Error(w, "неверный формат запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if validationErrs := validation.ValidateAPIKey(request.Name, request.Scopes, model.Scopes); validationErrs != nil {
+		Sugar.Errorf("неверный формат запроса: %v", validationErrs.Error())
+		writeValidationErrors(w, validationErrs)
+		return
+	}
+
+	apiKey, key, err := srv.CreateAPIKey(r.Context(), userInfo.Login, request.Name, request.Scopes)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// ключ показывается только при создании
+	response := struct {
+		*model.APIKey
+		Key string `json:"key"`
+	}{apiKey, key}
+
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(response)
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, body)
+}
+
+func (srv *Server) GetAPIKeysHandle(w http.ResponseWriter, r *http.Request) {
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	keys, err := srv.APIKeys(r.Context(), userInfo.Login)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		body := "нет ни одного ключа"
+		io.WriteString(w, body)
+		return
+	}
+
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(keys)
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, body)
+}
+
+func (srv *Server) RevokeAPIKeyHandle(w http.ResponseWriter, r *http.Request) {
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	revoked, err := srv.RevokeAPIKey(r.Context(), userInfo.Login, chi.URLParam(r, "id"))
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "ключ не найден", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body := "ключ отозван"
+	io.WriteString(w, body)
+}
+
+func (srv *Server) GetSessionsHandle(w http.ResponseWriter, r *http.Request) {
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+	sessionID, _ := r.Context().Value(ctxKey("sessionID")).(string)
+
+	sessions, err := srv.UserSessions(r.Context(), userInfo.Login)
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, el := range sessions {
+		el.Current = el.ID == sessionID
+	}
+
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(sessions)
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, body)
+}
+
+func (srv *Server) RevokeSessionHandle(w http.ResponseWriter, r *http.Request) {
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	revoked, err := srv.RevokeUserSession(r.Context(), userInfo.Login, chi.URLParam(r, "id"))
+	if err != nil {
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	body := "сеанс завершён"
+	io.WriteString(w, body)
+}
+
+// writeValidationErrors возвращает клиенту ошибки по полям запроса
+func writeValidationErrors(w http.ResponseWriter, validationErrs *validation.Errors) {
+	bodyBuffer := new(bytes.Buffer)
+	json.NewEncoder(bodyBuffer).Encode(validationErrs)
+	body := bodyBuffer.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	io.WriteString(w, body)
+}
+
+// clientIP возвращает адрес клиента без порта
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// setTokenHeaders передаёт клиенту токен доступа и токен обновления
+func setTokenHeaders(w http.ResponseWriter, token string, refreshToken string) {
+	w.Header().Add("Authorization", "Bearer "+token)
+	w.Header().Add("X-Refresh-Token", refreshToken)
 }
 
 func (srv *Server) PutOrder(w http.ResponseWriter, r *http.Request) {
@@ -261,6 +985,11 @@ func (srv *Server) Withdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if withdrawInfo.Sum <= 0 {
+		http.Error(w, "неверный формат запроса: сумма списания должна быть положительной", http.StatusBadRequest)
+		return
+	}
+
 	err = luhn.Validate(withdrawInfo.OrderID)
 	if err != nil {
 		Sugar.Errorf("неверный формат номера заказа: %v", err.Error())
@@ -268,6 +997,31 @@ func (srv *Server) Withdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// крупное списание требует свежего кода второго фактора
+	if srv.WithdrawalTwoFactorThreshold > 0 && withdrawInfo.Sum > srv.WithdrawalTwoFactorThreshold {
+		twoFactorEnabled, err := srv.TwoFactorEnabled(r.Context(), userInfo.Login)
+		if err != nil {
+			http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if twoFactorEnabled {
+			if srv.twoFactorLocked(w, r, userInfo.Login) {
+				return
+			}
+			valid, err := srv.CheckTwoFactor(r.Context(), userInfo.Login, r.Header.Get("X-TOTP-Code"))
+			if err != nil {
+				http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !valid {
+				srv.LoginFailed(r.Context(), userInfo.Login, clientIP(r))
+				http.Error(w, "списание требует кода второго фактора в заголовке X-TOTP-Code", http.StatusForbidden)
+				return
+			}
+			srv.LoginSucceeded(r.Context(), userInfo.Login)
+		}
+	}
+
 	withdrawInfo.ProcessedDate = time.Now()
 	withdrawInfo.User = userInfo.Login
 
@@ -294,6 +1048,33 @@ func (srv *Server) Withdraw(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (srv *Server) GetAdjustments(w http.ResponseWriter, r *http.Request) {
+
+	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+
+	adjustments, status, err := srv.AllAdjustments(r.Context(), userInfo)
+	if err != nil {
+		// other errros
+		Sugar.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status == model.AdjustmentsNoData {
+		w.WriteHeader(http.StatusNoContent)
+		body := "нет ни одной корректировки"
+		io.WriteString(w, body)
+	} else if status == model.AdjustmentsDataExists {
+		bodyBuffer := new(bytes.Buffer)
+		json.NewEncoder(bodyBuffer).Encode(adjustments)
+		body := bodyBuffer.String()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, body)
+	}
+}
+
 func (srv *Server) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 
 	userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
@@ -6,8 +6,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/kvvPro/gophermart/cmd/gophermart/auth"
 	"github.com/kvvPro/gophermart/internal/compress"
+	"github.com/kvvPro/gophermart/internal/model"
 	"go.uber.org/zap"
 )
 
@@ -110,21 +110,156 @@ func GzipMiddleware(h http.Handler) http.Handler {
 
 func (srv *Server) CheckAuth(h http.Handler) http.Handler {
 	authFn := func(w http.ResponseWriter, r *http.Request) {
+		// интеграции вместо токена передают ключ API
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			srv.checkAPIKeyAuth(h, w, r, key)
+			return
+		}
+
 		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
 		if len(authHeader) != 2 {
 			http.Error(w, "malformed token", http.StatusUnauthorized)
 			return
 		}
 		token := authHeader[1]
-		userInfo, err := auth.GetUserInfo(token)
+		claims, err := srv.authenticator.ParseClaims(token)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
+		// токен действует, пока не отозван его сеанс
+		if claims.SessionID == "" {
+			http.Error(w, "token has no session", http.StatusUnauthorized)
+			return
+		}
+		active, err := srv.CheckSession(r.Context(), claims.SessionID)
+		if err != nil {
+			http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !active {
+			http.Error(w, "session is revoked", http.StatusUnauthorized)
+			return
+		}
+
+		userInfo := claims.User()
+
 		newContext := context.WithValue(r.Context(), ctxKey("userInfo"), userInfo)
+		newContext = context.WithValue(newContext, ctxKey("sessionID"), claims.SessionID)
 
 		h.ServeHTTP(w, r.WithContext(newContext))
 	}
 	return http.HandlerFunc(authFn)
 }
+
+func (srv *Server) checkAPIKeyAuth(h http.Handler, w http.ResponseWriter, r *http.Request, key string) {
+	apiKey, err := srv.CheckAPIKey(r.Context(), key)
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if apiKey == nil {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return
+	}
+
+	userInfo, err := srv.GetUser(r.Context(), &model.User{Login: apiKey.User})
+	if err != nil {
+		http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if userInfo == nil || userInfo.Blocked {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return
+	}
+	userInfo.Password = ""
+
+	newContext := context.WithValue(r.Context(), ctxKey("userInfo"), userInfo)
+	newContext = context.WithValue(newContext, ctxKey("apiKey"), apiKey)
+
+	h.ServeHTTP(w, r.WithContext(newContext))
+}
+
+// RequireScope проверяет, что ключу API выдано право scope.
+// Запросы с токеном доступа пользователя не ограничиваются
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		scopeFn := func(w http.ResponseWriter, r *http.Request) {
+			if apiKey, ok := r.Context().Value(ctxKey("apiKey")).(*model.APIKey); ok {
+				allowed := false
+				for _, el := range apiKey.Scopes {
+					if el == scope {
+						allowed = true
+						break
+					}
+				}
+				if !allowed {
+					http.Error(w, "ключу API не выдано право "+scope, http.StatusForbidden)
+					return
+				}
+			}
+
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(scopeFn)
+	}
+}
+
+// RequireSession пропускает только запросы с токеном доступа пользователя.
+// Управление учётной записью и ключами через ключ API недоступно
+func RequireSession(h http.Handler) http.Handler {
+	sessionFn := func(w http.ResponseWriter, r *http.Request) {
+		if sessionID, _ := r.Context().Value(ctxKey("sessionID")).(string); sessionID == "" {
+			http.Error(w, "операция недоступна для ключа API", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(sessionFn)
+}
+
+// RequireAuditReason требует от оператора указать причину обращения
+// в заголовке X-Audit-Reason, причина попадает в журнал аудита
+func RequireAuditReason(h http.Handler) http.Handler {
+	reasonFn := func(w http.ResponseWriter, r *http.Request) {
+		reason := strings.TrimSpace(r.Header.Get("X-Audit-Reason"))
+		if reason == "" {
+			http.Error(w, "не указана причина в заголовке X-Audit-Reason", http.StatusBadRequest)
+			return
+		}
+
+		newContext := context.WithValue(r.Context(), ctxKey("auditReason"), reason)
+		h.ServeHTTP(w, r.WithContext(newContext))
+	}
+	return http.HandlerFunc(reasonFn)
+}
+
+// RequireRole пропускает только пользователей с указанной ролью. Роль
+// перепроверяется по базе, чтобы отзыв прав действовал сразу, а не после
+// истечения токена. Используется после CheckAuth
+func (srv *Server) RequireRole(role string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		roleFn := func(w http.ResponseWriter, r *http.Request) {
+			userInfo, _ := r.Context().Value(ctxKey("userInfo")).(*model.User)
+			if userInfo == nil || userInfo.Role != role {
+				http.Error(w, "недостаточно прав", http.StatusForbidden)
+				return
+			}
+
+			actualInfo, err := srv.GetUser(r.Context(), userInfo)
+			if err != nil {
+				http.Error(w, "внутренняя ошибка сервера: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if actualInfo == nil || actualInfo.Blocked || actualInfo.Role != role {
+				http.Error(w, "недостаточно прав", http.StatusForbidden)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(roleFn)
+	}
+}
@@ -0,0 +1,260 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/oidc"
+	"github.com/kvvPro/gophermart/internal/password"
+	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/validation"
+)
+
+const (
+	// время, за которое пользователь должен вернуться со страницы провайдера
+	oidcStateExp = 10 * time.Minute
+	// сколько логинов с номерами перебирается, прежде чем взять случайный суффикс
+	oidcLoginAttempts = 10
+	// после стольких занятых логинов вход завершается ошибкой
+	oidcLoginMaxAttempts = 20
+	// суффикс вида "-xxxx" добавляется к занятому логину
+	oidcLoginSuffixLength = 5
+	// логин для пользователя провайдера без подходящего имени
+	oidcDefaultLogin = "sso-user"
+	// cookie связывает state и nonce с браузером, начавшим вход
+	oidcStateCookie = "oidc_state"
+	// пользователь без пароля подтверждает смену пароля, удаление аккаунта
+	// и отключение второго фактора входом через провайдера не старше этого
+	defaultOIDCReauthExp = 10 * time.Minute
+)
+
+var errOIDCNoFreeLogin = errors.New("no free login for oidc user")
+
+// StartOIDCLogin начинает вход через внешнего провайдера: сохраняет state,
+// nonce и верификатор PKCE и возвращает адрес страницы входа провайдера
+// и сохранённый state, который нужно связать с браузером пользователя
+func (srv *Server) StartOIDCLogin(ctx context.Context) (string, *model.OIDCState, error) {
+	state, err := oidc.NewState()
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := oidc.NewState()
+	if err != nil {
+		return "", nil, err
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	stateInfo := &model.OIDCState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcStateExp),
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.AddOIDCState(ctx, stateInfo)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return "", nil, err
+	}
+
+	authURL, err := srv.oidcProvider.AuthCodeURL(ctx, state, nonce, oidc.Challenge(verifier))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return authURL, stateInfo, nil
+}
+
+// FinishOIDCLogin обменивает код авторизации на ID-токен, проверяет его
+// и возвращает пользователя, к которому привязана учётная запись провайдера.
+// nonce берётся из cookie браузера и должен совпасть с сохранённым для state.
+// При первом входе пользователь создаётся автоматически
+func (srv *Server) FinishOIDCLogin(ctx context.Context, state string, nonce string, code string) (*model.User, model.EndPointStatus, error) {
+	var stateInfo *model.OIDCState
+	var err error
+
+	err = retry.Do(func() error {
+		stateInfo, err = srv.storage.TakeOIDCState(ctx, state)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, model.OtherError, err
+	}
+	if stateInfo == nil || time.Now().After(stateInfo.ExpiresAt) {
+		return nil, model.OIDCStateInvalid, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(stateInfo.Nonce), []byte(nonce)) != 1 {
+		return nil, model.OIDCStateInvalid, nil
+	}
+
+	rawIDToken, err := srv.oidcProvider.Exchange(ctx, code, stateInfo.CodeVerifier)
+	if err != nil {
+		Sugar.Errorf("не удалось обменять код авторизации: %v", err.Error())
+		return nil, model.OIDCTokenInvalid, nil
+	}
+	idToken, err := srv.oidcProvider.Verify(ctx, rawIDToken, stateInfo.Nonce)
+	if err != nil {
+		if errors.Is(err, oidc.ErrInvalidToken) || errors.Is(err, oidc.ErrUnknownKey) {
+			Sugar.Errorf("ID-токен не прошёл проверку: %v", err.Error())
+			return nil, model.OIDCTokenInvalid, nil
+		}
+		return nil, model.OtherError, err
+	}
+
+	userInfo, err := srv.linkIdentity(ctx, idToken)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, model.OtherError, err
+	}
+
+	return userInfo, model.OIDCLoginSucceeded, nil
+}
+
+// linkIdentity находит пользователя, привязанного к учётной записи провайдера,
+// или создаёт нового. Существующие учётные записи по совпадению имени или почты
+// не привязываются: иначе заранее зарегистрированный логин перехватил бы вход
+func (srv *Server) linkIdentity(ctx context.Context, idToken *oidc.IDToken) (*model.User, error) {
+	userInfo, err := srv.userByIdentity(ctx, idToken.Issuer, idToken.Subject)
+	if err != nil || userInfo != nil {
+		return userInfo, err
+	}
+
+	// пароля нет - войти можно только через провайдера, пока пользователь
+	// не задаст пароль сам
+	user := &model.User{
+		Password: password.NoPassword,
+		Role:     model.RoleUser,
+	}
+	identity := &model.Identity{
+		Issuer:    idToken.Issuer,
+		Subject:   idToken.Subject,
+		Email:     idToken.Email,
+		CreatedAt: time.Now(),
+	}
+
+	base := oidcLoginBase(idToken)
+	for attempt := 1; attempt <= oidcLoginMaxAttempts; attempt++ {
+		user.Login, err = oidcLoginCandidate(base, attempt)
+		if err != nil {
+			return nil, err
+		}
+		identity.User = user.Login
+
+		err = srv.addUserWithIdentity(ctx, user, identity)
+		if err == nil {
+			return srv.GetUser(ctx, user)
+		}
+
+		// одновременный первый вход того же пользователя уже создал привязку
+		if errors.Is(err, storage.ErrConflict) {
+			return srv.userByIdentity(ctx, idToken.Issuer, idToken.Subject)
+		}
+		if !errors.Is(err, storage.ErrDuplicateLogin) {
+			return nil, err
+		}
+		// логин занят - пробуем следующий
+	}
+
+	return nil, fmt.Errorf("%w: %v", errOIDCNoFreeLogin, base)
+}
+
+// oidcLoginBase выбирает логин для нового пользователя по его имени
+// или адресу почты у провайдера
+func oidcLoginBase(idToken *oidc.IDToken) string {
+	candidates := []string{idToken.PreferredUsername}
+	if at := strings.LastIndex(idToken.Email, "@"); at > 0 {
+		candidates = append(candidates, idToken.Email[:at])
+	}
+
+	for _, el := range candidates {
+		if login := validation.SuggestLogin(el, oidcLoginSuffixLength); login != "" {
+			return login
+		}
+	}
+	return oidcDefaultLogin
+}
+
+func oidcLoginCandidate(base string, attempt int) (string, error) {
+	if attempt == 1 {
+		return base, nil
+	}
+	if attempt <= oidcLoginAttempts {
+		return base + "-" + strconv.Itoa(attempt), nil
+	}
+
+	suffix := make([]byte, (oidcLoginSuffixLength-1)/2)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return base + "-" + hex.EncodeToString(suffix), nil
+}
+
+func (srv *Server) userByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error) {
+	var userInfo *model.User
+	var err error
+
+	err = retry.Do(func() error {
+		userInfo, err = srv.storage.GetUserByIdentity(ctx, issuer, subject)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return userInfo, nil
+}
+
+func (srv *Server) addUserWithIdentity(ctx context.Context, user *model.User, identity *model.Identity) error {
+	return retry.Do(func() error {
+		return srv.storage.AddUserWithIdentity(ctx, user, identity)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+}
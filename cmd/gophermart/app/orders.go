@@ -5,10 +5,9 @@ import (
 	"errors"
 	"time"
 
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/kvvPro/gophermart/internal/model"
 	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
 )
 
 func (srv *Server) UploadOrder(ctx context.Context, orderID string, userInfo *model.User) (model.EndPointStatus, error) {
@@ -20,11 +19,7 @@ func (srv *Server) UploadOrder(ctx context.Context, orderID string, userInfo *mo
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -37,9 +32,8 @@ func (srv *Server) UploadOrder(ctx context.Context, orderID string, userInfo *mo
 		Sugar.Errorln(err)
 		// result = model.OtherError
 
-		var pgErr *pgconn.PgError
 		// connection problems
-		if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
+		if errors.Is(err, storage.ErrTransient) {
 			result = model.ConnectionError
 		}
 
@@ -58,11 +52,7 @@ func (srv *Server) OrderList(ctx context.Context, userInfo *model.User) ([]*mode
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -74,9 +64,8 @@ func (srv *Server) OrderList(ctx context.Context, userInfo *model.User) ([]*mode
 
 		Sugar.Errorln(err)
 
-		var pgErr *pgconn.PgError
 		// connection problems
-		if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
+		if errors.Is(err, storage.ErrTransient) {
 			return nil, model.ConnectionError, err
 		}
 
@@ -91,20 +80,91 @@ func (srv *Server) OrderList(ctx context.Context, userInfo *model.User) ([]*mode
 	return orders, model.OrderListExists, nil
 }
 
+func (srv *Server) GetOrder(ctx context.Context, orderID string) (*model.Order, error) {
+	var err error
+	var order *model.Order
+
+	err = retry.Do(func() error {
+		order, err = srv.storage.GetOrder(ctx, orderID)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// RepollOrder сразу запрашивает заказ в системе расчёта начислений,
+// не дожидаясь очередного цикла обновления. Заказ обновляется в любом
+// статусе, в том числе окончательном. Как и фоновый опрос, повторный запрос
+// берёт заказ в аренду, но под отдельным исполнителем, поэтому результат
+// опроса, уже идущего по этому заказу, не будет перезаписан. Если заказ
+// сейчас в аренде, возвращает nil
+func (srv *Server) RepollOrder(ctx context.Context, order *model.Order) (*model.Order, error) {
+	worker := srv.workerID + "/repoll"
+
+	var err error
+	var leased *model.Order
+
+	err = retry.Do(func() error {
+		leased, err = srv.storage.LeaseOrder(ctx, order.ID, worker, srv.AccrualLeaseTime)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+	if leased == nil {
+		return nil, nil
+	}
+
+	updatedOrder, needToUpdate := srv.RequestAccrual(ctx, *leased)
+	if needToUpdate {
+		updatedOrder.RetryAfter = srv.nextAccrualDelay(updatedOrder.Status, leased.Attempts)
+	} else {
+		// ответа нет - заказ сохраняется без изменений, чтобы снять аренду,
+		// и опрашивается снова после обычной паузы
+		updatedOrder = leased
+		updatedOrder.RetryAfter = srv.nextAccrualDelay(leased.Status, leased.Attempts)
+	}
+
+	if _, err := srv.UpdateOrders(ctx, worker, []model.Order{*updatedOrder}); err != nil {
+		return nil, err
+	}
+
+	return updatedOrder, nil
+}
+
 func (srv *Server) GetOrdersForUpdate(ctx context.Context) ([]model.Order, error) {
 	var err error
 	var orders []model.Order
 
 	err = retry.Do(func() error {
-		orders, err = srv.storage.GetOrdersForUpdate(ctx)
+		orders, err = srv.storage.GetOrdersForUpdate(ctx, srv.workerID, srv.AccrualBatchSize, srv.AccrualLeaseTime)
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -120,20 +180,39 @@ func (srv *Server) GetOrdersForUpdate(ctx context.Context) ([]model.Order, error
 	return orders, nil
 }
 
-func (srv *Server) UpdateOrders(ctx context.Context, orders []model.Order) error {
+// nextAccrualDelay возвращает паузу до следующего опроса заказа, ещё не получившего
+// окончательный статус: пауза удваивается с каждой попыткой. Для обработанного
+// заказа возвращает 0. Время опроса отсчитывает хранилище, чтобы очередь
+// и аренда заказов шли по одним часам
+func (srv *Server) nextAccrualDelay(status string, attempts int) time.Duration {
+	if status == model.OrderStatusProcessed || status == model.OrderStatusInvalid {
+		return 0
+	}
+
+	delay := time.Duration(srv.ReadingAccrualInterval) * time.Second
+	for i := 1; i < attempts && delay < maxAccrualBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxAccrualBackoff {
+		delay = maxAccrualBackoff
+	}
+
+	return delay
+}
+
+// UpdateOrders сохраняет пакет заказов, арендованных worker, и возвращает
+// заказы, у которых изменились статус или начисление
+func (srv *Server) UpdateOrders(ctx context.Context, worker string, orders []model.Order) ([]model.Order, error) {
 
 	var err error
+	var changed []model.Order
 
 	err = retry.Do(func() error {
-		err = srv.storage.UpdateBatchOrders(ctx, orders)
+		changed, err = srv.storage.UpdateBatchOrders(ctx, worker, orders)
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -143,8 +222,8 @@ func (srv *Server) UpdateOrders(ctx context.Context, orders []model.Order) error
 
 	if err != nil {
 		Sugar.Errorln(err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	return changed, nil
 }
@@ -7,6 +7,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/kvvPro/gophermart/cmd/gophermart/config"
+	"github.com/kvvPro/gophermart/internal/model"
 )
 
 func (srv *Server) StartServer(ctx context.Context, wg *sync.WaitGroup, srvFlags *config.ServerFlags) *http.Server {
@@ -14,17 +15,63 @@ func (srv *Server) StartServer(ctx context.Context, wg *sync.WaitGroup, srvFlags
 	r.Use(GzipMiddleware,
 		WithLogging)
 	r.Get("/ping", http.HandlerFunc(srv.PingHandle))
+	// открытые ключи публикуются, только если настроены асимметричные ключи
+	if len(srv.authenticator.JWKS().Keys) > 0 {
+		r.Get("/.well-known/jwks.json", http.HandlerFunc(srv.JWKSHandle))
+	}
 	r.Post("/api/user/register", http.HandlerFunc(srv.Register))
 	r.Post("/api/user/login", http.HandlerFunc(srv.Auth))
+	r.Post("/api/user/login/2fa", http.HandlerFunc(srv.AuthTwoFactor))
+	r.Post("/api/user/token/refresh", http.HandlerFunc(srv.RefreshToken))
+	// вход через внешнего провайдера доступен, только если он настроен
+	if srv.oidcProvider != nil {
+		r.Get("/api/user/oidc/login", http.HandlerFunc(srv.OIDCLoginHandle))
+		r.Get("/api/user/oidc/callback", http.HandlerFunc(srv.OIDCCallbackHandle))
+	}
 
 	r.Group(func(r chi.Router) {
 		r.Use(srv.CheckAuth)
 
-		r.Post("/api/user/orders", http.HandlerFunc(srv.PutOrder))
-		r.Get("/api/user/orders", http.HandlerFunc(srv.GetOrders))
-		r.Get("/api/user/balance", http.HandlerFunc(srv.GetBalanceHandle))
-		r.Post("/api/user/balance/withdraw", http.HandlerFunc(srv.Withdraw))
-		r.Get("/api/user/withdrawals", http.HandlerFunc(srv.GetWithdrawals))
+		// операции с учётной записью доступны только по токену доступа
+		r.Group(func(r chi.Router) {
+			r.Use(RequireSession)
+
+			r.Post("/api/user/logout", http.HandlerFunc(srv.LogoutHandle))
+			r.Get("/api/user/sessions", http.HandlerFunc(srv.GetSessionsHandle))
+			r.Delete("/api/user/sessions/{id}", http.HandlerFunc(srv.RevokeSessionHandle))
+			r.Put("/api/user/password", http.HandlerFunc(srv.ChangePasswordHandle))
+			r.Delete("/api/user", http.HandlerFunc(srv.DeleteAccountHandle))
+			r.Post("/api/user/api-keys", http.HandlerFunc(srv.CreateAPIKeyHandle))
+			r.Get("/api/user/api-keys", http.HandlerFunc(srv.GetAPIKeysHandle))
+			r.Delete("/api/user/api-keys/{id}", http.HandlerFunc(srv.RevokeAPIKeyHandle))
+			r.Post("/api/user/2fa/enroll", http.HandlerFunc(srv.EnrollTwoFactorHandle))
+			r.Post("/api/user/2fa/confirm", http.HandlerFunc(srv.ConfirmTwoFactorHandle))
+			r.Post("/api/user/2fa/disable", http.HandlerFunc(srv.DisableTwoFactorHandle))
+		})
+
+		// ключу API нужны права на операцию
+		r.With(RequireScope(model.ScopeOrdersWrite)).Post("/api/user/orders", http.HandlerFunc(srv.PutOrder))
+		r.With(RequireScope(model.ScopeOrdersRead)).Get("/api/user/orders", http.HandlerFunc(srv.GetOrders))
+		r.With(RequireScope(model.ScopeBalanceRead)).Get("/api/user/balance", http.HandlerFunc(srv.GetBalanceHandle))
+		r.With(RequireScope(model.ScopeWithdrawalsWrite)).Post("/api/user/balance/withdraw", http.HandlerFunc(srv.Withdraw))
+		r.With(RequireScope(model.ScopeWithdrawalsRead)).Get("/api/user/withdrawals", http.HandlerFunc(srv.GetWithdrawals))
+		r.With(RequireScope(model.ScopeBalanceRead)).Get("/api/user/adjustments", http.HandlerFunc(srv.GetAdjustments))
+	})
+
+	// операции поддержки
+	r.Route("/api/admin", func(r chi.Router) {
+		// каждое действие оператора записывается в журнал аудита с причиной
+		r.Use(srv.CheckAuth, RequireSession, srv.RequireRole(model.RoleAdmin), RequireAuditReason)
+
+		r.Get("/users", http.HandlerFunc(srv.AdminSearchUsers))
+		r.Get("/users/{login}", http.HandlerFunc(srv.AdminGetUser))
+		r.Get("/users/{login}/orders", http.HandlerFunc(srv.AdminGetOrders))
+		r.Get("/users/{login}/withdrawals", http.HandlerFunc(srv.AdminGetWithdrawals))
+		r.Get("/users/{login}/balance", http.HandlerFunc(srv.AdminGetBalance))
+		r.Post("/users/{login}/adjustments", http.HandlerFunc(srv.AdminAddAdjustment))
+		r.Post("/users/{login}/block", http.HandlerFunc(srv.AdminBlockUser))
+		r.Post("/users/{login}/unblock", http.HandlerFunc(srv.AdminUnblockUser))
+		r.Post("/users/{login}/orders/{number}/repoll", http.HandlerFunc(srv.AdminRepollOrder))
 	})
 
 	// записываем в лог, что сервер запускается
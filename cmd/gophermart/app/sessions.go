@@ -0,0 +1,256 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kvvPro/gophermart/cmd/gophermart/auth"
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+// время последней активности сеанса записывается в базу не чаще этого интервала
+const sessionTouchInterval = time.Minute
+
+// максимальная длина сохраняемого User-Agent
+const userAgentMaxLength = 512
+
+// StartSession создаёт новый сеанс пользователя и возвращает токены доступа и обновления.
+// userAgent и ip показываются пользователю в списке сеансов
+func (srv *Server) StartSession(ctx context.Context, user *model.User, userAgent string, ip string) (string, string, error) {
+	sessionID, err := auth.NewSessionID()
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(userAgent) > userAgentMaxLength {
+		userAgent = userAgent[:userAgentMaxLength]
+	}
+
+	now := time.Now()
+	session := &model.Session{
+		ID:         sessionID,
+		User:       user.Login,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(srv.RefreshTokenExp),
+	}
+	token := &model.RefreshToken{
+		Hash:      refreshHash,
+		SessionID: sessionID,
+		CreatedAt: now,
+		ExpiresAt: session.ExpiresAt,
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.AddSession(ctx, session, token)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return "", "", err
+	}
+
+	accessToken, err := srv.authenticator.BuildJWTString(user, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// RefreshSession обменивает токен обновления на новую пару токенов.
+// Повторное использование токена обновления отзывает весь сеанс
+func (srv *Server) RefreshSession(ctx context.Context, refreshToken string) (string, string, model.EndPointStatus, error) {
+	newRefreshToken, newRefreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return "", "", model.OtherError, err
+	}
+
+	now := time.Now()
+	newToken := &model.RefreshToken{
+		Hash:      newRefreshHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(srv.RefreshTokenExp),
+	}
+
+	var session *model.Session
+	var status model.EndPointStatus
+
+	err = retry.Do(func() error {
+		session, status, err = srv.storage.RotateRefreshToken(ctx, auth.HashRefreshToken(refreshToken), newToken)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return "", "", model.OtherError, err
+	}
+
+	if status == model.RefreshTokenReused {
+		Sugar.Warnln("повторное использование токена обновления, сеанс отозван")
+		srv.sessionCache.Invalidate(session.ID)
+	}
+	if status != model.RefreshTokenRotated {
+		return "", "", status, nil
+	}
+
+	// роль могла измениться с момента входа - берём актуальную
+	userInfo, err := srv.GetUser(ctx, &model.User{Login: session.User})
+	if err != nil {
+		return "", "", model.OtherError, err
+	}
+	if userInfo == nil || userInfo.Blocked {
+		return "", "", model.RefreshTokenInvalid, nil
+	}
+
+	accessToken, err := srv.authenticator.BuildJWTString(userInfo, session.ID)
+	if err != nil {
+		return "", "", model.OtherError, err
+	}
+
+	return accessToken, newRefreshToken, status, nil
+}
+
+// CheckSession проверяет, что сеанс существует и не отозван. Результат
+// проверки кэшируется, заодно с обращением к базе обновляется время
+// последней активности сеанса
+func (srv *Server) CheckSession(ctx context.Context, sessionID string) (bool, error) {
+	now := time.Now()
+	if active, ok := srv.sessionCache.Get(sessionID, now); ok {
+		return active, nil
+	}
+
+	var session *model.Session
+	var err error
+
+	err = retry.Do(func() error {
+		session, err = srv.storage.GetSession(ctx, sessionID)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	if session == nil {
+		return false, nil
+	}
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		srv.sessionCache.Set(sessionID, session.User, false, now)
+		return false, nil
+	}
+	srv.sessionCache.Set(sessionID, session.User, true, now)
+
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		// ошибка обновления времени активности не должна мешать запросу
+		if err := srv.storage.TouchSession(ctx, sessionID, now); err != nil {
+			Sugar.Errorf("не удалось обновить время активности сеанса: %v", err.Error())
+		}
+	}
+
+	return true, nil
+}
+
+func (srv *Server) Logout(ctx context.Context, sessionID string) error {
+	err := retry.Do(func() error {
+		return srv.storage.RevokeSession(ctx, sessionID)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	srv.sessionCache.Invalidate(sessionID)
+	if err != nil {
+		Sugar.Errorln(err)
+		return err
+	}
+
+	return nil
+}
+
+// UserSessions возвращает действующие сеансы пользователя
+func (srv *Server) UserSessions(ctx context.Context, login string) ([]*model.Session, error) {
+	var sessions []*model.Session
+	var err error
+
+	err = retry.Do(func() error {
+		sessions, err = srv.storage.GetUserSessions(ctx, login)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeUserSession завершает сеанс пользователя на другом устройстве.
+// Возвращает false, если сеанс не найден
+func (srv *Server) RevokeUserSession(ctx context.Context, login string, sessionID string) (bool, error) {
+	var revoked bool
+	var err error
+
+	err = retry.Do(func() error {
+		revoked, err = srv.storage.RevokeUserSession(ctx, login, sessionID)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	srv.sessionCache.Invalidate(sessionID)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return revoked, nil
+}
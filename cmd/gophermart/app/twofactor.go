@@ -0,0 +1,245 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/totp"
+)
+
+// TwoFactorEnrollment — данные для подключения второго фактора,
+// показываются пользователю один раз
+type TwoFactorEnrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"otpauth_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// EnrollTwoFactor создаёт новый секрет и коды восстановления. Второй фактор
+// начинает действовать после подтверждения кодом из приложения.
+// Возвращает nil, если второй фактор уже включён
+func (srv *Server) EnrollTwoFactor(ctx context.Context, login string) (*TwoFactorEnrollment, error) {
+	twoFactor, err := srv.getTwoFactor(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor != nil && twoFactor.Enabled {
+		return nil, nil
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, el := range codes {
+		hashes = append(hashes, totp.HashRecoveryCode(el))
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.SetTwoFactorSecret(ctx, login, secret, hashes)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	return &TwoFactorEnrollment{
+		Secret:        secret,
+		URI:           totp.URI(srv.twoFactorIssuer, login, secret),
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// ConfirmTwoFactor включает второй фактор, если код из приложения верный
+func (srv *Server) ConfirmTwoFactor(ctx context.Context, login string, code string) (bool, error) {
+	twoFactor, err := srv.getTwoFactor(ctx, login)
+	if err != nil {
+		return false, err
+	}
+	if twoFactor == nil {
+		return false, nil
+	}
+
+	valid, err := srv.checkTOTP(ctx, login, twoFactor, code)
+	if err != nil || !valid {
+		return false, err
+	}
+	if twoFactor.Enabled {
+		return true, nil
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.EnableTwoFactor(ctx, login)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DisableTwoFactor выключает второй фактор. Нужны пароль и код из приложения
+// или код восстановления, пользователь без пароля подтверждает отключение
+// недавним входом через провайдера
+func (srv *Server) DisableTwoFactor(ctx context.Context, login string, sessionID string, plain string, code string) (bool, error) {
+	userInfo, err := srv.GetUser(ctx, &model.User{Login: login})
+	if err != nil {
+		return false, err
+	}
+	if confirmed, err := srv.confirmUser(ctx, userInfo, sessionID, plain); err != nil || !confirmed {
+		return false, err
+	}
+
+	valid, err := srv.CheckTwoFactor(ctx, login, code)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.DisableTwoFactor(ctx, login)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// TwoFactorEnabled сообщает, включён ли у пользователя второй фактор
+func (srv *Server) TwoFactorEnabled(ctx context.Context, login string) (bool, error) {
+	twoFactor, err := srv.getTwoFactor(ctx, login)
+	if err != nil {
+		return false, err
+	}
+	return twoFactor != nil && twoFactor.Enabled, nil
+}
+
+// CheckTwoFactor проверяет код из приложения или код восстановления
+// включённого второго фактора. Каждый код принимается только один раз
+func (srv *Server) CheckTwoFactor(ctx context.Context, login string, code string) (bool, error) {
+	twoFactor, err := srv.getTwoFactor(ctx, login)
+	if err != nil {
+		return false, err
+	}
+	if twoFactor == nil || !twoFactor.Enabled {
+		return false, nil
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return srv.checkTOTP(ctx, login, twoFactor, code)
+	}
+
+	// всё, что не похоже на код из приложения, проверяем как код восстановления
+	var used bool
+	err = retry.Do(func() error {
+		used, err = srv.storage.UseRecoveryCode(ctx, login, totp.HashRecoveryCode(code))
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+	if used {
+		Sugar.Infof("использован код восстановления: %v", login)
+	}
+
+	return used, nil
+}
+
+func (srv *Server) checkTOTP(ctx context.Context, login string, twoFactor *model.TwoFactor, code string) (bool, error) {
+	valid, counter := totp.Validate(code, twoFactor.Secret, time.Now())
+	if !valid || counter <= twoFactor.LastCounter {
+		return false, nil
+	}
+
+	// защита от повторного использования перехваченного кода
+	var fresh bool
+	var err error
+	err = retry.Do(func() error {
+		fresh, err = srv.storage.UseTwoFactorCounter(ctx, login, counter)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return fresh, nil
+}
+
+func (srv *Server) getTwoFactor(ctx context.Context, login string) (*model.TwoFactor, error) {
+	var twoFactor *model.TwoFactor
+	var err error
+
+	err = retry.Do(func() error {
+		twoFactor, err = srv.storage.GetTwoFactor(ctx, login)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	return twoFactor, nil
+}
@@ -2,25 +2,34 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"time"
 
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/password"
 	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
 )
 
 func (srv *Server) AddUser(ctx context.Context, user *model.User) error {
-	err := retry.Do(func() error {
-		return srv.storage.AddUser(ctx, user)
+	// в базе храним только хеш пароля
+	hash, err := password.Hash(user.Password, srv.passwordParams)
+	if err != nil {
+		Sugar.Errorln(err)
+		return err
+	}
+	newUser := &model.User{
+		Login:    user.Login,
+		Password: hash,
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.AddUser(ctx, newUser)
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -44,11 +53,7 @@ func (srv *Server) GetUser(ctx context.Context, user *model.User) (*model.User,
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -63,3 +68,259 @@ func (srv *Server) GetUser(ctx context.Context, user *model.User) (*model.User,
 
 	return userInfo, nil
 }
+
+// CheckPassword сверяет пароль с сохранённым хешем. Если пароль хранится
+// в открытом виде или с устаревшими параметрами, хеш пересчитывается
+func (srv *Server) CheckPassword(ctx context.Context, userInfo *model.User, plain string) bool {
+	if userInfo == nil {
+		// пользователь не найден - тратим то же время, что и на проверку
+		password.Burn(plain, srv.passwordParams)
+		return false
+	}
+
+	match, needsRehash, err := password.Verify(plain, userInfo.Password, srv.passwordParams)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false
+	}
+	if !match {
+		return false
+	}
+
+	if needsRehash {
+		// ошибка обновления хеша не должна мешать входу пользователя
+		if err := srv.savePassword(ctx, userInfo.Login, plain); err != nil {
+			Sugar.Errorf("не удалось обновить хеш пароля: %v", err.Error())
+		}
+	}
+
+	return true
+}
+
+func (srv *Server) savePassword(ctx context.Context, login string, plain string) error {
+	hash, err := password.Hash(plain, srv.passwordParams)
+	if err != nil {
+		return err
+	}
+
+	return retry.Do(func() error {
+		return srv.storage.UpdatePassword(ctx, login, hash)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+}
+
+// LoginLocked возвращает время до снятия блокировки входа по логину или IP-адресу
+func (srv *Server) LoginLocked(ctx context.Context, login string, ip string) (time.Duration, error) {
+	retryAfter, err := srv.loginGuard.Check(ctx, login, ip)
+	if err != nil {
+		Sugar.Errorln(err)
+		return 0, err
+	}
+	return retryAfter, nil
+}
+
+// LoginFailed учитывает неудачную попытку входа, записывает блокировки
+// в журнал аудита и выдерживает задержку перед ответом клиенту
+func (srv *Server) LoginFailed(ctx context.Context, login string, ip string) {
+	delay, locked, err := srv.loginGuard.Fail(ctx, login, ip)
+	if err != nil {
+		Sugar.Errorln(err)
+		return
+	}
+
+	for _, key := range locked {
+		Sugar.Warnf("вход временно заблокирован: %v", key)
+		_ = srv.Audit(ctx, model.AuditActorSystem, model.AuditActionLoginLockout,
+			key, "too many failed login attempts")
+	}
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// LoginSucceeded сбрасывает счётчик неудачных попыток логина
+func (srv *Server) LoginSucceeded(ctx context.Context, login string) {
+	if err := srv.loginGuard.Succeed(ctx, login); err != nil {
+		Sugar.Errorln(err)
+	}
+}
+
+// confirmUser подтверждает операцию, для которой нужен пароль. Пользователь,
+// созданный при входе через провайдера, пароля не имеет: вместо пароля
+// он подтверждает операцию сеансом sessionID, начатым не раньше
+// oidcReauthExp назад, то есть повторным входом через провайдера
+func (srv *Server) confirmUser(ctx context.Context, userInfo *model.User, sessionID string, plain string) (bool, error) {
+	if userInfo == nil || userInfo.Password != password.NoPassword {
+		return srv.CheckPassword(ctx, userInfo, plain), nil
+	}
+
+	var session *model.Session
+	var err error
+
+	err = retry.Do(func() error {
+		session, err = srv.storage.GetSession(ctx, sessionID)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return session != nil && session.User == userInfo.Login &&
+		time.Since(session.CreatedAt) <= srv.oidcReauthExp, nil
+}
+
+// ChangePassword меняет пароль пользователя и завершает все его сеансы.
+// Пользователь без пароля задаёт первый пароль без текущего, см. confirmUser.
+// Возвращает false, если текущий пароль указан неверно
+func (srv *Server) ChangePassword(ctx context.Context, login string, sessionID string, currentPassword string, newPassword string) (bool, error) {
+	userInfo, err := srv.GetUser(ctx, &model.User{Login: login})
+	if err != nil {
+		return false, err
+	}
+	if confirmed, err := srv.confirmUser(ctx, userInfo, sessionID, currentPassword); err != nil || !confirmed {
+		return false, err
+	}
+
+	if err := srv.savePassword(ctx, login, newPassword); err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.RevokeUserSessions(ctx, login)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	srv.sessionCache.InvalidateUser(login)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DeleteAccount удаляет пользователя. Заказы и списания сохраняются
+// для учёта под анонимным идентификатором.
+// Возвращает false, если пароль указан неверно
+func (srv *Server) DeleteAccount(ctx context.Context, login string, sessionID string, plain string) (bool, error) {
+	userInfo, err := srv.GetUser(ctx, &model.User{Login: login})
+	if err != nil {
+		return false, err
+	}
+	if confirmed, err := srv.confirmUser(ctx, userInfo, sessionID, plain); err != nil || !confirmed {
+		return false, err
+	}
+
+	anonymousID, err := newAnonymousID()
+	if err != nil {
+		return false, err
+	}
+
+	err = retry.Do(func() error {
+		return srv.storage.DeleteUser(ctx, login, anonymousID)
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	srv.sessionCache.InvalidateUser(login)
+	if err != nil {
+		Sugar.Errorln(err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SearchUsers ищет пользователей по части логина
+func (srv *Server) SearchUsers(ctx context.Context, loginPattern string, limit int) ([]*model.User, error) {
+	var users []*model.User
+	var err error
+
+	err = retry.Do(func() error {
+		users, err = srv.storage.SearchUsers(ctx, loginPattern, limit)
+		return err
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	if err != nil {
+		Sugar.Errorln(err)
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SetUserBlocked блокирует или разблокирует пользователя. При блокировке
+// все сеансы пользователя завершаются
+func (srv *Server) SetUserBlocked(ctx context.Context, login string, blocked bool) error {
+	err := retry.Do(func() error {
+		if err := srv.storage.SetUserBlocked(ctx, login, blocked); err != nil {
+			return err
+		}
+		if blocked {
+			return srv.storage.RevokeUserSessions(ctx, login)
+		}
+		return nil
+	},
+		retry.RetryIf(func(errAttempt error) bool {
+			return errors.Is(errAttempt, storage.ErrTransient)
+		}),
+		retry.Attempts(3),
+		retry.InitDelay(5*time.Millisecond),
+		retry.Step(2*time.Millisecond),
+		retry.Context(ctx),
+	)
+	srv.sessionCache.InvalidateUser(login)
+	if err != nil {
+		Sugar.Errorln(err)
+		return err
+	}
+
+	return nil
+}
+
+func newAnonymousID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "deleted-" + hex.EncodeToString(id), nil
+}
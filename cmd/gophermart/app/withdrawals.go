@@ -5,10 +5,9 @@ import (
 	"errors"
 	"time"
 
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/kvvPro/gophermart/internal/model"
 	"github.com/kvvPro/gophermart/internal/retry"
+	"github.com/kvvPro/gophermart/internal/storage"
 )
 
 func (srv *Server) RequestWithdrawal(ctx context.Context, withdrawalInfo *model.Withdrawal) (model.EndPointStatus, error) {
@@ -20,11 +19,7 @@ func (srv *Server) RequestWithdrawal(ctx context.Context, withdrawalInfo *model.
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -36,9 +31,8 @@ func (srv *Server) RequestWithdrawal(ctx context.Context, withdrawalInfo *model.
 
 		Sugar.Errorln(err)
 
-		var pgErr *pgconn.PgError
 		// connection problems
-		if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
+		if errors.Is(err, storage.ErrTransient) {
 			result = model.ConnectionError
 		}
 
@@ -57,11 +51,7 @@ func (srv *Server) AllWithdrawals(ctx context.Context, user *model.User) ([]*mod
 		return err
 	},
 		retry.RetryIf(func(errAttempt error) bool {
-			var pgErr *pgconn.PgError
-			if errors.As(errAttempt, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				return true
-			}
-			return false
+			return errors.Is(errAttempt, storage.ErrTransient)
 		}),
 		retry.Attempts(3),
 		retry.InitDelay(5*time.Millisecond),
@@ -73,9 +63,8 @@ func (srv *Server) AllWithdrawals(ctx context.Context, user *model.User) ([]*mod
 
 		Sugar.Errorln(err)
 
-		var pgErr *pgconn.PgError
 		// connection problems
-		if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
+		if errors.Is(err, storage.ErrTransient) {
 			return nil, model.ConnectionError, err
 		}
 
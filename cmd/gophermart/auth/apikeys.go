@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+)
+
+const (
+	apiKeyPrefix = "gm_"
+	// сколько первых символов ключа показывается в списке ключей
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+)
+
+// NewAPIKey генерирует ключ API. Возвращает сам ключ, который показывается
+// пользователю один раз, видимое начало ключа и хеш для хранения в базе
+func NewAPIKey() (string, string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return key, key[:apiKeyDisplayLength], HashAPIKey(key), nil
+}
+
+// HashAPIKey вычисляет хеш ключа API. Как и токен обновления, ключ содержит
+// 256 бит случайных данных
+func HashAPIKey(key string) string {
+	return HashRefreshToken(strings.TrimSpace(key))
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -10,30 +12,134 @@ import (
 )
 
 // Claims — структура утверждений, которая включает стандартные утверждения
-// и одно пользовательское — UserLogin
+// (логин пользователя передаётся в sub) и пользовательские — UserLogin,
+// оставленный для совместимости, идентификатор сеанса, роль и назначение
+// токена
 type Claims struct {
 	jwt.RegisteredClaims
 	UserLogin string
+	SessionID string `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+	// Purpose задаётся только у вспомогательных токенов, такие токены
+	// не принимаются как токены доступа
+	Purpose string `json:"purpose,omitempty"`
 }
 
-const tokenExp = time.Hour * 3
-const secretKey = "supersecretkey"
+const (
+	defaultTokenExp = time.Hour * 3
+	// ChallengeTokenExp — время, за которое нужно ввести код второго фактора
+	ChallengeTokenExp = 5 * time.Minute
 
-// BuildJWTString создаёт токен и возвращает его в виде строки.
-func BuildJWTString(login string) (string, error) {
-	// создаём новый токен с алгоритмом подписи HS256 и утверждениями — Claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+	purposeTwoFactor = "2fa"
+)
+
+// Config — настройки выпуска и проверки токенов
+type Config struct {
+	// Keys — ключи в формате <kid>:<alg>:<значение>, см. ParseKey
+	Keys []string
+	// SigningKeyID — kid ключа, которым подписываются новые токены,
+	// остальные ключи используются только для проверки
+	SigningKeyID string
+	Issuer       string
+	Audience     string
+	TokenExp     time.Duration
+}
+
+// Authenticator выпускает и проверяет токены пользователей
+type Authenticator struct {
+	keys       map[string]*Key
+	signingKey *Key
+	issuer     string
+	audience   string
+	tokenExp   time.Duration
+}
+
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{
+		keys:     make(map[string]*Key, len(cfg.Keys)),
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		tokenExp: cfg.TokenExp,
+	}
+	if a.tokenExp <= 0 {
+		a.tokenExp = defaultTokenExp
+	}
+
+	for _, spec := range cfg.Keys {
+		key, err := ParseKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := a.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicated key id: %v", key.ID)
+		}
+		a.keys[key.ID] = key
+		// по умолчанию подписываем первым ключом из списка
+		if cfg.SigningKeyID == "" && a.signingKey == nil {
+			a.signingKey = key
+		}
+	}
+
+	if len(a.keys) == 0 {
+		// ключи не заданы - генерируем случайный ключ,
+		// выпущенные токены перестанут действовать после перезапуска
+		key, err := newRandomKey()
+		if err != nil {
+			return nil, err
+		}
+		a.keys[key.ID] = key
+		a.signingKey = key
+	}
+
+	if cfg.SigningKeyID != "" {
+		key, ok := a.keys[cfg.SigningKeyID]
+		if !ok {
+			return nil, fmt.Errorf("signing key not found: %v", cfg.SigningKeyID)
+		}
+		a.signingKey = key
+	}
+
+	if !a.signingKey.CanSign() {
+		return nil, fmt.Errorf("key %v has no private part and can't be used for signing", a.signingKey.ID)
+	}
+
+	return a, nil
+}
+
+// BuildJWTString создаёт токен для сеанса пользователя и возвращает его в виде строки.
+func (a *Authenticator) BuildJWTString(user *model.User, sessionID string) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:  a.issuer,
+			Subject: user.Login,
+			ID:      tokenID,
 			// когда создан токен
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenExp)),
+			IssuedAt: jwt.NewNumericDate(now),
+			// до какого момента действует
+			ExpiresAt: jwt.NewNumericDate(now.Add(a.tokenExp)),
 		},
-		// собственное утверждение
-		UserLogin: login,
-	})
+		// собственные утверждения
+		UserLogin: user.Login,
+		SessionID: sessionID,
+		Role:      user.Role,
+	}
+	if a.audience != "" {
+		claims.Audience = jwt.ClaimStrings{a.audience}
+	}
+
+	// создаём новый токен с алгоритмом подписи ключа и утверждениями — Claims
+	token := jwt.NewWithClaims(a.signingKey.Method, claims)
+	// по kid при проверке будет выбран нужный ключ
+	token.Header["kid"] = a.signingKey.ID
 
 	// создаём строку токена
-	// token.Method = &jwt.SigningMethodHMAC{}
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := token.SignedString(a.signingKey.signKey)
 	if err != nil {
 		return "", err
 	}
@@ -42,15 +148,103 @@ func BuildJWTString(login string) (string, error) {
 	return tokenString, nil
 }
 
-func GetUserInfo(tokenString string) (*model.User, error) {
+// BuildChallengeToken создаёт короткоживущий токен, подтверждающий, что
+// пользователь ввёл верный пароль и должен ввести код второго фактора
+func (a *Authenticator) BuildChallengeToken(login string) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    a.issuer,
+			Subject:   login,
+			ID:        tokenID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ChallengeTokenExp)),
+		},
+		Purpose: purposeTwoFactor,
+	}
+	if a.audience != "" {
+		claims.Audience = jwt.ClaimStrings{a.audience}
+	}
+
+	token := jwt.NewWithClaims(a.signingKey.Method, claims)
+	token.Header["kid"] = a.signingKey.ID
+
+	return token.SignedString(a.signingKey.signKey)
+}
+
+// ParseChallengeToken проверяет токен второго шага входа и возвращает логин
+func (a *Authenticator) ParseChallengeToken(tokenString string) (string, error) {
+	claims, err := a.parse(tokenString)
+	if err != nil {
+		return "", err
+	}
+	if claims.Purpose != purposeTwoFactor {
+		return "", errors.New("token is not a challenge token")
+	}
+
+	return claims.Login(), nil
+}
+
+func (a *Authenticator) GetUserInfo(tokenString string) (*model.User, error) {
+	claims, err := a.ParseClaims(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims.User(), nil
+}
+
+// User возвращает пользователя, которому выдан токен
+func (c *Claims) User() *model.User {
+	role := c.Role
+	// токены, выпущенные до появления ролей, принадлежат обычным пользователям
+	if role == "" {
+		role = model.RoleUser
+	}
+	return &model.User{
+		Login: c.Login(),
+		Role:  role,
+	}
+}
+
+// Login возвращает логин пользователя из sub или, для старых токенов, из UserLogin
+func (c *Claims) Login() string {
+	if c.Subject != "" {
+		return c.Subject
+	}
+	return c.UserLogin
+}
+
+// ParseClaims проверяет подпись и срок действия токена доступа и возвращает его утверждения
+func (a *Authenticator) ParseClaims(tokenString string) (*Claims, error) {
+	claims, err := a.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errors.New("token is not an access token")
+	}
+
+	return claims, nil
+}
+
+func (a *Authenticator) parse(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims,
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return []byte(secretKey), nil
-		})
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(a.validMethods()), jwt.WithIssuedAt()}
+	if a.issuer != "" {
+		options = append(options, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		options = append(options, jwt.WithAudience(a.audience))
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, a.keyFunc, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +253,52 @@ func GetUserInfo(tokenString string) (*model.User, error) {
 		return nil, errors.New("token is not valid")
 	}
 
-	return &model.User{
-			Login: claims.UserLogin},
-		nil
+	return claims, nil
+}
+
+func (a *Authenticator) keyFunc(t *jwt.Token) (interface{}, error) {
+	key := a.signingKey
+	// токены без kid выпущены до ротации ключей - проверяем текущим ключом
+	if kid, ok := t.Header["kid"]; ok {
+		id, _ := kid.(string)
+		key, ok = a.keys[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id: %v", kid)
+		}
+	}
+
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+
+	return key.verifyKey, nil
+}
+
+func (a *Authenticator) validMethods() []string {
+	methods := make([]string, 0, len(a.keys))
+	for _, key := range a.keys {
+		methods = append(methods, key.Method.Alg())
+	}
+	return methods
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func newRandomKey() (*Key, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Key{
+		ID:        "ephemeral",
+		Method:    jwt.SigningMethodHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}, nil
 }
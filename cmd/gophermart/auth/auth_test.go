@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/model"
+)
+
+func writePEM(t *testing.T, name string, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writeKeyPair(t *testing.T, name string, private crypto.PrivateKey, public crypto.PublicKey) (string, string) {
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, name+".pem", "PRIVATE KEY", privateDER),
+		writePEM(t, name+".pub.pem", "PUBLIC KEY", publicDER)
+}
+
+func TestAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, rsaPublic := writeKeyPair(t, "rsa", rsaKey, &rsaKey.PublicKey)
+
+	edPublicKey, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPrivate, edPublic := writeKeyPair(t, "ed", edPrivateKey, edPublicKey)
+
+	tests := []struct {
+		name    string
+		issuer  Config
+		checker Config
+		wantErr bool
+	}{
+		{
+			name:    "hs256",
+			issuer:  Config{Keys: []string{"k1:HS256:secret"}},
+			checker: Config{Keys: []string{"k1:HS256:secret"}},
+		},
+		{
+			name:    "hs256_wrong_secret",
+			issuer:  Config{Keys: []string{"k1:HS256:secret"}},
+			checker: Config{Keys: []string{"k1:HS256:another"}},
+			wantErr: true,
+		},
+		{
+			name:   "rotation_old_key_still_accepted",
+			issuer: Config{Keys: []string{"k1:HS256:secret"}},
+			checker: Config{
+				Keys:         []string{"k1:HS256:secret", "k2:EdDSA:" + edPrivate},
+				SigningKeyID: "k2",
+			},
+		},
+		{
+			name:    "rotation_old_key_removed",
+			issuer:  Config{Keys: []string{"k1:HS256:secret"}},
+			checker: Config{Keys: []string{"k2:HS256:secret"}},
+			wantErr: true,
+		},
+		{
+			name:   "rs256_public_key_verification",
+			issuer: Config{Keys: []string{"rsa:RS256:" + rsaPrivate}},
+			checker: Config{
+				Keys:         []string{"main:HS256:secret", "rsa:RS256:" + rsaPublic},
+				SigningKeyID: "main",
+			},
+		},
+		{
+			name:   "eddsa_public_key_verification",
+			issuer: Config{Keys: []string{"ed:EdDSA:" + edPrivate}},
+			checker: Config{
+				Keys:         []string{"main:HS256:secret", "ed:EdDSA:" + edPublic},
+				SigningKeyID: "main",
+			},
+		},
+		{
+			name:    "wrong_audience",
+			issuer:  Config{Keys: []string{"k1:HS256:secret"}, Audience: "other"},
+			checker: Config{Keys: []string{"k1:HS256:secret"}, Audience: "gophermart"},
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			issuer:  Config{Keys: []string{"k1:HS256:secret"}, TokenExp: -time.Minute},
+			checker: Config{Keys: []string{"k1:HS256:secret"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := New(tt.issuer)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			checker, err := New(tt.checker)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			// New заменяет неположительный срок жизни значением по умолчанию
+			if tt.issuer.TokenExp < 0 {
+				issuer.tokenExp = tt.issuer.TokenExp
+			}
+
+			token, err := issuer.BuildJWTString(&model.User{Login: "user1", Role: model.RoleAdmin}, "session1")
+			if err != nil {
+				t.Fatalf("BuildJWTString() error = %v", err)
+			}
+			user, err := checker.GetUserInfo(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetUserInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && user.Login != "user1" {
+				t.Errorf("GetUserInfo() login = %v, want %v", user.Login, "user1")
+			}
+		})
+	}
+}
+
+func TestNewVerifyOnlySigningKey(t *testing.T) {
+	edPublicKey, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edPublic := writeKeyPair(t, "ed", edPrivateKey, edPublicKey)
+
+	if _, err := New(Config{Keys: []string{"ed:EdDSA:" + edPublic}}); err == nil {
+		t.Errorf("New() expected error for public key used for signing")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rsaPublic := writeKeyPair(t, "rsa", rsaKey, &rsaKey.PublicKey)
+
+	edPublicKey, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPrivate, _ := writeKeyPair(t, "ed", edPrivateKey, edPublicKey)
+
+	a, err := New(Config{Keys: []string{
+		"hs:HS256:secret",
+		"rsa:RS256:" + rsaPublic,
+		"ed:EdDSA:" + edPrivate,
+	}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	set := a.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS() keys count = %v, want %v", len(set.Keys), 2)
+	}
+	if set.Keys[0].KeyID != "ed" || set.Keys[0].KeyType != "OKP" || set.Keys[0].X == "" {
+		t.Errorf("JWKS() invalid ed25519 key: %+v", set.Keys[0])
+	}
+	if set.Keys[1].KeyID != "rsa" || set.Keys[1].KeyType != "RSA" || set.Keys[1].Exponent != "AQAB" {
+		t.Errorf("JWKS() invalid rsa key: %+v", set.Keys[1])
+	}
+}
+
+func TestStandardClaims(t *testing.T) {
+	a, err := New(Config{Keys: []string{"k1:HS256:secret"}, Issuer: "gophermart", Audience: "api"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	token, err := a.BuildJWTString(&model.User{Login: "user1", Role: model.RoleAdmin}, "session1")
+	if err != nil {
+		t.Fatalf("BuildJWTString() error = %v", err)
+	}
+	claims, err := a.ParseClaims(token)
+	if err != nil {
+		t.Fatalf("ParseClaims() error = %v", err)
+	}
+	if claims.Subject != "user1" || claims.Login() != "user1" {
+		t.Errorf("ParseClaims() sub = %v, want %v", claims.Subject, "user1")
+	}
+	if claims.User().Role != model.RoleAdmin {
+		t.Errorf("ParseClaims() role = %v, want %v", claims.User().Role, model.RoleAdmin)
+	}
+	if claims.ID == "" || claims.IssuedAt == nil {
+		t.Errorf("ParseClaims() jti and iat must be set: %+v", claims.RegisteredClaims)
+	}
+	if claims.Issuer != "gophermart" || len(claims.Audience) != 1 || claims.Audience[0] != "api" {
+		t.Errorf("ParseClaims() invalid iss/aud: %+v", claims.RegisteredClaims)
+	}
+}
+
+func TestChallengeToken(t *testing.T) {
+	a, err := New(Config{Keys: []string{"k1:HS256:secret"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	challenge, err := a.BuildChallengeToken("user1")
+	if err != nil {
+		t.Fatalf("BuildChallengeToken() error = %v", err)
+	}
+
+	login, err := a.ParseChallengeToken(challenge)
+	if err != nil || login != "user1" {
+		t.Errorf("ParseChallengeToken() = %v, %v, want user1", login, err)
+	}
+	// токен второго шага не заменяет токен доступа
+	if _, err := a.ParseClaims(challenge); err == nil {
+		t.Errorf("ParseClaims() accepted challenge token")
+	}
+
+	access, err := a.BuildJWTString(&model.User{Login: "user1"}, "session1")
+	if err != nil {
+		t.Fatalf("BuildJWTString() error = %v", err)
+	}
+	if _, err := a.ParseChallengeToken(access); err == nil {
+		t.Errorf("ParseChallengeToken() accepted access token")
+	}
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key — ключ подписи токенов
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// signKey равен nil для ключей, которые используются только для проверки
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// CanSign сообщает, можно ли подписывать токены этим ключом
+func (k *Key) CanSign() bool {
+	return k.signKey != nil
+}
+
+// ParseKey разбирает описание ключа в формате <kid>:<alg>:<значение>.
+// Для HS256 значение — это секрет, для RS256 и EdDSA — путь к PEM-файлу
+// с закрытым ключом (подпись и проверка) или открытым ключом (только проверка)
+func ParseKey(spec string) (*Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return nil, errors.New("key must be in format <kid>:<alg>:<value>")
+	}
+	id, alg, value := parts[0], parts[1], parts[2]
+
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		return &Key{
+			ID:        id,
+			Method:    jwt.SigningMethodHS256,
+			signKey:   []byte(value),
+			verifyKey: []byte(value),
+		}, nil
+	case jwt.SigningMethodRS256.Alg():
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("can't read key %v: %w", id, err)
+		}
+		return parseRSAKey(id, data)
+	case jwt.SigningMethodEdDSA.Alg():
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("can't read key %v: %w", id, err)
+		}
+		return parseEdKey(id, data)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %v for key %v", alg, id)
+	}
+}
+
+func parseRSAKey(id string, data []byte) (*Key, error) {
+	key := &Key{
+		ID:     id,
+		Method: jwt.SigningMethodRS256,
+	}
+
+	if private, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		key.signKey = private
+		key.verifyKey = &private.PublicKey
+		return key, nil
+	}
+
+	public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse RSA key %v: %w", id, err)
+	}
+	key.verifyKey = public
+	return key, nil
+}
+
+func parseEdKey(id string, data []byte) (*Key, error) {
+	key := &Key{
+		ID:     id,
+		Method: jwt.SigningMethodEdDSA,
+	}
+
+	if private, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		edPrivate, ok := private.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %v is not ed25519 key", id)
+		}
+		key.signKey = edPrivate
+		key.verifyKey = edPrivate.Public()
+		return key, nil
+	}
+
+	public, err := jwt.ParseEdPublicKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse EdDSA key %v: %w", id, err)
+	}
+	key.verifyKey = public
+	return key, nil
+}
@@ -1,17 +1,70 @@
 package config
 
 import (
+	"strings"
+	"time"
+
 	"github.com/caarlos0/env/v9"
+	"github.com/kvvPro/gophermart/internal/password"
+	"github.com/kvvPro/gophermart/internal/validation"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 )
 
 type ServerFlags struct {
-	Address                string `env:"RUN_ADDRESS"`
-	DBConnection           string `env:"DATABASE_URI"`
-	AccrualSystemAddress   string `env:"ACCRUAL_SYSTEM_ADDRESS"`
-	ReadingAccrualInterval int    `env:"READING_ACCRUAL_INTERVAL"`
-	UpdateThreadCount      int    `env:"UPDATE_THREAD_COUNT"`
+	Address string `env:"RUN_ADDRESS"`
+	// db или memory; данные в памяти теряются при остановке сервиса
+	StorageType string `env:"STORAGE"`
+	// строка подключения к Postgres или sqlite:///путь/к/файлу для SQLite
+	DBConnection string `env:"DATABASE_URI"`
+	// при выключенном автоприменении схема обновляется командой migrate up
+	DBAutoMigrate bool `env:"DB_AUTO_MIGRATE"`
+	// пул соединений и ограничения времени запросов к Postgres
+	DBMaxConns             int32         `env:"DB_MAX_CONNS"`
+	DBMinConns             int32         `env:"DB_MIN_CONNS"`
+	DBMaxConnLifetime      time.Duration `env:"DB_MAX_CONN_LIFETIME"`
+	DBMaxConnIdleTime      time.Duration `env:"DB_MAX_CONN_IDLE_TIME"`
+	DBStatementTimeout     time.Duration `env:"DB_STATEMENT_TIMEOUT"`
+	DBQueryTimeout         time.Duration `env:"DB_QUERY_TIMEOUT"`
+	AccrualSystemAddress   string        `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	ReadingAccrualInterval int           `env:"READING_ACCRUAL_INTERVAL"`
+	UpdateThreadCount      int           `env:"UPDATE_THREAD_COUNT"`
+	// заказы для опроса системы начислений берутся в аренду пакетами,
+	// чтобы экземпляры сервиса не опрашивали одни и те же заказы
+	AccrualBatchSize       int           `env:"ACCRUAL_BATCH_SIZE"`
+	AccrualLeaseTime       time.Duration `env:"ACCRUAL_LEASE_TIME"`
+	PasswordHashMemory     uint32        `env:"PASSWORD_HASH_MEMORY"`
+	PasswordHashIterations uint32        `env:"PASSWORD_HASH_ITERATIONS"`
+	PasswordHashThreads    uint8         `env:"PASSWORD_HASH_THREADS"`
+	PasswordMinLength      int           `env:"PASSWORD_MIN_LENGTH"`
+	PasswordMinClasses     int           `env:"PASSWORD_MIN_CLASSES"`
+	// ключи содержат секреты, поэтому не выводятся в лог
+	JWTKeys         []string      `env:"JWT_KEYS" envSeparator:";" json:"-"`
+	JWTSigningKeyID string        `env:"JWT_SIGNING_KEY_ID"`
+	JWTIssuer       string        `env:"JWT_ISSUER"`
+	JWTAudience     string        `env:"JWT_AUDIENCE"`
+	JWTTokenExp     time.Duration `env:"JWT_TOKEN_EXP"`
+	RefreshTokenExp time.Duration `env:"REFRESH_TOKEN_EXP"`
+	// отзыв сеанса на других экземплярах сервиса действует не позже чем через это время
+	SessionCacheTTL time.Duration `env:"SESSION_CACHE_TTL"`
+	// защита от перебора паролей
+	LoginMaxFailures   int           `env:"LOGIN_MAX_FAILURES"`
+	LoginIPMaxFailures int           `env:"LOGIN_IP_MAX_FAILURES"`
+	LoginFailureWindow time.Duration `env:"LOGIN_FAILURE_WINDOW"`
+	LoginLockDuration  time.Duration `env:"LOGIN_LOCK_DURATION"`
+	LoginDelayStep     time.Duration `env:"LOGIN_DELAY_STEP"`
+	LoginMaxDelay      time.Duration `env:"LOGIN_MAX_DELAY"`
+	LoginAttemptsStore string        `env:"LOGIN_ATTEMPTS_STORE"`
+	AdminLogins        []string      `env:"ADMIN_LOGINS" envSeparator:","`
+	// двухфакторная аутентификация
+	TwoFactorIssuer              string  `env:"TOTP_ISSUER"`
+	WithdrawalTwoFactorThreshold float64 `env:"WITHDRAWAL_2FA_THRESHOLD"`
+	// вход через внешнего провайдера OpenID Connect
+	OIDCIssuer       string   `env:"OIDC_ISSUER"`
+	OIDCClientID     string   `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string   `env:"OIDC_CLIENT_SECRET" json:"-"`
+	OIDCRedirectURL  string   `env:"OIDC_REDIRECT_URL"`
+	OIDCScopes       []string `env:"OIDC_SCOPES" envSeparator:" "`
 }
 
 var Sugar zap.SugaredLogger
@@ -20,19 +73,92 @@ func Initialize() (*ServerFlags, error) {
 	srvFlags := new(ServerFlags)
 	// try to get vars from Flags
 	pflag.StringVarP(&srvFlags.Address, "addr", "a", "localhost:8080", "Net address host:port")
-	pflag.StringVarP(&srvFlags.DBConnection, "databaseURI", "d", "user=postgres password=postgres host=localhost port=5432 dbname=postgres sslmode=disable", "Connection string to DB: user=<> password=<> host=<> port=<> dbname=<>")
+	pflag.StringVar(&srvFlags.StorageType, "storage", "db", "Storage backend: db (Postgres or SQLite, chosen by databaseURI) or memory (for tests and local development, data is lost on exit)")
+	pflag.StringVarP(&srvFlags.DBConnection, "databaseURI", "d", "user=postgres password=postgres host=localhost port=5432 dbname=postgres sslmode=disable", "Connection string to DB: user=<> password=<> host=<> port=<> dbname=<> for Postgres or sqlite:///path/to/file.db for SQLite")
+	pflag.BoolVar(&srvFlags.DBAutoMigrate, "autoMigrate", true, "Apply pending schema migrations on start")
+	pflag.Int32Var(&srvFlags.DBMaxConns, "dbMaxConns", 10, "Maximum size of Postgres connection pool")
+	pflag.Int32Var(&srvFlags.DBMinConns, "dbMinConns", 0, "Connections kept open in Postgres pool even when idle")
+	pflag.DurationVar(&srvFlags.DBMaxConnLifetime, "dbMaxConnLifetime", time.Hour, "Postgres connection is closed after this time since creation")
+	pflag.DurationVar(&srvFlags.DBMaxConnIdleTime, "dbMaxConnIdleTime", 30*time.Minute, "Idle Postgres connection is closed after this time")
+	pflag.DurationVar(&srvFlags.DBStatementTimeout, "dbStatementTimeout", 15*time.Second, "Postgres statement_timeout for every query, 0 - server default")
+	pflag.DurationVar(&srvFlags.DBQueryTimeout, "dbQueryTimeout", 30*time.Second, "Deadline for one storage operation including wait for free connection, 0 - no deadline")
 	pflag.StringVarP(&srvFlags.AccrualSystemAddress, "accrAddr", "r", "", "Hash key to calculate hash sum")
 	pflag.IntVarP(&srvFlags.ReadingAccrualInterval, "accrInterval", "i", 5, "Interval in sec to update orders info from accrual system")
 	pflag.IntVarP(&srvFlags.UpdateThreadCount, "updThreads", "t", 3, "Thread count to parallel update orders info from accrual system")
+	pflag.IntVar(&srvFlags.AccrualBatchSize, "accrBatchSize", 100, "Orders taken at once to poll accrual system")
+	pflag.DurationVar(&srvFlags.AccrualLeaseTime, "accrLeaseTime", time.Minute, "Time for which taken orders are hidden from other instances; orders not updated in time are polled again")
+	pflag.Uint32Var(&srvFlags.PasswordHashMemory, "pwdMemory", password.DefaultParams.Memory, "Memory in KiB used by argon2id to hash passwords")
+	pflag.Uint32Var(&srvFlags.PasswordHashIterations, "pwdIterations", password.DefaultParams.Iterations, "Iterations count used by argon2id to hash passwords")
+	pflag.Uint8Var(&srvFlags.PasswordHashThreads, "pwdThreads", password.DefaultParams.Parallelism, "Threads count used by argon2id to hash passwords")
+	pflag.IntVar(&srvFlags.PasswordMinLength, "pwdMinLength", validation.DefaultPolicy.PasswordMinLength, "Minimum password length")
+	pflag.IntVar(&srvFlags.PasswordMinClasses, "pwdMinClasses", validation.DefaultPolicy.PasswordMinClasses, "Minimum count of character classes (letters, digits, other) in password")
+	pflag.StringArrayVar(&srvFlags.JWTKeys, "jwtKey", nil, "JWT key <kid>:<alg>:<value>, alg is HS256 (value is secret), RS256 or EdDSA (value is path to PEM file); can be repeated")
+	pflag.StringVar(&srvFlags.JWTSigningKeyID, "jwtSigningKey", "", "Kid of JWT key used to sign new tokens, first key by default")
+	pflag.StringVar(&srvFlags.JWTIssuer, "jwtIssuer", "", "JWT issuer (iss claim)")
+	pflag.StringVar(&srvFlags.JWTAudience, "jwtAudience", "", "JWT audience (aud claim)")
+	pflag.DurationVar(&srvFlags.JWTTokenExp, "jwtExp", 3*time.Hour, "JWT lifetime")
+	pflag.DurationVar(&srvFlags.RefreshTokenExp, "refreshExp", 30*24*time.Hour, "Refresh token and session lifetime")
+	pflag.DurationVar(&srvFlags.SessionCacheTTL, "sessionCacheTTL", 10*time.Second, "How long session checks are cached in memory")
+	pflag.IntVar(&srvFlags.LoginMaxFailures, "loginMaxFailures", 5, "Failed login attempts per login before temporary lockout, 0 disables lockout")
+	pflag.IntVar(&srvFlags.LoginIPMaxFailures, "loginIPMaxFailures", 50, "Failed login attempts per IP before temporary lockout, 0 disables lockout")
+	pflag.DurationVar(&srvFlags.LoginFailureWindow, "loginFailureWindow", 15*time.Minute, "Window in which failed login attempts are counted")
+	pflag.DurationVar(&srvFlags.LoginLockDuration, "loginLockDuration", 15*time.Minute, "Duration of login lockout")
+	pflag.DurationVar(&srvFlags.LoginDelayStep, "loginDelayStep", 200*time.Millisecond, "Response delay added for each failed login attempt")
+	pflag.DurationVar(&srvFlags.LoginMaxDelay, "loginMaxDelay", 2*time.Second, "Maximum response delay for failed login attempt")
+	pflag.StringSliceVar(&srvFlags.AdminLogins, "admins", nil, "Logins of existing users who get admin role on start")
+	pflag.StringVar(&srvFlags.TwoFactorIssuer, "totpIssuer", "Gophermart", "Issuer name shown in authenticator apps")
+	pflag.Float64Var(&srvFlags.WithdrawalTwoFactorThreshold, "withdrawal2faThreshold", 0, "Withdrawals above this sum require a fresh 2FA code (0 - never)")
+	pflag.StringVar(&srvFlags.OIDCIssuer, "oidcIssuer", "", "OpenID Connect issuer URL, empty disables SSO login")
+	pflag.StringVar(&srvFlags.OIDCClientID, "oidcClientID", "", "OpenID Connect client id")
+	pflag.StringVar(&srvFlags.OIDCClientSecret, "oidcClientSecret", "", "OpenID Connect client secret, empty for public clients")
+	pflag.StringVar(&srvFlags.OIDCRedirectURL, "oidcRedirectURL", "", "Callback URL registered at the provider, e.g. https://host/api/user/oidc/callback")
+	pflag.StringSliceVar(&srvFlags.OIDCScopes, "oidcScopes", []string{"openid", "email", "profile"}, "OpenID Connect scopes")
+	pflag.StringVar(&srvFlags.LoginAttemptsStore, "loginAttemptsStore", "memory", "Where to keep failed login counters: memory (single instance) or db (shared by replicas)")
 
 	pflag.Parse()
 
 	Sugar.Infoln("\nFLAGS-----------")
 	Sugar.Infof("RUN_ADDRESS=%v", srvFlags.Address)
+	Sugar.Infof("STORAGE=%v", srvFlags.StorageType)
 	Sugar.Infof("DATABASE_URI=%v", srvFlags.DBConnection)
+	Sugar.Infof("DB_AUTO_MIGRATE=%v", srvFlags.DBAutoMigrate)
+	Sugar.Infof("DB_MAX_CONNS=%v", srvFlags.DBMaxConns)
+	Sugar.Infof("DB_MIN_CONNS=%v", srvFlags.DBMinConns)
+	Sugar.Infof("DB_MAX_CONN_LIFETIME=%v", srvFlags.DBMaxConnLifetime)
+	Sugar.Infof("DB_MAX_CONN_IDLE_TIME=%v", srvFlags.DBMaxConnIdleTime)
+	Sugar.Infof("DB_STATEMENT_TIMEOUT=%v", srvFlags.DBStatementTimeout)
+	Sugar.Infof("DB_QUERY_TIMEOUT=%v", srvFlags.DBQueryTimeout)
 	Sugar.Infof("ACCRUAL_SYSTEM_ADDRESS=%v", srvFlags.AccrualSystemAddress)
 	Sugar.Infof("READING_ACCRUAL_INTERVAL=%v", srvFlags.ReadingAccrualInterval)
 	Sugar.Infof("UPDATE_THREAD_COUNT=%v", srvFlags.UpdateThreadCount)
+	Sugar.Infof("ACCRUAL_BATCH_SIZE=%v", srvFlags.AccrualBatchSize)
+	Sugar.Infof("ACCRUAL_LEASE_TIME=%v", srvFlags.AccrualLeaseTime)
+	Sugar.Infof("PASSWORD_HASH_MEMORY=%v", srvFlags.PasswordHashMemory)
+	Sugar.Infof("PASSWORD_HASH_ITERATIONS=%v", srvFlags.PasswordHashIterations)
+	Sugar.Infof("PASSWORD_HASH_THREADS=%v", srvFlags.PasswordHashThreads)
+	Sugar.Infof("PASSWORD_MIN_LENGTH=%v", srvFlags.PasswordMinLength)
+	Sugar.Infof("PASSWORD_MIN_CLASSES=%v", srvFlags.PasswordMinClasses)
+	Sugar.Infof("JWT_KEYS=%v", keyIDs(srvFlags.JWTKeys))
+	Sugar.Infof("JWT_SIGNING_KEY_ID=%v", srvFlags.JWTSigningKeyID)
+	Sugar.Infof("JWT_ISSUER=%v", srvFlags.JWTIssuer)
+	Sugar.Infof("JWT_AUDIENCE=%v", srvFlags.JWTAudience)
+	Sugar.Infof("JWT_TOKEN_EXP=%v", srvFlags.JWTTokenExp)
+	Sugar.Infof("REFRESH_TOKEN_EXP=%v", srvFlags.RefreshTokenExp)
+	Sugar.Infof("SESSION_CACHE_TTL=%v", srvFlags.SessionCacheTTL)
+	Sugar.Infof("LOGIN_MAX_FAILURES=%v", srvFlags.LoginMaxFailures)
+	Sugar.Infof("LOGIN_IP_MAX_FAILURES=%v", srvFlags.LoginIPMaxFailures)
+	Sugar.Infof("LOGIN_FAILURE_WINDOW=%v", srvFlags.LoginFailureWindow)
+	Sugar.Infof("LOGIN_LOCK_DURATION=%v", srvFlags.LoginLockDuration)
+	Sugar.Infof("LOGIN_DELAY_STEP=%v", srvFlags.LoginDelayStep)
+	Sugar.Infof("LOGIN_MAX_DELAY=%v", srvFlags.LoginMaxDelay)
+	Sugar.Infof("LOGIN_ATTEMPTS_STORE=%v", srvFlags.LoginAttemptsStore)
+	Sugar.Infof("ADMIN_LOGINS=%v", srvFlags.AdminLogins)
+	Sugar.Infof("TOTP_ISSUER=%v", srvFlags.TwoFactorIssuer)
+	Sugar.Infof("WITHDRAWAL_2FA_THRESHOLD=%v", srvFlags.WithdrawalTwoFactorThreshold)
+	Sugar.Infof("OIDC_ISSUER=%v", srvFlags.OIDCIssuer)
+	Sugar.Infof("OIDC_CLIENT_ID=%v", srvFlags.OIDCClientID)
+	Sugar.Infof("OIDC_REDIRECT_URL=%v", srvFlags.OIDCRedirectURL)
+	Sugar.Infof("OIDC_SCOPES=%v", srvFlags.OIDCScopes)
 
 	// try to get vars from env
 	if err := env.Parse(srvFlags); err != nil {
@@ -40,10 +166,56 @@ func Initialize() (*ServerFlags, error) {
 	}
 	Sugar.Infoln("ENV-----------")
 	Sugar.Infof("RUN_ADDRESS=%v", srvFlags.Address)
+	Sugar.Infof("STORAGE=%v", srvFlags.StorageType)
 	Sugar.Infof("DATABASE_URI=%v", srvFlags.DBConnection)
+	Sugar.Infof("DB_AUTO_MIGRATE=%v", srvFlags.DBAutoMigrate)
+	Sugar.Infof("DB_MAX_CONNS=%v", srvFlags.DBMaxConns)
+	Sugar.Infof("DB_MIN_CONNS=%v", srvFlags.DBMinConns)
+	Sugar.Infof("DB_MAX_CONN_LIFETIME=%v", srvFlags.DBMaxConnLifetime)
+	Sugar.Infof("DB_MAX_CONN_IDLE_TIME=%v", srvFlags.DBMaxConnIdleTime)
+	Sugar.Infof("DB_STATEMENT_TIMEOUT=%v", srvFlags.DBStatementTimeout)
+	Sugar.Infof("DB_QUERY_TIMEOUT=%v", srvFlags.DBQueryTimeout)
 	Sugar.Infof("ACCRUAL_SYSTEM_ADDRESS=%v", srvFlags.AccrualSystemAddress)
 	Sugar.Infof("READING_ACCRUAL_INTERVAL=%v", srvFlags.ReadingAccrualInterval)
 	Sugar.Infof("UPDATE_THREAD_COUNT=%v", srvFlags.UpdateThreadCount)
+	Sugar.Infof("ACCRUAL_BATCH_SIZE=%v", srvFlags.AccrualBatchSize)
+	Sugar.Infof("ACCRUAL_LEASE_TIME=%v", srvFlags.AccrualLeaseTime)
+	Sugar.Infof("PASSWORD_HASH_MEMORY=%v", srvFlags.PasswordHashMemory)
+	Sugar.Infof("PASSWORD_HASH_ITERATIONS=%v", srvFlags.PasswordHashIterations)
+	Sugar.Infof("PASSWORD_HASH_THREADS=%v", srvFlags.PasswordHashThreads)
+	Sugar.Infof("PASSWORD_MIN_LENGTH=%v", srvFlags.PasswordMinLength)
+	Sugar.Infof("PASSWORD_MIN_CLASSES=%v", srvFlags.PasswordMinClasses)
+	Sugar.Infof("JWT_KEYS=%v", keyIDs(srvFlags.JWTKeys))
+	Sugar.Infof("JWT_SIGNING_KEY_ID=%v", srvFlags.JWTSigningKeyID)
+	Sugar.Infof("JWT_ISSUER=%v", srvFlags.JWTIssuer)
+	Sugar.Infof("JWT_AUDIENCE=%v", srvFlags.JWTAudience)
+	Sugar.Infof("JWT_TOKEN_EXP=%v", srvFlags.JWTTokenExp)
+	Sugar.Infof("REFRESH_TOKEN_EXP=%v", srvFlags.RefreshTokenExp)
+	Sugar.Infof("SESSION_CACHE_TTL=%v", srvFlags.SessionCacheTTL)
+	Sugar.Infof("LOGIN_MAX_FAILURES=%v", srvFlags.LoginMaxFailures)
+	Sugar.Infof("LOGIN_IP_MAX_FAILURES=%v", srvFlags.LoginIPMaxFailures)
+	Sugar.Infof("LOGIN_FAILURE_WINDOW=%v", srvFlags.LoginFailureWindow)
+	Sugar.Infof("LOGIN_LOCK_DURATION=%v", srvFlags.LoginLockDuration)
+	Sugar.Infof("LOGIN_DELAY_STEP=%v", srvFlags.LoginDelayStep)
+	Sugar.Infof("LOGIN_MAX_DELAY=%v", srvFlags.LoginMaxDelay)
+	Sugar.Infof("LOGIN_ATTEMPTS_STORE=%v", srvFlags.LoginAttemptsStore)
+	Sugar.Infof("ADMIN_LOGINS=%v", srvFlags.AdminLogins)
+	Sugar.Infof("TOTP_ISSUER=%v", srvFlags.TwoFactorIssuer)
+	Sugar.Infof("WITHDRAWAL_2FA_THRESHOLD=%v", srvFlags.WithdrawalTwoFactorThreshold)
+	Sugar.Infof("OIDC_ISSUER=%v", srvFlags.OIDCIssuer)
+	Sugar.Infof("OIDC_CLIENT_ID=%v", srvFlags.OIDCClientID)
+	Sugar.Infof("OIDC_REDIRECT_URL=%v", srvFlags.OIDCRedirectURL)
+	Sugar.Infof("OIDC_SCOPES=%v", srvFlags.OIDCScopes)
 
 	return srvFlags, nil
 }
+
+// keyIDs оставляет от описаний ключей только kid и алгоритм
+func keyIDs(keys []string) []string {
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.SplitN(key, ":", 3)
+		ids = append(ids, strings.Join(parts[:len(parts)-1], ":"))
+	}
+	return ids
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/kvvPro/gophermart/cmd/gophermart/app"
 	"github.com/kvvPro/gophermart/cmd/gophermart/config"
+	"github.com/spf13/pflag"
 
 	"go.uber.org/zap"
 )
@@ -40,6 +41,22 @@ func main() {
 
 	ctx := context.Background()
 
+	// gophermart migrate up|down|status управляет схемой базы и завершается
+	if args := pflag.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(ctx, srvFlags, args[1:]); err != nil {
+			app.Sugar.Fatalw(err.Error(), "event", "migrate")
+		}
+		return
+	}
+
+	// gophermart reconcile сверяет журнал баллов с заказами и списаниями
+	if args := pflag.Args(); len(args) > 0 && args[0] == "reconcile" {
+		if err := runReconcile(ctx, srvFlags); err != nil {
+			app.Sugar.Fatalw(err.Error(), "event", "reconcile")
+		}
+		return
+	}
+
 	srv, err := app.NewServer(ctx, srvFlags)
 
 	if err != nil {
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/kvvPro/gophermart/cmd/gophermart/config"
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/storage/migration"
+	"github.com/kvvPro/gophermart/internal/storage/postgres"
+	"github.com/kvvPro/gophermart/internal/storage/sqlite"
+)
+
+const migrateUsage = "usage: gophermart migrate up|down [steps]|status"
+
+// database — база, с которой работают команды migrate и reconcile
+type database interface {
+	MigrateUp(ctx context.Context) ([]migration.Migration, error)
+	MigrateDown(ctx context.Context, steps int) ([]migration.Migration, error)
+	MigrationStatus(ctx context.Context) ([]migration.Status, error)
+	Reconcile(ctx context.Context) ([]model.LedgerDrift, error)
+	Quit(ctx context.Context)
+}
+
+// connectDatabase подключается к Postgres или к файлу SQLite
+// по строке подключения, не изменяя схему
+func connectDatabase(ctx context.Context, connection string) (database, error) {
+	if sqlite.IsURI(connection) {
+		st, err := sqlite.Connect(ctx, connection)
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	}
+
+	st, err := postgres.Connect(ctx, connection, postgres.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// runMigrate выполняет команду migrate: up применяет все новые шаги,
+// down откатывает последние шаги (по умолчанию один), status показывает
+// состояние всех шагов
+func runMigrate(ctx context.Context, srvFlags *config.ServerFlags, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	st, err := connectDatabase(ctx, srvFlags.DBConnection)
+	if err != nil {
+		return err
+	}
+	defer st.Quit(ctx)
+
+	switch args[0] {
+	case "up":
+		applied, err := st.MigrateUp(ctx)
+		for _, el := range applied {
+			fmt.Printf("applied %v_%v\n", el.Version, el.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				return errors.New(migrateUsage)
+			}
+		}
+		rolledBack, err := st.MigrateDown(ctx, steps)
+		for _, el := range rolledBack {
+			fmt.Printf("rolled back %v_%v\n", el.Version, el.Name)
+		}
+		return err
+	case "status":
+		statuses, err := st.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, el := range statuses {
+			appliedAt := "pending"
+			if el.AppliedAt != nil {
+				appliedAt = el.AppliedAt.Format("2006-01-02 15:04:05 -0700")
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\n", el.Version, el.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+}
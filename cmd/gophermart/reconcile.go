@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kvvPro/gophermart/cmd/gophermart/config"
+)
+
+// runReconcile выполняет команду reconcile: сверяет журнал баллов с заказами,
+// списаниями и корректировками и печатает расхождения. При расхождениях
+// возвращает ошибку, чтобы команду можно было запускать по расписанию
+func runReconcile(ctx context.Context, srvFlags *config.ServerFlags) error {
+	st, err := connectDatabase(ctx, srvFlags.DBConnection)
+	if err != nil {
+		return err
+	}
+	defer st.Quit(ctx)
+
+	drifts, err := st.Reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	if len(drifts) == 0 {
+		fmt.Println("ledger is consistent")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tACCOUNT\tKIND\tREFERENCE\tEXPECTED\tRECORDED")
+	for _, el := range drifts {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			el.Check, el.Account, el.Kind, el.Reference, el.Expected, el.Recorded)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("ledger drift: %v problems found", len(drifts))
+}
@@ -0,0 +1,155 @@
+// Package lockout защищает вход от перебора паролей: считает неудачные
+// попытки по логину и по IP-адресу, замедляет ответы и временно блокирует вход
+package lockout
+
+import (
+	"context"
+	"time"
+)
+
+// Policy — пороги блокировки
+type Policy struct {
+	// MaxFailures — число неудачных попыток, после которого ключ блокируется
+	MaxFailures int
+	// Window — неудачные попытки старше окна забываются
+	Window time.Duration
+	// LockDuration — длительность блокировки
+	LockDuration time.Duration
+	// DelayStep — задержка ответа растёт на этот шаг с каждой неудачной попыткой
+	DelayStep time.Duration
+	// MaxDelay — максимальная задержка ответа
+	MaxDelay time.Duration
+}
+
+// State — состояние счётчика неудачных попыток
+type State struct {
+	Failures     int
+	FirstFailure time.Time
+	LastFailure  time.Time
+	LockedUntil  time.Time
+	// JustLocked = true, если блокировка установлена этой попыткой
+	JustLocked bool
+}
+
+// Store хранит счётчики неудачных попыток
+type Store interface {
+	GetLoginAttempts(ctx context.Context, key string) (*State, error)
+	RegisterLoginFailure(ctx context.Context, key string, policy Policy, now time.Time) (*State, error)
+	ResetLoginAttempts(ctx context.Context, key string) error
+}
+
+// Guard применяет политики блокировки к ключам вида login:<логин> и ip:<адрес>
+type Guard struct {
+	store       Store
+	loginPolicy Policy
+	ipPolicy    Policy
+}
+
+func NewGuard(store Store, loginPolicy Policy, ipPolicy Policy) *Guard {
+	return &Guard{
+		store:       store,
+		loginPolicy: loginPolicy,
+		ipPolicy:    ipPolicy,
+	}
+}
+
+func LoginKey(login string) string {
+	return "login:" + login
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check возвращает время до снятия блокировки или 0, если вход разрешён
+func (g *Guard) Check(ctx context.Context, login string, ip string) (time.Duration, error) {
+	var retryAfter time.Duration
+	now := time.Now()
+
+	for _, key := range []string{LoginKey(login), IPKey(ip)} {
+		state, err := g.store.GetLoginAttempts(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if state != nil && state.LockedUntil.After(now) {
+			if wait := state.LockedUntil.Sub(now); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+
+	return retryAfter, nil
+}
+
+// Fail учитывает неудачную попытку. Возвращает задержку, с которой нужно
+// ответить клиенту, и ключи, заблокированные этой попыткой
+func (g *Guard) Fail(ctx context.Context, login string, ip string) (time.Duration, []string, error) {
+	var delay time.Duration
+	var locked []string
+	now := time.Now()
+
+	keys := []struct {
+		key    string
+		policy Policy
+	}{
+		{LoginKey(login), g.loginPolicy},
+		{IPKey(ip), g.ipPolicy},
+	}
+	for _, el := range keys {
+		state, err := g.store.RegisterLoginFailure(ctx, el.key, el.policy, now)
+		if err != nil {
+			return 0, nil, err
+		}
+		failures := state.Failures
+		if state.JustLocked {
+			locked = append(locked, el.key)
+			failures = el.policy.MaxFailures
+		}
+		if d := el.policy.Delay(failures); d > delay {
+			delay = d
+		}
+	}
+
+	return delay, locked, nil
+}
+
+// Succeed сбрасывает счётчик логина после успешного входа. Счётчик IP-адреса
+// не сбрасывается, иначе перебор можно чередовать со входом в свой аккаунт
+func (g *Guard) Succeed(ctx context.Context, login string) error {
+	return g.store.ResetLoginAttempts(ctx, LoginKey(login))
+}
+
+// Delay возвращает задержку ответа после failures неудачных попыток
+func (p Policy) Delay(failures int) time.Duration {
+	delay := time.Duration(failures) * p.DelayStep
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Apply применяет неудачную попытку к состоянию и возвращает новое состояние,
+// хранилища вызывают его, чтобы счётчики считались одинаково
+func (p Policy) Apply(state *State, now time.Time) *State {
+	next := &State{}
+	if state != nil {
+		*next = *state
+		next.JustLocked = false
+	}
+
+	if next.Failures == 0 || now.Sub(next.FirstFailure) > p.Window {
+		next.Failures = 0
+		next.FirstFailure = now
+	}
+	next.Failures++
+	next.LastFailure = now
+
+	if p.MaxFailures > 0 && next.Failures >= p.MaxFailures {
+		// после блокировки счёт начинается заново
+		next.LockedUntil = now.Add(p.LockDuration)
+		next.Failures = 0
+		next.JustLocked = true
+	}
+
+	return next
+}
@@ -0,0 +1,115 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	loginPolicy := Policy{
+		MaxFailures:  3,
+		Window:       time.Minute,
+		LockDuration: time.Minute,
+		DelayStep:    time.Millisecond,
+		MaxDelay:     2 * time.Millisecond,
+	}
+	ipPolicy := loginPolicy
+	ipPolicy.MaxFailures = 5
+	guard := NewGuard(NewMemoryStore(), loginPolicy, ipPolicy)
+
+	tests := []struct {
+		name       string
+		login      string
+		ip         string
+		wantDelay  time.Duration
+		wantLocked []string
+	}{
+		{
+			name:      "first_failure",
+			login:     "user1",
+			ip:        "10.0.0.1",
+			wantDelay: time.Millisecond,
+		},
+		{
+			name:      "second_failure",
+			login:     "user1",
+			ip:        "10.0.0.1",
+			wantDelay: 2 * time.Millisecond,
+		},
+		{
+			name:       "login_locked",
+			login:      "user1",
+			ip:         "10.0.0.1",
+			wantDelay:  2 * time.Millisecond,
+			wantLocked: []string{"login:user1"},
+		},
+		{
+			name:      "another_login_same_ip",
+			login:     "user2",
+			ip:        "10.0.0.1",
+			wantDelay: 2 * time.Millisecond,
+		},
+		{
+			name:       "ip_locked",
+			login:      "user3",
+			ip:         "10.0.0.1",
+			wantDelay:  2 * time.Millisecond,
+			wantLocked: []string{"ip:10.0.0.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, locked, err := guard.Fail(ctx, tt.login, tt.ip)
+			if err != nil {
+				t.Fatalf("Fail() error = %v", err)
+			}
+			if delay != tt.wantDelay {
+				t.Errorf("Fail() delay = %v, want %v", delay, tt.wantDelay)
+			}
+			if len(locked) != len(tt.wantLocked) || (len(locked) > 0 && locked[0] != tt.wantLocked[0]) {
+				t.Errorf("Fail() locked = %v, want %v", locked, tt.wantLocked)
+			}
+		})
+	}
+
+	checks := []struct {
+		name       string
+		login      string
+		ip         string
+		wantLocked bool
+	}{
+		{name: "locked_login", login: "user1", ip: "10.0.0.2", wantLocked: true},
+		{name: "locked_ip", login: "user4", ip: "10.0.0.1", wantLocked: true},
+		{name: "not_locked", login: "user2", ip: "10.0.0.2", wantLocked: false},
+	}
+	for _, tt := range checks {
+		t.Run(tt.name, func(t *testing.T) {
+			retryAfter, err := guard.Check(ctx, tt.login, tt.ip)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if (retryAfter > 0) != tt.wantLocked {
+				t.Errorf("Check() retryAfter = %v, wantLocked %v", retryAfter, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestPolicyApplyWindow(t *testing.T) {
+	policy := Policy{MaxFailures: 2, Window: time.Minute, LockDuration: time.Minute}
+	now := time.Now()
+
+	state := policy.Apply(nil, now)
+	// попытка за пределами окна начинает счёт заново
+	state = policy.Apply(state, now.Add(2*time.Minute))
+	if state.JustLocked || state.Failures != 1 {
+		t.Errorf("Apply() failures = %v, locked = %v, want 1 and not locked", state.Failures, state.JustLocked)
+	}
+
+	state = policy.Apply(state, now.Add(2*time.Minute+time.Second))
+	if !state.JustLocked || !state.LockedUntil.Equal(now.Add(3*time.Minute+time.Second)) {
+		t.Errorf("Apply() expected lock until %v, got %+v", now.Add(3*time.Minute+time.Second), state)
+	}
+}
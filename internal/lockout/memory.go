@@ -0,0 +1,66 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// сколько записей хранить, прежде чем удалять устаревшие
+const memoryPruneThreshold = 10000
+
+// MemoryStore хранит счётчики в памяти процесса, подходит для одного экземпляра сервиса
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]*State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		states: make(map[string]*State),
+	}
+}
+
+func (s *MemoryStore) GetLoginAttempts(ctx context.Context, key string) (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[key]
+	if !ok {
+		return nil, nil
+	}
+	copyState := *state
+	return &copyState, nil
+}
+
+func (s *MemoryStore) RegisterLoginFailure(ctx context.Context, key string, policy Policy, now time.Time) (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.states) > memoryPruneThreshold {
+		s.prune(policy, now)
+	}
+
+	state := policy.Apply(s.states[key], now)
+	s.states[key] = state
+
+	copyState := *state
+	return &copyState, nil
+}
+
+func (s *MemoryStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.states, key)
+	return nil
+}
+
+// prune удаляет незаблокированные записи, попытки в которых вышли за окно
+func (s *MemoryStore) prune(policy Policy, now time.Time) {
+	for key, state := range s.states {
+		if state.LockedUntil.Before(now) && now.Sub(state.LastFailure) > policy.Window {
+			delete(s.states, key)
+		}
+	}
+}
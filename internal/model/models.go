@@ -1,18 +1,162 @@
 package model
 
-import "time"
+import (
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/money"
+)
 
 type User struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	Role     string `json:"-"` // роль не принимается из запроса пользователя
+	Blocked  bool   `json:"-"`
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// UserProfile — сведения о пользователе, доступные оператору поддержки
+type UserProfile struct {
+	Login   string `json:"login"`
+	Role    string `json:"role"`
+	Blocked bool   `json:"blocked"`
+}
+
+// Session — сеанс пользователя, к которому привязаны токены доступа и обновления
+type Session struct {
+	ID         string     `json:"id"`
+	User       string     `json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+	Current    bool       `json:"current"` // сеанс, из которого пришёл запрос
+}
+
+// RefreshToken — одноразовый токен обновления, в базе хранится только его хеш
+type RefreshToken struct {
+	Hash      string
+	SessionID string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// TwoFactor — настройки второго фактора (TOTP) пользователя
+type TwoFactor struct {
+	Secret  string
+	Enabled bool // второй фактор включается после подтверждения первым кодом
+	// LastCounter — период последнего принятого кода, коды этого
+	// и предыдущих периодов повторно не принимаются
+	LastCounter int64
+}
+
+// Identity — учётная запись пользователя у внешнего провайдера OpenID Connect.
+// Пара (Issuer, Subject) однозначно определяет пользователя провайдера
+type Identity struct {
+	Issuer    string
+	Subject   string
+	User      string
+	Email     string
+	CreatedAt time.Time
+}
+
+// OIDCState — параметры начатого входа через внешнего провайдера,
+// хранятся до возврата пользователя со страницы провайдера
+type OIDCState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// APIKey — ключ API для интеграций, которые не могут выполнить вход
+// по логину и паролю. В базе хранится только хеш ключа
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // начало ключа, чтобы пользователь мог его узнать
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Hash       string     `json:"-"`
+	User       string     `json:"-"`
+}
+
+// права ключей API
+const (
+	ScopeOrdersRead       = "orders:read"
+	ScopeOrdersWrite      = "orders:write"
+	ScopeBalanceRead      = "balance:read"
+	ScopeWithdrawalsRead  = "withdrawals:read"
+	ScopeWithdrawalsWrite = "withdrawals:write"
+)
+
+// Scopes — все права, которые можно выдать ключу API
+var Scopes = []string{
+	ScopeOrdersRead,
+	ScopeOrdersWrite,
+	ScopeBalanceRead,
+	ScopeWithdrawalsRead,
+	ScopeWithdrawalsWrite,
+}
+
+// AuditRecord — запись журнала аудита
+type AuditRecord struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Actor     string    `json:"actor"`  // кто выполнил действие: логин оператора или system
+	Action    string    `json:"action"` // что было сделано
+	Target    string    `json:"target"` // над чем было выполнено действие
+	Reason    string    `json:"reason"`
 }
 
+const (
+	AuditActorSystem        = "system"
+	AuditActionLoginLockout = "login_lockout"
+
+	// действия операторов поддержки
+	AuditActionSearchUsers     = "admin_search_users"
+	AuditActionViewUser        = "admin_view_user"
+	AuditActionViewOrders      = "admin_view_orders"
+	AuditActionViewWithdrawals = "admin_view_withdrawals"
+	AuditActionViewBalance     = "admin_view_balance"
+	AuditActionBlockUser       = "admin_block_user"
+	AuditActionUnblockUser     = "admin_unblock_user"
+	AuditActionRepollOrder     = "admin_repoll_order"
+	AuditActionAdjustBalance   = "admin_adjust_balance"
+)
+
 type Order struct {
-	ID         string    `json:"number"`
-	Status     string    `json:"status"`
-	Bonus      float64   `json:"accrual"`
-	UploadDate time.Time `json:"uploaded_at"`
-	Owner      string    `json:"-"` // user login, who uploaded this order
+	ID         string       `json:"number"`
+	Status     string       `json:"status"`
+	Bonus      money.Amount `json:"accrual"`
+	UploadDate time.Time    `json:"uploaded_at"`
+	Owner      string       `json:"-"` // user login, who uploaded this order
+	// очередь опроса системы начислений: число выдач заказа в аренду
+	// и время, раньше которого заказ не выдаётся снова (nil - сразу)
+	Attempts      int        `json:"-"`
+	NextAttemptAt *time.Time `json:"-"`
+	// пауза до следующего опроса. При обновлении заказа хранилище отсчитывает
+	// её по тем же часам, по которым проверяет аренду (0 - без паузы)
+	RetryAfter time.Duration `json:"-"`
+}
+
+// NextAttempt возвращает время следующего опроса заказа, обновлённого в now,
+// или nil, если пауза не нужна
+func (o *Order) NextAttempt(now time.Time) *time.Time {
+	if o.RetryAfter <= 0 {
+		return nil
+	}
+	next := now.Add(o.RetryAfter)
+	return &next
 }
 
 const (
@@ -22,22 +166,116 @@ const (
 	OrderStatusProcessed  = "PROCESSED"
 )
 
+// OrderStatusesForUpdate возвращает статусы заказов, по которым ещё
+// запрашивается расчёт начисления
+func OrderStatusesForUpdate() []string {
+	return []string{
+		OrderStatusNew,
+		OrderStatusProcessing,
+		BonusStatusNew, // под вопросом
+	}
+}
+
 type Balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
+}
+
+// BalanceBreakdown — расчёт баланса по составляющим для оператора поддержки.
+// Суммы берутся из журнала баллов, текущий баланс и списанное — из сохранённого
+// баланса счёта
+type BalanceBreakdown struct {
+	Accrued         money.Amount            `json:"accrued"`   // начислено по обработанным заказам
+	Adjusted        money.Amount            `json:"adjusted"`  // ручные корректировки
+	Withdrawn       money.Amount            `json:"withdrawn"` // списано
+	Current         money.Amount            `json:"current"`
+	Ledger          map[string]money.Amount `json:"ledger"` // суммы журнала по видам операций
+	OrdersByStatus  map[string]int          `json:"orders_by_status"`
+	WithdrawalCount int                     `json:"withdrawal_count"`
 }
 
 type Withdrawal struct {
-	OrderID       string    `json:"order"`
-	Sum           float64   `json:"sum"`
-	ProcessedDate time.Time `json:"processed_at,omitempty"`
-	User          string    `json:"-"`
+	OrderID       string       `json:"order"`
+	Sum           money.Amount `json:"sum"`
+	ProcessedDate time.Time    `json:"processed_at,omitempty"`
+	User          string       `json:"-"`
+}
+
+// Adjustment — ручная корректировка баланса оператором поддержки.
+// Положительная сумма начисляет баллы, отрицательная списывает
+type Adjustment struct {
+	ID            int64        `json:"id"`
+	Amount        money.Amount `json:"amount"`
+	Reason        string       `json:"reason"`
+	ProcessedDate time.Time    `json:"processed_at"`
+	Operator      string       `json:"-"`
+	User          string       `json:"-"`
+}
+
+// LedgerEntry — запись журнала баллов. Каждая операция состоит из записи
+// на счёте пользователя и встречной записи на системном счёте
+type LedgerEntry struct {
+	ID            int64        `json:"id"`
+	TransactionID int64        `json:"transaction_id"`
+	Account       string       `json:"account"`
+	Kind          string       `json:"kind"`
+	Amount        money.Amount `json:"amount"`
+	Balance       money.Amount `json:"balance"` // баланс счёта пользователя после записи
+	Reference     string       `json:"reference,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// Виды операций в журнале баллов
+const (
+	LedgerAccrual    = "accrual"    // начисление по заказу
+	LedgerWithdrawal = "withdrawal" // списание в счёт заказа
+	LedgerAdjustment = "adjustment" // ручная корректировка
+	LedgerExpiration = "expiration" // сгорание баллов
+	LedgerRefund     = "refund"     // возврат списанных баллов
+)
+
+// LedgerSystemAccount возвращает встречный системный счёт для вида операции
+func LedgerSystemAccount(kind string) string {
+	return "system:" + kind
+}
+
+// Withdrawn возвращает сумму, на которую запись меняет списанное пользователем:
+// списание её увеличивает, возврат списанных баллов уменьшает
+func (e *LedgerEntry) Withdrawn() money.Amount {
+	if e.Kind == LedgerWithdrawal || e.Kind == LedgerRefund {
+		return -e.Amount
+	}
+	return 0
+}
+
+// Проверки сверки журнала
+const (
+	// операция по заказу, списанию или корректировке не совпадает с журналом
+	DriftSourceMismatch = "source_mismatch"
+	// баланс записи не равен сумме предыдущих записей счёта
+	DriftRunningBalance = "running_balance"
+	// сумма записей операции не равна нулю
+	DriftUnbalanced = "unbalanced_transaction"
+	// сохранённый баланс счёта не совпадает с журналом
+	DriftAccountBalance = "account_balance"
+)
+
+// LedgerDrift — расхождение, найденное при сверке журнала
+type LedgerDrift struct {
+	Check     string
+	Account   string
+	Kind      string
+	Reference string
+	Expected  money.Amount
+	Recorded  money.Amount
 }
 
+// OrderBonus — ответ системы расчёта начислений. Начисление с лишними знаками
+// после запятой округляется до сотых
 type OrderBonus struct {
-	ID      string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual"`
+	ID      string        `json:"order"`
+	Status  string        `json:"status"`
+	Accrual money.Rounded `json:"accrual"`
 }
 
 const (
@@ -63,6 +301,14 @@ const (
 	WithdrawalAlreadyRequested
 	WithdrawalsNoData
 	WithdrawalsDataExists
+	AdjustmentsNoData
+	AdjustmentsDataExists
+	RefreshTokenRotated
+	RefreshTokenInvalid
+	RefreshTokenReused
+	OIDCLoginSucceeded
+	OIDCStateInvalid
+	OIDCTokenInvalid
 	ConnectionError
 	OtherError
 )
@@ -0,0 +1,222 @@
+// Package money хранит суммы баллов точно — целым числом сотых долей.
+// В JSON и в базе суммы остаются десятичными числами
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Amount — сумма в сотых долях балла
+type Amount int64
+
+const (
+	// Scale — число сотых долей в одном балле
+	Scale = 100
+	// FractionDigits — число знаков после запятой
+	FractionDigits = 2
+)
+
+var (
+	ErrInvalidAmount = errors.New("invalid amount")
+	ErrPrecision     = errors.New("amount has more than 2 fraction digits")
+	ErrOverflow      = errors.New("amount is out of range")
+)
+
+// FromMinor возвращает сумму по числу сотых долей
+func FromMinor(minor int64) Amount {
+	return Amount(minor)
+}
+
+// FromFloat округляет число с плавающей точкой до сотых. Используется
+// только для настроек, суммы из запросов разбираются функцией Parse
+func FromFloat(value float64) Amount {
+	return Amount(math.Round(value * Scale))
+}
+
+// Parse разбирает десятичную запись суммы, например "729.98" или "-5".
+// Больше двух значащих знаков после запятой не допускается
+func Parse(value string) (Amount, error) {
+	if value == "" {
+		return 0, ErrInvalidAmount
+	}
+
+	// экспоненциальную запись, допустимую в JSON, переводим в обычную
+	if strings.ContainsAny(value, "eE") {
+		rat, ok := new(big.Rat).SetString(value)
+		if !ok {
+			return 0, ErrInvalidAmount
+		}
+		return fromRat(rat)
+	}
+
+	negative := false
+	switch value[0] {
+	case '-':
+		negative = true
+		value = value[1:]
+	case '+':
+		value = value[1:]
+	}
+
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" && fraction == "" {
+		return 0, ErrInvalidAmount
+	}
+	fraction = strings.TrimRight(fraction, "0")
+	if len(fraction) > FractionDigits {
+		return 0, ErrPrecision
+	}
+	for _, digits := range []string{whole, fraction} {
+		for _, r := range digits {
+			if r < '0' || r > '9' {
+				return 0, ErrInvalidAmount
+			}
+		}
+	}
+	fraction += strings.Repeat("0", FractionDigits-len(fraction))
+
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, ErrOverflow
+		}
+		return 0, ErrInvalidAmount
+	}
+	if negative {
+		minor = -minor
+	}
+
+	return Amount(minor), nil
+}
+
+func fromRat(rat *big.Rat) (Amount, error) {
+	minor := new(big.Rat).Mul(rat, big.NewRat(Scale, 1))
+	if !minor.IsInt() {
+		return 0, ErrPrecision
+	}
+	if !minor.Num().IsInt64() {
+		return 0, ErrOverflow
+	}
+	return Amount(minor.Num().Int64()), nil
+}
+
+// Round разбирает десятичную запись суммы, как Parse, но лишние знаки после
+// запятой не отклоняет, а округляет до сотых: половина округляется от нуля,
+// как функцией round в Postgres, например 0.125 - до 0.13, а -0.125 - до -0.13.
+// rounded = true, если значение изменилось при округлении
+func Round(value string) (amount Amount, rounded bool, err error) {
+	amount, err = Parse(value)
+	if !errors.Is(err, ErrPrecision) {
+		return amount, false, err
+	}
+
+	rat, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return 0, false, ErrInvalidAmount
+	}
+	minor := new(big.Rat).Mul(rat, big.NewRat(Scale, 1))
+
+	// |minor| = quo + rem/den, округляем модуль и возвращаем знак
+	num := new(big.Int).Abs(minor.Num())
+	quo, rem := new(big.Int).QuoRem(num, minor.Denom(), new(big.Int))
+	if rem.Lsh(rem, 1).Cmp(minor.Denom()) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if minor.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	if !quo.IsInt64() {
+		return 0, false, ErrOverflow
+	}
+
+	return Amount(quo.Int64()), true, nil
+}
+
+// Minor возвращает сумму в сотых долях
+func (a Amount) Minor() int64 {
+	return int64(a)
+}
+
+// String возвращает десятичную запись суммы без лишних нулей: "500", "0.5", "729.98"
+func (a Amount) String() string {
+	minor := int64(a)
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+	}
+
+	// модуль через uint64, чтобы не переполниться на минимальном значении
+	abs := uint64(minor)
+	if minor < 0 {
+		abs = uint64(-(minor + 1)) + 1
+	}
+
+	whole := abs / Scale
+	fraction := abs % Scale
+	if fraction == 0 {
+		return sign + strconv.FormatUint(whole, 10)
+	}
+
+	fractionPart := strings.TrimRight(fmt.Sprintf("%0*d", FractionDigits, fraction), "0")
+	return sign + strconv.FormatUint(whole, 10) + "." + fractionPart
+}
+
+// MarshalJSON записывает сумму JSON-числом
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON читает сумму из JSON-числа без промежуточного float64
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		return fmt.Errorf("%w: amount must be a number", ErrInvalidAmount)
+	}
+
+	amount, err := Parse(value)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Rounded — сумма, которую присылает внешняя система. В отличие от Amount
+// при разборе JSON лишние знаки после запятой не отклоняются, а округляются
+// функцией Round, чтобы ответ с такой суммой не застревал без обработки.
+// Суммы из запросов пользователей разбираются только как Amount
+type Rounded struct {
+	Amount Amount
+	// Raw — исходная запись суммы, если она была округлена, иначе ""
+	Raw string
+}
+
+// UnmarshalJSON читает сумму из JSON-числа и при необходимости округляет её
+func (r *Rounded) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		return fmt.Errorf("%w: amount must be a number", ErrInvalidAmount)
+	}
+
+	amount, rounded, err := Round(value)
+	if err != nil {
+		return err
+	}
+	r.Amount = amount
+	r.Raw = ""
+	if rounded {
+		r.Raw = value
+	}
+	return nil
+}
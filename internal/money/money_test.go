@@ -0,0 +1,140 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    Amount
+		wantErr error
+	}{
+		{name: "integer", value: "500", want: 50000},
+		{name: "fraction", value: "729.98", want: 72998},
+		{name: "one_digit_fraction", value: "0.5", want: 50},
+		{name: "trailing_zeros", value: "1.2300", want: 123},
+		{name: "negative", value: "-15.05", want: -1505},
+		{name: "exponent", value: "1.5e2", want: 15000},
+		{name: "too_precise", value: "0.001", wantErr: ErrPrecision},
+		{name: "too_precise_exponent", value: "1e-3", wantErr: ErrPrecision},
+		{name: "not_a_number", value: "12a", wantErr: ErrInvalidAmount},
+		{name: "empty", value: "", wantErr: ErrInvalidAmount},
+		{name: "sign_only", value: "-", wantErr: ErrInvalidAmount},
+		{name: "overflow", value: "100000000000000000000", wantErr: ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Parse() = %v, want %v", got.Minor(), tt.want.Minor())
+			}
+		})
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		want        Amount
+		wantRounded bool
+		wantErr     error
+	}{
+		{name: "exact", value: "729.98", want: 72998},
+		{name: "round_down", value: "729.984", want: 72998, wantRounded: true},
+		{name: "round_up", value: "729.986", want: 72999, wantRounded: true},
+		{name: "half_away_from_zero", value: "0.125", want: 13, wantRounded: true},
+		{name: "negative_half_away_from_zero", value: "-0.125", want: -13, wantRounded: true},
+		{name: "exponent", value: "1.2345e1", want: 1235, wantRounded: true},
+		{name: "not_a_number", value: "12.3a5", wantErr: ErrInvalidAmount},
+		{name: "overflow", value: "100000000000000000000.001", wantErr: ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rounded, err := Round(tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Round() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || rounded != tt.wantRounded {
+				t.Errorf("Round() = %v, %v, want %v, %v", got.Minor(), rounded, tt.want.Minor(), tt.wantRounded)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		want   string
+	}{
+		{amount: 50000, want: "500"},
+		{amount: 72998, want: "729.98"},
+		{amount: 50, want: "0.5"},
+		{amount: 5, want: "0.05"},
+		{amount: -1505, want: "-15.05"},
+		{amount: 0, want: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.amount.String(); got != tt.want {
+				t.Errorf("String() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var withdrawal struct {
+		Sum Amount `json:"sum"`
+	}
+	if err := json.Unmarshal([]byte(`{"sum": 0.1}`), &withdrawal); err != nil {
+		t.Fatal(err)
+	}
+	var other struct {
+		Sum Amount `json:"sum"`
+	}
+	if err := json.Unmarshal([]byte(`{"sum": 0.2}`), &other); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0.1 + 0.2 в float64 не равно 0.3
+	total := withdrawal.Sum + other.Sum
+	if want, _ := Parse("0.3"); total != want {
+		t.Errorf("0.1 + 0.2 = %v, want %v", total, want)
+	}
+
+	data, err := json.Marshal(struct {
+		Sum Amount `json:"sum"`
+	}{total})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"sum":0.3}` {
+		t.Errorf("Marshal() = %v", string(data))
+	}
+
+	if err := json.Unmarshal([]byte(`{"sum": "0.3"}`), &withdrawal); err == nil {
+		t.Error("Unmarshal() accepted amount as string")
+	}
+
+	// суммы пользователей не округляются, суммы внешней системы округляются
+	if err := json.Unmarshal([]byte(`{"sum": 0.125}`), &withdrawal); !errors.Is(err, ErrPrecision) {
+		t.Errorf("Unmarshal() of too precise amount error = %v, want %v", err, ErrPrecision)
+	}
+	var accrual struct {
+		Accrual Rounded `json:"accrual"`
+	}
+	if err := json.Unmarshal([]byte(`{"accrual": 0.125}`), &accrual); err != nil {
+		t.Fatal(err)
+	}
+	if accrual.Accrual.Amount != 13 || accrual.Accrual.Raw != "0.125" {
+		t.Errorf("Unmarshal() rounded = %+v", accrual.Accrual)
+	}
+}
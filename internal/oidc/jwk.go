@@ -0,0 +1,71 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// jsonWebKey — открытый ключ провайдера в формате RFC 7517
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	// RSA
+	Modulus  string `json:"n"`
+	Exponent string `json:"e"`
+	// EC
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeInt(k.Modulus)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.Exponent)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, errors.New("unsupported curve: " + k.Curve)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("ec point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, errors.New("unsupported key type: " + k.KeyType)
+	}
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, errors.New("empty key parameter")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,392 @@
+// Package oidc реализует вход через внешнего провайдера OpenID Connect:
+// получение кода авторизации с PKCE, обмен кода на токены и проверку
+// ID-токена по открытым ключам провайдера
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// ключи провайдера перезапрашиваются из-за неизвестного kid не чаще этого интервала
+	keysRefreshInterval = time.Minute
+	// допустимое расхождение часов с провайдером
+	clockSkew    = time.Minute
+	httpTimeout  = 10 * time.Second
+	maxBodyBytes = 1 << 20
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid id token")
+	ErrUnknownKey   = errors.New("unknown id token signing key")
+)
+
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// Config — настройки клиента, зарегистрированного у провайдера
+type Config struct {
+	// Issuer — адрес провайдера, по нему читается
+	// <Issuer>/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL — адрес, на который провайдер вернёт пользователя с кодом
+	RedirectURL string
+	Scopes      []string
+	HTTPClient  *http.Client
+}
+
+// IDToken — проверенные утверждения ID-токена
+type IDToken struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// Provider — клиент провайдера OpenID Connect. Настройки и ключи провайдера
+// запрашиваются при первом обращении и кэшируются
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu            sync.Mutex
+	metadata      *metadata
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+// metadata — нужная часть документа /.well-known/openid-configuration
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+func New(cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc issuer, client id and redirect url are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = DefaultScopes
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: httpTimeout}
+	}
+
+	return &Provider{
+		cfg:    cfg,
+		client: client,
+	}, nil
+}
+
+// Issuer возвращает адрес провайдера
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// AuthCodeURL возвращает адрес страницы входа провайдера. state и nonce
+// нужно сохранить до возврата пользователя, codeChallenge получается
+// из верификатора PKCE функцией Challenge
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, codeChallenge string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange обменивает код авторизации на токены и возвращает ID-токен
+// без проверки, его нужно проверить методом Verify
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	if p.cfg.ClientSecret == "" {
+		// публичный клиент передаёт только свой идентификатор
+		form.Set("client_id", p.cfg.ClientID)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	var response struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.doJSON(request, &response)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK || response.Error != "" {
+		return "", fmt.Errorf("token request failed with status %v: %v %v", status, response.Error, response.ErrorDescription)
+	}
+	if response.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+
+	return response.IDToken, nil
+}
+
+// Verify проверяет подпись, издателя, получателя, срок действия и nonce
+// ID-токена и возвращает его утверждения
+func (p *Provider) Verify(ctx context.Context, rawIDToken string, nonce string) (*IDToken, error) {
+	if _, err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{}
+	token, err := jwt.ParseWithClaims(rawIDToken, claims,
+		func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return p.key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodES256.Alg(),
+		}),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: token has no exp claim", ErrInvalidToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no sub claim", ErrInvalidToken)
+	}
+	// токен, выданный нескольким получателям, должен быть выписан для нас
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return nil, fmt.Errorf("%w: unexpected azp claim", ErrInvalidToken)
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	return &IDToken{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+		Name:              claims.Name,
+	}, nil
+}
+
+// NewState возвращает случайное значение для параметров state и nonce
+func NewState() (string, error) {
+	return randomString(16)
+}
+
+// NewVerifier возвращает случайный верификатор PKCE (RFC 7636)
+func NewVerifier() (string, error) {
+	return randomString(32)
+}
+
+// Challenge вычисляет code_challenge по верификатору методом S256
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomString(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// discover читает и кэширует настройки провайдера
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	address := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &metadata{}
+	status, err := p.doJSON(request, meta)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("discovery request failed with status %v", status)
+	}
+	// адрес в документе должен совпадать с настроенным, иначе токены
+	// с этим издателем не пройдут проверку
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %v doesn't match configured issuer %v", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks required endpoints")
+	}
+
+	p.metadata = meta
+	return meta, nil
+}
+
+// key возвращает открытый ключ провайдера по kid. Неизвестный kid означает,
+// что провайдер сменил ключи, тогда набор ключей запрашивается заново
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.findKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < keysRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+
+	if err := p.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := p.findKey(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (p *Provider) findKey(kid string) (interface{}, bool) {
+	if kid == "" {
+		// без kid ключ определяется однозначно, только если он один
+		if len(p.keys) != 1 {
+			return nil, false
+		}
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.metadata.JWKSURI, nil)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	status, err := p.doJSON(request, &set)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("jwks request failed with status %v", status)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, el := range set.Keys {
+		if el.Use != "" && el.Use != "sig" {
+			continue
+		}
+		key, err := el.publicKey()
+		if err != nil {
+			// ключи неподдерживаемых типов пропускаем
+			continue
+		}
+		keys[el.KeyID] = key
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	return nil
+}
+
+func (p *Provider) doJSON(request *http.Request, v interface{}) (int, error) {
+	response, err := p.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxBodyBytes))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(data, v); err != nil && response.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("can't decode response from %v: %w", request.URL, err)
+	}
+
+	return response.StatusCode, nil
+}
@@ -0,0 +1,208 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kvvPro/gophermart/internal/oidc/oidctest"
+)
+
+const redirectURL = "http://localhost:8080/api/user/oidc/callback"
+
+func newProvider(t *testing.T, issuer *oidctest.Issuer) *Provider {
+	provider, err := New(Config{
+		Issuer:       issuer.URL(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  redirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// authorize проходит страницу входа провайдера и возвращает код и state
+func authorize(t *testing.T, authURL string) (string, string) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %v, want %v", response.StatusCode, http.StatusFound)
+	}
+
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	issuer := oidctest.NewIssuer()
+	defer issuer.Close()
+	issuer.SetUser(oidctest.User{Subject: "42", Email: "ivan@example.com", EmailVerified: true})
+
+	ctx := context.Background()
+	provider := newProvider(t, issuer)
+
+	state, _ := NewState()
+	nonce, _ := NewState()
+	verifier, _ := NewVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, Challenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, returnedState := authorize(t, authURL)
+	if returnedState != state {
+		t.Fatalf("state = %v, want %v", returnedState, state)
+	}
+
+	t.Run("wrong_verifier", func(t *testing.T) {
+		otherVerifier, _ := NewVerifier()
+		if _, err := provider.Exchange(ctx, code, otherVerifier); err == nil {
+			t.Fatal("Exchange() with wrong verifier succeeded")
+		}
+	})
+
+	// код одноразовый и уже потрачен на неудачный обмен
+	code, _ = authorize(t, authURL)
+	rawIDToken, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken, err := provider.Verify(ctx, rawIDToken, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idToken.Subject != "42" || idToken.Email != "ivan@example.com" || !idToken.EmailVerified {
+		t.Errorf("Verify() = %+v", idToken)
+	}
+	if idToken.Issuer != issuer.URL() {
+		t.Errorf("Verify() issuer = %v, want %v", idToken.Issuer, issuer.URL())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer := oidctest.NewIssuer()
+	defer issuer.Close()
+
+	ctx := context.Background()
+	provider := newProvider(t, issuer)
+	user := oidctest.User{Subject: "42"}
+
+	tests := []struct {
+		name    string
+		claims  func() jwt.MapClaims
+		nonce   string
+		wantErr bool
+	}{
+		{
+			name:   "ok",
+			claims: func() jwt.MapClaims { return issuer.IDTokenClaims(user, "n1") },
+			nonce:  "n1",
+		},
+		{
+			name:    "wrong_nonce",
+			claims:  func() jwt.MapClaims { return issuer.IDTokenClaims(user, "n1") },
+			nonce:   "n2",
+			wantErr: true,
+		},
+		{
+			name: "wrong_audience",
+			claims: func() jwt.MapClaims {
+				claims := issuer.IDTokenClaims(user, "n1")
+				claims["aud"] = "other-client"
+				return claims
+			},
+			nonce:   "n1",
+			wantErr: true,
+		},
+		{
+			name: "foreign_azp",
+			claims: func() jwt.MapClaims {
+				claims := issuer.IDTokenClaims(user, "n1")
+				claims["aud"] = []string{oidctest.ClientID, "other-client"}
+				claims["azp"] = "other-client"
+				return claims
+			},
+			nonce:   "n1",
+			wantErr: true,
+		},
+		{
+			name: "wrong_issuer",
+			claims: func() jwt.MapClaims {
+				claims := issuer.IDTokenClaims(user, "n1")
+				claims["iss"] = "https://evil.example.com"
+				return claims
+			},
+			nonce:   "n1",
+			wantErr: true,
+		},
+		{
+			name: "expired",
+			claims: func() jwt.MapClaims {
+				claims := issuer.IDTokenClaims(user, "n1")
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return claims
+			},
+			nonce:   "n1",
+			wantErr: true,
+		},
+		{
+			name: "no_exp",
+			claims: func() jwt.MapClaims {
+				claims := issuer.IDTokenClaims(user, "n1")
+				delete(claims, "exp")
+				return claims
+			},
+			nonce:   "n1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := provider.Verify(ctx, issuer.Sign(tt.claims()), tt.nonce)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("unsigned", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodNone, issuer.IDTokenClaims(user, "n1"))
+		raw, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+		if _, err := provider.Verify(ctx, raw, "n1"); err == nil {
+			t.Error("Verify() accepted unsigned token")
+		}
+	})
+
+	t.Run("key_rotation", func(t *testing.T) {
+		issuer.RotateKey()
+		raw := issuer.Sign(issuer.IDTokenClaims(user, "n1"))
+
+		// ключи запрошены только что - новый kid не приводит к повторному запросу
+		if _, err := provider.Verify(ctx, raw, "n1"); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Verify() error = %v, want %v", err, ErrInvalidToken)
+		}
+
+		provider.keysFetchedAt = time.Time{}
+		if _, err := provider.Verify(ctx, raw, "n1"); err != nil {
+			t.Errorf("Verify() after key rotation error = %v", err)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+// Package oidctest — локальный провайдер OpenID Connect для тестов.
+// Страница входа не показывается: пользователь, заданный методом SetUser,
+// сразу возвращается на адрес клиента с кодом авторизации
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	ClientID     = "gophermart"
+	ClientSecret = "gophermart-secret"
+)
+
+// User — пользователь, который входит через провайдера
+type User struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+type authorization struct {
+	user          User
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+}
+
+// Issuer — тестовый провайдер
+type Issuer struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	keyID string
+	key   *rsa.PrivateKey
+	user  User
+	codes map[string]authorization
+}
+
+func NewIssuer() *Issuer {
+	issuer := &Issuer{
+		codes: make(map[string]authorization),
+		user: User{
+			Subject:           "subject-1",
+			Email:             "user@example.com",
+			EmailVerified:     true,
+			PreferredUsername: "sso-user",
+		},
+	}
+	issuer.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/authorize", issuer.authorize)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+
+	return issuer
+}
+
+// URL возвращает адрес провайдера (iss)
+func (i *Issuer) URL() string {
+	return i.server.URL
+}
+
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// SetUser задаёт пользователя, который войдёт при следующем обращении к /authorize
+func (i *Issuer) SetUser(user User) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.user = user
+}
+
+// RotateKey заменяет ключ подписи, старый ключ перестаёт публиковаться
+func (i *Issuer) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.key = key
+	i.keyID = randomString()
+}
+
+// Sign подписывает произвольные утверждения текущим ключом провайдера
+func (i *Issuer) Sign(claims jwt.MapClaims) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = i.keyID
+	signed, err := token.SignedString(i.key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+// IDTokenClaims возвращает утверждения корректного ID-токена для пользователя
+func (i *Issuer) IDTokenClaims(user User, nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":                i.URL(),
+		"sub":                user.Subject,
+		"aud":                ClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"email":              user.Email,
+		"email_verified":     user.EmailVerified,
+		"preferred_username": user.PreferredUsername,
+	}
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL(),
+		"authorization_endpoint":                i.URL() + "/authorize",
+		"token_endpoint":                        i.URL() + "/token",
+		"jwks_uri":                              i.URL() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": i.keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != ClientID || query.Get("response_type") != "code" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "pkce is required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	i.mu.Lock()
+	i.codes[code] = authorization{
+		user:          i.user,
+		redirectURI:   query.Get("redirect_uri"),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	i.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != ClientID || clientSecret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	// код одноразовый
+	code := r.PostForm.Get("code")
+	i.mu.Lock()
+	auth, ok := i.codes[code]
+	delete(i.codes, code)
+	i.mu.Unlock()
+
+	if !ok || auth.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != auth.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error":             "invalid_grant",
+			"error_description": "pkce verification failed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     i.Sign(i.IDTokenClaims(auth.user, auth.nonce)),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func randomString() string {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data)
+}
@@ -0,0 +1,139 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Params — параметры argon2id, с которыми вычисляется хеш пароля.
+// Параметры сохраняются вместе с хешем, поэтому их можно менять
+// без потери совместимости со старыми записями
+type Params struct {
+	Memory      uint32 // объём памяти в КиБ
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams — рекомендованные OWASP параметры argon2id
+var DefaultParams = Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+const algorithm = "argon2id"
+
+// NoPassword хранится вместо хеша у пользователя, который входит только через
+// внешнего провайдера: с этим значением не совпадает ни один пароль
+const NoPassword = "!"
+
+var ErrInvalidHash = errors.New("invalid password hash format")
+
+// Hash вычисляет хеш пароля со случайной солью и возвращает его в формате
+// $argon2id$v=19$m=<память>,t=<итерации>,p=<потоки>$<соль>$<хеш>
+func Hash(plain string, p Params) (string, error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(plain), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		algorithm,
+		argon2.Version,
+		p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify сравнивает пароль с сохранённым значением за постоянное время.
+// needsRehash = true, если пароль верный, но сохранён в открытом виде
+// или с параметрами, отличными от текущих
+func Verify(plain string, encoded string, p Params) (match bool, needsRehash bool, err error) {
+	if encoded == NoPassword {
+		// отвечаем за то же время, что и при проверке настоящего пароля
+		Burn(plain, p)
+		return false, false, nil
+	}
+	if !IsHashed(encoded) {
+		// старые записи хранят пароль в открытом виде
+		match = subtle.ConstantTimeCompare([]byte(plain), []byte(encoded)) == 1
+		return match, match, nil
+	}
+
+	stored, salt, key, err := decode(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plain), salt, stored.Iterations, stored.Memory, stored.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return false, false, nil
+	}
+
+	needsRehash = stored.Memory != p.Memory ||
+		stored.Iterations != p.Iterations ||
+		stored.Parallelism != p.Parallelism ||
+		uint32(len(salt)) != p.SaltLength ||
+		uint32(len(key)) != p.KeyLength
+
+	return true, needsRehash, nil
+}
+
+// IsHashed проверяет, что значение является хешем, а не паролем в открытом виде
+func IsHashed(encoded string) bool {
+	return strings.HasPrefix(encoded, "$"+algorithm+"$")
+}
+
+// Burn вычисляет хеш вхолостую, чтобы ответ для несуществующего логина
+// занимал столько же времени, сколько и проверка реального пароля
+func Burn(plain string, p Params) {
+	salt := make([]byte, p.SaltLength)
+	_ = argon2.IDKey([]byte(plain), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+}
+
+func decode(encoded string) (*Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	// "", algorithm, version, params, salt, key
+	if len(parts) != 6 || parts[1] != algorithm {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version: %v", version)
+	}
+
+	p := &Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	p.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,93 @@
+package password
+
+import "testing"
+
+var testParams = Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  8,
+	KeyLength:   16,
+}
+
+func TestVerify(t *testing.T) {
+	hashed, err := Hash("secret", testParams)
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	stronger := testParams
+	stronger.Iterations = 2
+
+	tests := []struct {
+		name            string
+		plain           string
+		encoded         string
+		params          Params
+		wantMatch       bool
+		wantNeedsRehash bool
+		wantErr         bool
+	}{
+		{
+			name:      "hash_ok",
+			plain:     "secret",
+			encoded:   hashed,
+			params:    testParams,
+			wantMatch: true,
+		},
+		{
+			name:    "hash_wrong_password",
+			plain:   "secret2",
+			encoded: hashed,
+			params:  testParams,
+		},
+		{
+			name:            "hash_params_raised",
+			plain:           "secret",
+			encoded:         hashed,
+			params:          stronger,
+			wantMatch:       true,
+			wantNeedsRehash: true,
+		},
+		{
+			name:            "plaintext_ok",
+			plain:           "secret",
+			encoded:         "secret",
+			params:          testParams,
+			wantMatch:       true,
+			wantNeedsRehash: true,
+		},
+		{
+			name:    "plaintext_wrong_password",
+			plain:   "secret2",
+			encoded: "secret",
+			params:  testParams,
+		},
+		{
+			name:    "no_password",
+			plain:   NoPassword,
+			encoded: NoPassword,
+			params:  testParams,
+		},
+		{
+			name:    "broken_hash",
+			plain:   "secret",
+			encoded: "$argon2id$v=19$m=64$broken",
+			params:  testParams,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash, err := Verify(tt.plain, tt.encoded, tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if match != tt.wantMatch {
+				t.Errorf("Verify() match = %v, want %v", match, tt.wantMatch)
+			}
+			if needsRehash != tt.wantNeedsRehash {
+				t.Errorf("Verify() needsRehash = %v, want %v", needsRehash, tt.wantNeedsRehash)
+			}
+		})
+	}
+}
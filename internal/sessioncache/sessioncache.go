@@ -0,0 +1,84 @@
+// Package sessioncache хранит в памяти результаты проверки сеансов, чтобы
+// не обращаться к базе на каждый запрос. Отзыв сеанса на этом экземпляре
+// сервиса действует сразу, на остальных - не позже чем через TTL
+package sessioncache
+
+import (
+	"sync"
+	"time"
+)
+
+// сколько записей хранить, прежде чем удалять устаревшие
+const pruneThreshold = 10000
+
+type entry struct {
+	login    string
+	active   bool
+	cachedAt time.Time
+}
+
+// Cache — кэш состояния сеансов
+type Cache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]entry
+}
+
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		entries: make(map[string]entry),
+	}
+}
+
+// Get возвращает сохранённое состояние сеанса. ok = false, если состояния
+// нет в кэше или оно устарело
+func (c *Cache) Get(sessionID string, now time.Time) (active bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.entries[sessionID]
+	if !found || now.Sub(el.cachedAt) >= c.ttl {
+		return false, false
+	}
+	return el.active, true
+}
+
+// Set сохраняет состояние сеанса пользователя login
+func (c *Cache) Set(sessionID string, login string, active bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) > pruneThreshold {
+		c.prune(now)
+	}
+	c.entries[sessionID] = entry{login: login, active: active, cachedAt: now}
+}
+
+// Invalidate удаляет сеанс из кэша, следующая проверка пойдёт в базу
+func (c *Cache) Invalidate(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, sessionID)
+}
+
+// InvalidateUser удаляет из кэша все сеансы пользователя
+func (c *Cache) InvalidateUser(login string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, el := range c.entries {
+		if el.login == login {
+			delete(c.entries, id)
+		}
+	}
+}
+
+func (c *Cache) prune(now time.Time) {
+	for id, el := range c.entries {
+		if now.Sub(el.cachedAt) >= c.ttl {
+			delete(c.entries, id)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package sessioncache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	cache := New(time.Minute)
+	now := time.Now()
+
+	cache.Set("s1", "user1", true, now)
+	cache.Set("s2", "user1", true, now)
+	cache.Set("s3", "user2", false, now)
+
+	tests := []struct {
+		name       string
+		sessionID  string
+		now        time.Time
+		wantActive bool
+		wantOk     bool
+	}{
+		{name: "active", sessionID: "s1", now: now, wantActive: true, wantOk: true},
+		{name: "revoked", sessionID: "s3", now: now, wantActive: false, wantOk: true},
+		{name: "unknown", sessionID: "s4", now: now, wantActive: false, wantOk: false},
+		{name: "expired", sessionID: "s1", now: now.Add(time.Minute), wantActive: false, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, ok := cache.Get(tt.sessionID, tt.now)
+			if active != tt.wantActive || ok != tt.wantOk {
+				t.Errorf("Get() = %v, %v, want %v, %v", active, ok, tt.wantActive, tt.wantOk)
+			}
+		})
+	}
+
+	cache.InvalidateUser("user1")
+	if _, ok := cache.Get("s2", now); ok {
+		t.Errorf("InvalidateUser() session s2 is still cached")
+	}
+	if _, ok := cache.Get("s3", now); !ok {
+		t.Errorf("InvalidateUser() removed session of another user")
+	}
+}
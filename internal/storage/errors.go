@@ -0,0 +1,16 @@
+package storage
+
+import "errors"
+
+// Ошибки, к которым реализации хранилища приводят ошибки своей базы.
+// Приложение проверяет их через errors.Is и не зависит от драйвера
+var (
+	// ErrDuplicateLogin - логин уже занят другим пользователем
+	ErrDuplicateLogin = errors.New("login already exists")
+	// ErrNotFound - запись или запись, на которую она ссылается, не найдена
+	ErrNotFound = errors.New("not found")
+	// ErrTransient - временная ошибка базы, операцию можно повторить
+	ErrTransient = errors.New("storage temporarily unavailable")
+	// ErrConflict - запись с тем же ключом уже существует
+	ErrConflict = errors.New("record already exists")
+)
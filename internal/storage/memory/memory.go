@@ -0,0 +1,1077 @@
+// Package memory хранит данные сервиса в памяти процесса. Хранилище нужно
+// для тестов и локальной разработки: данные теряются при остановке сервиса
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/lockout"
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+type identityKey struct {
+	issuer  string
+	subject string
+}
+
+// orderLease — аренда заказа исполнителем опроса системы начислений
+type orderLease struct {
+	worker    string
+	expiresAt time.Time
+}
+
+// MemoryStorage повторяет поведение PostgresStorage. Все операции выполняются
+// под одной блокировкой, поэтому каждая из них атомарна, как транзакция в базе
+type MemoryStorage struct {
+	// счётчики неудачных входов, как и в базе, общие для всего хранилища
+	*lockout.MemoryStore
+
+	mu sync.RWMutex
+	// пользователи по логину в нижнем регистре: логины уникальны без учёта регистра
+	users         map[string]*model.User
+	identities    map[identityKey]*model.Identity
+	oidcStates    map[string]*model.OIDCState
+	sessions      map[string]*model.Session
+	refreshTokens map[string]*model.RefreshToken
+	twoFactor     map[string]*model.TwoFactor
+	// коды восстановления пользователя: хеш кода - время погашения
+	recoveryCodes map[string]map[string]*time.Time
+	apiKeys       map[string]*model.APIKey
+	auditLog      []*model.AuditRecord
+	orders        map[string]*model.Order
+	leases        map[string]orderLease
+	withdrawals   map[string]*model.Withdrawal
+	adjustments   []*model.Adjustment
+	ledger        []*model.LedgerEntry
+	// баланс счёта после последней записи журнала и сумма списаний
+	balances map[string]model.Balance
+
+	lastAuditID             int64
+	lastAdjustmentID        int64
+	lastLedgerEntryID       int64
+	lastLedgerTransactionID int64
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		MemoryStore:   lockout.NewMemoryStore(),
+		users:         make(map[string]*model.User),
+		identities:    make(map[identityKey]*model.Identity),
+		oidcStates:    make(map[string]*model.OIDCState),
+		sessions:      make(map[string]*model.Session),
+		refreshTokens: make(map[string]*model.RefreshToken),
+		twoFactor:     make(map[string]*model.TwoFactor),
+		recoveryCodes: make(map[string]map[string]*time.Time),
+		apiKeys:       make(map[string]*model.APIKey),
+		orders:        make(map[string]*model.Order),
+		leases:        make(map[string]orderLease),
+		withdrawals:   make(map[string]*model.Withdrawal),
+		balances:      make(map[string]model.Balance),
+	}
+}
+
+// duplicateLogin возвращает ошибку занятого логина
+func duplicateLogin(login string) error {
+	return fmt.Errorf("%w: %v", storage.ErrDuplicateLogin, login)
+}
+
+// conflict возвращает ошибку повторного ключа с именем ограничения базы
+func conflict(constraint string) error {
+	return fmt.Errorf("%w: %v", storage.ErrConflict, constraint)
+}
+
+// missingReference возвращает ошибку ссылки на несуществующую запись
+func missingReference(constraint string) error {
+	return fmt.Errorf("%w: %v", storage.ErrNotFound, constraint)
+}
+
+func copyTime(value *time.Time) *time.Time {
+	if value == nil {
+		return nil
+	}
+	copyValue := *value
+	return &copyValue
+}
+
+func (s *MemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStorage) Quit(ctx context.Context) {
+}
+
+// user возвращает пользователя с точно таким логином, как в ссылках на него
+func (s *MemoryStorage) user(login string) *model.User {
+	userInfo, ok := s.users[strings.ToLower(login)]
+	if !ok || userInfo.Login != login {
+		return nil
+	}
+	return userInfo
+}
+
+func (s *MemoryStorage) addUser(user *model.User) error {
+	if _, ok := s.users[strings.ToLower(user.Login)]; ok {
+		return duplicateLogin(user.Login)
+	}
+	s.users[strings.ToLower(user.Login)] = &model.User{
+		Login:    user.Login,
+		Password: user.Password,
+		Role:     model.RoleUser,
+	}
+	return nil
+}
+
+func (s *MemoryStorage) AddUser(ctx context.Context, user *model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addUser(user)
+}
+
+// AddUserWithIdentity создаёт пользователя, вошедшего через внешнего
+// провайдера, и привязывает к нему учётную запись провайдера
+func (s *MemoryStorage) AddUserWithIdentity(ctx context.Context, user *model.User, identity *model.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[strings.ToLower(user.Login)]; ok {
+		return duplicateLogin(user.Login)
+	}
+	key := identityKey{issuer: identity.Issuer, subject: identity.Subject}
+	if _, ok := s.identities[key]; ok {
+		return conflict("user_identities_pkey")
+	}
+
+	if err := s.addUser(user); err != nil {
+		return err
+	}
+	s.identities[key] = &model.Identity{
+		Issuer:    identity.Issuer,
+		Subject:   identity.Subject,
+		User:      user.Login,
+		Email:     identity.Email,
+		CreatedAt: identity.CreatedAt,
+	}
+	return nil
+}
+
+// GetUserByIdentity возвращает пользователя, к которому привязана
+// учётная запись внешнего провайдера, или nil
+func (s *MemoryStorage) GetUserByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	identity, ok := s.identities[identityKey{issuer: issuer, subject: subject}]
+	if !ok {
+		return nil, nil
+	}
+	userInfo := s.user(identity.User)
+	if userInfo == nil {
+		return nil, nil
+	}
+	copyUser := *userInfo
+	return &copyUser, nil
+}
+
+// AddOIDCState сохраняет параметры начатого входа через внешнего провайдера
+// и заодно удаляет просроченные
+func (s *MemoryStorage) AddOIDCState(ctx context.Context, state *model.OIDCState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, el := range s.oidcStates {
+		if el.ExpiresAt.Before(state.CreatedAt) {
+			delete(s.oidcStates, key)
+		}
+	}
+
+	if _, ok := s.oidcStates[state.State]; ok {
+		return conflict("oidc_states_pkey")
+	}
+	copyState := *state
+	s.oidcStates[state.State] = &copyState
+	return nil
+}
+
+// TakeOIDCState возвращает и удаляет параметры входа, повторно
+// они не выдаются. Возвращает nil, если state не найден
+func (s *MemoryStorage) TakeOIDCState(ctx context.Context, state string) (*model.OIDCState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stateInfo, ok := s.oidcStates[state]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.oidcStates, state)
+	return stateInfo, nil
+}
+
+func (s *MemoryStorage) GetUser(ctx context.Context, user *model.User) (*model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userInfo, ok := s.users[strings.ToLower(user.Login)]
+	if !ok {
+		// пользователь не найден
+		return nil, nil
+	}
+	copyUser := *userInfo
+	return &copyUser, nil
+}
+
+// SearchUsers ищет пользователей по части логина без учёта регистра
+func (s *MemoryStorage) SearchUsers(ctx context.Context, loginPattern string, limit int) ([]*model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []*model.User{}
+	pattern := strings.ToLower(loginPattern)
+	for key, el := range s.users {
+		if strings.Contains(key, pattern) {
+			users = append(users, &model.User{
+				Login:   el.Login,
+				Role:    el.Role,
+				Blocked: el.Blocked,
+			})
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Login < users[j].Login
+	})
+	if limit >= 0 && len(users) > limit {
+		users = users[:limit]
+	}
+
+	return users, nil
+}
+
+func (s *MemoryStorage) SetUserRole(ctx context.Context, login string, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userInfo, ok := s.users[strings.ToLower(login)]
+	if !ok {
+		return fmt.Errorf("role not updated: user %w", storage.ErrNotFound)
+	}
+	userInfo.Role = role
+	return nil
+}
+
+func (s *MemoryStorage) SetUserBlocked(ctx context.Context, login string, blocked bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userInfo, ok := s.users[strings.ToLower(login)]
+	if !ok {
+		return fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+	userInfo.Blocked = blocked
+	return nil
+}
+
+func (s *MemoryStorage) UpdatePassword(ctx context.Context, login string, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userInfo := s.user(login)
+	if userInfo == nil {
+		return fmt.Errorf("password not updated: user %w", storage.ErrNotFound)
+	}
+	userInfo.Password = passwordHash
+	return nil
+}
+
+// DeleteUser удаляет пользователя, его сеансы и токены. Заказы, списания
+// и журнал баллов остаются для учёта, но вместо логина в них записывается anonymousID
+func (s *MemoryStorage) DeleteUser(ctx context.Context, login string, anonymousID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user(login) == nil {
+		return fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	for _, el := range s.orders {
+		if el.Owner == login {
+			el.Owner = anonymousID
+		}
+	}
+	for _, el := range s.withdrawals {
+		if el.User == login {
+			el.User = anonymousID
+		}
+	}
+	for _, el := range s.adjustments {
+		if el.User == login {
+			el.User = anonymousID
+		}
+	}
+	for _, el := range s.ledger {
+		if el.Account == login {
+			el.Account = anonymousID
+		}
+	}
+	if balance, ok := s.balances[login]; ok {
+		s.balances[anonymousID] = balance
+		delete(s.balances, login)
+	}
+
+	// остальные данные пользователя удаляются вместе с ним, как каскадом в базе
+	for id, el := range s.sessions {
+		if el.User == login {
+			s.deleteSession(id)
+		}
+	}
+	delete(s.twoFactor, login)
+	delete(s.recoveryCodes, login)
+	for id, el := range s.apiKeys {
+		if el.User == login {
+			delete(s.apiKeys, id)
+		}
+	}
+	for key, el := range s.identities {
+		if el.User == login {
+			delete(s.identities, key)
+		}
+	}
+	delete(s.users, strings.ToLower(login))
+
+	return nil
+}
+
+func (s *MemoryStorage) deleteSession(id string) {
+	for hash, el := range s.refreshTokens {
+		if el.SessionID == id {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	delete(s.sessions, id)
+}
+
+func (s *MemoryStorage) AddSession(ctx context.Context, session *model.Session, token *model.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user(session.User) == nil {
+		return missingReference("fk_users")
+	}
+	if _, ok := s.sessions[session.ID]; ok {
+		return conflict("sessions_pkey")
+	}
+	if _, ok := s.sessions[token.SessionID]; !ok && token.SessionID != session.ID {
+		return missingReference("fk_sessions")
+	}
+	if _, ok := s.refreshTokens[token.Hash]; ok {
+		return conflict("refresh_tokens_pkey")
+	}
+
+	s.sessions[session.ID] = &model.Session{
+		ID:         session.ID,
+		User:       session.User,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.CreatedAt,
+		ExpiresAt:  session.ExpiresAt,
+	}
+	s.refreshTokens[token.Hash] = &model.RefreshToken{
+		Hash:      token.Hash,
+		SessionID: token.SessionID,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+
+	return nil
+}
+
+func copySession(session *model.Session) *model.Session {
+	copySession := *session
+	copySession.RevokedAt = copyTime(session.RevokedAt)
+	copySession.Current = false
+	return &copySession
+}
+
+func (s *MemoryStorage) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	return copySession(session), nil
+}
+
+// GetUserSessions возвращает действующие сеансы пользователя
+func (s *MemoryStorage) GetUserSessions(ctx context.Context, login string) ([]*model.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := []*model.Session{}
+	now := time.Now()
+	for _, el := range s.sessions {
+		if el.User == login && el.RevokedAt == nil && el.ExpiresAt.After(now) {
+			sessions = append(sessions, copySession(el))
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	return sessions, nil
+}
+
+func (s *MemoryStorage) TouchSession(ctx context.Context, sessionID string, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionID]
+	if ok && session.LastSeenAt.Before(lastSeen) {
+		session.LastSeenAt = lastSeen
+	}
+	return nil
+}
+
+func (s *MemoryStorage) RotateRefreshToken(ctx context.Context, tokenHash string, newToken *model.RefreshToken) (*model.Session, model.EndPointStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return nil, model.RefreshTokenInvalid, nil
+	}
+	stored := s.sessions[token.SessionID]
+	if stored.RevokedAt != nil {
+		return nil, model.RefreshTokenInvalid, nil
+	}
+
+	// возвращаются те же поля сеанса, что читает PostgresStorage
+	session := &model.Session{
+		ID:        stored.ID,
+		User:      stored.User,
+		CreatedAt: stored.CreatedAt,
+		ExpiresAt: stored.ExpiresAt,
+	}
+
+	now := newToken.CreatedAt
+	if token.UsedAt != nil {
+		// токен уже был использован - похоже на кражу токена,
+		// отзываем весь сеанс
+		stored.RevokedAt = &now
+		return session, model.RefreshTokenReused, nil
+	}
+
+	if now.After(token.ExpiresAt) || now.After(stored.ExpiresAt) {
+		return nil, model.RefreshTokenInvalid, nil
+	}
+
+	if _, ok := s.refreshTokens[newToken.Hash]; ok {
+		return nil, model.OtherError, conflict("refresh_tokens_pkey")
+	}
+
+	token.UsedAt = &now
+	newToken.SessionID = session.ID
+	s.refreshTokens[newToken.Hash] = &model.RefreshToken{
+		Hash:      newToken.Hash,
+		SessionID: newToken.SessionID,
+		CreatedAt: newToken.CreatedAt,
+		ExpiresAt: newToken.ExpiresAt,
+	}
+
+	return session, model.RefreshTokenRotated, nil
+}
+
+func (s *MemoryStorage) RevokeSession(ctx context.Context, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionID]
+	if ok && session.RevokedAt == nil {
+		now := time.Now()
+		session.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *MemoryStorage) RevokeUserSessions(ctx context.Context, login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, el := range s.sessions {
+		if el.User == login && el.RevokedAt == nil {
+			revokedAt := now
+			el.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+// RevokeUserSession отзывает один сеанс пользователя. Возвращает false,
+// если у пользователя нет действующего сеанса с таким идентификатором
+func (s *MemoryStorage) RevokeUserSession(ctx context.Context, login string, sessionID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionID]
+	if !ok || session.User != login || session.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	return true, nil
+}
+
+// SetTwoFactorSecret сохраняет новый секрет и коды восстановления.
+// Второй фактор остаётся выключенным до подтверждения
+func (s *MemoryStorage) SetTwoFactorSecret(ctx context.Context, login string, secret string, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user(login) == nil {
+		return missingReference("fk_users")
+	}
+
+	codes := make(map[string]*time.Time, len(recoveryCodeHashes))
+	for _, el := range recoveryCodeHashes {
+		if _, ok := codes[el]; ok {
+			return conflict("two_factor_recovery_codes_pkey")
+		}
+		codes[el] = nil
+	}
+
+	s.twoFactor[login] = &model.TwoFactor{Secret: secret}
+	s.recoveryCodes[login] = codes
+	return nil
+}
+
+func (s *MemoryStorage) GetTwoFactor(ctx context.Context, login string) (*model.TwoFactor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	twoFactor, ok := s.twoFactor[login]
+	if !ok {
+		return nil, nil
+	}
+	copyTwoFactor := *twoFactor
+	return &copyTwoFactor, nil
+}
+
+func (s *MemoryStorage) EnableTwoFactor(ctx context.Context, login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	twoFactor, ok := s.twoFactor[login]
+	if !ok {
+		return fmt.Errorf("two-factor authentication is not enrolled: secret %w", storage.ErrNotFound)
+	}
+	twoFactor.Enabled = true
+	return nil
+}
+
+func (s *MemoryStorage) DisableTwoFactor(ctx context.Context, login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.twoFactor, login)
+	delete(s.recoveryCodes, login)
+	return nil
+}
+
+// UseTwoFactorCounter запоминает период принятого кода. Возвращает false,
+// если код этого периода уже был использован
+func (s *MemoryStorage) UseTwoFactorCounter(ctx context.Context, login string, counter int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	twoFactor, ok := s.twoFactor[login]
+	if !ok || twoFactor.LastCounter >= counter {
+		return false, nil
+	}
+	twoFactor.LastCounter = counter
+	return true, nil
+}
+
+// UseRecoveryCode погашает код восстановления. Возвращает false, если
+// код не найден или уже использован
+func (s *MemoryStorage) UseRecoveryCode(ctx context.Context, login string, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usedAt, ok := s.recoveryCodes[login][codeHash]
+	if !ok || usedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	s.recoveryCodes[login][codeHash] = &now
+	return true, nil
+}
+
+func copyAPIKey(key *model.APIKey) *model.APIKey {
+	copyKey := *key
+	copyKey.Scopes = append([]string(nil), key.Scopes...)
+	copyKey.LastUsedAt = copyTime(key.LastUsedAt)
+	copyKey.RevokedAt = copyTime(key.RevokedAt)
+	return &copyKey
+}
+
+func (s *MemoryStorage) AddAPIKey(ctx context.Context, key *model.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user(key.User) == nil {
+		return missingReference("fk_users")
+	}
+	if _, ok := s.apiKeys[key.ID]; ok {
+		return conflict("api_keys_pkey")
+	}
+	for _, el := range s.apiKeys {
+		if el.Hash == key.Hash {
+			return conflict("api_keys_key_hash_key")
+		}
+	}
+
+	newKey := copyAPIKey(key)
+	newKey.LastUsedAt = nil
+	newKey.RevokedAt = nil
+	s.apiKeys[key.ID] = newKey
+	return nil
+}
+
+func (s *MemoryStorage) GetAPIKeys(ctx context.Context, login string) ([]*model.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []*model.APIKey{}
+	for _, el := range s.apiKeys {
+		if el.User == login {
+			keys = append(keys, copyAPIKey(el))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+func (s *MemoryStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (*model.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, el := range s.apiKeys {
+		if el.Hash == keyHash {
+			return copyAPIKey(el), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStorage) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.apiKeys[id]; ok {
+		key.LastUsedAt = &usedAt
+	}
+	return nil
+}
+
+// RevokeAPIKey отзывает ключ пользователя. Возвращает false, если у
+// пользователя нет действующего ключа с таким идентификатором
+func (s *MemoryStorage) RevokeAPIKey(ctx context.Context, login string, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.User != login || key.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	key.RevokedAt = &now
+	return true, nil
+}
+
+func (s *MemoryStorage) AddAuditRecord(ctx context.Context, record *model.AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastAuditID++
+	record.ID = s.lastAuditID
+	copyRecord := *record
+	s.auditLog = append(s.auditLog, &copyRecord)
+	return nil
+}
+
+func (s *MemoryStorage) UploadOrder(ctx context.Context, orderID string, user *model.User) (model.EndPointStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orderInfo, ok := s.orders[orderID]
+	if !ok {
+		// заказа нет - создаем новый
+		s.orders[orderID] = &model.Order{
+			ID:         orderID,
+			Owner:      user.Login,
+			UploadDate: time.Now(),
+			Status:     model.OrderStatusNew,
+		}
+		return model.OrderAcceptedToProcessing, nil
+	}
+
+	// заказ есть - проверим, кем был загружен
+	if orderInfo.Owner == user.Login {
+		return model.OrderAlreadyUploaded, nil
+	}
+	return model.OrderAlreadyUploadedByAnotherUser, nil
+}
+
+func (s *MemoryStorage) GetOrder(ctx context.Context, orderID string) (*model.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderInfo, ok := s.orders[orderID]
+	if !ok {
+		return nil, nil
+	}
+	copyOrder := *orderInfo
+	return &copyOrder, nil
+}
+
+// sortOrders упорядочивает заказы по времени загрузки
+func sortOrders(orders []model.Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].UploadDate.Equal(orders[j].UploadDate) {
+			return orders[i].UploadDate.Before(orders[j].UploadDate)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+}
+
+func (s *MemoryStorage) GetAllOrders(ctx context.Context, user *model.User) ([]*model.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := []model.Order{}
+	for _, el := range s.orders {
+		if el.Owner == user.Login {
+			found = append(found, *el)
+		}
+	}
+	sortOrders(found)
+
+	orders := make([]*model.Order, 0, len(found))
+	for i := range found {
+		orders = append(orders, &found[i])
+	}
+	return orders, nil
+}
+
+// GetBalance возвращает сохранённый баланс пользователя
+func (s *MemoryStorage) GetBalance(ctx context.Context, user *model.User) (*model.Balance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	balance := s.balances[user.Login]
+	return &balance, nil
+}
+
+// GetLedgerTotals возвращает суммы записей журнала по счёту пользователя
+// по видам операций
+func (s *MemoryStorage) GetLedgerTotals(ctx context.Context, user *model.User) (map[string]money.Amount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	totals := map[string]money.Amount{}
+	for _, el := range s.ledger {
+		if el.Account == user.Login {
+			totals[el.Kind] += el.Amount
+		}
+	}
+	return totals, nil
+}
+
+// RequestWithdrawal проверяет баланс и записывает списание атомарно
+func (s *MemoryStorage) RequestWithdrawal(ctx context.Context, withdrawalInfo *model.Withdrawal) (model.EndPointStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user(withdrawalInfo.User) == nil {
+		return model.OtherError, fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	// проверим, нет ли уже списаний по этому заказу
+	if _, ok := s.withdrawals[withdrawalInfo.OrderID]; ok {
+		return model.WithdrawalAlreadyRequested, nil
+	}
+
+	balance, ok := s.balances[withdrawalInfo.User]
+	if !ok {
+		// бонусов нет
+		return model.WithdrawalNoBonuses, nil
+	}
+	// проверим хватит ли бонусов для списания в счет заказа
+	if balance.Current < withdrawalInfo.Sum {
+		return model.WithdrawalNotEnoughBonuses, nil
+	}
+
+	s.withdrawals[withdrawalInfo.OrderID] = &model.Withdrawal{
+		OrderID:       withdrawalInfo.OrderID,
+		Sum:           withdrawalInfo.Sum,
+		ProcessedDate: withdrawalInfo.ProcessedDate,
+		User:          withdrawalInfo.User,
+	}
+	s.postLedgerEntry(&model.LedgerEntry{
+		Account:   withdrawalInfo.User,
+		Kind:      model.LedgerWithdrawal,
+		Amount:    -withdrawalInfo.Sum,
+		Reference: withdrawalInfo.OrderID,
+		CreatedAt: withdrawalInfo.ProcessedDate,
+	})
+
+	return model.WithdrawalAccepted, nil
+}
+
+func (s *MemoryStorage) GetAllWithdrawals(ctx context.Context, user *model.User) ([]*model.Withdrawal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	withdrawals := []*model.Withdrawal{}
+	for _, el := range s.withdrawals {
+		if el.User == user.Login {
+			withdrawals = append(withdrawals, &model.Withdrawal{
+				OrderID:       el.OrderID,
+				Sum:           el.Sum,
+				ProcessedDate: el.ProcessedDate,
+			})
+		}
+	}
+
+	sort.Slice(withdrawals, func(i, j int) bool {
+		if !withdrawals[i].ProcessedDate.Equal(withdrawals[j].ProcessedDate) {
+			return withdrawals[i].ProcessedDate.Before(withdrawals[j].ProcessedDate)
+		}
+		return withdrawals[i].OrderID < withdrawals[j].OrderID
+	})
+
+	return withdrawals, nil
+}
+
+// AddAdjustment записывает корректировку и проводит её по журналу баллов
+func (s *MemoryStorage) AddAdjustment(ctx context.Context, adjustment *model.Adjustment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastAdjustmentID++
+	adjustment.ID = s.lastAdjustmentID
+	copyAdjustment := *adjustment
+	s.adjustments = append(s.adjustments, &copyAdjustment)
+
+	s.postLedgerEntry(&model.LedgerEntry{
+		Account:   adjustment.User,
+		Kind:      model.LedgerAdjustment,
+		Amount:    adjustment.Amount,
+		Reference: strconv.FormatInt(adjustment.ID, 10),
+		CreatedAt: adjustment.ProcessedDate,
+	})
+
+	return nil
+}
+
+func (s *MemoryStorage) GetAllAdjustments(ctx context.Context, user *model.User) ([]*model.Adjustment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	adjustments := []*model.Adjustment{}
+	for _, el := range s.adjustments {
+		if el.User == user.Login {
+			copyAdjustment := *el
+			adjustments = append(adjustments, &copyAdjustment)
+		}
+	}
+
+	sort.SliceStable(adjustments, func(i, j int) bool {
+		return adjustments[i].ProcessedDate.Before(adjustments[j].ProcessedDate)
+	})
+
+	return adjustments, nil
+}
+
+// GetOrdersForUpdate выдаёт worker в аренду на leaseTime до limit заказов,
+// ожидающих расчёта начисления. Заказы, которые уже в аренде, пропускаются
+func (s *MemoryStorage) GetOrdersForUpdate(ctx context.Context, worker string, limit int, leaseTime time.Duration) ([]model.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statusesForUpdate := make(map[string]bool)
+	for _, el := range model.OrderStatusesForUpdate() {
+		statusesForUpdate[el] = true
+	}
+
+	now := time.Now()
+	pending := []*model.Order{}
+	for _, el := range s.orders {
+		if !statusesForUpdate[el.Status] {
+			continue
+		}
+		if el.NextAttemptAt != nil && el.NextAttemptAt.After(now) {
+			continue
+		}
+		if lease, ok := s.leases[el.ID]; ok && lease.expiresAt.After(now) {
+			continue
+		}
+		pending = append(pending, el)
+	}
+
+	// сначала заказы без отложенной попытки, затем по времени попытки и загрузки
+	sort.Slice(pending, func(i, j int) bool {
+		left, right := pending[i].NextAttemptAt, pending[j].NextAttemptAt
+		if (left == nil) != (right == nil) {
+			return left == nil
+		}
+		if left != nil && !left.Equal(*right) {
+			return left.Before(*right)
+		}
+		if !pending[i].UploadDate.Equal(pending[j].UploadDate) {
+			return pending[i].UploadDate.Before(pending[j].UploadDate)
+		}
+		return pending[i].ID < pending[j].ID
+	})
+	if len(pending) > limit {
+		pending = pending[:limit]
+	}
+
+	orders := make([]model.Order, 0, len(pending))
+	for _, el := range pending {
+		el.Attempts++
+		s.leases[el.ID] = orderLease{worker: worker, expiresAt: now.Add(leaseTime)}
+		orderInfo := *el
+		orderInfo.NextAttemptAt = copyTime(el.NextAttemptAt)
+		orders = append(orders, orderInfo)
+	}
+	sortOrders(orders)
+
+	return orders, nil
+}
+
+// LeaseOrder выдаёт worker в аренду на leaseTime заказ orderID в любом статусе,
+// если он не в аренде у другого исполнителя. Число попыток опроса не меняется.
+// Возвращает nil, если заказа нет или он уже в аренде
+func (s *MemoryStorage) LeaseOrder(ctx context.Context, orderID string, worker string, leaseTime time.Duration) (*model.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.orders[orderID]
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now()
+	if lease, ok := s.leases[orderID]; ok && lease.expiresAt.After(now) {
+		return nil, nil
+	}
+
+	s.leases[orderID] = orderLease{worker: worker, expiresAt: now.Add(leaseTime)}
+	orderInfo := *el
+	orderInfo.NextAttemptAt = copyTime(el.NextAttemptAt)
+	return &orderInfo, nil
+}
+
+// UpdateBatchOrders обновляет статусы заказов, снимает с них аренду и проводит
+// начисления по журналу баллов. Если хотя бы одного заказа нет, не обновляется ни один.
+// Заказ, аренда которого истекла или перешла к другому исполнителю, пропускается.
+// Возвращает заказы, у которых изменились статус или начисление
+func (s *MemoryStorage) UpdateBatchOrders(ctx context.Context, worker string, orders []model.Order) ([]model.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, el := range orders {
+		if _, ok := s.orders[el.ID]; !ok {
+			return nil, fmt.Errorf("order not updated: order %w", storage.ErrNotFound)
+		}
+	}
+
+	now := time.Now()
+	changed := []model.Order{}
+	for _, el := range orders {
+		// аренда истекла или перешла к другому исполнителю
+		lease, ok := s.leases[el.ID]
+		if !ok || lease.worker != worker || !lease.expiresAt.After(now) {
+			continue
+		}
+
+		orderInfo := s.orders[el.ID]
+		if orderInfo.Status != el.Status || orderInfo.Bonus != el.Bonus {
+			changed = append(changed, el)
+		}
+		orderInfo.Status = el.Status
+		orderInfo.Bonus = el.Bonus
+		orderInfo.NextAttemptAt = el.NextAttempt(now)
+		delete(s.leases, el.ID)
+
+		// начисляется разница с уже проведённой суммой, поэтому
+		// повторное обновление заказа не начисляет баллы дважды
+		posted := s.ledgerPosted(el.Owner, model.LedgerAccrual, el.ID)
+		if el.Bonus == posted {
+			continue
+		}
+		s.postLedgerEntry(&model.LedgerEntry{
+			Account:   el.Owner,
+			Kind:      model.LedgerAccrual,
+			Amount:    el.Bonus - posted,
+			Reference: el.ID,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	return changed, nil
+}
+
+// postLedgerEntry добавляет в журнал операцию по счёту пользователя
+// и встречную запись на системном счёте
+func (s *MemoryStorage) postLedgerEntry(entry *model.LedgerEntry) {
+	s.lastLedgerTransactionID++
+	entry.TransactionID = s.lastLedgerTransactionID
+	balance := s.balances[entry.Account]
+	balance.Current += entry.Amount
+	balance.Withdrawn += entry.Withdrawn()
+	s.balances[entry.Account] = balance
+	entry.Balance = balance.Current
+
+	s.lastLedgerEntryID++
+	entry.ID = s.lastLedgerEntryID
+	userEntry := *entry
+	s.ledger = append(s.ledger, &userEntry)
+
+	s.lastLedgerEntryID++
+	s.ledger = append(s.ledger, &model.LedgerEntry{
+		ID:            s.lastLedgerEntryID,
+		TransactionID: entry.TransactionID,
+		Account:       model.LedgerSystemAccount(entry.Kind),
+		Kind:          entry.Kind,
+		Amount:        -entry.Amount,
+		Reference:     entry.Reference,
+		CreatedAt:     entry.CreatedAt,
+	})
+}
+
+func (s *MemoryStorage) ledgerPosted(account string, kind string, reference string) money.Amount {
+	var posted money.Amount
+	for _, el := range s.ledger {
+		if el.Account == account && el.Kind == kind && el.Reference == reference {
+			posted += el.Amount
+		}
+	}
+	return posted
+}
@@ -0,0 +1,18 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/storage/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return NewMemoryStorage()
+	})
+}
+
+func BenchmarkMemoryStorage(b *testing.B) {
+	storagetest.Bench(b, NewMemoryStorage(), nil)
+}
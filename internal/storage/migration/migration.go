@@ -0,0 +1,107 @@
+// Package migration читает шаги изменения схемы базы. Каждая реализация
+// хранилища встраивает свои файлы шагов и применяет их сама
+package migration
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration — шаг изменения схемы. Файлы шага называются
+// <версия>_<название>.up.sql и <версия>_<название>.down.sql
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status — состояние шага миграции в базе
+type Status struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Load читает шаги из каталога dir и возвращает их в порядке версий
+func Load(files fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %v", fileName)
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionPart, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %v must be named <version>_<name>.%v.sql", fileName, direction)
+		}
+		version, err := strconv.ParseInt(versionPart, 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file %v has invalid version", fileName)
+		}
+
+		data, err := fs.ReadFile(files, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		step, ok := byVersion[version]
+		if !ok {
+			step = &Migration{Version: version, Name: name}
+			byVersion[version] = step
+		}
+		if step.Name != name {
+			return nil, fmt.Errorf("migration %v has different names: %v and %v", version, step.Name, name)
+		}
+		if direction == "up" {
+			step.Up = string(data)
+		} else {
+			step.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, el := range byVersion {
+		if el.Up == "" || el.Down == "" {
+			return nil, fmt.Errorf("migration %v_%v must have both up and down steps", el.Version, el.Name)
+		}
+		migrations = append(migrations, *el)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Statuses сопоставляет шаги со временем их применения
+func Statuses(migrations []Migration, applied map[int64]time.Time) []Status {
+	statuses := make([]Status, 0, len(migrations))
+	for _, el := range migrations {
+		status := Status{Version: el.Version, Name: el.Name}
+		if appliedAt, ok := applied[el.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"math/big"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/kvvPro/gophermart/internal/money"
+)
+
+// registerAmount учит соединение передавать суммы баллов в колонки numeric
+// и читать их оттуда. Без этого pgx передал бы сумму как целое число
+// сотых долей. Обёртки ставятся перед стандартными, как советует pgx
+func registerAmount(typeMap *pgtype.Map) {
+	typeMap.TryWrapEncodePlanFuncs = append([]pgtype.TryWrapEncodePlanFunc{tryWrapAmountEncodePlan},
+		typeMap.TryWrapEncodePlanFuncs...)
+	typeMap.TryWrapScanPlanFuncs = append([]pgtype.TryWrapScanPlanFunc{tryWrapAmountScanPlan},
+		typeMap.TryWrapScanPlanFuncs...)
+}
+
+// numericAmount — сумма баллов со стороны колонки numeric
+type numericAmount struct {
+	amount *money.Amount
+}
+
+// ScanNumeric читает значение колонки numeric
+func (n numericAmount) ScanNumeric(v pgtype.Numeric) error {
+	if !v.Valid {
+		// SUM по пустому набору строк
+		*n.amount = 0
+		return nil
+	}
+	if v.NaN || v.InfinityModifier != pgtype.Finite {
+		return money.ErrInvalidAmount
+	}
+
+	amount, err := money.Parse(v.Int.String() + "e" + strconv.Itoa(int(v.Exp)))
+	if err != nil {
+		return err
+	}
+	*n.amount = amount
+	return nil
+}
+
+// NumericValue передаёт сумму в колонку numeric
+func (n numericAmount) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{
+		Int:   big.NewInt(int64(*n.amount)),
+		Exp:   -money.FractionDigits,
+		Valid: true,
+	}, nil
+}
+
+type amountEncodePlan struct {
+	next pgtype.EncodePlan
+}
+
+func (plan *amountEncodePlan) SetNext(next pgtype.EncodePlan) {
+	plan.next = next
+}
+
+func (plan *amountEncodePlan) Encode(value any, buf []byte) ([]byte, error) {
+	amount := value.(money.Amount)
+	return plan.next.Encode(numericAmount{amount: &amount}, buf)
+}
+
+func tryWrapAmountEncodePlan(value any) (pgtype.WrappedEncodePlanNextSetter, any, bool) {
+	if amount, ok := value.(money.Amount); ok {
+		return &amountEncodePlan{}, numericAmount{amount: &amount}, true
+	}
+	return nil, nil, false
+}
+
+type amountScanPlan struct {
+	next pgtype.ScanPlan
+}
+
+func (plan *amountScanPlan) SetNext(next pgtype.ScanPlan) {
+	plan.next = next
+}
+
+func (plan *amountScanPlan) Scan(src []byte, target any) error {
+	return plan.next.Scan(src, numericAmount{amount: target.(*money.Amount)})
+}
+
+func tryWrapAmountScanPlan(target any) (pgtype.WrappedScanPlanNextSetter, any, bool) {
+	if amount, ok := target.(*money.Amount); ok {
+		return &amountScanPlan{}, numericAmount{amount: amount}, true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/kvvPro/gophermart/internal/money"
+)
+
+func TestScanNumeric(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   pgtype.Numeric
+		want    money.Amount
+		wantErr bool
+	}{
+		{name: "scale_2", value: pgtype.Numeric{Int: big.NewInt(72998), Exp: -2, Valid: true}, want: 72998},
+		{name: "positive_exp", value: pgtype.Numeric{Int: big.NewInt(5), Exp: 2, Valid: true}, want: 50000},
+		{name: "scale_4", value: pgtype.Numeric{Int: big.NewInt(12300), Exp: -4, Valid: true}, want: 123},
+		{name: "negative", value: pgtype.Numeric{Int: big.NewInt(-1505), Exp: -2, Valid: true}, want: -1505},
+		{name: "null", value: pgtype.Numeric{}, want: 0},
+		{name: "too_precise", value: pgtype.Numeric{Int: big.NewInt(1), Exp: -3, Valid: true}, wantErr: true},
+		{name: "nan", value: pgtype.Numeric{NaN: true, Valid: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got money.Amount
+			err := numericAmount{amount: &got}.ScanNumeric(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ScanNumeric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ScanNumeric() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRegisterAmount проверяет, что сумма проходит через колонку numeric
+// без изменений в обоих форматах протокола
+func TestRegisterAmount(t *testing.T) {
+	typeMap := pgtype.NewMap()
+	registerAmount(typeMap)
+
+	tests := []struct {
+		name   string
+		format int16
+		value  money.Amount
+		text   string
+	}{
+		{name: "binary", format: pgtype.BinaryFormatCode, value: 72998},
+		{name: "text", format: pgtype.TextFormatCode, value: -1505, text: "-15.05"},
+		{name: "text_zero", format: pgtype.TextFormatCode, value: 0, text: "0.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := typeMap.Encode(pgtype.NumericOID, tt.format, tt.value, nil)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if tt.text != "" && string(buf) != tt.text {
+				t.Errorf("Encode() = %v, want %v", string(buf), tt.text)
+			}
+
+			var got money.Amount
+			if err := typeMap.Scan(pgtype.NumericOID, tt.format, buf, &got); err != nil {
+				t.Fatalf("Scan() error = %v", err)
+			}
+			if got != tt.value {
+				t.Errorf("Scan() = %v, want %v", got, tt.value)
+			}
+		})
+	}
+
+	// SUM по пустому набору строк возвращает NULL
+	got := money.Amount(1)
+	if err := typeMap.Scan(pgtype.NumericOID, pgtype.BinaryFormatCode, nil, &got); err != nil || got != 0 {
+		t.Errorf("Scan(NULL) = %v, %v, want 0", got, err)
+	}
+}
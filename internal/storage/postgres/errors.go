@@ -0,0 +1,48 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+// loginConstraints - ограничения, нарушение которых означает занятый логин
+var loginConstraints = map[string]bool{
+	"users_pkey":            true,
+	"users_login_lower_idx": true,
+}
+
+// storageError приводит ошибку Postgres к ошибке пакета storage.
+// Исходная ошибка остаётся в цепочке и видна в журнале
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		// запрос не дошёл до сервера, его можно отправить ещё раз
+		if pgconn.SafeToRetry(err) {
+			return fmt.Errorf("%w: %w", storage.ErrTransient, err)
+		}
+		return err
+	}
+
+	switch {
+	case pgerrcode.IsConnectionException(pgErr.Code),
+		pgErr.Code == pgerrcode.SerializationFailure,
+		pgErr.Code == pgerrcode.DeadlockDetected:
+		return fmt.Errorf("%w: %w", storage.ErrTransient, err)
+	case pgErr.Code == pgerrcode.UniqueViolation && loginConstraints[pgErr.ConstraintName]:
+		return fmt.Errorf("%w: %w", storage.ErrDuplicateLogin, err)
+	case pgErr.Code == pgerrcode.UniqueViolation:
+		return fmt.Errorf("%w: %w", storage.ErrConflict, err)
+	case pgErr.Code == pgerrcode.ForeignKeyViolation:
+		return fmt.Errorf("%w: %w", storage.ErrNotFound, err)
+	}
+
+	return err
+}
@@ -0,0 +1,214 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kvvPro/gophermart/internal/storage/migration"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey — ключ рекомендательной блокировки, под которой
+// миграции применяются только одним экземпляром сервиса
+const migrationLockKey int64 = 7_426_015_001
+
+// Migrations возвращает шаги миграции в порядке версий
+func Migrations() ([]migration.Migration, error) {
+	return migration.Load(migrationFiles, "migrations")
+}
+
+// MigrateUp применяет все непримененные шаги и возвращает применённые
+func (s *PostgresStorage) MigrateUp(ctx context.Context) ([]migration.Migration, error) {
+	return migrateUp(ctx, s.pool)
+}
+
+// MigrateDown откатывает последние steps применённых шагов и возвращает откаченные
+func (s *PostgresStorage) MigrateDown(ctx context.Context, steps int) ([]migration.Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var rolledBack []migration.Migration
+	err = withMigrationLock(ctx, s.pool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+			step := migrations[i]
+			if _, ok := applied[step.Version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, step.Down, getDeleteMigrationQuery(), step.Version); err != nil {
+				return fmt.Errorf("migration %v_%v down: %w", step.Version, step.Name, err)
+			}
+			rolledBack = append(rolledBack, step)
+		}
+		return nil
+	})
+
+	return rolledBack, err
+}
+
+// MigrationStatus возвращает все известные шаги и время их применения
+func (s *PostgresStorage) MigrationStatus(ctx context.Context) ([]migration.Status, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []migration.Status
+	err = withMigrationLock(ctx, s.pool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		statuses = migration.Statuses(migrations, applied)
+		return nil
+	})
+
+	return statuses, err
+}
+
+func migrateUp(ctx context.Context, pool *pgxpool.Pool) ([]migration.Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration.Migration
+	err = withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, step := range migrations {
+			if _, ok := applied[step.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, step.Up, getAddMigrationQuery(), step.Version, step.Name); err != nil {
+				return fmt.Errorf("migration %v_%v up: %w", step.Version, step.Name, err)
+			}
+			done = append(done, step)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+// withMigrationLock выполняет f на отдельном соединении под рекомендательной
+// блокировкой: экземпляры сервиса, запущенные одновременно, применяют
+// миграции по очереди и не повторяют уже применённые шаги
+func withMigrationLock(ctx context.Context, pool *pgxpool.Pool, f func(conn *pgxpool.Conn) error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		// блокировка снимается и при закрытии соединения,
+		// поэтому ошибку снятия можно не проверять
+		conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+	}()
+
+	if _, err := conn.Exec(ctx, getInitMigrationsQuery()); err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+// runMigration выполняет шаг и изменяет журнал миграций в одной транзакции
+func runMigration(ctx context.Context, conn *pgxpool.Conn, script string, journalQuery string, journalArgs ...interface{}) error {
+	transaction, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback(ctx)
+
+	// построение индексов на больших таблицах идёт дольше statement_timeout
+	if _, err := transaction.Exec(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		return err
+	}
+
+	// без параметров скрипт выполняется по простому протоколу
+	// и может содержать несколько команд
+	if _, err := transaction.Exec(ctx, script, pgx.QueryExecModeSimpleProtocol); err != nil {
+		return err
+	}
+	if _, err := transaction.Exec(ctx, journalQuery, journalArgs...); err != nil {
+		return err
+	}
+
+	return transaction.Commit(ctx)
+}
+
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int64]time.Time, error) {
+	result, err := conn.Query(ctx, getAppliedMigrationsQuery())
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	applied := make(map[int64]time.Time)
+	for result.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := result.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, result.Err()
+}
+
+func getInitMigrationsQuery() string {
+	return `
+	CREATE TABLE IF NOT EXISTS public.schema_migrations
+	(
+		version bigint NOT NULL,
+		name character varying NOT NULL,
+		applied_at timestamp with time zone NOT NULL DEFAULT now(),
+		CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+	);
+	`
+}
+
+func getAppliedMigrationsQuery() string {
+	return `
+	SELECT version, applied_at
+		FROM public.schema_migrations
+	ORDER BY version
+	`
+}
+
+func getAddMigrationQuery() string {
+	return `
+	INSERT INTO public.schema_migrations(version, name)
+		VALUES ($1, $2);
+	`
+}
+
+func getDeleteMigrationQuery() string {
+	return `
+	DELETE FROM public.schema_migrations
+	WHERE
+		version = $1
+	`
+}
@@ -0,0 +1,26 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Migrations() returned no migrations")
+	}
+
+	for i, el := range migrations {
+		if i > 0 && el.Version <= migrations[i-1].Version {
+			t.Errorf("migration %v goes after %v", el.Version, migrations[i-1].Version)
+		}
+		// владельца таблиц может менять только суперпользователь
+		if strings.Contains(el.Up, "OWNER to") {
+			t.Errorf("migration %v_%v changes table owner", el.Version, el.Name)
+		}
+	}
+}
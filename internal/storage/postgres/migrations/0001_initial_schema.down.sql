@@ -0,0 +1,14 @@
+-- Удаляет всю схему вместе с данными
+DROP TABLE IF EXISTS public.audit_log;
+DROP TABLE IF EXISTS public.login_attempts;
+DROP TABLE IF EXISTS public.oidc_states;
+DROP TABLE IF EXISTS public.user_identities;
+DROP TABLE IF EXISTS public.api_keys;
+DROP TABLE IF EXISTS public.two_factor_recovery_codes;
+DROP TABLE IF EXISTS public.two_factor;
+DROP TABLE IF EXISTS public.refresh_tokens;
+DROP TABLE IF EXISTS public.sessions;
+DROP TABLE IF EXISTS public.adjustments;
+DROP TABLE IF EXISTS public.withdrawals;
+DROP TABLE IF EXISTS public.orders;
+DROP TABLE IF EXISTS public.users;
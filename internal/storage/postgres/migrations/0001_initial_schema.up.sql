@@ -0,0 +1,241 @@
+-- Исходная схема. Все объекты создаются с IF NOT EXISTS, чтобы миграция
+-- применялась и к базам, созданным до появления миграций
+
+-- Table: public.users
+
+CREATE TABLE IF NOT EXISTS public.users
+(
+	login character varying(50) NOT NULL,
+	password character varying,
+	CONSTRAINT users_pkey PRIMARY KEY (login)
+);
+
+ALTER TABLE IF EXISTS public.users
+	ADD COLUMN IF NOT EXISTS role character varying NOT NULL DEFAULT 'user';
+
+ALTER TABLE IF EXISTS public.users
+	ADD COLUMN IF NOT EXISTS blocked boolean NOT NULL DEFAULT false;
+
+-- логины уникальны без учёта регистра
+
+-- В базах, созданных до миграций, логин сравнивался с учётом регистра,
+-- и там могут быть пользователи, различающиеся только регистром логина.
+-- Они не объединяются автоматически: у каждого свои заказы, баллы и сеансы,
+-- и какой логин переименовать, решает поддержка вместе с владельцами.
+-- Поэтому миграция останавливается и перечисляет такие логины. Логин
+-- переименовывается в одной транзакции во всех таблицах, где он хранится
+-- (users, orders.owner, withdrawals.user_id, adjustments.user_id и других
+-- таблицах с user_id); после этого миграцию можно запустить повторно
+DO $$
+DECLARE
+	collisions text;
+BEGIN
+	SELECT string_agg(repeated.logins, '; ' ORDER BY repeated.logins)
+		INTO collisions
+		FROM (
+			SELECT string_agg(users.login, ', ' ORDER BY users.login) AS logins
+				FROM public.users as users
+			GROUP BY
+				lower(users.login)
+			HAVING
+				COUNT(*) > 1
+		) AS repeated;
+
+	IF collisions IS NOT NULL THEN
+		RAISE EXCEPTION 'logins are not unique ignoring case, colliding logins: %', collisions
+			USING HINT = 'rename all but one login of each group in users and in every table that stores the login, then rerun the migration';
+	END IF;
+END
+$$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_login_lower_idx
+	ON public.users (lower(login));
+
+-- Table: public.orders
+
+CREATE TABLE IF NOT EXISTS public.orders
+(
+	id character varying NOT NULL,
+	owner character varying NOT NULL,
+	upload_date timestamp with time zone NOT NULL,
+	status character varying NOT NULL,
+	bonus double precision NOT NULL,
+	CONSTRAINT orders_pkey PRIMARY KEY (id)
+);
+
+-- заказы хранятся после удаления пользователя для учёта,
+-- поэтому каскадное удаление вместе с пользователем недопустимо
+ALTER TABLE IF EXISTS public.orders
+	DROP CONSTRAINT IF EXISTS fk_users;
+
+-- Table: public.withdrawals
+
+CREATE TABLE IF NOT EXISTS public.withdrawals
+(
+	order_id character varying NOT NULL,
+	sum double precision NOT NULL,
+	processed_date timestamp with time zone NOT NULL,
+	user_id character varying NOT NULL
+	-- CONSTRAINT fk_orders FOREIGN KEY (order_id)
+	--	REFERENCES public.orders (id) MATCH SIMPLE
+	--	ON UPDATE NO ACTION
+	--	ON DELETE CASCADE,
+);
+
+ALTER TABLE IF EXISTS public.withdrawals
+	DROP CONSTRAINT IF EXISTS fk_users;
+
+-- Table: public.adjustments
+
+-- ручные корректировки баланса, как и заказы, хранятся после удаления пользователя
+CREATE TABLE IF NOT EXISTS public.adjustments
+(
+	id bigserial NOT NULL,
+	user_id character varying NOT NULL,
+	amount double precision NOT NULL,
+	reason character varying NOT NULL,
+	operator character varying NOT NULL,
+	processed_date timestamp with time zone NOT NULL,
+	CONSTRAINT adjustments_pkey PRIMARY KEY (id)
+);
+
+-- Table: public.sessions
+
+CREATE TABLE IF NOT EXISTS public.sessions
+(
+	id character varying NOT NULL,
+	user_id character varying NOT NULL,
+	created_at timestamp with time zone NOT NULL,
+	expires_at timestamp with time zone NOT NULL,
+	revoked_at timestamp with time zone,
+	CONSTRAINT sessions_pkey PRIMARY KEY (id),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES public.users (login) MATCH SIMPLE
+		ON UPDATE NO ACTION
+		ON DELETE CASCADE
+);
+
+ALTER TABLE IF EXISTS public.sessions
+	ADD COLUMN IF NOT EXISTS user_agent character varying NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS ip character varying NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS last_seen_at timestamp with time zone NOT NULL DEFAULT now();
+
+-- Table: public.refresh_tokens
+
+CREATE TABLE IF NOT EXISTS public.refresh_tokens
+(
+	token_hash character varying NOT NULL,
+	session_id character varying NOT NULL,
+	created_at timestamp with time zone NOT NULL,
+	expires_at timestamp with time zone NOT NULL,
+	used_at timestamp with time zone,
+	CONSTRAINT refresh_tokens_pkey PRIMARY KEY (token_hash),
+	CONSTRAINT fk_sessions FOREIGN KEY (session_id)
+		REFERENCES public.sessions (id) MATCH SIMPLE
+		ON UPDATE NO ACTION
+		ON DELETE CASCADE
+);
+
+-- Table: public.two_factor
+
+CREATE TABLE IF NOT EXISTS public.two_factor
+(
+	user_id character varying NOT NULL,
+	secret character varying NOT NULL,
+	enabled boolean NOT NULL,
+	last_counter bigint NOT NULL,
+	created_at timestamp with time zone NOT NULL,
+	CONSTRAINT two_factor_pkey PRIMARY KEY (user_id),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES public.users (login) MATCH SIMPLE
+		ON UPDATE NO ACTION
+		ON DELETE CASCADE
+);
+
+-- Table: public.two_factor_recovery_codes
+
+CREATE TABLE IF NOT EXISTS public.two_factor_recovery_codes
+(
+	user_id character varying NOT NULL,
+	code_hash character varying NOT NULL,
+	used_at timestamp with time zone,
+	CONSTRAINT two_factor_recovery_codes_pkey PRIMARY KEY (user_id, code_hash),
+	CONSTRAINT fk_two_factor FOREIGN KEY (user_id)
+		REFERENCES public.two_factor (user_id) MATCH SIMPLE
+		ON UPDATE NO ACTION
+		ON DELETE CASCADE
+);
+
+-- Table: public.api_keys
+
+CREATE TABLE IF NOT EXISTS public.api_keys
+(
+	id character varying NOT NULL,
+	user_id character varying NOT NULL,
+	name character varying NOT NULL,
+	prefix character varying NOT NULL,
+	key_hash character varying NOT NULL,
+	scopes character varying[] NOT NULL,
+	created_at timestamp with time zone NOT NULL,
+	last_used_at timestamp with time zone,
+	revoked_at timestamp with time zone,
+	CONSTRAINT api_keys_pkey PRIMARY KEY (id),
+	CONSTRAINT api_keys_key_hash_key UNIQUE (key_hash),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES public.users (login) MATCH SIMPLE
+		ON UPDATE NO ACTION
+		ON DELETE CASCADE
+);
+
+-- Table: public.user_identities
+
+CREATE TABLE IF NOT EXISTS public.user_identities
+(
+	issuer character varying NOT NULL,
+	subject character varying NOT NULL,
+	user_id character varying NOT NULL,
+	email character varying NOT NULL,
+	created_at timestamp with time zone NOT NULL,
+	CONSTRAINT user_identities_pkey PRIMARY KEY (issuer, subject),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES public.users (login) MATCH SIMPLE
+		ON UPDATE NO ACTION
+		ON DELETE CASCADE
+);
+
+-- Table: public.oidc_states
+
+CREATE TABLE IF NOT EXISTS public.oidc_states
+(
+	state character varying NOT NULL,
+	nonce character varying NOT NULL,
+	code_verifier character varying NOT NULL,
+	created_at timestamp with time zone NOT NULL,
+	expires_at timestamp with time zone NOT NULL,
+	CONSTRAINT oidc_states_pkey PRIMARY KEY (state)
+);
+
+-- Table: public.login_attempts
+
+CREATE TABLE IF NOT EXISTS public.login_attempts
+(
+	key character varying NOT NULL,
+	failures integer NOT NULL,
+	first_failure timestamp with time zone NOT NULL,
+	last_failure timestamp with time zone NOT NULL,
+	locked_until timestamp with time zone,
+	CONSTRAINT login_attempts_pkey PRIMARY KEY (key)
+);
+
+-- Table: public.audit_log
+
+CREATE TABLE IF NOT EXISTS public.audit_log
+(
+	id bigserial NOT NULL,
+	created_at timestamp with time zone NOT NULL,
+	actor character varying NOT NULL,
+	action character varying NOT NULL,
+	target character varying NOT NULL,
+	reason character varying NOT NULL,
+	CONSTRAINT audit_log_pkey PRIMARY KEY (id)
+);
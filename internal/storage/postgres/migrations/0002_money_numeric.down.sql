@@ -0,0 +1,8 @@
+ALTER TABLE public.orders
+	ALTER COLUMN bonus TYPE double precision;
+
+ALTER TABLE public.withdrawals
+	ALTER COLUMN sum TYPE double precision;
+
+ALTER TABLE public.adjustments
+	ALTER COLUMN amount TYPE double precision;
@@ -0,0 +1,9 @@
+-- суммы баллов хранятся точно, с двумя знаками после запятой
+ALTER TABLE public.orders
+	ALTER COLUMN bonus TYPE numeric(20, 2) USING round(bonus::numeric, 2);
+
+ALTER TABLE public.withdrawals
+	ALTER COLUMN sum TYPE numeric(20, 2) USING round(sum::numeric, 2);
+
+ALTER TABLE public.adjustments
+	ALTER COLUMN amount TYPE numeric(20, 2) USING round(amount::numeric, 2);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS public.withdrawals_order_id_idx;
@@ -0,0 +1,32 @@
+-- по одному заказу возможно только одно списание, в том числе
+-- при одновременных запросах разных пользователей
+
+-- Повторные списания, накопившиеся до этой миграции, не удаляются
+-- автоматически: каждое из них уже уменьшило баланс пользователя, и какое
+-- оставить, а какое вернуть корректировкой, решает поддержка. Поэтому
+-- миграция останавливается и перечисляет номера таких заказов; после разбора
+-- её можно запустить повторно
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(repeated.order_id, ', ' ORDER BY repeated.order_id)
+		INTO duplicates
+		FROM (
+			SELECT withdrawals.order_id
+				FROM public.withdrawals as withdrawals
+			GROUP BY
+				withdrawals.order_id
+			HAVING
+				COUNT(*) > 1
+		) AS repeated;
+
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'withdrawals are not unique by order, duplicated orders: %', duplicates
+			USING HINT = 'keep one withdrawal per order, return the points of the others with an adjustment and rerun the migration';
+	END IF;
+END
+$$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_order_id_idx
+	ON public.withdrawals (order_id);
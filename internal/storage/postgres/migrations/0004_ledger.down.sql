@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS public.ledger_entries;
+
+DROP FUNCTION IF EXISTS public.ledger_entries_append_only();
+
+DROP SEQUENCE IF EXISTS public.ledger_transaction_seq;
@@ -0,0 +1,111 @@
+-- Table: public.ledger_entries
+
+-- журнал баллов: каждая операция — две записи с общим transaction_id,
+-- на счёте пользователя (логин) и на встречном системном счёте "system:<вид>".
+-- Сумма записей операции равна нулю. balance — баланс счёта пользователя
+-- после записи, для системных счетов не ведётся
+CREATE SEQUENCE IF NOT EXISTS public.ledger_transaction_seq;
+
+CREATE TABLE IF NOT EXISTS public.ledger_entries
+(
+	id bigserial NOT NULL,
+	transaction_id bigint NOT NULL,
+	account character varying NOT NULL,
+	kind character varying NOT NULL,
+	amount numeric(20, 2) NOT NULL,
+	balance numeric(20, 2),
+	reference character varying,
+	created_at timestamp with time zone NOT NULL,
+	CONSTRAINT ledger_entries_pkey PRIMARY KEY (id),
+	CONSTRAINT ledger_entries_kind_check
+		CHECK (kind IN ('accrual', 'withdrawal', 'adjustment', 'expiration', 'refund'))
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx
+	ON public.ledger_entries (account, id);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_transaction_idx
+	ON public.ledger_entries (transaction_id);
+
+-- записи журнала не изменяются и не удаляются; при удалении пользователя
+-- меняется только название его счёта
+CREATE OR REPLACE FUNCTION public.ledger_entries_append_only() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		RAISE EXCEPTION 'ledger entries cannot be deleted';
+	END IF;
+	IF NEW.id <> OLD.id
+		OR NEW.transaction_id <> OLD.transaction_id
+		OR NEW.kind <> OLD.kind
+		OR NEW.amount <> OLD.amount
+		OR NEW.balance IS DISTINCT FROM OLD.balance
+		OR NEW.reference IS DISTINCT FROM OLD.reference
+		OR NEW.created_at <> OLD.created_at THEN
+		RAISE EXCEPTION 'ledger entries are append-only';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS ledger_entries_append_only ON public.ledger_entries;
+CREATE TRIGGER ledger_entries_append_only
+	BEFORE UPDATE OR DELETE ON public.ledger_entries
+	FOR EACH ROW EXECUTE FUNCTION public.ledger_entries_append_only();
+
+-- перенос истории: начисления по заказам, списания и корректировки
+-- в порядке их дат
+WITH movements AS (
+	SELECT orders.owner AS account,
+		'accrual' AS kind,
+		orders.bonus AS amount,
+		orders.id AS reference,
+		orders.upload_date AS created_at
+	FROM public.orders AS orders
+	WHERE
+		orders.bonus <> 0
+	UNION ALL
+	SELECT withdrawals.user_id,
+		'withdrawal',
+		-withdrawals.sum,
+		withdrawals.order_id,
+		withdrawals.processed_date
+	FROM public.withdrawals AS withdrawals
+	UNION ALL
+	SELECT adjustments.user_id,
+		'adjustment',
+		adjustments.amount,
+		adjustments.id::text,
+		adjustments.processed_date
+	FROM public.adjustments AS adjustments
+), numbered AS (
+	SELECT movements.*,
+		nextval('public.ledger_transaction_seq') AS transaction_id
+	FROM (SELECT * FROM movements ORDER BY created_at) AS movements
+)
+INSERT INTO public.ledger_entries(
+	transaction_id, account, kind, amount, balance, reference, created_at)
+SELECT entries.transaction_id, entries.account, entries.kind, entries.amount,
+	entries.balance, entries.reference, entries.created_at
+FROM (
+	SELECT numbered.transaction_id,
+		numbered.account,
+		numbered.kind,
+		numbered.amount,
+		SUM(numbered.amount) OVER (
+			PARTITION BY numbered.account
+			ORDER BY numbered.transaction_id) AS balance,
+		numbered.reference,
+		numbered.created_at,
+		0 AS leg
+	FROM numbered
+	UNION ALL
+	SELECT numbered.transaction_id,
+		'system:' || numbered.kind,
+		numbered.kind,
+		-numbered.amount,
+		NULL,
+		numbered.reference,
+		numbered.created_at,
+		1
+	FROM numbered) AS entries
+ORDER BY entries.transaction_id, entries.leg;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS public.orders_queue_idx;
+
+ALTER TABLE IF EXISTS public.orders
+	DROP COLUMN IF EXISTS lease_owner,
+	DROP COLUMN IF EXISTS lease_expires_at,
+	DROP COLUMN IF EXISTS attempts,
+	DROP COLUMN IF EXISTS next_attempt_at;
@@ -0,0 +1,11 @@
+-- очередь опроса системы начислений: экземпляр сервиса берёт заказы
+-- в аренду до lease_expires_at, другие экземпляры их пропускают.
+-- Заказ, аренда которого истекла, снова попадает в очередь
+ALTER TABLE IF EXISTS public.orders
+	ADD COLUMN IF NOT EXISTS lease_owner character varying,
+	ADD COLUMN IF NOT EXISTS lease_expires_at timestamp with time zone,
+	ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS next_attempt_at timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS orders_queue_idx
+	ON public.orders (status, next_attempt_at);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS public.account_balances;
+
+DROP INDEX IF EXISTS public.ledger_entries_reference_idx;
+DROP INDEX IF EXISTS public.adjustments_user_id_processed_date_idx;
+DROP INDEX IF EXISTS public.withdrawals_user_id_processed_date_idx;
+DROP INDEX IF EXISTS public.orders_owner_upload_date_idx;
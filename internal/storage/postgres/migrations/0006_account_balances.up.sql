@@ -0,0 +1,38 @@
+-- списки заказов, списаний и корректировок пользователя читаются
+-- по индексу сразу в порядке дат, без сортировки всей таблицы
+CREATE INDEX IF NOT EXISTS orders_owner_upload_date_idx
+	ON public.orders (owner, upload_date);
+
+CREATE INDEX IF NOT EXISTS withdrawals_user_id_processed_date_idx
+	ON public.withdrawals (user_id, processed_date);
+
+CREATE INDEX IF NOT EXISTS adjustments_user_id_processed_date_idx
+	ON public.adjustments (user_id, processed_date);
+
+-- сумма, уже проведённая по заказу, при каждом обновлении заказа
+CREATE INDEX IF NOT EXISTS ledger_entries_reference_idx
+	ON public.ledger_entries (account, kind, reference);
+
+-- Table: public.account_balances
+
+-- баланс счёта пользователя и сумма его списаний. Строка меняется в той же
+-- транзакции, что и записи журнала, поэтому баланс читается без обхода журнала
+CREATE TABLE IF NOT EXISTS public.account_balances
+(
+	account character varying NOT NULL,
+	balance numeric(20, 2) NOT NULL DEFAULT 0,
+	withdrawn numeric(20, 2) NOT NULL DEFAULT 0,
+	CONSTRAINT account_balances_pkey PRIMARY KEY (account)
+);
+
+INSERT INTO public.account_balances(account, balance, withdrawn)
+SELECT entries.account,
+	(array_agg(entries.balance ORDER BY entries.id DESC))[1],
+	COALESCE(-SUM(entries.amount)
+		FILTER (WHERE entries.kind IN ('withdrawal', 'refund')), 0)
+FROM public.ledger_entries AS entries
+WHERE
+	entries.account NOT LIKE 'system:%'
+GROUP BY
+	entries.account
+ON CONFLICT (account) DO NOTHING;
@@ -0,0 +1,7 @@
+-- прежняя версия сравнила бы '!' как пароль в открытом виде, поэтому
+-- вместо него записывается хеш, который не разбирается и не совпадает
+-- ни с одним паролем
+UPDATE public.users
+	SET password = '$argon2id$disabled'
+	WHERE
+		password = '!';
@@ -3,95 +3,1332 @@ package postgres
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/kvvPro/gophermart/internal/lockout"
 	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/storage"
 	"github.com/lib/pq"
 )
 
 type PostgresStorage struct {
-	ConnStr string
-	pool    *pgxpool.Pool
+	ConnStr      string
+	pool         *pgxpool.Pool
+	queryTimeout time.Duration
 }
 
-func NewPSQLStorage(ctx context.Context, connection string) (*PostgresStorage, error) {
-	// init
-	init := getInitQuery()
-	pool, err := pgxpool.New(ctx, connection)
+// Config — настройки пула соединений и ограничения времени запросов.
+// Нулевые значения оставляют умолчания pgxpool и не ограничивают время
+type Config struct {
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+	// StatementTimeout передаётся серверу как statement_timeout
+	// и прерывает любой долгий запрос
+	StatementTimeout time.Duration
+	// QueryTimeout ограничивает время одной операции хранилища
+	// вместе с ожиданием свободного соединения
+	QueryTimeout time.Duration
+}
+
+// NewPSQLStorage подключается к базе и применяет непримененные миграции
+func NewPSQLStorage(ctx context.Context, connection string, cfg Config) (*PostgresStorage, error) {
+	storage, err := Connect(ctx, connection, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = storage.MigrateUp(ctx)
+	if err != nil {
+		storage.pool.Close()
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// Connect подключается к базе без изменения схемы
+func Connect(ctx context.Context, connection string, cfg Config) (*PostgresStorage, error) {
+	poolConfig, err := pgxpool.ParseConfig(connection)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns > 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolConfig.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+	if cfg.StatementTimeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] =
+			strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		registerAmount(conn.TypeMap())
+		return nil
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostgresStorage{
+		ConnStr:      connection,
+		pool:         pool,
+		queryTimeout: cfg.QueryTimeout,
+	}, nil
+}
+
+// operationContext ограничивает время операции хранилища, чтобы медленная
+// база не держала горутины запросов бесконечно
+func (s *PostgresStorage) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
+func (s *PostgresStorage) Ping(ctx context.Context) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	err := s.pool.Ping(ctx)
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) Quit(ctx context.Context) {
+	s.pool.Close()
+}
+
+func (s *PostgresStorage) AddUser(ctx context.Context, user *model.User) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	addUserQuery := addUserQuery()
+	insertRes, err := s.pool.Exec(ctx, addUserQuery, user.Login, user.Password)
+	if err != nil {
+		return storageError(err)
+	}
+	if insertRes.RowsAffected() == 0 {
+		return errors.New("can't add user")
+	}
+
+	return nil
+}
+
+func addUserQuery() string {
+	return `
+	INSERT INTO public.users(login, password)
+		VALUES ($1, $2);
+	`
+}
+
+// AddUserWithIdentity создаёт пользователя, вошедшего через внешнего
+// провайдера, и привязывает к нему учётную запись провайдера
+func (s *PostgresStorage) AddUserWithIdentity(ctx context.Context, user *model.User, identity *model.Identity) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	transaction, err := s.pool.Begin(ctx)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback(ctx)
+
+	_, err = transaction.Exec(ctx, addUserQuery(), user.Login, user.Password)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getAddIdentityQuery(), identity.Issuer,
+		identity.Subject, user.Login, identity.Email, identity.CreatedAt)
+	if err != nil {
+		return storageError(err)
+	}
+
+	return storageError(transaction.Commit(ctx))
+}
+
+func getAddIdentityQuery() string {
+	return `
+	INSERT INTO public.user_identities(
+		issuer, subject, user_id, email, created_at)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+}
+
+// GetUserByIdentity возвращает пользователя, к которому привязана
+// учётная запись внешнего провайдера, или nil
+func (s *PostgresStorage) GetUserByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var userInfo model.User
+	query := getUserByIdentityQuery()
+	result := s.pool.QueryRow(ctx, query, issuer, subject)
+	switch err := result.Scan(&userInfo.Login, &userInfo.Password, &userInfo.Role, &userInfo.Blocked); err {
+	case pgx.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &userInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getUserByIdentityQuery() string {
+	return `
+	SELECT users.login, users.password, users.role, users.blocked
+		FROM public.user_identities AS identities
+		INNER JOIN public.users AS users
+	ON identities.user_id = users.login
+	WHERE
+		identities.issuer = $1
+		AND identities.subject = $2
+	`
+}
+
+// AddOIDCState сохраняет параметры начатого входа через внешнего провайдера
+// и заодно удаляет просроченные
+func (s *PostgresStorage) AddOIDCState(ctx context.Context, state *model.OIDCState) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, getDeleteExpiredOIDCStatesQuery(), state.CreatedAt)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = s.pool.Exec(ctx, getAddOIDCStateQuery(), state.State, state.Nonce,
+		state.CodeVerifier, state.CreatedAt, state.ExpiresAt)
+	return storageError(err)
+}
+
+// TakeOIDCState возвращает и удаляет параметры входа, повторно
+// они не выдаются. Возвращает nil, если state не найден
+func (s *PostgresStorage) TakeOIDCState(ctx context.Context, state string) (*model.OIDCState, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var stateInfo model.OIDCState
+	result := s.pool.QueryRow(ctx, getTakeOIDCStateQuery(), state)
+	switch err := result.Scan(&stateInfo.State, &stateInfo.Nonce, &stateInfo.CodeVerifier,
+		&stateInfo.CreatedAt, &stateInfo.ExpiresAt); err {
+	case pgx.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &stateInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getAddOIDCStateQuery() string {
+	return `
+	INSERT INTO public.oidc_states(
+		state, nonce, code_verifier, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+}
+
+func getDeleteExpiredOIDCStatesQuery() string {
+	return `
+	DELETE FROM public.oidc_states
+	WHERE
+		expires_at < $1
+	`
+}
+
+func getTakeOIDCStateQuery() string {
+	return `
+	DELETE FROM public.oidc_states
+	WHERE
+		state = $1
+	RETURNING state, nonce, code_verifier, created_at, expires_at
+	`
+}
+
+func (s *PostgresStorage) GetUser(ctx context.Context, user *model.User) (*model.User, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var userInfo model.User
+	getUserQuery := getUserQuery()
+	result := s.pool.QueryRow(ctx, getUserQuery, user.Login)
+	switch err := result.Scan(&userInfo.Login, &userInfo.Password, &userInfo.Role, &userInfo.Blocked); err {
+	case pgx.ErrNoRows:
+		// пользователь не найден
+		return nil, nil
+	case nil:
+		return &userInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getUserQuery() string {
+	return `
+	SELECT login, password, role, blocked
+		FROM public.users
+	WHERE
+		lower(login) = lower($1)
+	`
+}
+
+// SearchUsers ищет пользователей по части логина без учёта регистра
+func (s *PostgresStorage) SearchUsers(ctx context.Context, loginPattern string, limit int) ([]*model.User, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	users := []*model.User{}
+
+	// символы шаблона LIKE в строке поиска ищутся как обычные символы
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(loginPattern)
+
+	query := getSearchUsersQuery()
+	result, err := s.pool.Query(ctx, query, "%"+escaped+"%", limit)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var userInfo model.User
+		err = result.Scan(&userInfo.Login,
+			&userInfo.Role,
+			&userInfo.Blocked)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		users = append(users, &userInfo)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return users, nil
+}
+
+func getSearchUsersQuery() string {
+	return `
+	SELECT login, role, blocked
+		FROM public.users
+	WHERE
+		lower(login) LIKE lower($1)
+	ORDER BY
+		login ASC
+	LIMIT $2
+	`
+}
+
+func (s *PostgresStorage) SetUserRole(ctx context.Context, login string, role string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateQuery := getSetUserRoleQuery()
+	updateRes, err := s.pool.Exec(ctx, updateQuery, role, login)
+	if err != nil {
+		return storageError(err)
+	}
+	if updateRes.RowsAffected() == 0 {
+		return fmt.Errorf("role not updated: user %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getSetUserRoleQuery() string {
+	return `
+	UPDATE public.users
+		SET role=$1
+		WHERE lower(login)=lower($2);
+	`
+}
+
+func (s *PostgresStorage) SetUserBlocked(ctx context.Context, login string, blocked bool) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateQuery := getSetUserBlockedQuery()
+	updateRes, err := s.pool.Exec(ctx, updateQuery, blocked, login)
+	if err != nil {
+		return storageError(err)
+	}
+	if updateRes.RowsAffected() == 0 {
+		return fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getSetUserBlockedQuery() string {
+	return `
+	UPDATE public.users
+		SET blocked=$1
+		WHERE lower(login)=lower($2);
+	`
+}
+
+func (s *PostgresStorage) UpdatePassword(ctx context.Context, login string, passwordHash string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateQuery := getUpdatePasswordQuery()
+	updateRes, err := s.pool.Exec(ctx, updateQuery, passwordHash, login)
+	if err != nil {
+		return storageError(err)
+	}
+	if updateRes.RowsAffected() == 0 {
+		return fmt.Errorf("password not updated: user %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getUpdatePasswordQuery() string {
+	return `
+	UPDATE public.users
+		SET password=$1
+		WHERE login=$2;
+	`
+}
+
+// DeleteUser удаляет пользователя, его сеансы и токены. Заказы, списания
+// и журнал баллов остаются для учёта, но вместо логина в них записывается anonymousID
+func (s *PostgresStorage) DeleteUser(ctx context.Context, login string, anonymousID string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	transaction, err := s.pool.Begin(ctx)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback(ctx)
+
+	// одновременное списание или начисление должно закончиться
+	// до обезличивания журнала
+	_, err = transaction.Exec(ctx, getLockUserQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getAnonymizeOrdersQuery(), login, anonymousID)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getAnonymizeWithdrawalsQuery(), login, anonymousID)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getAnonymizeAdjustmentsQuery(), login, anonymousID)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getAnonymizeLedgerQuery(), login, anonymousID)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getAnonymizeAccountBalanceQuery(), login, anonymousID)
+	if err != nil {
+		return storageError(err)
+	}
+
+	deleteRes, err := transaction.Exec(ctx, getDeleteUserQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+	if deleteRes.RowsAffected() == 0 {
+		return fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	return storageError(transaction.Commit(ctx))
+}
+
+func getAnonymizeOrdersQuery() string {
+	return `
+	UPDATE public.orders
+		SET owner=$2
+		WHERE owner=$1;
+	`
+}
+
+func getAnonymizeWithdrawalsQuery() string {
+	return `
+	UPDATE public.withdrawals
+		SET user_id=$2
+		WHERE user_id=$1;
+	`
+}
+
+func getAnonymizeAdjustmentsQuery() string {
+	return `
+	UPDATE public.adjustments
+		SET user_id=$2
+		WHERE user_id=$1;
+	`
+}
+
+func getAnonymizeLedgerQuery() string {
+	return `
+	UPDATE public.ledger_entries
+		SET account=$2
+		WHERE account=$1;
+	`
+}
+
+func getAnonymizeAccountBalanceQuery() string {
+	return `
+	UPDATE public.account_balances
+		SET account=$2
+		WHERE account=$1;
+	`
+}
+
+func getDeleteUserQuery() string {
+	return `
+	DELETE FROM public.users
+		WHERE login=$1;
+	`
+}
+
+func (s *PostgresStorage) AddSession(ctx context.Context, session *model.Session, token *model.RefreshToken) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	transaction, err := s.pool.Begin(ctx)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback(ctx)
+
+	_, err = transaction.Exec(ctx, getAddSessionQuery(), session.ID,
+		session.User, session.CreatedAt, session.ExpiresAt, session.UserAgent, session.IP)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getAddRefreshTokenQuery(), token.Hash,
+		token.SessionID, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return storageError(err)
+	}
+
+	return storageError(transaction.Commit(ctx))
+}
+
+func getAddSessionQuery() string {
+	return `
+	INSERT INTO public.sessions(
+		id, user_id, created_at, expires_at, user_agent, ip, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $3);
+	`
+}
+
+func getAddRefreshTokenQuery() string {
+	return `
+	INSERT INTO public.refresh_tokens(
+		token_hash, session_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4);
+	`
+}
+
+func (s *PostgresStorage) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var session model.Session
+
+	query := getSessionQuery()
+	result := s.pool.QueryRow(ctx, query, sessionID)
+	switch err := result.Scan(&session.ID,
+		&session.User,
+		&session.UserAgent,
+		&session.IP,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+		&session.ExpiresAt,
+		&session.RevokedAt); err {
+	case pgx.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &session, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getSessionQuery() string {
+	return `
+	SELECT sessions.id,
+			sessions.user_id,
+			sessions.user_agent,
+			sessions.ip,
+			sessions.created_at,
+			sessions.last_seen_at,
+			sessions.expires_at,
+			sessions.revoked_at
+	FROM public.sessions AS sessions
+	WHERE
+		sessions.id = $1
+	`
+}
+
+// GetUserSessions возвращает действующие сеансы пользователя
+func (s *PostgresStorage) GetUserSessions(ctx context.Context, login string) ([]*model.Session, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	sessions := []*model.Session{}
+
+	query := getUserSessionsQuery()
+	result, err := s.pool.Query(ctx, query, login, time.Now())
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var session model.Session
+		err = result.Scan(&session.ID,
+			&session.User,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+			&session.RevokedAt)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		sessions = append(sessions, &session)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return sessions, nil
+}
+
+func getUserSessionsQuery() string {
+	return `
+	SELECT sessions.id,
+			sessions.user_id,
+			sessions.user_agent,
+			sessions.ip,
+			sessions.created_at,
+			sessions.last_seen_at,
+			sessions.expires_at,
+			sessions.revoked_at
+	FROM public.sessions AS sessions
+	WHERE
+		sessions.user_id = $1
+		AND sessions.revoked_at IS NULL
+		AND sessions.expires_at > $2
+	ORDER BY
+		sessions.last_seen_at DESC
+	`
+}
+
+func (s *PostgresStorage) TouchSession(ctx context.Context, sessionID string, lastSeen time.Time) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, getTouchSessionQuery(), sessionID, lastSeen)
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func getTouchSessionQuery() string {
+	return `
+	UPDATE public.sessions
+		SET last_seen_at=$2
+		WHERE id=$1 AND last_seen_at < $2;
+	`
+}
+
+func (s *PostgresStorage) RotateRefreshToken(ctx context.Context, tokenHash string, newToken *model.RefreshToken) (*model.Session, model.EndPointStatus, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var token model.RefreshToken
+	var session model.Session
+
+	transaction, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+	defer transaction.Rollback(ctx)
+
+	// блокируем токен, чтобы два одновременных обновления не получили новые токены
+	result := transaction.QueryRow(ctx, getRefreshTokenForUpdateQuery(), tokenHash)
+	switch err := result.Scan(&token.Hash,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&session.ID,
+		&session.User,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+		&session.RevokedAt); err {
+	case pgx.ErrNoRows:
+		return nil, model.RefreshTokenInvalid, nil
+	case nil:
+	default:
+		return nil, model.OtherError, storageError(err)
+	}
+
+	if session.RevokedAt != nil {
+		return nil, model.RefreshTokenInvalid, nil
+	}
+
+	now := newToken.CreatedAt
+	if token.UsedAt != nil {
+		// токен уже был использован - похоже на кражу токена,
+		// отзываем весь сеанс
+		_, err = transaction.Exec(ctx, getRevokeSessionQuery(), session.ID, now)
+		if err != nil {
+			return nil, model.OtherError, storageError(err)
+		}
+		if err = transaction.Commit(ctx); err != nil {
+			return nil, model.OtherError, storageError(err)
+		}
+		return &session, model.RefreshTokenReused, nil
+	}
+
+	if now.After(token.ExpiresAt) || now.After(session.ExpiresAt) {
+		return nil, model.RefreshTokenInvalid, nil
+	}
+
+	_, err = transaction.Exec(ctx, getUseRefreshTokenQuery(), token.Hash, now)
+	if err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+
+	newToken.SessionID = session.ID
+	_, err = transaction.Exec(ctx, getAddRefreshTokenQuery(), newToken.Hash,
+		newToken.SessionID, newToken.CreatedAt, newToken.ExpiresAt)
+	if err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+
+	if err = transaction.Commit(ctx); err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+
+	return &session, model.RefreshTokenRotated, nil
+}
+
+func getRefreshTokenForUpdateQuery() string {
+	return `
+	SELECT tokens.token_hash,
+			tokens.expires_at,
+			tokens.used_at,
+			sessions.id,
+			sessions.user_id,
+			sessions.created_at,
+			sessions.expires_at,
+			sessions.revoked_at
+	FROM public.refresh_tokens AS tokens
+		INNER JOIN public.sessions AS sessions
+	ON tokens.session_id = sessions.id
+	WHERE
+		tokens.token_hash = $1
+	FOR UPDATE
+	`
+}
+
+func getUseRefreshTokenQuery() string {
+	return `
+	UPDATE public.refresh_tokens
+		SET used_at=$2
+		WHERE token_hash=$1;
+	`
+}
+
+func (s *PostgresStorage) RevokeSession(ctx context.Context, sessionID string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, getRevokeSessionQuery(), sessionID, time.Now())
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) RevokeUserSessions(ctx context.Context, login string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, getRevokeUserSessionsQuery(), login, time.Now())
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+// RevokeUserSession отзывает один сеанс пользователя. Возвращает false,
+// если у пользователя нет действующего сеанса с таким идентификатором
+func (s *PostgresStorage) RevokeUserSession(ctx context.Context, login string, sessionID string) (bool, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateRes, err := s.pool.Exec(ctx, getRevokeUserSessionQuery(), sessionID, login, time.Now())
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	return updateRes.RowsAffected() > 0, nil
+}
+
+func getRevokeUserSessionQuery() string {
+	return `
+	UPDATE public.sessions
+		SET revoked_at=$3
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL;
+	`
+}
+
+func getRevokeUserSessionsQuery() string {
+	return `
+	UPDATE public.sessions
+		SET revoked_at=$2
+		WHERE user_id=$1 AND revoked_at IS NULL;
+	`
+}
+
+func getRevokeSessionQuery() string {
+	return `
+	UPDATE public.sessions
+		SET revoked_at=$2
+		WHERE id=$1 AND revoked_at IS NULL;
+	`
+}
+
+// SetTwoFactorSecret сохраняет новый секрет и коды восстановления.
+// Второй фактор остаётся выключенным до подтверждения
+func (s *PostgresStorage) SetTwoFactorSecret(ctx context.Context, login string, secret string, recoveryCodeHashes []string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	transaction, err := s.pool.Begin(ctx)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback(ctx)
+
+	_, err = transaction.Exec(ctx, getSetTwoFactorSecretQuery(), login, secret, time.Now())
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.Exec(ctx, getDeleteRecoveryCodesQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+
+	for _, el := range recoveryCodeHashes {
+		_, err = transaction.Exec(ctx, getAddRecoveryCodeQuery(), login, el)
+		if err != nil {
+			return storageError(err)
+		}
+	}
+
+	return storageError(transaction.Commit(ctx))
+}
+
+func getSetTwoFactorSecretQuery() string {
+	return `
+	INSERT INTO public.two_factor(
+		user_id, secret, enabled, last_counter, created_at)
+		VALUES ($1, $2, false, 0, $3)
+	ON CONFLICT (user_id) DO UPDATE
+		SET secret=EXCLUDED.secret, enabled=false, last_counter=0, created_at=EXCLUDED.created_at;
+	`
+}
+
+func getDeleteRecoveryCodesQuery() string {
+	return `
+	DELETE FROM public.two_factor_recovery_codes
+		WHERE user_id=$1;
+	`
+}
+
+func getAddRecoveryCodeQuery() string {
+	return `
+	INSERT INTO public.two_factor_recovery_codes(
+		user_id, code_hash)
+		VALUES ($1, $2);
+	`
+}
+
+func (s *PostgresStorage) GetTwoFactor(ctx context.Context, login string) (*model.TwoFactor, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var twoFactor model.TwoFactor
+
+	query := getTwoFactorQuery()
+	result := s.pool.QueryRow(ctx, query, login)
+	switch err := result.Scan(&twoFactor.Secret,
+		&twoFactor.Enabled,
+		&twoFactor.LastCounter); err {
+	case pgx.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &twoFactor, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getTwoFactorQuery() string {
+	return `
+	SELECT two_factor.secret,
+			two_factor.enabled,
+			two_factor.last_counter
+	FROM public.two_factor AS two_factor
+	WHERE
+		two_factor.user_id = $1
+	`
+}
+
+func (s *PostgresStorage) EnableTwoFactor(ctx context.Context, login string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateRes, err := s.pool.Exec(ctx, getEnableTwoFactorQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+	if updateRes.RowsAffected() == 0 {
+		return fmt.Errorf("two-factor authentication is not enrolled: secret %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getEnableTwoFactorQuery() string {
+	return `
+	UPDATE public.two_factor
+		SET enabled=true
+		WHERE user_id=$1;
+	`
+}
+
+func (s *PostgresStorage) DisableTwoFactor(ctx context.Context, login string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	// коды восстановления удаляются каскадно
+	_, err := s.pool.Exec(ctx, getDisableTwoFactorQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func getDisableTwoFactorQuery() string {
+	return `
+	DELETE FROM public.two_factor
+		WHERE user_id=$1;
+	`
+}
+
+// UseTwoFactorCounter запоминает период принятого кода. Возвращает false,
+// если код этого периода уже был использован
+func (s *PostgresStorage) UseTwoFactorCounter(ctx context.Context, login string, counter int64) (bool, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateRes, err := s.pool.Exec(ctx, getUseTwoFactorCounterQuery(), login, counter)
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	return updateRes.RowsAffected() > 0, nil
+}
+
+func getUseTwoFactorCounterQuery() string {
+	return `
+	UPDATE public.two_factor
+		SET last_counter=$2
+		WHERE user_id=$1 AND last_counter < $2;
+	`
+}
+
+// UseRecoveryCode погашает код восстановления. Возвращает false, если
+// код не найден или уже использован
+func (s *PostgresStorage) UseRecoveryCode(ctx context.Context, login string, codeHash string) (bool, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateRes, err := s.pool.Exec(ctx, getUseRecoveryCodeQuery(), login, codeHash, time.Now())
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	return updateRes.RowsAffected() > 0, nil
+}
+
+func getUseRecoveryCodeQuery() string {
+	return `
+	UPDATE public.two_factor_recovery_codes
+		SET used_at=$3
+		WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL;
+	`
+}
+
+func (s *PostgresStorage) AddAPIKey(ctx context.Context, key *model.APIKey) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	insert := getAddAPIKeyQuery()
+	insertRes, err := s.pool.Exec(ctx, insert, key.ID, key.User, key.Name,
+		key.Prefix, key.Hash, key.Scopes, key.CreatedAt)
+	if err != nil {
+		return storageError(err)
+	}
+	if insertRes.RowsAffected() == 0 {
+		return errors.New("api key not added")
+	}
+
+	return nil
+}
+
+func getAddAPIKeyQuery() string {
+	return `
+	INSERT INTO public.api_keys(
+		id, user_id, name, prefix, key_hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);
+	`
+}
+
+func (s *PostgresStorage) GetAPIKeys(ctx context.Context, login string) ([]*model.APIKey, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	keys := []*model.APIKey{}
+
+	query := getAPIKeysQuery()
+	result, err := s.pool.Query(ctx, query, login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		key, err := scanAPIKey(result)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		keys = append(keys, key)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return keys, nil
+}
+
+func (s *PostgresStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (*model.APIKey, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	query := getAPIKeyByHashQuery()
+	key, err := scanAPIKey(s.pool.QueryRow(ctx, query, keyHash))
+	switch err {
+	case pgx.ErrNoRows:
+		return nil, nil
+	case nil:
+		return key, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func scanAPIKey(row pgx.Row) (*model.APIKey, error) {
+	var key model.APIKey
+	err := row.Scan(&key.ID,
+		&key.User,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		&key.Scopes,
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&key.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func getAPIKeysQuery() string {
+	return `
+	SELECT keys.id,
+			keys.user_id,
+			keys.name,
+			keys.prefix,
+			keys.key_hash,
+			keys.scopes,
+			keys.created_at,
+			keys.last_used_at,
+			keys.revoked_at
+	FROM public.api_keys AS keys
+	WHERE
+		keys.user_id = $1
+	ORDER BY
+		keys.created_at ASC
+	`
+}
+
+func getAPIKeyByHashQuery() string {
+	return `
+	SELECT keys.id,
+			keys.user_id,
+			keys.name,
+			keys.prefix,
+			keys.key_hash,
+			keys.scopes,
+			keys.created_at,
+			keys.last_used_at,
+			keys.revoked_at
+	FROM public.api_keys AS keys
+	WHERE
+		keys.key_hash = $1
+	`
+}
+
+func (s *PostgresStorage) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, getTouchAPIKeyQuery(), id, usedAt)
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func getTouchAPIKeyQuery() string {
+	return `
+	UPDATE public.api_keys
+		SET last_used_at=$2
+		WHERE id=$1;
+	`
+}
+
+// RevokeAPIKey отзывает ключ пользователя. Возвращает false, если у
+// пользователя нет действующего ключа с таким идентификатором
+func (s *PostgresStorage) RevokeAPIKey(ctx context.Context, login string, id string) (bool, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	updateRes, err := s.pool.Exec(ctx, getRevokeAPIKeyQuery(), id, login, time.Now())
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	return updateRes.RowsAffected() > 0, nil
+}
+
+func getRevokeAPIKeyQuery() string {
+	return `
+	UPDATE public.api_keys
+		SET revoked_at=$3
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL;
+	`
+}
+
+func (s *PostgresStorage) AddAuditRecord(ctx context.Context, record *model.AuditRecord) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	insert := getAddAuditRecordQuery()
+	result := s.pool.QueryRow(ctx, insert, record.CreatedAt,
+		record.Actor, record.Action, record.Target, record.Reason)
+	if err := result.Scan(&record.ID); err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func getAddAuditRecordQuery() string {
+	return `
+	INSERT INTO public.audit_log(
+		created_at, actor, action, target, reason)
+		VALUES ($1, $2, $3, $4, $5)
+	RETURNING id;
+	`
+}
+
+func (s *PostgresStorage) GetLoginAttempts(ctx context.Context, key string) (*lockout.State, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	return getLoginAttempts(ctx, s.pool, getLoginAttemptsQuery(), key)
+}
+
+// RegisterLoginFailure учитывает неудачную попытку входа. Строка счётчика
+// блокируется, поэтому экземпляры сервиса не теряют попытки друг друга
+func (s *PostgresStorage) RegisterLoginFailure(ctx context.Context, key string, policy lockout.Policy, now time.Time) (*lockout.State, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	transaction, err := s.pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
+	defer transaction.Rollback(ctx)
 
-	//defer pool.Close()
+	_, err = transaction.Exec(ctx, getInitLoginAttemptsQuery(), key, now)
+	if err != nil {
+		return nil, storageError(err)
+	}
 
-	_, err = pool.Exec(ctx, init)
+	state, err := getLoginAttempts(ctx, transaction, getLoginAttemptsQuery()+"FOR UPDATE", key)
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 
-	return &PostgresStorage{
-		ConnStr: connection,
-		pool:    pool,
-	}, nil
+	newState := policy.Apply(state, now)
+	var lockedUntil *time.Time
+	if !newState.LockedUntil.IsZero() {
+		lockedUntil = &newState.LockedUntil
+	}
+	_, err = transaction.Exec(ctx, getUpdateLoginAttemptsQuery(), key, newState.Failures,
+		newState.FirstFailure, newState.LastFailure, lockedUntil)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	if err = transaction.Commit(ctx); err != nil {
+		return nil, storageError(err)
+	}
+
+	return newState, nil
 }
 
-func (s *PostgresStorage) Ping(ctx context.Context) error {
-	err := s.pool.Ping(ctx)
+func (s *PostgresStorage) ResetLoginAttempts(ctx context.Context, key string) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, getResetLoginAttemptsQuery(), key)
 	if err != nil {
-		return err
+		return storageError(err)
 	}
 
 	return nil
 }
 
-func (s *PostgresStorage) Quit(ctx context.Context) {
-	s.pool.Close()
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
 }
 
-func (s *PostgresStorage) AddUser(ctx context.Context, user *model.User) error {
-	addUserQuery := addUserQuery()
-	insertRes, err := s.pool.Exec(ctx, addUserQuery, user.Login, user.Password)
-	if err != nil {
-		return err
-	}
-	if insertRes.RowsAffected() == 0 {
-		return errors.New("can't add user")
-	}
+func getLoginAttempts(ctx context.Context, q queryRower, query string, key string) (*lockout.State, error) {
+	var state lockout.State
+	var lockedUntil *time.Time
 
-	return nil
+	result := q.QueryRow(ctx, query, key)
+	switch err := result.Scan(&state.Failures,
+		&state.FirstFailure,
+		&state.LastFailure,
+		&lockedUntil); err {
+	case pgx.ErrNoRows:
+		return nil, nil
+	case nil:
+		if lockedUntil != nil {
+			state.LockedUntil = *lockedUntil
+		}
+		return &state, nil
+	default:
+		return nil, err
+	}
 }
 
-func addUserQuery() string {
+func getLoginAttemptsQuery() string {
 	return `
-	INSERT INTO public.users(login, password)
-		VALUES ($1, $2);
+	SELECT attempts.failures,
+			attempts.first_failure,
+			attempts.last_failure,
+			attempts.locked_until
+	FROM public.login_attempts AS attempts
+	WHERE
+		attempts.key = $1
 	`
 }
 
-func (s *PostgresStorage) GetUser(ctx context.Context, user *model.User) (*model.User, error) {
-	var userInfo model.User
-	getUserQuery := getUserQuery()
-	result := s.pool.QueryRow(ctx, getUserQuery, user.Login)
-	if err := result.Scan(&userInfo.Login, &userInfo.Password); err != nil {
-		return nil, err
-	}
+func getInitLoginAttemptsQuery() string {
+	return `
+	INSERT INTO public.login_attempts(
+		key, failures, first_failure, last_failure)
+		VALUES ($1, 0, $2, $2)
+	ON CONFLICT (key) DO NOTHING;
+	`
+}
 
-	return &userInfo, nil
+func getUpdateLoginAttemptsQuery() string {
+	return `
+	UPDATE public.login_attempts
+		SET failures=$2, first_failure=$3, last_failure=$4, locked_until=$5
+		WHERE key=$1;
+	`
 }
 
-func getUserQuery() string {
+func getResetLoginAttemptsQuery() string {
 	return `
-	SELECT login, password
-		FROM public.users
-	WHERE
-		login = $1
+	DELETE FROM public.login_attempts
+		WHERE key=$1;
 	`
 }
 
 func (s *PostgresStorage) UploadOrder(ctx context.Context, orderID string, user *model.User) (model.EndPointStatus, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
 
 	var orderInfo model.Order
 	var status model.EndPointStatus
@@ -110,7 +1347,7 @@ func (s *PostgresStorage) UploadOrder(ctx context.Context, orderID string, user
 			user.Login, time.Now(), model.OrderStatusNew, 0.0)
 		if err != nil {
 			status = model.OtherError
-			return status, err
+			return status, storageError(err)
 		}
 		if insertRes.RowsAffected() == 0 {
 			status = model.OtherError
@@ -129,7 +1366,7 @@ func (s *PostgresStorage) UploadOrder(ctx context.Context, orderID string, user
 			return status, nil // errors.New("номер заказа уже был загружен другим пользователем")
 		}
 	default:
-		return model.OtherError, err
+		return model.OtherError, storageError(err)
 	}
 }
 
@@ -140,9 +1377,7 @@ func getOrderInfoQuery() string {
 			orders.upload_date, 
 			orders.status, 
 			orders.bonus
-	FROM public.orders AS orders 
-		LEFT JOIN public.users AS users 
-	ON orders.owner = users.login
+	FROM public.orders AS orders
 	WHERE
 	orders.id = $1
 	`
@@ -156,14 +1391,38 @@ func getAddOrderQuery() string {
 	`
 }
 
+func (s *PostgresStorage) GetOrder(ctx context.Context, orderID string) (*model.Order, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var orderInfo model.Order
+
+	query := getOrderInfoQuery()
+	result := s.pool.QueryRow(ctx, query, orderID)
+	switch err := result.Scan(&orderInfo.ID,
+		&orderInfo.Owner,
+		&orderInfo.UploadDate,
+		&orderInfo.Status,
+		&orderInfo.Bonus); err {
+	case pgx.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &orderInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
 func (s *PostgresStorage) GetAllOrders(ctx context.Context, user *model.User) ([]*model.Order, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
 
 	orders := []*model.Order{}
 
 	query := getAllOrdersQuery()
 	result, err := s.pool.Query(ctx, query, user.Login)
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 
 	defer result.Close()
@@ -176,14 +1435,14 @@ func (s *PostgresStorage) GetAllOrders(ctx context.Context, user *model.User) ([
 			&orderInfo.Status,
 			&orderInfo.Bonus)
 		if err != nil {
-			return nil, err
+			return nil, storageError(err)
 		}
 		orders = append(orders, &orderInfo)
 	}
 
 	err = result.Err()
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 
 	return orders, nil
@@ -204,117 +1463,163 @@ func getAllOrdersQuery() string {
 	`
 }
 
+// GetBalance возвращает сохранённый баланс пользователя
 func (s *PostgresStorage) GetBalance(ctx context.Context, user *model.User) (*model.Balance, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
 
 	var balance model.Balance
 
-	query := getBonusBalanceQuery()
-	result := s.pool.QueryRow(ctx, query, user.Login)
+	result := s.pool.QueryRow(ctx, getAccountBalanceQuery(), user.Login)
 	switch err := result.Scan(&balance.Current, &balance.Withdrawn); err {
 	case pgx.ErrNoRows:
-		// нет ни одной записи в таблицах
-		return &model.Balance{
-			Current:   0.0,
-			Withdrawn: 0.0,
-		}, nil
+		// операций по счёту ещё не было
+		return &balance, nil
 	case nil:
-		return &model.Balance{
-			Current:   balance.Current - balance.Withdrawn,
-			Withdrawn: balance.Withdrawn,
-		}, nil
+		return &balance, nil
 	default:
-		return nil, err
+		return nil, storageError(err)
+	}
+}
+
+// GetLedgerTotals возвращает суммы записей журнала по счёту пользователя
+// по видам операций
+func (s *PostgresStorage) GetLedgerTotals(ctx context.Context, user *model.User) (map[string]money.Amount, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	result, err := s.pool.Query(ctx, getLedgerTotalsQuery(), user.Login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	defer result.Close()
+
+	totals := map[string]money.Amount{}
+	for result.Next() {
+		var kind string
+		var amount money.Amount
+		if err := result.Scan(&kind, &amount); err != nil {
+			return nil, storageError(err)
+		}
+		totals[kind] = amount
+	}
+	if err := result.Err(); err != nil {
+		return nil, storageError(err)
 	}
+
+	return totals, nil
+}
+
+func getLedgerTotalsQuery() string {
+	return `
+	SELECT entries.kind,
+		SUM(entries.amount)
+	FROM public.ledger_entries as entries
+	WHERE
+		entries.account = $1
+	GROUP BY
+		entries.kind
+	`
 }
 
+// RequestWithdrawal проверяет баланс и записывает списание в одной транзакции.
+// Строка пользователя блокируется до конца транзакции, поэтому одновременные
+// списания одного пользователя выполняются по очереди и не уводят баланс в минус
 func (s *PostgresStorage) RequestWithdrawal(ctx context.Context, withdrawalInfo *model.Withdrawal) (model.EndPointStatus, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
 
-	var allBonuses float64
-	var allWithdrawals float64
+	var current money.Amount
 
 	transaction, err := s.pool.Begin(ctx)
 	if err != nil {
-		return model.OtherError, err
+		return model.OtherError, storageError(err)
 	}
 	defer transaction.Rollback(ctx)
 
-	query := getBonusBalanceQuery()
-	result := s.pool.QueryRow(ctx, query, withdrawalInfo.User)
-	switch err := result.Scan(&allBonuses, &allWithdrawals); err {
+	lockRes, err := transaction.Exec(ctx, getLockUserQuery(), withdrawalInfo.User)
+	if err != nil {
+		return model.OtherError, storageError(err)
+	}
+	if lockRes.RowsAffected() == 0 {
+		return model.OtherError, fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	// проверим, нет ли уже списаний по этому заказу
+	var exists bool
+	err = transaction.QueryRow(ctx, getWithdrawalExistsQuery(), withdrawalInfo.OrderID).Scan(&exists)
+	if err != nil {
+		return model.OtherError, storageError(err)
+	}
+	if exists {
+		// списания есть - запрещаем повторное списание
+		return model.WithdrawalAlreadyRequested, nil
+	}
+
+	var withdrawn money.Amount
+	result := transaction.QueryRow(ctx, getAccountBalanceQuery(), withdrawalInfo.User)
+	switch err := result.Scan(&current, &withdrawn); err {
 	case pgx.ErrNoRows:
 		// бонусов нет
 		return model.WithdrawalNoBonuses, nil
 	case nil:
-		// бонусы есть
-		// проверим хватит ли их для списания в счет заказа
-		availableBonuses := allBonuses - allWithdrawals
-		if availableBonuses < withdrawalInfo.Sum {
-			// бонусов не хватает
-			return model.WithdrawalNotEnoughBonuses, nil
-		} else {
-			// проверим, нет ли уже списаний по этому заказу
-			queryCheck := getWithdrawalInfoQuery()
-			result := s.pool.QueryRow(ctx, queryCheck, withdrawalInfo.OrderID)
-			switch err := result.Scan(); err {
-			case pgx.ErrNoRows:
-				// списаний по этому заказу нет
-				// добавляем новое списание
-				insert := getAddWithdrawalQuery()
-				insertRes, err := s.pool.Exec(ctx, insert, withdrawalInfo.OrderID,
-					withdrawalInfo.Sum, withdrawalInfo.ProcessedDate, withdrawalInfo.User)
-				if err != nil {
-					return model.OtherError, err
-				}
-				if insertRes.RowsAffected() == 0 {
-					return model.OtherError, errors.New("списание не прошло")
-				}
-				transaction.Commit(ctx)
-				return model.WithdrawalAccepted, nil
-			case nil:
-				// списания есть - запрещаем повторное списание
-				return model.WithdrawalAlreadyRequested, nil
-			default:
-				return model.OtherError, err
-			}
-		}
 	default:
-		return model.OtherError, err
+		return model.OtherError, storageError(err)
+	}
+
+	// проверим хватит ли бонусов для списания в счет заказа
+	if current < withdrawalInfo.Sum {
+		return model.WithdrawalNotEnoughBonuses, nil
+	}
+
+	insertRes, err := transaction.Exec(ctx, getAddWithdrawalQuery(), withdrawalInfo.OrderID,
+		withdrawalInfo.Sum, withdrawalInfo.ProcessedDate, withdrawalInfo.User)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		// тот же заказ одновременно списывает другой пользователь
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return model.WithdrawalAlreadyRequested, nil
+		}
+		return model.OtherError, storageError(err)
+	}
+	if insertRes.RowsAffected() == 0 {
+		return model.OtherError, errors.New("списание не прошло")
+	}
+
+	err = postLedgerEntry(ctx, transaction, &model.LedgerEntry{
+		Account:   withdrawalInfo.User,
+		Kind:      model.LedgerWithdrawal,
+		Amount:    -withdrawalInfo.Sum,
+		Reference: withdrawalInfo.OrderID,
+		CreatedAt: withdrawalInfo.ProcessedDate,
+	})
+	if err != nil {
+		return model.OtherError, storageError(err)
 	}
+
+	if err := transaction.Commit(ctx); err != nil {
+		return model.OtherError, storageError(err)
+	}
+	return model.WithdrawalAccepted, nil
 }
 
-func getBonusBalanceQuery() string {
+func getLockUserQuery() string {
 	return `
-	SELECT
-		SUM(balance.bonuses),
-		SUM(balance.withdrawals)
-	FROM
-		(SELECT orders.bonus as bonuses, 
-				0 as withdrawals,
-				orders.owner as user
-		FROM public.orders as orders
-		WHERE 
-			orders.owner = $1
-		UNION ALL
-		SELECT 0, 
-			withdrawals.sum,
-			withdrawals.user_id
-		FROM public.withdrawals as withdrawals
-		WHERE 
-			withdrawals.user_id = $1) as balance
-	GROUP BY
-		balance.user
+	SELECT users.login
+		FROM public.users as users
+	WHERE
+		users.login = $1
+	FOR NO KEY UPDATE
 	`
 }
 
-func getWithdrawalInfoQuery() string {
+func getWithdrawalExistsQuery() string {
 	return `
-	SELECT withdrawals.order_id, 
-			withdrawals.sum, 
-			withdrawals.processed_date,
-			withdrawals.user_id
-	FROM public.withdrawals as withdrawals
-	WHERE 
-		withdrawals.order_id = $1
+	SELECT EXISTS(
+		SELECT 1
+			FROM public.withdrawals as withdrawals
+		WHERE
+			withdrawals.order_id = $1)
 	`
 }
 
@@ -327,13 +1632,15 @@ func getAddWithdrawalQuery() string {
 }
 
 func (s *PostgresStorage) GetAllWithdrawals(ctx context.Context, user *model.User) ([]*model.Withdrawal, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
 
 	withdrawals := []*model.Withdrawal{}
 
 	query := getAllWithdrawalsQuery()
 	result, err := s.pool.Query(ctx, query, user.Login)
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 
 	defer result.Close()
@@ -344,14 +1651,14 @@ func (s *PostgresStorage) GetAllWithdrawals(ctx context.Context, user *model.Use
 			&withdrawalInfo.Sum,
 			&withdrawalInfo.ProcessedDate)
 		if err != nil {
-			return nil, err
+			return nil, storageError(err)
 		}
 		withdrawals = append(withdrawals, &withdrawalInfo)
 	}
 
 	err = result.Err()
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 
 	return withdrawals, nil
@@ -370,15 +1677,118 @@ func getAllWithdrawalsQuery() string {
 	`
 }
 
-func (s *PostgresStorage) GetOrdersForUpdate(ctx context.Context) ([]model.Order, error) {
+// AddAdjustment записывает корректировку и проводит её по журналу баллов
+func (s *PostgresStorage) AddAdjustment(ctx context.Context, adjustment *model.Adjustment) error {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	transaction, err := s.pool.Begin(ctx)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback(ctx)
+
+	if _, err := transaction.Exec(ctx, getLockUserQuery(), adjustment.User); err != nil {
+		return storageError(err)
+	}
+
+	insert := getAddAdjustmentQuery()
+	result := transaction.QueryRow(ctx, insert, adjustment.User, adjustment.Amount,
+		adjustment.Reason, adjustment.Operator, adjustment.ProcessedDate)
+	if err := result.Scan(&adjustment.ID); err != nil {
+		return storageError(err)
+	}
+
+	err = postLedgerEntry(ctx, transaction, &model.LedgerEntry{
+		Account:   adjustment.User,
+		Kind:      model.LedgerAdjustment,
+		Amount:    adjustment.Amount,
+		Reference: strconv.FormatInt(adjustment.ID, 10),
+		CreatedAt: adjustment.ProcessedDate,
+	})
+	if err != nil {
+		return storageError(err)
+	}
+
+	return storageError(transaction.Commit(ctx))
+}
+
+func getAddAdjustmentQuery() string {
+	return `
+	INSERT INTO public.adjustments(
+		user_id, amount, reason, operator, processed_date)
+		VALUES ($1, $2, $3, $4, $5)
+	RETURNING id;
+	`
+}
+
+func (s *PostgresStorage) GetAllAdjustments(ctx context.Context, user *model.User) ([]*model.Adjustment, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	adjustments := []*model.Adjustment{}
+
+	query := getAllAdjustmentsQuery()
+	result, err := s.pool.Query(ctx, query, user.Login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var adjustment model.Adjustment
+		err = result.Scan(&adjustment.ID,
+			&adjustment.User,
+			&adjustment.Amount,
+			&adjustment.Reason,
+			&adjustment.Operator,
+			&adjustment.ProcessedDate)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		adjustments = append(adjustments, &adjustment)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return adjustments, nil
+}
+
+func getAllAdjustmentsQuery() string {
+	return `
+	SELECT adjustments.id,
+			adjustments.user_id,
+			adjustments.amount,
+			adjustments.reason,
+			adjustments.operator,
+			adjustments.processed_date
+	FROM public.adjustments as adjustments
+	WHERE
+		adjustments.user_id = $1
+	ORDER BY
+		adjustments.processed_date ASC
+	`
+}
+
+// GetOrdersForUpdate выдаёт worker в аренду на leaseTime до limit заказов,
+// ожидающих расчёта начисления. Заказы, которые в это же время выбирает
+// другой экземпляр сервиса или которые уже в аренде, пропускаются
+func (s *PostgresStorage) GetOrdersForUpdate(ctx context.Context, worker string, limit int, leaseTime time.Duration) ([]model.Order, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
 
 	orders := []model.Order{}
-	statusesForUpdate := StatusesForUpdate()
+	statusesForUpdate := model.OrderStatusesForUpdate()
 
-	query := getOrdersForUpdateQuery()
-	result, err := s.pool.Query(ctx, query, pq.Array(statusesForUpdate))
+	query := getClaimOrdersQuery()
+	result, err := s.pool.Query(ctx, query, pq.Array(statusesForUpdate), limit,
+		worker, leaseTime.Seconds())
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 
 	defer result.Close()
@@ -389,150 +1799,256 @@ func (s *PostgresStorage) GetOrdersForUpdate(ctx context.Context) ([]model.Order
 			&orderInfo.Owner,
 			&orderInfo.UploadDate,
 			&orderInfo.Status,
-			&orderInfo.Bonus)
+			&orderInfo.Bonus,
+			&orderInfo.Attempts,
+			&orderInfo.NextAttemptAt)
 		if err != nil {
-			return nil, err
+			return nil, storageError(err)
 		}
 		orders = append(orders, orderInfo)
 	}
 
 	err = result.Err()
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 
+	sortOrders(orders)
+
 	return orders, nil
 }
 
-func StatusesForUpdate() []string {
-	return []string{
-		model.OrderStatusNew,
-		model.OrderStatusProcessing,
-		model.BonusStatusNew, // под вопросом
+func getClaimOrdersQuery() string {
+	return `
+	WITH claimed AS (
+		SELECT orders.id
+			FROM public.orders as orders
+		WHERE
+			orders.status=ANY($1)
+			AND (orders.next_attempt_at IS NULL OR orders.next_attempt_at <= now())
+			AND (orders.lease_expires_at IS NULL OR orders.lease_expires_at <= now())
+		ORDER BY
+			orders.next_attempt_at ASC NULLS FIRST,
+			orders.upload_date ASC,
+			orders.id ASC
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	)
+	UPDATE public.orders as orders
+		SET lease_owner=$3,
+			lease_expires_at=now() + $4::float8 * interval '1 second',
+			attempts=orders.attempts + 1
+	FROM claimed
+	WHERE
+		orders.id = claimed.id
+	RETURNING orders.id,
+		orders.owner,
+		orders.upload_date,
+		orders.status,
+		orders.bonus,
+		orders.attempts,
+		orders.next_attempt_at
+	`
+}
+
+// LeaseOrder выдаёт worker в аренду на leaseTime заказ orderID в любом статусе,
+// если он не в аренде у другого исполнителя. Число попыток опроса не меняется.
+// Возвращает nil, если заказа нет или он уже в аренде
+func (s *PostgresStorage) LeaseOrder(ctx context.Context, orderID string, worker string, leaseTime time.Duration) (*model.Order, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
+
+	var orderInfo model.Order
+	err := s.pool.QueryRow(ctx, getLeaseOrderQuery(), orderID, worker, leaseTime.Seconds()).
+		Scan(&orderInfo.ID,
+			&orderInfo.Owner,
+			&orderInfo.UploadDate,
+			&orderInfo.Status,
+			&orderInfo.Bonus,
+			&orderInfo.Attempts,
+			&orderInfo.NextAttemptAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return &orderInfo, nil
 }
 
-func getOrdersForUpdateQuery() string {
+func getLeaseOrderQuery() string {
 	return `
-	SELECT orders.id, 
-			orders.owner, 
-			orders.upload_date, 
-			orders.status, 
-			orders.bonus
-		FROM public.orders as orders
+	UPDATE public.orders as orders
+		SET lease_owner=$2,
+			lease_expires_at=now() + $3::float8 * interval '1 second'
 	WHERE
-		orders.status=ANY($1)
-	ORDER BY
-		orders.upload_date ASC
+		orders.id = $1
+		AND (orders.lease_expires_at IS NULL OR orders.lease_expires_at <= now())
+	RETURNING orders.id,
+		orders.owner,
+		orders.upload_date,
+		orders.status,
+		orders.bonus,
+		orders.attempts,
+		orders.next_attempt_at
 	`
 }
 
-func (s *PostgresStorage) UpdateBatchOrders(ctx context.Context, orders []model.Order) error {
+// sortOrders упорядочивает выданные заказы по времени загрузки:
+// RETURNING не сохраняет порядок подзапроса
+func sortOrders(orders []model.Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].UploadDate.Equal(orders[j].UploadDate) {
+			return orders[i].UploadDate.Before(orders[j].UploadDate)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+}
+
+// UpdateBatchOrders обновляет статусы заказов, снимает с них аренду и проводит
+// начисления по журналу баллов в одной транзакции. Заказ, ещё ожидающий расчёта,
+// снова попадёт в очередь через RetryAfter по часам базы, по которым проверяется
+// и аренда. Обновляются только заказы, аренда которых ещё принадлежит worker:
+// результат исполнителя, опоздавшего к концу аренды, пропускается. Возвращает
+// заказы, у которых изменились статус или начисление
+func (s *PostgresStorage) UpdateBatchOrders(ctx context.Context, worker string, orders []model.Order) ([]model.Order, error) {
+	ctx, cancel := s.operationContext(ctx)
+	defer cancel()
 
 	transaction, err := s.pool.Begin(ctx)
 	if err != nil {
-		return err
+		return nil, storageError(err)
 	}
 	defer transaction.Rollback(ctx)
 
-	for _, el := range orders {
-		err = s.updateOrder(ctx, &el)
-		if err != nil {
-			return err
-		}
+	changed, err := updateOrders(ctx, transaction, worker, orders)
+	if err != nil {
+		return nil, storageError(err)
 	}
 
-	transaction.Commit(ctx)
-
-	return nil
-}
-
-func (s *PostgresStorage) updateOrder(ctx context.Context, order *model.Order) error {
-	update := getUpdateOrderQuery()
-	insertRes, err := s.pool.Exec(ctx, update, order.Status, order.Bonus, order.ID)
+	err = transaction.Commit(ctx)
 	if err != nil {
-		return err
-	}
-	if insertRes.RowsAffected() == 0 {
-		return errors.New("order not updated")
+		return nil, storageError(err)
 	}
-	return nil
-}
 
-func getUpdateOrderQuery() string {
-	return `
-	UPDATE public.orders
-		SET status=$1, bonus=$2
-		WHERE id=$3;
-	`
+	return changed, nil
 }
 
-func getInitQuery() string {
-	return `
-	-- Table: public.users
+// updateOrders отправляет все запросы пакета серверу за один обмен. Сервер
+// выполняет их по очереди, поэтому каждая запись журнала видит баланс
+// после предыдущей
+func updateOrders(ctx context.Context, transaction pgx.Tx, worker string, orders []model.Order) ([]model.Order, error) {
+	owners := make([]string, 0, len(orders))
+	ids := make([]string, 0, len(orders))
+	for _, el := range orders {
+		owners = append(owners, el.Owner)
+		ids = append(ids, el.ID)
+	}
 
-	-- DROP TABLE IF EXISTS public.users;
+	now := time.Now()
+	batch := &pgx.Batch{}
+	// строки пользователей блокируются в одном порядке во всех потоках,
+	// чтобы параллельные пакеты не ждали друг друга по кругу. Владелец
+	// удалённого пользователем заказа обезличен, и его строки уже нет
+	batch.Queue(getLockUsersQuery(), pq.Array(owners))
+	batch.Queue(getMissingOrdersQuery(), pq.Array(ids))
+	for _, el := range orders {
+		batch.Queue(getUpdateOrderQuery(), el.Status, el.Bonus, el.RetryAfter.Seconds(), el.ID, worker)
+		// проводится разница между начислением в заказе и уже проведённой суммой,
+		// поэтому пропущенное или повторное обновление не меняет баланс
+		batch.Queue(getPostAccrualQuery(), el.Owner, model.LedgerAccrual, el.ID,
+			now, model.LedgerSystemAccount(model.LedgerAccrual))
+	}
 
-	CREATE TABLE IF NOT EXISTS public.users
-	(
-		login character varying(50) NOT NULL,
-		password character varying,
-		CONSTRAINT users_pkey PRIMARY KEY (login)
-	)
+	results := transaction.SendBatch(ctx, batch)
+	defer results.Close()
 
-	TABLESPACE pg_default;
+	if _, err := results.Exec(); err != nil {
+		return nil, err
+	}
 
-	ALTER TABLE IF EXISTS public.users
-		OWNER to postgres;
+	var missing int
+	if err := results.QueryRow().Scan(&missing); err != nil {
+		return nil, err
+	}
+	if missing > 0 {
+		return nil, fmt.Errorf("order not updated: order %w", storage.ErrNotFound)
+	}
 
-	-- Table: public.orders
+	changed := []model.Order{}
+	for _, el := range orders {
+		var status string
+		var bonus money.Amount
+		updateErr := results.QueryRow().Scan(&status, &bonus)
+		if updateErr != nil && updateErr != pgx.ErrNoRows {
+			return nil, updateErr
+		}
+		if _, err := results.Exec(); err != nil {
+			return nil, err
+		}
 
-	-- DROP TABLE IF EXISTS public.orders;
+		// аренда истекла или перешла к другому исполнителю
+		if updateErr == pgx.ErrNoRows {
+			continue
+		}
+		if status != el.Status || bonus != el.Bonus {
+			changed = append(changed, el)
+		}
+	}
 
-	CREATE TABLE IF NOT EXISTS public.orders
-	(
-		id character varying NOT NULL,
-		owner character varying NOT NULL,
-		upload_date timestamp with time zone NOT NULL,
-		status character varying NOT NULL,
-		bonus double precision NOT NULL,
-		CONSTRAINT orders_pkey PRIMARY KEY (id),
-		CONSTRAINT fk_users FOREIGN KEY (owner)
-			REFERENCES public.users (login) MATCH SIMPLE
-			ON UPDATE NO ACTION
-			ON DELETE CASCADE
-			NOT VALID
-	)
+	return changed, results.Close()
+}
 
-	TABLESPACE pg_default;
-
-	ALTER TABLE IF EXISTS public.orders
-		OWNER to postgres;
-
-	-- Table: public.withdrawals
-
-	-- DROP TABLE IF EXISTS public.withdrawals;
-
-	CREATE TABLE IF NOT EXISTS public.withdrawals
-	(
-		order_id character varying NOT NULL,
-		sum double precision NOT NULL,
-		processed_date timestamp with time zone NOT NULL,
-		user_id character varying NOT NULL,
-		-- CONSTRAINT fk_orders FOREIGN KEY (order_id)
-		--	REFERENCES public.orders (id) MATCH SIMPLE
-		--	ON UPDATE NO ACTION
-		--	ON DELETE CASCADE,
-		CONSTRAINT fk_users FOREIGN KEY (user_id)
-			REFERENCES public.users (login) MATCH SIMPLE
-			ON UPDATE NO ACTION
-			ON DELETE CASCADE
-			NOT VALID
-	)
+func getLockUsersQuery() string {
+	return `
+	SELECT users.login
+		FROM public.users as users
+	WHERE
+		users.login = ANY($1)
+	ORDER BY
+		users.login
+	FOR NO KEY UPDATE
+	`
+}
 
-	TABLESPACE pg_default;
+// getMissingOrdersQuery возвращает число номеров из $1, которых нет среди заказов
+func getMissingOrdersQuery() string {
+	return `
+	SELECT COUNT(*)
+		FROM unnest($1::varchar[]) AS ids(id)
+	WHERE
+		NOT EXISTS (
+			SELECT 1
+				FROM public.orders as orders
+			WHERE
+				orders.id = ids.id)
+	`
+}
 
-	ALTER TABLE IF EXISTS public.withdrawals
-		OWNER to postgres;
+// getUpdateOrderQuery обновляет заказ, если он в действующей аренде у $5,
+// откладывает следующий опрос на $3 секунд по часам базы
+// и возвращает статус и начисление заказа до обновления
+func getUpdateOrderQuery() string {
+	return `
+	WITH old AS (
+		SELECT orders.id, orders.status, orders.bonus
+			FROM public.orders as orders
+		WHERE
+			orders.id = $4
+			AND orders.lease_owner = $5
+			AND orders.lease_expires_at > now()
+		FOR NO KEY UPDATE
+	)
+	UPDATE public.orders
+		SET status=$1, bonus=$2,
+			next_attempt_at=CASE WHEN $3::float8 > 0
+				THEN now() + $3::float8 * interval '1 second' END,
+			lease_owner=NULL, lease_expires_at=NULL
+		FROM old
+		WHERE orders.id = old.id
+			AND orders.lease_owner = $5
+			AND orders.lease_expires_at > now()
+	RETURNING old.status, old.bonus;
 	`
 }
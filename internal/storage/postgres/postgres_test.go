@@ -0,0 +1,237 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/storage/storagetest"
+)
+
+// testDatabaseURI возвращает адрес отдельной тестовой базы из TEST_DATABASE_URI.
+// Без базы проверки пропускаются, но в CI это ошибка: иначе проверки
+// на Postgres молча перестали бы выполняться
+func testDatabaseURI(tb testing.TB) string {
+	tb.Helper()
+	connection := os.Getenv("TEST_DATABASE_URI")
+	if connection == "" {
+		if os.Getenv("CI") != "" {
+			tb.Fatal("TEST_DATABASE_URI is not set in CI")
+		}
+		tb.Skip("TEST_DATABASE_URI is not set")
+	}
+	return connection
+}
+
+// TestPostgresStorage запускается на отдельной базе, указанной в
+// TEST_DATABASE_URI. Все таблицы базы очищаются перед каждой проверкой
+func TestPostgresStorage(t *testing.T) {
+	connection := testDatabaseURI(t)
+
+	ctx := context.Background()
+	st, err := NewPSQLStorage(ctx, connection, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Quit(ctx)
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		_, err := st.pool.Exec(ctx, getTruncateAllQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	})
+}
+
+// BenchmarkPostgresStorage заполняет базу из TEST_DATABASE_URI,
+// предварительно очистив все её таблицы
+func BenchmarkPostgresStorage(b *testing.B) {
+	connection := testDatabaseURI(b)
+
+	ctx := context.Background()
+	st, err := NewPSQLStorage(ctx, connection, Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer st.Quit(ctx)
+
+	if _, err := st.pool.Exec(ctx, getTruncateAllQuery()); err != nil {
+		b.Fatal(err)
+	}
+	storagetest.Bench(b, st, func() error {
+		_, err := st.pool.Exec(ctx, "ANALYZE")
+		return err
+	})
+}
+
+// TestWithdrawalsUniqueMigration проверяет, что миграция уникального индекса
+// списаний останавливается на повторных списаниях по заказу и не удаляет их
+func TestWithdrawalsUniqueMigration(t *testing.T) {
+	connection := testDatabaseURI(t)
+
+	ctx := context.Background()
+	st, err := NewPSQLStorage(ctx, connection, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Quit(ctx)
+
+	if _, err := st.pool.Exec(ctx, getTruncateAllQuery()); err != nil {
+		t.Fatal(err)
+	}
+
+	// откатываем схему к версии перед индексом
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := 0
+	for _, el := range migrations {
+		if el.Version >= 3 {
+			steps++
+		}
+	}
+	if _, err := st.MigrateDown(ctx, steps); err != nil {
+		t.Fatal(err)
+	}
+	// следующие проверки получают полную схему
+	defer func() {
+		if _, err := st.MigrateUp(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if _, err := st.pool.Exec(ctx, getAddDuplicateWithdrawalsQuery()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.MigrateUp(ctx)
+	if err == nil || !strings.Contains(err.Error(), "duplicated orders: 5") {
+		t.Fatalf("MigrateUp() with duplicated withdrawals error = %v", err)
+	}
+
+	var count int
+	if err := st.pool.QueryRow(ctx, getCountWithdrawalsQuery()).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("withdrawals after failed migration = %v, want 2", count)
+	}
+
+	// после разбора повторных списаний миграция применяется
+	if _, err := st.pool.Exec(ctx, getDeleteWithdrawalsQuery(), "petr"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.MigrateUp(ctx); err != nil {
+		t.Errorf("MigrateUp() after resolving duplicates error = %v", err)
+	}
+}
+
+func TestConnectConfig(t *testing.T) {
+	ctx := context.Background()
+	connection := "host=localhost port=5432 user=postgres dbname=postgres"
+
+	tests := []struct {
+		name             string
+		cfg              Config
+		maxConns         int32
+		minConns         int32
+		statementTimeout string
+		queryTimeout     time.Duration
+	}{
+		{
+			name: "defaults",
+			cfg:  Config{},
+		},
+		{
+			name: "configured",
+			cfg: Config{
+				MaxConns:         20,
+				MinConns:         2,
+				MaxConnLifetime:  time.Minute,
+				MaxConnIdleTime:  time.Second,
+				StatementTimeout: 1500 * time.Millisecond,
+				QueryTimeout:     3 * time.Second,
+			},
+			maxConns:         20,
+			minConns:         2,
+			statementTimeout: "1500",
+			queryTimeout:     3 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// пул открывает соединения только по запросу, база не нужна
+			st, err := Connect(ctx, connection, tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Quit(ctx)
+
+			poolConfig := st.pool.Config()
+			if tt.maxConns > 0 && poolConfig.MaxConns != tt.maxConns {
+				t.Errorf("MaxConns = %v, want %v", poolConfig.MaxConns, tt.maxConns)
+			}
+			if poolConfig.MinConns != tt.minConns {
+				t.Errorf("MinConns = %v, want %v", poolConfig.MinConns, tt.minConns)
+			}
+			if tt.cfg.MaxConnLifetime > 0 && poolConfig.MaxConnLifetime != tt.cfg.MaxConnLifetime {
+				t.Errorf("MaxConnLifetime = %v, want %v", poolConfig.MaxConnLifetime, tt.cfg.MaxConnLifetime)
+			}
+			if tt.cfg.MaxConnIdleTime > 0 && poolConfig.MaxConnIdleTime != tt.cfg.MaxConnIdleTime {
+				t.Errorf("MaxConnIdleTime = %v, want %v", poolConfig.MaxConnIdleTime, tt.cfg.MaxConnIdleTime)
+			}
+			if got := poolConfig.ConnConfig.RuntimeParams["statement_timeout"]; got != tt.statementTimeout {
+				t.Errorf("statement_timeout = %q, want %q", got, tt.statementTimeout)
+			}
+
+			opCtx, cancel := st.operationContext(ctx)
+			defer cancel()
+			deadline, ok := opCtx.Deadline()
+			if ok != (tt.queryTimeout > 0) {
+				t.Fatalf("operation deadline set = %v, want %v", ok, tt.queryTimeout > 0)
+			}
+			if ok && time.Until(deadline) > tt.queryTimeout {
+				t.Errorf("operation deadline in %v, want at most %v", time.Until(deadline), tt.queryTimeout)
+			}
+		})
+	}
+}
+
+func getTruncateAllQuery() string {
+	return `
+	TRUNCATE public.users, public.orders, public.withdrawals, public.adjustments,
+		public.sessions, public.refresh_tokens, public.two_factor,
+		public.two_factor_recovery_codes, public.api_keys, public.user_identities,
+		public.oidc_states, public.login_attempts, public.audit_log,
+		public.ledger_entries, public.account_balances
+		RESTART IDENTITY CASCADE
+	`
+}
+
+func getAddDuplicateWithdrawalsQuery() string {
+	return `
+	INSERT INTO public.withdrawals(
+		order_id, sum, processed_date, user_id)
+		VALUES ('5', 1, now(), 'ivan'),
+			('5', 2, now(), 'petr')
+	`
+}
+
+func getCountWithdrawalsQuery() string {
+	return `
+	SELECT COUNT(*)
+	FROM public.withdrawals
+	`
+}
+
+func getDeleteWithdrawalsQuery() string {
+	return `
+	DELETE FROM public.withdrawals
+	WHERE
+		user_id = $1
+	`
+}
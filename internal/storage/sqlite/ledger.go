@@ -0,0 +1,271 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+)
+
+// postLedgerEntry добавляет в журнал операцию по счёту пользователя и встречную
+// запись на системном счёте и меняет сохранённый баланс счёта. Вызывающий держит
+// транзакцию записи, поэтому баланс и номер операции не меняются до её конца
+func postLedgerEntry(ctx context.Context, transaction *sql.Tx, entry *model.LedgerEntry) error {
+	err := transaction.QueryRowContext(ctx, getAddAccountBalanceQuery(), entry.Account,
+		entry.Amount, entry.Withdrawn()).Scan(&entry.Balance)
+	if err != nil {
+		return err
+	}
+
+	err = transaction.QueryRowContext(ctx, getNextLedgerTransactionQuery()).Scan(&entry.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	err = transaction.QueryRowContext(ctx, getAddLedgerEntriesQuery(), entry.TransactionID,
+		entry.Account, entry.Kind, entry.Amount, entry.Balance, entry.Reference, toMicros(entry.CreatedAt),
+		model.LedgerSystemAccount(entry.Kind), -entry.Amount).Scan(&entry.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ledgerPosted возвращает сумму, уже проведённую по счёту для операции
+// указанного вида с данной ссылкой
+func ledgerPosted(ctx context.Context, transaction *sql.Tx, account string, kind string, reference string) (money.Amount, error) {
+	var posted money.Amount
+	err := transaction.QueryRowContext(ctx, getLedgerPostedQuery(), account, kind, reference).Scan(&posted)
+	return posted, err
+}
+
+// getAddAccountBalanceQuery прибавляет к балансу счёта $2, к списанному $3
+// и возвращает новый баланс
+func getAddAccountBalanceQuery() string {
+	return `
+	INSERT INTO account_balances(
+		account, balance, withdrawn)
+		VALUES ($1, $2, $3)
+	ON CONFLICT (account) DO UPDATE
+		SET balance = balance + excluded.balance,
+			withdrawn = withdrawn + excluded.withdrawn
+	RETURNING balance;
+	`
+}
+
+// getAccountBalanceQuery возвращает сохранённый баланс счёта и сумму списаний
+func getAccountBalanceQuery() string {
+	return `
+	SELECT balances.balance,
+		balances.withdrawn
+	FROM account_balances as balances
+	WHERE
+		balances.account = $1
+	`
+}
+
+// последовательностей в SQLite нет, но записи журнала не удаляются,
+// и транзакции записи идут по очереди
+func getNextLedgerTransactionQuery() string {
+	return `
+	SELECT COALESCE(MAX(entries.transaction_id), 0) + 1
+		FROM ledger_entries as entries
+	`
+}
+
+func getAddLedgerEntriesQuery() string {
+	return `
+	INSERT INTO ledger_entries(
+		transaction_id, account, kind, amount, balance, reference, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7),
+			($1, $8, $3, $9, NULL, NULLIF($6, ''), $7)
+	RETURNING id;
+	`
+}
+
+func getLedgerPostedQuery() string {
+	return `
+	SELECT COALESCE(SUM(entries.amount), 0)
+		FROM ledger_entries as entries
+	WHERE
+		entries.account = $1
+		AND entries.kind = $2
+		AND entries.reference = $3
+	`
+}
+
+// Reconcile сверяет журнал с заказами, списаниями и корректировками,
+// проверяет балансы записей и равновесие операций
+func (s *SQLiteStorage) Reconcile(ctx context.Context) ([]model.LedgerDrift, error) {
+	drifts := []model.LedgerDrift{}
+
+	queries := []struct {
+		check string
+		query string
+	}{
+		{check: model.DriftSourceMismatch, query: getReconcileSourceQuery()},
+		{check: model.DriftRunningBalance, query: getReconcileRunningBalanceQuery()},
+		{check: model.DriftUnbalanced, query: getReconcileTransactionsQuery()},
+		{check: model.DriftAccountBalance, query: getReconcileAccountBalancesQuery()},
+	}
+
+	for _, el := range queries {
+		result, err := s.db.QueryContext(ctx, el.query)
+		if err != nil {
+			return nil, err
+		}
+
+		for result.Next() {
+			drift := model.LedgerDrift{Check: el.check}
+			err = result.Scan(&drift.Account, &drift.Kind, &drift.Reference,
+				&drift.Expected, &drift.Recorded)
+			if err != nil {
+				result.Close()
+				return nil, err
+			}
+			drifts = append(drifts, drift)
+		}
+		result.Close()
+
+		if err := result.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return drifts, nil
+}
+
+// getReconcileSourceQuery сравнивает суммы по каждому заказу, списанию
+// и корректировке с записями на счёте пользователя
+func getReconcileSourceQuery() string {
+	return `
+	WITH source AS (
+		SELECT orders.owner AS account,
+			'accrual' AS kind,
+			orders.id AS reference,
+			orders.bonus AS amount
+		FROM orders AS orders
+		WHERE
+			orders.bonus <> 0
+		UNION ALL
+		SELECT withdrawals.user_id,
+			'withdrawal',
+			withdrawals.order_id,
+			-withdrawals.sum
+		FROM withdrawals AS withdrawals
+		UNION ALL
+		SELECT adjustments.user_id,
+			'adjustment',
+			CAST(adjustments.id AS TEXT),
+			adjustments.amount
+		FROM adjustments AS adjustments
+	), ledger AS (
+		SELECT entries.account,
+			entries.kind,
+			entries.reference,
+			SUM(entries.amount) AS amount
+		FROM ledger_entries AS entries
+		WHERE
+			entries.kind IN ('accrual', 'withdrawal', 'adjustment')
+			AND entries.account NOT LIKE 'system:%'
+		GROUP BY
+			entries.account, entries.kind, entries.reference
+	)
+	SELECT COALESCE(source.account, ledger.account),
+		COALESCE(source.kind, ledger.kind),
+		COALESCE(source.reference, ledger.reference, ''),
+		COALESCE(source.amount, 0),
+		COALESCE(ledger.amount, 0)
+	FROM source
+		FULL JOIN ledger
+	ON source.account = ledger.account
+		AND source.kind = ledger.kind
+		AND source.reference = ledger.reference
+	WHERE
+		source.amount IS NOT ledger.amount
+	ORDER BY 1, 2, 3
+	`
+}
+
+func getReconcileRunningBalanceQuery() string {
+	return `
+	SELECT entries.account,
+		entries.kind,
+		COALESCE(entries.reference, ''),
+		entries.expected,
+		COALESCE(entries.balance, 0)
+	FROM (
+		SELECT ledger.*,
+			SUM(ledger.amount) OVER (
+				PARTITION BY ledger.account
+				ORDER BY ledger.id) AS expected
+		FROM ledger_entries AS ledger
+		WHERE
+			ledger.account NOT LIKE 'system:%') AS entries
+	WHERE
+		entries.balance IS NOT entries.expected
+	ORDER BY entries.account, entries.id
+	`
+}
+
+func getReconcileTransactionsQuery() string {
+	return `
+	SELECT MIN(entries.account),
+		MIN(entries.kind),
+		CAST(entries.transaction_id AS TEXT),
+		0,
+		SUM(entries.amount)
+	FROM ledger_entries AS entries
+	GROUP BY
+		entries.transaction_id
+	HAVING
+		SUM(entries.amount) <> 0
+		OR COUNT(*) <> 2
+	ORDER BY entries.transaction_id
+	`
+}
+
+// getReconcileAccountBalancesQuery сравнивает сохранённые балансы и суммы
+// списаний с последней записью и списаниями по журналу
+func getReconcileAccountBalancesQuery() string {
+	return `
+	WITH ledger AS (
+		SELECT entries.account,
+			(SELECT last.balance
+				FROM ledger_entries AS last
+			WHERE
+				last.account = entries.account
+			ORDER BY
+				last.id DESC
+			LIMIT 1) AS balance,
+			COALESCE(-SUM(entries.amount)
+				FILTER (WHERE entries.kind IN ('withdrawal', 'refund')), 0) AS withdrawn
+		FROM ledger_entries AS entries
+		WHERE
+			entries.account NOT LIKE 'system:%'
+		GROUP BY
+			entries.account
+	), compared AS (
+		SELECT COALESCE(ledger.account, balances.account) AS account,
+			COALESCE(ledger.balance, 0) AS ledger_balance,
+			COALESCE(balances.balance, 0) AS balance,
+			COALESCE(ledger.withdrawn, 0) AS ledger_withdrawn,
+			COALESCE(balances.withdrawn, 0) AS withdrawn
+		FROM ledger
+			FULL JOIN account_balances AS balances
+		ON ledger.account = balances.account
+	)
+	SELECT compared.account, 'balance', '', compared.ledger_balance, compared.balance
+		FROM compared
+	WHERE
+		compared.ledger_balance <> compared.balance
+	UNION ALL
+	SELECT compared.account, 'withdrawn', '', compared.ledger_withdrawn, compared.withdrawn
+		FROM compared
+	WHERE
+		compared.ledger_withdrawn <> compared.withdrawn
+	ORDER BY 1, 2
+	`
+}
@@ -0,0 +1,179 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/storage/migration"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrations возвращает шаги миграции в порядке версий
+func Migrations() ([]migration.Migration, error) {
+	return migration.Load(migrationFiles, "migrations")
+}
+
+// MigrateUp применяет все непримененные шаги и возвращает применённые
+func (s *SQLiteStorage) MigrateUp(ctx context.Context) ([]migration.Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration.Migration
+	err = s.withMigrations(ctx, func(transaction *sql.Tx, applied map[int64]time.Time) error {
+		for _, step := range migrations {
+			if _, ok := applied[step.Version]; ok {
+				continue
+			}
+			if _, err := transaction.ExecContext(ctx, step.Up); err != nil {
+				return fmt.Errorf("migration %v_%v up: %w", step.Version, step.Name, err)
+			}
+			_, err := transaction.ExecContext(ctx, getAddMigrationQuery(),
+				step.Version, step.Name, toMicros(time.Now()))
+			if err != nil {
+				return err
+			}
+			done = append(done, step)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return done, nil
+}
+
+// MigrateDown откатывает последние steps применённых шагов и возвращает откаченные
+func (s *SQLiteStorage) MigrateDown(ctx context.Context, steps int) ([]migration.Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var rolledBack []migration.Migration
+	err = s.withMigrations(ctx, func(transaction *sql.Tx, applied map[int64]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+			step := migrations[i]
+			if _, ok := applied[step.Version]; !ok {
+				continue
+			}
+			if _, err := transaction.ExecContext(ctx, step.Down); err != nil {
+				return fmt.Errorf("migration %v_%v down: %w", step.Version, step.Name, err)
+			}
+			if _, err := transaction.ExecContext(ctx, getDeleteMigrationQuery(), step.Version); err != nil {
+				return err
+			}
+			rolledBack = append(rolledBack, step)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rolledBack, nil
+}
+
+// MigrationStatus возвращает все известные шаги и время их применения
+func (s *SQLiteStorage) MigrationStatus(ctx context.Context) ([]migration.Status, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []migration.Status
+	err = s.withMigrations(ctx, func(transaction *sql.Tx, applied map[int64]time.Time) error {
+		statuses = migration.Statuses(migrations, applied)
+		return nil
+	})
+
+	return statuses, err
+}
+
+// withMigrations выполняет f в одной транзакции с журналом миграций.
+// Транзакции записи в SQLite идут по очереди, поэтому процессы, открывшие
+// один файл, не применят шаг дважды. При ошибке не применяется ни один шаг
+func (s *SQLiteStorage) withMigrations(ctx context.Context, f func(transaction *sql.Tx, applied map[int64]time.Time) error) error {
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	if _, err := transaction.ExecContext(ctx, getInitMigrationsQuery()); err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(ctx, transaction)
+	if err != nil {
+		return err
+	}
+
+	if err := f(transaction, applied); err != nil {
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+func appliedMigrations(ctx context.Context, transaction *sql.Tx) (map[int64]time.Time, error) {
+	result, err := transaction.QueryContext(ctx, getAppliedMigrationsQuery())
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	applied := make(map[int64]time.Time)
+	for result.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := result.Scan(&version, timeValue(&appliedAt)); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, result.Err()
+}
+
+func getInitMigrationsQuery() string {
+	return `
+	CREATE TABLE IF NOT EXISTS schema_migrations
+	(
+		version integer NOT NULL,
+		name text NOT NULL,
+		applied_at integer NOT NULL,
+		CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+	);
+	`
+}
+
+func getAppliedMigrationsQuery() string {
+	return `
+	SELECT version, applied_at
+		FROM schema_migrations
+	ORDER BY version
+	`
+}
+
+func getAddMigrationQuery() string {
+	return `
+	INSERT INTO schema_migrations(version, name, applied_at)
+		VALUES ($1, $2, $3);
+	`
+}
+
+func getDeleteMigrationQuery() string {
+	return `
+	DELETE FROM schema_migrations
+	WHERE
+		version = $1
+	`
+}
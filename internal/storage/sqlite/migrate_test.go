@@ -0,0 +1,48 @@
+package sqlite
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStorage(t)
+
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Migrations() returned no migrations")
+	}
+
+	statuses, err := st.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, el := range statuses {
+		if el.AppliedAt == nil {
+			t.Errorf("migration %v_%v is not applied", el.Version, el.Name)
+		}
+	}
+
+	// все шаги откатываются и применяются заново
+	rolledBack, err := st.MigrateDown(ctx, len(migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rolledBack) != len(migrations) {
+		t.Errorf("MigrateDown() rolled back %v of %v migrations", len(rolledBack), len(migrations))
+	}
+	applied, err := st.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("MigrateUp() applied %v of %v migrations", len(applied), len(migrations))
+	}
+	if applied, _ := st.MigrateUp(ctx); len(applied) != 0 {
+		t.Errorf("second MigrateUp() applied %v migrations", len(applied))
+	}
+}
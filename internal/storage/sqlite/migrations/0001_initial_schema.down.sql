@@ -0,0 +1,15 @@
+-- Удаляет всю схему вместе с данными
+DROP TABLE IF EXISTS ledger_entries;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS oidc_states;
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS two_factor_recovery_codes;
+DROP TABLE IF EXISTS two_factor;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS adjustments;
+DROP TABLE IF EXISTS withdrawals;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,205 @@
+-- Схема SQLite повторяет схему Postgres. Суммы баллов хранятся целым
+-- числом сотых долей, время — числом микросекунд с начала эпохи Unix
+
+CREATE TABLE users
+(
+	login text NOT NULL,
+	password text,
+	role text NOT NULL DEFAULT 'user',
+	blocked integer NOT NULL DEFAULT 0,
+	CONSTRAINT users_pkey PRIMARY KEY (login)
+);
+
+-- логины уникальны без учёта регистра; lower в SQLite меняет только латиницу
+CREATE UNIQUE INDEX users_login_lower_idx
+	ON users (lower(login));
+
+-- заказы, списания и корректировки хранятся после удаления пользователя
+-- для учёта, поэтому внешних ключей на пользователя у них нет
+CREATE TABLE orders
+(
+	id text NOT NULL,
+	owner text NOT NULL,
+	upload_date integer NOT NULL,
+	status text NOT NULL,
+	bonus integer NOT NULL,
+	CONSTRAINT orders_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE withdrawals
+(
+	order_id text NOT NULL,
+	sum integer NOT NULL,
+	processed_date integer NOT NULL,
+	user_id text NOT NULL
+);
+
+CREATE UNIQUE INDEX withdrawals_order_id_idx
+	ON withdrawals (order_id);
+
+CREATE TABLE adjustments
+(
+	id integer NOT NULL,
+	user_id text NOT NULL,
+	amount integer NOT NULL,
+	reason text NOT NULL,
+	operator text NOT NULL,
+	processed_date integer NOT NULL,
+	CONSTRAINT adjustments_pkey PRIMARY KEY (id AUTOINCREMENT)
+);
+
+CREATE TABLE sessions
+(
+	id text NOT NULL,
+	user_id text NOT NULL,
+	user_agent text NOT NULL DEFAULT '',
+	ip text NOT NULL DEFAULT '',
+	created_at integer NOT NULL,
+	last_seen_at integer NOT NULL,
+	expires_at integer NOT NULL,
+	revoked_at integer,
+	CONSTRAINT sessions_pkey PRIMARY KEY (id),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES users (login)
+		ON DELETE CASCADE
+);
+
+CREATE TABLE refresh_tokens
+(
+	token_hash text NOT NULL,
+	session_id text NOT NULL,
+	created_at integer NOT NULL,
+	expires_at integer NOT NULL,
+	used_at integer,
+	CONSTRAINT refresh_tokens_pkey PRIMARY KEY (token_hash),
+	CONSTRAINT fk_sessions FOREIGN KEY (session_id)
+		REFERENCES sessions (id)
+		ON DELETE CASCADE
+);
+
+CREATE TABLE two_factor
+(
+	user_id text NOT NULL,
+	secret text NOT NULL,
+	enabled integer NOT NULL,
+	last_counter integer NOT NULL,
+	created_at integer NOT NULL,
+	CONSTRAINT two_factor_pkey PRIMARY KEY (user_id),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES users (login)
+		ON DELETE CASCADE
+);
+
+CREATE TABLE two_factor_recovery_codes
+(
+	user_id text NOT NULL,
+	code_hash text NOT NULL,
+	used_at integer,
+	CONSTRAINT two_factor_recovery_codes_pkey PRIMARY KEY (user_id, code_hash),
+	CONSTRAINT fk_two_factor FOREIGN KEY (user_id)
+		REFERENCES two_factor (user_id)
+		ON DELETE CASCADE
+);
+
+-- scopes — области доступа через пробел
+CREATE TABLE api_keys
+(
+	id text NOT NULL,
+	user_id text NOT NULL,
+	name text NOT NULL,
+	prefix text NOT NULL,
+	key_hash text NOT NULL,
+	scopes text NOT NULL,
+	created_at integer NOT NULL,
+	last_used_at integer,
+	revoked_at integer,
+	CONSTRAINT api_keys_pkey PRIMARY KEY (id),
+	CONSTRAINT api_keys_key_hash_key UNIQUE (key_hash),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES users (login)
+		ON DELETE CASCADE
+);
+
+CREATE TABLE user_identities
+(
+	issuer text NOT NULL,
+	subject text NOT NULL,
+	user_id text NOT NULL,
+	email text NOT NULL,
+	created_at integer NOT NULL,
+	CONSTRAINT user_identities_pkey PRIMARY KEY (issuer, subject),
+	CONSTRAINT fk_users FOREIGN KEY (user_id)
+		REFERENCES users (login)
+		ON DELETE CASCADE
+);
+
+CREATE TABLE oidc_states
+(
+	state text NOT NULL,
+	nonce text NOT NULL,
+	code_verifier text NOT NULL,
+	created_at integer NOT NULL,
+	expires_at integer NOT NULL,
+	CONSTRAINT oidc_states_pkey PRIMARY KEY (state)
+);
+
+CREATE TABLE login_attempts
+(
+	key text NOT NULL,
+	failures integer NOT NULL,
+	first_failure integer NOT NULL,
+	last_failure integer NOT NULL,
+	locked_until integer,
+	CONSTRAINT login_attempts_pkey PRIMARY KEY (key)
+);
+
+CREATE TABLE audit_log
+(
+	id integer NOT NULL,
+	created_at integer NOT NULL,
+	actor text NOT NULL,
+	action text NOT NULL,
+	target text NOT NULL,
+	reason text NOT NULL,
+	CONSTRAINT audit_log_pkey PRIMARY KEY (id AUTOINCREMENT)
+);
+
+-- журнал баллов: каждая операция — две записи с общим transaction_id,
+-- на счёте пользователя (логин) и на встречном системном счёте "system:<вид>".
+-- Сумма записей операции равна нулю. balance — баланс счёта пользователя
+-- после записи, для системных счетов не ведётся
+CREATE TABLE ledger_entries
+(
+	id integer NOT NULL,
+	transaction_id integer NOT NULL,
+	account text NOT NULL,
+	kind text NOT NULL,
+	amount integer NOT NULL,
+	balance integer,
+	reference text,
+	created_at integer NOT NULL,
+	CONSTRAINT ledger_entries_pkey PRIMARY KEY (id AUTOINCREMENT),
+	CONSTRAINT ledger_entries_kind_check
+		CHECK (kind IN ('accrual', 'withdrawal', 'adjustment', 'expiration', 'refund'))
+);
+
+CREATE INDEX ledger_entries_account_idx
+	ON ledger_entries (account, id);
+
+CREATE INDEX ledger_entries_transaction_idx
+	ON ledger_entries (transaction_id);
+
+-- записи журнала не изменяются и не удаляются; при удалении пользователя
+-- меняется только название его счёта
+CREATE TRIGGER ledger_entries_no_delete
+	BEFORE DELETE ON ledger_entries
+BEGIN
+	SELECT RAISE(ABORT, 'ledger entries cannot be deleted');
+END;
+
+CREATE TRIGGER ledger_entries_append_only
+	BEFORE UPDATE OF id, transaction_id, kind, amount, balance, reference, created_at
+	ON ledger_entries
+BEGIN
+	SELECT RAISE(ABORT, 'ledger entries are append-only');
+END;
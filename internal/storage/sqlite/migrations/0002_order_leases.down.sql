@@ -0,0 +1,6 @@
+DROP INDEX orders_queue_idx;
+
+ALTER TABLE orders DROP COLUMN lease_owner;
+ALTER TABLE orders DROP COLUMN lease_expires_at;
+ALTER TABLE orders DROP COLUMN attempts;
+ALTER TABLE orders DROP COLUMN next_attempt_at;
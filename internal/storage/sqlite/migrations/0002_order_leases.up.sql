@@ -0,0 +1,8 @@
+-- очередь опроса системы начислений, как в Postgres
+ALTER TABLE orders ADD COLUMN lease_owner text;
+ALTER TABLE orders ADD COLUMN lease_expires_at integer;
+ALTER TABLE orders ADD COLUMN attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN next_attempt_at integer;
+
+CREATE INDEX orders_queue_idx
+	ON orders (status, next_attempt_at);
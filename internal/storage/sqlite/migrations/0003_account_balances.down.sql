@@ -0,0 +1,6 @@
+DROP TABLE account_balances;
+
+DROP INDEX ledger_entries_reference_idx;
+DROP INDEX adjustments_user_id_processed_date_idx;
+DROP INDEX withdrawals_user_id_processed_date_idx;
+DROP INDEX orders_owner_upload_date_idx;
@@ -0,0 +1,37 @@
+-- индексы для списков пользователя и сохранённый баланс счёта, как в Postgres
+CREATE INDEX orders_owner_upload_date_idx
+	ON orders (owner, upload_date);
+
+CREATE INDEX withdrawals_user_id_processed_date_idx
+	ON withdrawals (user_id, processed_date);
+
+CREATE INDEX adjustments_user_id_processed_date_idx
+	ON adjustments (user_id, processed_date);
+
+CREATE INDEX ledger_entries_reference_idx
+	ON ledger_entries (account, kind, reference);
+
+CREATE TABLE account_balances
+(
+	account text NOT NULL,
+	balance integer NOT NULL DEFAULT 0,
+	withdrawn integer NOT NULL DEFAULT 0,
+	CONSTRAINT account_balances_pkey PRIMARY KEY (account)
+);
+
+INSERT INTO account_balances(account, balance, withdrawn)
+SELECT entries.account,
+	(SELECT last.balance
+		FROM ledger_entries AS last
+	WHERE
+		last.account = entries.account
+	ORDER BY
+		last.id DESC
+	LIMIT 1),
+	COALESCE(-SUM(entries.amount)
+		FILTER (WHERE entries.kind IN ('withdrawal', 'refund')), 0)
+FROM ledger_entries AS entries
+WHERE
+	entries.account NOT LIKE 'system:%'
+GROUP BY
+	entries.account;
@@ -0,0 +1,13 @@
+-- пользователи, созданные при входе через провайдера, получали случайный
+-- пароль, который никто не знает. Теперь у них нет пароля ('!'): сменить
+-- пароль и удалить аккаунт они подтверждают недавним входом через провайдера.
+-- Пароль таких пользователей сменить было нельзя, поэтому случайный пароль
+-- есть у каждого пользователя с привязкой к провайдеру
+UPDATE users
+	SET password = '!'
+	WHERE
+		EXISTS (
+			SELECT 1
+				FROM user_identities as identities
+			WHERE
+				identities.user_id = users.login);
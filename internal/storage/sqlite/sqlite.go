@@ -0,0 +1,1839 @@
+// Package sqlite хранит данные сервиса во встроенной базе SQLite —
+// для небольших установок на одном сервере и демонстраций
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/lockout"
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/storage"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// URIScheme — начало строки подключения к SQLite, например
+// sqlite:///var/lib/gophermart.db или sqlite://gophermart.db
+const URIScheme = "sqlite://"
+
+type SQLiteStorage struct {
+	ConnStr string
+	db      *sql.DB
+}
+
+// IsURI возвращает true, если строка подключения указывает на файл SQLite
+func IsURI(connection string) bool {
+	return strings.HasPrefix(connection, URIScheme)
+}
+
+// dataSource возвращает путь к файлу базы с параметрами соединения.
+// Транзакции сразу берут блокировку записи, поэтому проверка баланса
+// и списание не разделяются чужой записью; занятая база ожидается,
+// а не возвращает SQLITE_BUSY. Журнал WAL позволяет читать во время записи
+func dataSource(connection string) (string, error) {
+	path := strings.TrimPrefix(connection, URIScheme)
+	if path == "" || strings.ContainsAny(path, "?#") {
+		return "", errors.New("sqlite database uri must look like sqlite:///path/to/file.db")
+	}
+
+	return path + "?_pragma=busy_timeout(10000)&_pragma=foreign_keys(1)" +
+		"&_pragma=journal_mode(WAL)&_txlock=immediate", nil
+}
+
+// NewSQLiteStorage открывает файл базы, создавая его при необходимости,
+// и применяет непримененные миграции
+func NewSQLiteStorage(ctx context.Context, connection string) (*SQLiteStorage, error) {
+	storage, err := Connect(ctx, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = storage.MigrateUp(ctx)
+	if err != nil {
+		storage.db.Close()
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// Connect открывает файл базы без изменения схемы
+func Connect(ctx context.Context, connection string) (*SQLiteStorage, error) {
+	dsn, err := dataSource(connection)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStorage{
+		ConnStr: connection,
+		db:      db,
+	}, nil
+}
+
+func (s *SQLiteStorage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLiteStorage) Quit(ctx context.Context) {
+	s.db.Close()
+}
+
+// loginConstraints - ограничения, нарушение которых означает занятый логин
+var loginConstraints = map[string]bool{
+	"users_pkey":            true,
+	"users_login_lower_idx": true,
+}
+
+// storageError приводит ошибку SQLite к ошибке пакета storage. Имя
+// нарушенного ограничения восстанавливается по сообщению, как в Postgres
+func storageError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	// база занята другой транзакцией записи дольше busy_timeout
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return fmt.Errorf("%w: %w", storage.ErrTransient, err)
+	}
+
+	// сообщение SQLite: "UNIQUE constraint failed: users.login (1555)"
+	// или "UNIQUE constraint failed: index 'users_login_lower_idx' (2067)"
+	detail := sqliteErr.Error()
+	if pos := strings.LastIndex(detail, "failed: "); pos >= 0 {
+		detail = detail[pos+len("failed: "):]
+	}
+	if pos := strings.LastIndex(detail, " ("); pos >= 0 {
+		detail = detail[:pos]
+	}
+	table, columns, _ := strings.Cut(detail, ".")
+
+	var constraint string
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		constraint = table + "_pkey"
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		if strings.HasPrefix(detail, "index '") {
+			constraint = strings.Trim(strings.TrimPrefix(detail, "index "), "'")
+		} else {
+			columns = strings.ReplaceAll(columns, ", "+table+".", "_")
+			constraint = table + "_" + columns + "_key"
+		}
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		return fmt.Errorf("%w: %w", storage.ErrNotFound, err)
+	default:
+		return err
+	}
+
+	if loginConstraints[constraint] {
+		return fmt.Errorf("%w: %v: %w", storage.ErrDuplicateLogin, constraint, err)
+	}
+	return fmt.Errorf("%w: %v: %w", storage.ErrConflict, constraint, err)
+}
+
+func (s *SQLiteStorage) AddUser(ctx context.Context, user *model.User) error {
+	_, err := s.db.ExecContext(ctx, addUserQuery(), user.Login, user.Password)
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func addUserQuery() string {
+	return `
+	INSERT INTO users(login, password)
+		VALUES ($1, $2);
+	`
+}
+
+// AddUserWithIdentity создаёт пользователя, вошедшего через внешнего
+// провайдера, и привязывает к нему учётную запись провайдера
+func (s *SQLiteStorage) AddUserWithIdentity(ctx context.Context, user *model.User, identity *model.Identity) error {
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback()
+
+	_, err = transaction.ExecContext(ctx, addUserQuery(), user.Login, user.Password)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.ExecContext(ctx, getAddIdentityQuery(), identity.Issuer,
+		identity.Subject, user.Login, identity.Email, toMicros(identity.CreatedAt))
+	if err != nil {
+		return storageError(err)
+	}
+
+	return storageError(transaction.Commit())
+}
+
+func getAddIdentityQuery() string {
+	return `
+	INSERT INTO user_identities(
+		issuer, subject, user_id, email, created_at)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+}
+
+// GetUserByIdentity возвращает пользователя, к которому привязана
+// учётная запись внешнего провайдера, или nil
+func (s *SQLiteStorage) GetUserByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error) {
+	var userInfo model.User
+	result := s.db.QueryRowContext(ctx, getUserByIdentityQuery(), issuer, subject)
+	switch err := result.Scan(&userInfo.Login, &userInfo.Password, &userInfo.Role, &userInfo.Blocked); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &userInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getUserByIdentityQuery() string {
+	return `
+	SELECT users.login, users.password, users.role, users.blocked
+		FROM user_identities AS identities
+		INNER JOIN users AS users
+	ON identities.user_id = users.login
+	WHERE
+		identities.issuer = $1
+		AND identities.subject = $2
+	`
+}
+
+// AddOIDCState сохраняет параметры начатого входа через внешнего провайдера
+// и заодно удаляет просроченные
+func (s *SQLiteStorage) AddOIDCState(ctx context.Context, state *model.OIDCState) error {
+	_, err := s.db.ExecContext(ctx, getDeleteExpiredOIDCStatesQuery(), toMicros(state.CreatedAt))
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = s.db.ExecContext(ctx, getAddOIDCStateQuery(), state.State, state.Nonce,
+		state.CodeVerifier, toMicros(state.CreatedAt), toMicros(state.ExpiresAt))
+	return storageError(err)
+}
+
+// TakeOIDCState возвращает и удаляет параметры входа, повторно
+// они не выдаются. Возвращает nil, если state не найден
+func (s *SQLiteStorage) TakeOIDCState(ctx context.Context, state string) (*model.OIDCState, error) {
+	var stateInfo model.OIDCState
+	result := s.db.QueryRowContext(ctx, getTakeOIDCStateQuery(), state)
+	switch err := result.Scan(&stateInfo.State, &stateInfo.Nonce, &stateInfo.CodeVerifier,
+		timeValue(&stateInfo.CreatedAt), timeValue(&stateInfo.ExpiresAt)); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &stateInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getAddOIDCStateQuery() string {
+	return `
+	INSERT INTO oidc_states(
+		state, nonce, code_verifier, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+}
+
+func getDeleteExpiredOIDCStatesQuery() string {
+	return `
+	DELETE FROM oidc_states
+	WHERE
+		expires_at < $1
+	`
+}
+
+func getTakeOIDCStateQuery() string {
+	return `
+	DELETE FROM oidc_states
+	WHERE
+		state = $1
+	RETURNING state, nonce, code_verifier, created_at, expires_at
+	`
+}
+
+func (s *SQLiteStorage) GetUser(ctx context.Context, user *model.User) (*model.User, error) {
+	var userInfo model.User
+	result := s.db.QueryRowContext(ctx, getUserQuery(), user.Login)
+	switch err := result.Scan(&userInfo.Login, &userInfo.Password, &userInfo.Role, &userInfo.Blocked); err {
+	case sql.ErrNoRows:
+		// пользователь не найден
+		return nil, nil
+	case nil:
+		return &userInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getUserQuery() string {
+	return `
+	SELECT login, password, role, blocked
+		FROM users
+	WHERE
+		lower(login) = lower($1)
+	`
+}
+
+// SearchUsers ищет пользователей по части логина без учёта регистра
+func (s *SQLiteStorage) SearchUsers(ctx context.Context, loginPattern string, limit int) ([]*model.User, error) {
+
+	users := []*model.User{}
+
+	// символы шаблона LIKE в строке поиска ищутся как обычные символы
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(loginPattern)
+
+	result, err := s.db.QueryContext(ctx, getSearchUsersQuery(), "%"+escaped+"%", limit)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var userInfo model.User
+		err = result.Scan(&userInfo.Login,
+			&userInfo.Role,
+			&userInfo.Blocked)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		users = append(users, &userInfo)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return users, nil
+}
+
+func getSearchUsersQuery() string {
+	return `
+	SELECT login, role, blocked
+		FROM users
+	WHERE
+		lower(login) LIKE lower($1) ESCAPE '\'
+	ORDER BY
+		login ASC
+	LIMIT $2
+	`
+}
+
+func (s *SQLiteStorage) SetUserRole(ctx context.Context, login string, role string) error {
+	updateRes, err := s.db.ExecContext(ctx, getSetUserRoleQuery(), role, login)
+	if err != nil {
+		return storageError(err)
+	}
+	if rows, err := updateRes.RowsAffected(); err != nil || rows == 0 {
+		return fmt.Errorf("role not updated: user %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getSetUserRoleQuery() string {
+	return `
+	UPDATE users
+		SET role=$1
+		WHERE lower(login)=lower($2);
+	`
+}
+
+func (s *SQLiteStorage) SetUserBlocked(ctx context.Context, login string, blocked bool) error {
+	updateRes, err := s.db.ExecContext(ctx, getSetUserBlockedQuery(), blocked, login)
+	if err != nil {
+		return storageError(err)
+	}
+	if rows, err := updateRes.RowsAffected(); err != nil || rows == 0 {
+		return fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getSetUserBlockedQuery() string {
+	return `
+	UPDATE users
+		SET blocked=$1
+		WHERE lower(login)=lower($2);
+	`
+}
+
+func (s *SQLiteStorage) UpdatePassword(ctx context.Context, login string, passwordHash string) error {
+	updateRes, err := s.db.ExecContext(ctx, getUpdatePasswordQuery(), passwordHash, login)
+	if err != nil {
+		return storageError(err)
+	}
+	if rows, err := updateRes.RowsAffected(); err != nil || rows == 0 {
+		return fmt.Errorf("password not updated: user %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getUpdatePasswordQuery() string {
+	return `
+	UPDATE users
+		SET password=$1
+		WHERE login=$2;
+	`
+}
+
+// DeleteUser удаляет пользователя, его сеансы и токены. Заказы, списания
+// и журнал баллов остаются для учёта, но вместо логина в них записывается anonymousID
+func (s *SQLiteStorage) DeleteUser(ctx context.Context, login string, anonymousID string) error {
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback()
+
+	queries := []string{
+		getAnonymizeOrdersQuery(),
+		getAnonymizeWithdrawalsQuery(),
+		getAnonymizeAdjustmentsQuery(),
+		getAnonymizeLedgerQuery(),
+		getAnonymizeAccountBalanceQuery(),
+	}
+	for _, el := range queries {
+		if _, err := transaction.ExecContext(ctx, el, login, anonymousID); err != nil {
+			return storageError(err)
+		}
+	}
+
+	deleteRes, err := transaction.ExecContext(ctx, getDeleteUserQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+	if rows, err := deleteRes.RowsAffected(); err != nil || rows == 0 {
+		return fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	return storageError(transaction.Commit())
+}
+
+func getAnonymizeOrdersQuery() string {
+	return `
+	UPDATE orders
+		SET owner=$2
+		WHERE owner=$1;
+	`
+}
+
+func getAnonymizeWithdrawalsQuery() string {
+	return `
+	UPDATE withdrawals
+		SET user_id=$2
+		WHERE user_id=$1;
+	`
+}
+
+func getAnonymizeAdjustmentsQuery() string {
+	return `
+	UPDATE adjustments
+		SET user_id=$2
+		WHERE user_id=$1;
+	`
+}
+
+func getAnonymizeLedgerQuery() string {
+	return `
+	UPDATE ledger_entries
+		SET account=$2
+		WHERE account=$1;
+	`
+}
+
+func getAnonymizeAccountBalanceQuery() string {
+	return `
+	UPDATE account_balances
+		SET account=$2
+		WHERE account=$1;
+	`
+}
+
+func getDeleteUserQuery() string {
+	return `
+	DELETE FROM users
+		WHERE login=$1;
+	`
+}
+
+func (s *SQLiteStorage) AddSession(ctx context.Context, session *model.Session, token *model.RefreshToken) error {
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback()
+
+	_, err = transaction.ExecContext(ctx, getAddSessionQuery(), session.ID, session.User,
+		toMicros(session.CreatedAt), toMicros(session.ExpiresAt), session.UserAgent, session.IP)
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.ExecContext(ctx, getAddRefreshTokenQuery(), token.Hash,
+		token.SessionID, toMicros(token.CreatedAt), toMicros(token.ExpiresAt))
+	if err != nil {
+		return storageError(err)
+	}
+
+	return storageError(transaction.Commit())
+}
+
+func getAddSessionQuery() string {
+	return `
+	INSERT INTO sessions(
+		id, user_id, created_at, expires_at, user_agent, ip, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $3);
+	`
+}
+
+func getAddRefreshTokenQuery() string {
+	return `
+	INSERT INTO refresh_tokens(
+		token_hash, session_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4);
+	`
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row rowScanner) (*model.Session, error) {
+	var session model.Session
+	err := row.Scan(&session.ID,
+		&session.User,
+		&session.UserAgent,
+		&session.IP,
+		timeValue(&session.CreatedAt),
+		timeValue(&session.LastSeenAt),
+		timeValue(&session.ExpiresAt),
+		nullTimeValue(&session.RevokedAt))
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SQLiteStorage) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx, getSessionQuery(), sessionID))
+	switch err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return session, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getSessionQuery() string {
+	return `
+	SELECT sessions.id,
+			sessions.user_id,
+			sessions.user_agent,
+			sessions.ip,
+			sessions.created_at,
+			sessions.last_seen_at,
+			sessions.expires_at,
+			sessions.revoked_at
+	FROM sessions AS sessions
+	WHERE
+		sessions.id = $1
+	`
+}
+
+// GetUserSessions возвращает действующие сеансы пользователя
+func (s *SQLiteStorage) GetUserSessions(ctx context.Context, login string) ([]*model.Session, error) {
+
+	sessions := []*model.Session{}
+
+	result, err := s.db.QueryContext(ctx, getUserSessionsQuery(), login, toMicros(time.Now()))
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		session, err := scanSession(result)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return sessions, nil
+}
+
+func getUserSessionsQuery() string {
+	return `
+	SELECT sessions.id,
+			sessions.user_id,
+			sessions.user_agent,
+			sessions.ip,
+			sessions.created_at,
+			sessions.last_seen_at,
+			sessions.expires_at,
+			sessions.revoked_at
+	FROM sessions AS sessions
+	WHERE
+		sessions.user_id = $1
+		AND sessions.revoked_at IS NULL
+		AND sessions.expires_at > $2
+	ORDER BY
+		sessions.last_seen_at DESC
+	`
+}
+
+func (s *SQLiteStorage) TouchSession(ctx context.Context, sessionID string, lastSeen time.Time) error {
+	_, err := s.db.ExecContext(ctx, getTouchSessionQuery(), sessionID, toMicros(lastSeen))
+	return storageError(err)
+}
+
+func getTouchSessionQuery() string {
+	return `
+	UPDATE sessions
+		SET last_seen_at=$2
+		WHERE id=$1 AND last_seen_at < $2;
+	`
+}
+
+func (s *SQLiteStorage) RotateRefreshToken(ctx context.Context, tokenHash string, newToken *model.RefreshToken) (*model.Session, model.EndPointStatus, error) {
+
+	var token model.RefreshToken
+	var session model.Session
+
+	// транзакция сразу берёт блокировку записи, поэтому два одновременных
+	// обновления не получат новые токены
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+	defer transaction.Rollback()
+
+	result := transaction.QueryRowContext(ctx, getRefreshTokenQuery(), tokenHash)
+	switch err := result.Scan(&token.Hash,
+		timeValue(&token.ExpiresAt),
+		nullTimeValue(&token.UsedAt),
+		&session.ID,
+		&session.User,
+		timeValue(&session.CreatedAt),
+		timeValue(&session.ExpiresAt),
+		nullTimeValue(&session.RevokedAt)); err {
+	case sql.ErrNoRows:
+		return nil, model.RefreshTokenInvalid, nil
+	case nil:
+	default:
+		return nil, model.OtherError, storageError(err)
+	}
+
+	if session.RevokedAt != nil {
+		return nil, model.RefreshTokenInvalid, nil
+	}
+
+	now := newToken.CreatedAt
+	if token.UsedAt != nil {
+		// токен уже был использован - похоже на кражу токена,
+		// отзываем весь сеанс
+		_, err = transaction.ExecContext(ctx, getRevokeSessionQuery(), session.ID, toMicros(now))
+		if err != nil {
+			return nil, model.OtherError, storageError(err)
+		}
+		if err = transaction.Commit(); err != nil {
+			return nil, model.OtherError, storageError(err)
+		}
+		return &session, model.RefreshTokenReused, nil
+	}
+
+	if now.After(token.ExpiresAt) || now.After(session.ExpiresAt) {
+		return nil, model.RefreshTokenInvalid, nil
+	}
+
+	_, err = transaction.ExecContext(ctx, getUseRefreshTokenQuery(), token.Hash, toMicros(now))
+	if err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+
+	newToken.SessionID = session.ID
+	_, err = transaction.ExecContext(ctx, getAddRefreshTokenQuery(), newToken.Hash,
+		newToken.SessionID, toMicros(newToken.CreatedAt), toMicros(newToken.ExpiresAt))
+	if err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+
+	if err = transaction.Commit(); err != nil {
+		return nil, model.OtherError, storageError(err)
+	}
+
+	return &session, model.RefreshTokenRotated, nil
+}
+
+func getRefreshTokenQuery() string {
+	return `
+	SELECT tokens.token_hash,
+			tokens.expires_at,
+			tokens.used_at,
+			sessions.id,
+			sessions.user_id,
+			sessions.created_at,
+			sessions.expires_at,
+			sessions.revoked_at
+	FROM refresh_tokens AS tokens
+		INNER JOIN sessions AS sessions
+	ON tokens.session_id = sessions.id
+	WHERE
+		tokens.token_hash = $1
+	`
+}
+
+func getUseRefreshTokenQuery() string {
+	return `
+	UPDATE refresh_tokens
+		SET used_at=$2
+		WHERE token_hash=$1;
+	`
+}
+
+func (s *SQLiteStorage) RevokeSession(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, getRevokeSessionQuery(), sessionID, toMicros(time.Now()))
+	return storageError(err)
+}
+
+func (s *SQLiteStorage) RevokeUserSessions(ctx context.Context, login string) error {
+	_, err := s.db.ExecContext(ctx, getRevokeUserSessionsQuery(), login, toMicros(time.Now()))
+	return storageError(err)
+}
+
+// RevokeUserSession отзывает один сеанс пользователя. Возвращает false,
+// если у пользователя нет действующего сеанса с таким идентификатором
+func (s *SQLiteStorage) RevokeUserSession(ctx context.Context, login string, sessionID string) (bool, error) {
+	updateRes, err := s.db.ExecContext(ctx, getRevokeUserSessionQuery(), sessionID, login, toMicros(time.Now()))
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	rows, err := updateRes.RowsAffected()
+	return rows > 0, storageError(err)
+}
+
+func getRevokeUserSessionQuery() string {
+	return `
+	UPDATE sessions
+		SET revoked_at=$3
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL;
+	`
+}
+
+func getRevokeUserSessionsQuery() string {
+	return `
+	UPDATE sessions
+		SET revoked_at=$2
+		WHERE user_id=$1 AND revoked_at IS NULL;
+	`
+}
+
+func getRevokeSessionQuery() string {
+	return `
+	UPDATE sessions
+		SET revoked_at=$2
+		WHERE id=$1 AND revoked_at IS NULL;
+	`
+}
+
+// SetTwoFactorSecret сохраняет новый секрет и коды восстановления.
+// Второй фактор остаётся выключенным до подтверждения
+func (s *SQLiteStorage) SetTwoFactorSecret(ctx context.Context, login string, secret string, recoveryCodeHashes []string) error {
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback()
+
+	_, err = transaction.ExecContext(ctx, getSetTwoFactorSecretQuery(), login, secret, toMicros(time.Now()))
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = transaction.ExecContext(ctx, getDeleteRecoveryCodesQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+
+	for _, el := range recoveryCodeHashes {
+		_, err = transaction.ExecContext(ctx, getAddRecoveryCodeQuery(), login, el)
+		if err != nil {
+			return storageError(err)
+		}
+	}
+
+	return storageError(transaction.Commit())
+}
+
+func getSetTwoFactorSecretQuery() string {
+	return `
+	INSERT INTO two_factor(
+		user_id, secret, enabled, last_counter, created_at)
+		VALUES ($1, $2, false, 0, $3)
+	ON CONFLICT (user_id) DO UPDATE
+		SET secret=excluded.secret, enabled=false, last_counter=0, created_at=excluded.created_at;
+	`
+}
+
+func getDeleteRecoveryCodesQuery() string {
+	return `
+	DELETE FROM two_factor_recovery_codes
+		WHERE user_id=$1;
+	`
+}
+
+func getAddRecoveryCodeQuery() string {
+	return `
+	INSERT INTO two_factor_recovery_codes(
+		user_id, code_hash)
+		VALUES ($1, $2);
+	`
+}
+
+func (s *SQLiteStorage) GetTwoFactor(ctx context.Context, login string) (*model.TwoFactor, error) {
+	var twoFactor model.TwoFactor
+
+	result := s.db.QueryRowContext(ctx, getTwoFactorQuery(), login)
+	switch err := result.Scan(&twoFactor.Secret,
+		&twoFactor.Enabled,
+		&twoFactor.LastCounter); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &twoFactor, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func getTwoFactorQuery() string {
+	return `
+	SELECT two_factor.secret,
+			two_factor.enabled,
+			two_factor.last_counter
+	FROM two_factor AS two_factor
+	WHERE
+		two_factor.user_id = $1
+	`
+}
+
+func (s *SQLiteStorage) EnableTwoFactor(ctx context.Context, login string) error {
+	updateRes, err := s.db.ExecContext(ctx, getEnableTwoFactorQuery(), login)
+	if err != nil {
+		return storageError(err)
+	}
+	if rows, err := updateRes.RowsAffected(); err != nil || rows == 0 {
+		return fmt.Errorf("two-factor authentication is not enrolled: secret %w", storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+func getEnableTwoFactorQuery() string {
+	return `
+	UPDATE two_factor
+		SET enabled=true
+		WHERE user_id=$1;
+	`
+}
+
+func (s *SQLiteStorage) DisableTwoFactor(ctx context.Context, login string) error {
+	// коды восстановления удаляются каскадно
+	_, err := s.db.ExecContext(ctx, getDisableTwoFactorQuery(), login)
+	return storageError(err)
+}
+
+func getDisableTwoFactorQuery() string {
+	return `
+	DELETE FROM two_factor
+		WHERE user_id=$1;
+	`
+}
+
+// UseTwoFactorCounter запоминает период принятого кода. Возвращает false,
+// если код этого периода уже был использован
+func (s *SQLiteStorage) UseTwoFactorCounter(ctx context.Context, login string, counter int64) (bool, error) {
+	updateRes, err := s.db.ExecContext(ctx, getUseTwoFactorCounterQuery(), login, counter)
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	rows, err := updateRes.RowsAffected()
+	return rows > 0, storageError(err)
+}
+
+func getUseTwoFactorCounterQuery() string {
+	return `
+	UPDATE two_factor
+		SET last_counter=$2
+		WHERE user_id=$1 AND last_counter < $2;
+	`
+}
+
+// UseRecoveryCode погашает код восстановления. Возвращает false, если
+// код не найден или уже использован
+func (s *SQLiteStorage) UseRecoveryCode(ctx context.Context, login string, codeHash string) (bool, error) {
+	updateRes, err := s.db.ExecContext(ctx, getUseRecoveryCodeQuery(), login, codeHash, toMicros(time.Now()))
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	rows, err := updateRes.RowsAffected()
+	return rows > 0, storageError(err)
+}
+
+func getUseRecoveryCodeQuery() string {
+	return `
+	UPDATE two_factor_recovery_codes
+		SET used_at=$3
+		WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL;
+	`
+}
+
+func (s *SQLiteStorage) AddAPIKey(ctx context.Context, key *model.APIKey) error {
+	_, err := s.db.ExecContext(ctx, getAddAPIKeyQuery(), key.ID, key.User, key.Name,
+		key.Prefix, key.Hash, joinScopes(key.Scopes), toMicros(key.CreatedAt))
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+func getAddAPIKeyQuery() string {
+	return `
+	INSERT INTO api_keys(
+		id, user_id, name, prefix, key_hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);
+	`
+}
+
+func (s *SQLiteStorage) GetAPIKeys(ctx context.Context, login string) ([]*model.APIKey, error) {
+
+	keys := []*model.APIKey{}
+
+	result, err := s.db.QueryContext(ctx, getAPIKeysQuery(), login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		key, err := scanAPIKey(result)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		keys = append(keys, key)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return keys, nil
+}
+
+func (s *SQLiteStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (*model.APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, getAPIKeyByHashQuery(), keyHash))
+	switch err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return key, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func scanAPIKey(row rowScanner) (*model.APIKey, error) {
+	var key model.APIKey
+	err := row.Scan(&key.ID,
+		&key.User,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		scopesValue(&key.Scopes),
+		timeValue(&key.CreatedAt),
+		nullTimeValue(&key.LastUsedAt),
+		nullTimeValue(&key.RevokedAt))
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func getAPIKeysQuery() string {
+	return `
+	SELECT keys.id,
+			keys.user_id,
+			keys.name,
+			keys.prefix,
+			keys.key_hash,
+			keys.scopes,
+			keys.created_at,
+			keys.last_used_at,
+			keys.revoked_at
+	FROM api_keys AS keys
+	WHERE
+		keys.user_id = $1
+	ORDER BY
+		keys.created_at ASC
+	`
+}
+
+func getAPIKeyByHashQuery() string {
+	return `
+	SELECT keys.id,
+			keys.user_id,
+			keys.name,
+			keys.prefix,
+			keys.key_hash,
+			keys.scopes,
+			keys.created_at,
+			keys.last_used_at,
+			keys.revoked_at
+	FROM api_keys AS keys
+	WHERE
+		keys.key_hash = $1
+	`
+}
+
+func (s *SQLiteStorage) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, getTouchAPIKeyQuery(), id, toMicros(usedAt))
+	return storageError(err)
+}
+
+func getTouchAPIKeyQuery() string {
+	return `
+	UPDATE api_keys
+		SET last_used_at=$2
+		WHERE id=$1;
+	`
+}
+
+// RevokeAPIKey отзывает ключ пользователя. Возвращает false, если у
+// пользователя нет действующего ключа с таким идентификатором
+func (s *SQLiteStorage) RevokeAPIKey(ctx context.Context, login string, id string) (bool, error) {
+	updateRes, err := s.db.ExecContext(ctx, getRevokeAPIKeyQuery(), id, login, toMicros(time.Now()))
+	if err != nil {
+		return false, storageError(err)
+	}
+
+	rows, err := updateRes.RowsAffected()
+	return rows > 0, storageError(err)
+}
+
+func getRevokeAPIKeyQuery() string {
+	return `
+	UPDATE api_keys
+		SET revoked_at=$3
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL;
+	`
+}
+
+func (s *SQLiteStorage) AddAuditRecord(ctx context.Context, record *model.AuditRecord) error {
+	insertRes, err := s.db.ExecContext(ctx, getAddAuditRecordQuery(), toMicros(record.CreatedAt),
+		record.Actor, record.Action, record.Target, record.Reason)
+	if err != nil {
+		return storageError(err)
+	}
+
+	record.ID, err = insertRes.LastInsertId()
+	return storageError(err)
+}
+
+func getAddAuditRecordQuery() string {
+	return `
+	INSERT INTO audit_log(
+		created_at, actor, action, target, reason)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+}
+
+func (s *SQLiteStorage) GetLoginAttempts(ctx context.Context, key string) (*lockout.State, error) {
+	return getLoginAttempts(ctx, s.db, key)
+}
+
+// RegisterLoginFailure учитывает неудачную попытку входа. Транзакция сразу
+// берёт блокировку записи, поэтому одновременные попытки не теряются
+func (s *SQLiteStorage) RegisterLoginFailure(ctx context.Context, key string, policy lockout.Policy, now time.Time) (*lockout.State, error) {
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	defer transaction.Rollback()
+
+	_, err = transaction.ExecContext(ctx, getInitLoginAttemptsQuery(), key, toMicros(now))
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	state, err := getLoginAttempts(ctx, transaction, key)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	newState := policy.Apply(state, now)
+	var lockedUntil *time.Time
+	if !newState.LockedUntil.IsZero() {
+		lockedUntil = &newState.LockedUntil
+	}
+	_, err = transaction.ExecContext(ctx, getUpdateLoginAttemptsQuery(), key, newState.Failures,
+		toMicros(newState.FirstFailure), toMicros(newState.LastFailure), nullMicros(lockedUntil))
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	if err = transaction.Commit(); err != nil {
+		return nil, storageError(err)
+	}
+
+	return newState, nil
+}
+
+func (s *SQLiteStorage) ResetLoginAttempts(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, getResetLoginAttemptsQuery(), key)
+	return storageError(err)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func getLoginAttempts(ctx context.Context, q queryRower, key string) (*lockout.State, error) {
+	var state lockout.State
+	var lockedUntil *time.Time
+
+	result := q.QueryRowContext(ctx, getLoginAttemptsQuery(), key)
+	switch err := result.Scan(&state.Failures,
+		timeValue(&state.FirstFailure),
+		timeValue(&state.LastFailure),
+		nullTimeValue(&lockedUntil)); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		if lockedUntil != nil {
+			state.LockedUntil = *lockedUntil
+		}
+		return &state, nil
+	default:
+		return nil, err
+	}
+}
+
+func getLoginAttemptsQuery() string {
+	return `
+	SELECT attempts.failures,
+			attempts.first_failure,
+			attempts.last_failure,
+			attempts.locked_until
+	FROM login_attempts AS attempts
+	WHERE
+		attempts.key = $1
+	`
+}
+
+func getInitLoginAttemptsQuery() string {
+	return `
+	INSERT INTO login_attempts(
+		key, failures, first_failure, last_failure)
+		VALUES ($1, 0, $2, $2)
+	ON CONFLICT (key) DO NOTHING;
+	`
+}
+
+func getUpdateLoginAttemptsQuery() string {
+	return `
+	UPDATE login_attempts
+		SET failures=$2, first_failure=$3, last_failure=$4, locked_until=$5
+		WHERE key=$1;
+	`
+}
+
+func getResetLoginAttemptsQuery() string {
+	return `
+	DELETE FROM login_attempts
+		WHERE key=$1;
+	`
+}
+
+func scanOrder(row rowScanner) (*model.Order, error) {
+	var orderInfo model.Order
+	err := row.Scan(&orderInfo.ID,
+		&orderInfo.Owner,
+		timeValue(&orderInfo.UploadDate),
+		&orderInfo.Status,
+		&orderInfo.Bonus)
+	if err != nil {
+		return nil, err
+	}
+	return &orderInfo, nil
+}
+
+func (s *SQLiteStorage) UploadOrder(ctx context.Context, orderID string, user *model.User) (model.EndPointStatus, error) {
+
+	orderInfo, err := scanOrder(s.db.QueryRowContext(ctx, getOrderInfoQuery(), orderID))
+	switch err {
+	case sql.ErrNoRows:
+		// заказа нет - создаем новый
+		_, err := s.db.ExecContext(ctx, getAddOrderQuery(), orderID,
+			user.Login, toMicros(time.Now()), model.OrderStatusNew, money.Amount(0))
+		if err != nil {
+			return model.OtherError, storageError(err)
+		}
+		return model.OrderAcceptedToProcessing, nil
+	case nil:
+		// заказ есть - проверим, кем был загружен
+		if orderInfo.Owner == user.Login {
+			return model.OrderAlreadyUploaded, nil
+		}
+		return model.OrderAlreadyUploadedByAnotherUser, nil
+	default:
+		return model.OtherError, storageError(err)
+	}
+}
+
+func getOrderInfoQuery() string {
+	return `
+	SELECT orders.id,
+			orders.owner,
+			orders.upload_date,
+			orders.status,
+			orders.bonus
+	FROM orders AS orders
+	WHERE
+		orders.id = $1
+	`
+}
+
+func getAddOrderQuery() string {
+	return `
+	INSERT INTO orders(
+		id, owner, upload_date, status, bonus)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+}
+
+func (s *SQLiteStorage) GetOrder(ctx context.Context, orderID string) (*model.Order, error) {
+	orderInfo, err := scanOrder(s.db.QueryRowContext(ctx, getOrderInfoQuery(), orderID))
+	switch err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return orderInfo, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+func (s *SQLiteStorage) GetAllOrders(ctx context.Context, user *model.User) ([]*model.Order, error) {
+
+	orders := []*model.Order{}
+
+	result, err := s.db.QueryContext(ctx, getAllOrdersQuery(), user.Login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		orderInfo, err := scanOrder(result)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		orders = append(orders, orderInfo)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return orders, nil
+}
+
+func getAllOrdersQuery() string {
+	return `
+	SELECT orders.id,
+			orders.owner,
+			orders.upload_date,
+			orders.status,
+			orders.bonus
+		FROM orders as orders
+	WHERE
+		orders.owner = $1
+	ORDER BY
+		orders.upload_date ASC
+	`
+}
+
+// GetBalance возвращает сохранённый баланс пользователя
+func (s *SQLiteStorage) GetBalance(ctx context.Context, user *model.User) (*model.Balance, error) {
+
+	var balance model.Balance
+
+	result := s.db.QueryRowContext(ctx, getAccountBalanceQuery(), user.Login)
+	switch err := result.Scan(&balance.Current, &balance.Withdrawn); err {
+	case sql.ErrNoRows:
+		// операций по счёту ещё не было
+		return &balance, nil
+	case nil:
+		return &balance, nil
+	default:
+		return nil, storageError(err)
+	}
+}
+
+// GetLedgerTotals возвращает суммы записей журнала по счёту пользователя
+// по видам операций
+func (s *SQLiteStorage) GetLedgerTotals(ctx context.Context, user *model.User) (map[string]money.Amount, error) {
+
+	result, err := s.db.QueryContext(ctx, getLedgerTotalsQuery(), user.Login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	defer result.Close()
+
+	totals := map[string]money.Amount{}
+	for result.Next() {
+		var kind string
+		var amount money.Amount
+		if err := result.Scan(&kind, &amount); err != nil {
+			return nil, storageError(err)
+		}
+		totals[kind] = amount
+	}
+	if err := result.Err(); err != nil {
+		return nil, storageError(err)
+	}
+
+	return totals, nil
+}
+
+func getLedgerTotalsQuery() string {
+	return `
+	SELECT entries.kind,
+		SUM(entries.amount)
+	FROM ledger_entries as entries
+	WHERE
+		entries.account = $1
+	GROUP BY
+		entries.kind
+	`
+}
+
+// RequestWithdrawal проверяет баланс и записывает списание в одной транзакции.
+// Транзакции записи в SQLite выполняются по очереди, поэтому одновременные
+// списания не уводят баланс в минус
+func (s *SQLiteStorage) RequestWithdrawal(ctx context.Context, withdrawalInfo *model.Withdrawal) (model.EndPointStatus, error) {
+
+	var current money.Amount
+
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.OtherError, storageError(err)
+	}
+	defer transaction.Rollback()
+
+	var exists bool
+	err = transaction.QueryRowContext(ctx, getUserExistsQuery(), withdrawalInfo.User).Scan(&exists)
+	if err != nil {
+		return model.OtherError, storageError(err)
+	}
+	if !exists {
+		return model.OtherError, fmt.Errorf("user %w", storage.ErrNotFound)
+	}
+
+	// проверим, нет ли уже списаний по этому заказу
+	err = transaction.QueryRowContext(ctx, getWithdrawalExistsQuery(), withdrawalInfo.OrderID).Scan(&exists)
+	if err != nil {
+		return model.OtherError, storageError(err)
+	}
+	if exists {
+		// списания есть - запрещаем повторное списание
+		return model.WithdrawalAlreadyRequested, nil
+	}
+
+	var withdrawn money.Amount
+	result := transaction.QueryRowContext(ctx, getAccountBalanceQuery(), withdrawalInfo.User)
+	switch err := result.Scan(&current, &withdrawn); err {
+	case sql.ErrNoRows:
+		// бонусов нет
+		return model.WithdrawalNoBonuses, nil
+	case nil:
+	default:
+		return model.OtherError, storageError(err)
+	}
+
+	// проверим хватит ли бонусов для списания в счет заказа
+	if current < withdrawalInfo.Sum {
+		return model.WithdrawalNotEnoughBonuses, nil
+	}
+
+	_, err = transaction.ExecContext(ctx, getAddWithdrawalQuery(), withdrawalInfo.OrderID,
+		withdrawalInfo.Sum, toMicros(withdrawalInfo.ProcessedDate), withdrawalInfo.User)
+	if err != nil {
+		return model.OtherError, storageError(err)
+	}
+
+	err = postLedgerEntry(ctx, transaction, &model.LedgerEntry{
+		Account:   withdrawalInfo.User,
+		Kind:      model.LedgerWithdrawal,
+		Amount:    -withdrawalInfo.Sum,
+		Reference: withdrawalInfo.OrderID,
+		CreatedAt: withdrawalInfo.ProcessedDate,
+	})
+	if err != nil {
+		return model.OtherError, storageError(err)
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return model.OtherError, storageError(err)
+	}
+	return model.WithdrawalAccepted, nil
+}
+
+func getUserExistsQuery() string {
+	return `
+	SELECT EXISTS(
+		SELECT 1
+			FROM users as users
+		WHERE
+			users.login = $1)
+	`
+}
+
+func getWithdrawalExistsQuery() string {
+	return `
+	SELECT EXISTS(
+		SELECT 1
+			FROM withdrawals as withdrawals
+		WHERE
+			withdrawals.order_id = $1)
+	`
+}
+
+func getAddWithdrawalQuery() string {
+	return `
+	INSERT INTO withdrawals(
+		order_id, sum, processed_date, user_id)
+		VALUES ($1, $2, $3, $4);
+	`
+}
+
+func (s *SQLiteStorage) GetAllWithdrawals(ctx context.Context, user *model.User) ([]*model.Withdrawal, error) {
+
+	withdrawals := []*model.Withdrawal{}
+
+	result, err := s.db.QueryContext(ctx, getAllWithdrawalsQuery(), user.Login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var withdrawalInfo model.Withdrawal
+		err = result.Scan(&withdrawalInfo.OrderID,
+			&withdrawalInfo.Sum,
+			timeValue(&withdrawalInfo.ProcessedDate))
+		if err != nil {
+			return nil, storageError(err)
+		}
+		withdrawals = append(withdrawals, &withdrawalInfo)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return withdrawals, nil
+}
+
+func getAllWithdrawalsQuery() string {
+	return `
+	SELECT withdrawals.order_id,
+			withdrawals.sum,
+			withdrawals.processed_date
+	FROM withdrawals as withdrawals
+	WHERE
+		withdrawals.user_id = $1
+	ORDER BY
+		withdrawals.processed_date ASC
+	`
+}
+
+// AddAdjustment записывает корректировку и проводит её по журналу баллов
+func (s *SQLiteStorage) AddAdjustment(ctx context.Context, adjustment *model.Adjustment) error {
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storageError(err)
+	}
+	defer transaction.Rollback()
+
+	insertRes, err := transaction.ExecContext(ctx, getAddAdjustmentQuery(), adjustment.User,
+		adjustment.Amount, adjustment.Reason, adjustment.Operator, toMicros(adjustment.ProcessedDate))
+	if err != nil {
+		return storageError(err)
+	}
+	adjustment.ID, err = insertRes.LastInsertId()
+	if err != nil {
+		return storageError(err)
+	}
+
+	err = postLedgerEntry(ctx, transaction, &model.LedgerEntry{
+		Account:   adjustment.User,
+		Kind:      model.LedgerAdjustment,
+		Amount:    adjustment.Amount,
+		Reference: strconv.FormatInt(adjustment.ID, 10),
+		CreatedAt: adjustment.ProcessedDate,
+	})
+	if err != nil {
+		return storageError(err)
+	}
+
+	return storageError(transaction.Commit())
+}
+
+func getAddAdjustmentQuery() string {
+	return `
+	INSERT INTO adjustments(
+		user_id, amount, reason, operator, processed_date)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+}
+
+func (s *SQLiteStorage) GetAllAdjustments(ctx context.Context, user *model.User) ([]*model.Adjustment, error) {
+
+	adjustments := []*model.Adjustment{}
+
+	result, err := s.db.QueryContext(ctx, getAllAdjustmentsQuery(), user.Login)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var adjustment model.Adjustment
+		err = result.Scan(&adjustment.ID,
+			&adjustment.User,
+			&adjustment.Amount,
+			&adjustment.Reason,
+			&adjustment.Operator,
+			timeValue(&adjustment.ProcessedDate))
+		if err != nil {
+			return nil, storageError(err)
+		}
+		adjustments = append(adjustments, &adjustment)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return adjustments, nil
+}
+
+func getAllAdjustmentsQuery() string {
+	return `
+	SELECT adjustments.id,
+			adjustments.user_id,
+			adjustments.amount,
+			adjustments.reason,
+			adjustments.operator,
+			adjustments.processed_date
+	FROM adjustments as adjustments
+	WHERE
+		adjustments.user_id = $1
+	ORDER BY
+		adjustments.processed_date ASC
+	`
+}
+
+// GetOrdersForUpdate выдаёт worker в аренду на leaseTime до limit заказов,
+// ожидающих расчёта начисления. Заказы, которые уже в аренде, пропускаются;
+// запросы записи в SQLite идут по очереди, поэтому заказ не выдаётся дважды
+func (s *SQLiteStorage) GetOrdersForUpdate(ctx context.Context, worker string, limit int, leaseTime time.Duration) ([]model.Order, error) {
+
+	orders := []model.Order{}
+	now := time.Now()
+
+	statuses := model.OrderStatusesForUpdate()
+	args := make([]interface{}, 0, len(statuses)+4)
+	for _, el := range statuses {
+		args = append(args, el)
+	}
+	args = append(args, toMicros(now), limit, worker, toMicros(now.Add(leaseTime)))
+
+	result, err := s.db.QueryContext(ctx, getClaimOrdersQuery(len(statuses)), args...)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var orderInfo model.Order
+		err = result.Scan(&orderInfo.ID,
+			&orderInfo.Owner,
+			timeValue(&orderInfo.UploadDate),
+			&orderInfo.Status,
+			&orderInfo.Bonus,
+			&orderInfo.Attempts,
+			nullTimeValue(&orderInfo.NextAttemptAt))
+		if err != nil {
+			return nil, storageError(err)
+		}
+		orders = append(orders, orderInfo)
+	}
+
+	err = result.Err()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	sortOrders(orders)
+
+	return orders, nil
+}
+
+// getClaimOrdersQuery выдаёт в аренду заказы со статусами из первых count
+// параметров, следующие параметры - текущее время, число заказов, исполнитель
+// и окончание аренды
+func getClaimOrdersQuery(count int) string {
+	params := make([]string, 0, count)
+	for i := 1; i <= count; i++ {
+		params = append(params, "$"+strconv.Itoa(i))
+	}
+	param := func(n int) string {
+		return "$" + strconv.Itoa(count+n)
+	}
+
+	return `
+	UPDATE orders
+		SET lease_owner=` + param(3) + `,
+			lease_expires_at=` + param(4) + `,
+			attempts=attempts + 1
+	WHERE
+		id IN (
+			SELECT orders.id
+				FROM orders as orders
+			WHERE
+				orders.status IN (` + strings.Join(params, ", ") + `)
+				AND (orders.next_attempt_at IS NULL OR orders.next_attempt_at <= ` + param(1) + `)
+				AND (orders.lease_expires_at IS NULL OR orders.lease_expires_at <= ` + param(1) + `)
+			ORDER BY
+				orders.next_attempt_at ASC NULLS FIRST,
+				orders.upload_date ASC,
+				orders.id ASC
+			LIMIT ` + param(2) + `)
+	RETURNING id,
+		owner,
+		upload_date,
+		status,
+		bonus,
+		attempts,
+		next_attempt_at
+	`
+}
+
+// LeaseOrder выдаёт worker в аренду на leaseTime заказ orderID в любом статусе,
+// если он не в аренде у другого исполнителя. Число попыток опроса не меняется.
+// Возвращает nil, если заказа нет или он уже в аренде
+func (s *SQLiteStorage) LeaseOrder(ctx context.Context, orderID string, worker string, leaseTime time.Duration) (*model.Order, error) {
+
+	now := time.Now()
+	var orderInfo model.Order
+	err := s.db.QueryRowContext(ctx, getLeaseOrderQuery(),
+		orderID, toMicros(now), worker, toMicros(now.Add(leaseTime))).
+		Scan(&orderInfo.ID,
+			&orderInfo.Owner,
+			timeValue(&orderInfo.UploadDate),
+			&orderInfo.Status,
+			&orderInfo.Bonus,
+			&orderInfo.Attempts,
+			nullTimeValue(&orderInfo.NextAttemptAt))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return &orderInfo, nil
+}
+
+func getLeaseOrderQuery() string {
+	return `
+	UPDATE orders
+		SET lease_owner=$3,
+			lease_expires_at=$4
+	WHERE
+		id = $1
+		AND (lease_expires_at IS NULL OR lease_expires_at <= $2)
+	RETURNING id,
+		owner,
+		upload_date,
+		status,
+		bonus,
+		attempts,
+		next_attempt_at
+	`
+}
+
+// sortOrders упорядочивает выданные заказы по времени загрузки:
+// RETURNING не сохраняет порядок подзапроса
+func sortOrders(orders []model.Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].UploadDate.Equal(orders[j].UploadDate) {
+			return orders[i].UploadDate.Before(orders[j].UploadDate)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+}
+
+// UpdateBatchOrders обновляет статусы заказов, снимает с них аренду и проводит
+// начисления по журналу баллов в одной транзакции. Заказ, ещё ожидающий расчёта,
+// снова попадёт в очередь через RetryAfter. Обновляются только заказы,
+// аренда которых ещё принадлежит worker: результат исполнителя, опоздавшего
+// к концу аренды, пропускается. Возвращает заказы, у которых изменились
+// статус или начисление
+func (s *SQLiteStorage) UpdateBatchOrders(ctx context.Context, worker string, orders []model.Order) ([]model.Order, error) {
+
+	transaction, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	defer transaction.Rollback()
+
+	now := time.Now()
+	changed := []model.Order{}
+	for _, el := range orders {
+		updated, err := updateOrder(ctx, transaction, worker, now, &el)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		if updated {
+			changed = append(changed, el)
+		}
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return changed, nil
+}
+
+// updateOrder обновляет заказ, если он в действующей аренде у worker,
+// и сообщает, изменились ли его статус или начисление
+func updateOrder(ctx context.Context, transaction *sql.Tx, worker string, now time.Time, order *model.Order) (bool, error) {
+	var status string
+	var bonus money.Amount
+	var leased bool
+	err := transaction.QueryRowContext(ctx, getOrderStateQuery(), order.ID, worker,
+		toMicros(now)).Scan(&status, &bonus, &leased)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("order not updated: order %w", storage.ErrNotFound)
+	}
+	if err != nil {
+		return false, err
+	}
+	// аренда истекла или перешла к другому исполнителю
+	if !leased {
+		return false, nil
+	}
+
+	_, err = transaction.ExecContext(ctx, getUpdateOrderQuery(), order.Status, order.Bonus,
+		nullMicros(order.NextAttempt(now)), order.ID)
+	if err != nil {
+		return false, err
+	}
+	updated := status != order.Status || bonus != order.Bonus
+
+	// начисляется разница с уже проведённой суммой, поэтому
+	// повторное обновление заказа не начисляет баллы дважды
+	posted, err := ledgerPosted(ctx, transaction, order.Owner, model.LedgerAccrual, order.ID)
+	if err != nil {
+		return false, err
+	}
+	if order.Bonus == posted {
+		return updated, nil
+	}
+
+	return updated, postLedgerEntry(ctx, transaction, &model.LedgerEntry{
+		Account:   order.Owner,
+		Kind:      model.LedgerAccrual,
+		Amount:    order.Bonus - posted,
+		Reference: order.ID,
+		CreatedAt: now,
+	})
+}
+
+// getOrderStateQuery возвращает статус и начисление заказа и признак того,
+// что заказ в действующей аренде у $2
+func getOrderStateQuery() string {
+	return `
+	SELECT orders.status,
+		orders.bonus,
+		COALESCE(orders.lease_owner = $2 AND orders.lease_expires_at > $3, 0)
+	FROM orders as orders
+	WHERE
+		orders.id = $1
+	`
+}
+
+func getUpdateOrderQuery() string {
+	return `
+	UPDATE orders
+		SET status=$1, bonus=$2, next_attempt_at=$3,
+			lease_owner=NULL, lease_expires_at=NULL
+		WHERE id=$4;
+	`
+}
@@ -0,0 +1,79 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/kvvPro/gophermart/internal/storage"
+	"github.com/kvvPro/gophermart/internal/storage/storagetest"
+)
+
+func newTestStorage(t testing.TB) *SQLiteStorage {
+	ctx := context.Background()
+	st, err := NewSQLiteStorage(ctx, URIScheme+filepath.Join(t.TempDir(), "gophermart.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		st.Quit(ctx)
+	})
+	return st
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		st := newTestStorage(t)
+		// после каждой проверки журнал должен сходиться с операциями
+		t.Cleanup(func() {
+			drifts, err := st.Reconcile(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(drifts) != 0 {
+				t.Errorf("Reconcile() = %+v", drifts)
+			}
+		})
+		return st
+	})
+}
+
+func TestDataSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection string
+		wantPath   string
+		wantErr    bool
+	}{
+		{name: "absolute", connection: "sqlite:///var/lib/gophermart.db", wantPath: "/var/lib/gophermart.db"},
+		{name: "relative", connection: "sqlite://gophermart.db", wantPath: "gophermart.db"},
+		{name: "empty", connection: "sqlite://", wantErr: true},
+		{name: "parameters", connection: "sqlite:///tmp/db?mode=ro", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !IsURI(tt.connection) {
+				t.Fatalf("IsURI(%q) = false", tt.connection)
+			}
+			dsn, err := dataSource(tt.connection)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dataSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && filepath.Clean(dsn[:len(tt.wantPath)]) != filepath.Clean(tt.wantPath) {
+				t.Errorf("dataSource() = %v, want path %v", dsn, tt.wantPath)
+			}
+		})
+	}
+
+	if IsURI("user=postgres host=localhost") {
+		t.Error("IsURI() = true for postgres connection string")
+	}
+}
+
+func BenchmarkSQLiteStorage(b *testing.B) {
+	st := newTestStorage(b)
+	storagetest.Bench(b, st, func() error {
+		_, err := st.db.Exec("ANALYZE")
+		return err
+	})
+}
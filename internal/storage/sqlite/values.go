@@ -0,0 +1,85 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Время хранится числом микросекунд с начала эпохи Unix: так оно
+// сравнивается в запросах и совпадает по точности с timestamp в Postgres
+
+func toMicros(t time.Time) int64 {
+	return t.UnixMicro()
+}
+
+func nullMicros(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMicro()
+}
+
+type timeScanner struct {
+	dest *time.Time
+}
+
+func (s timeScanner) Scan(src interface{}) error {
+	micros, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("unexpected time value %T", src)
+	}
+	*s.dest = time.UnixMicro(micros)
+	return nil
+}
+
+// timeValue читает в dest время, сохранённое функцией toMicros
+func timeValue(dest *time.Time) sql.Scanner {
+	return timeScanner{dest: dest}
+}
+
+type nullTimeScanner struct {
+	dest **time.Time
+}
+
+func (s nullTimeScanner) Scan(src interface{}) error {
+	if src == nil {
+		*s.dest = nil
+		return nil
+	}
+	var t time.Time
+	if err := timeValue(&t).Scan(src); err != nil {
+		return err
+	}
+	*s.dest = &t
+	return nil
+}
+
+// nullTimeValue читает в dest время, которого может не быть
+func nullTimeValue(dest **time.Time) sql.Scanner {
+	return nullTimeScanner{dest: dest}
+}
+
+// области доступа ключа хранятся одной строкой через пробел
+
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+type scopesScanner struct {
+	dest *[]string
+}
+
+func (s scopesScanner) Scan(src interface{}) error {
+	value, ok := src.(string)
+	if !ok {
+		return fmt.Errorf("unexpected scopes value %T", src)
+	}
+	*s.dest = strings.Fields(value)
+	return nil
+}
+
+func scopesValue(dest *[]string) sql.Scanner {
+	return scopesScanner{dest: dest}
+}
@@ -2,20 +2,56 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
 )
 
 type Storage interface {
 	Ping(ctx context.Context) error
 	Quit(ctx context.Context)
 	AddUser(ctx context.Context, user *model.User) error
+	AddUserWithIdentity(ctx context.Context, user *model.User, identity *model.Identity) error
+	GetUserByIdentity(ctx context.Context, issuer string, subject string) (*model.User, error)
+	AddOIDCState(ctx context.Context, state *model.OIDCState) error
+	TakeOIDCState(ctx context.Context, state string) (*model.OIDCState, error)
 	GetUser(ctx context.Context, user *model.User) (*model.User, error)
+	UpdatePassword(ctx context.Context, login string, passwordHash string) error
+	SetUserRole(ctx context.Context, login string, role string) error
+	SetUserBlocked(ctx context.Context, login string, blocked bool) error
+	SearchUsers(ctx context.Context, loginPattern string, limit int) ([]*model.User, error)
+	DeleteUser(ctx context.Context, login string, anonymousID string) error
+	AddSession(ctx context.Context, session *model.Session, token *model.RefreshToken) error
+	GetSession(ctx context.Context, sessionID string) (*model.Session, error)
+	RotateRefreshToken(ctx context.Context, tokenHash string, newToken *model.RefreshToken) (*model.Session, model.EndPointStatus, error)
+	GetUserSessions(ctx context.Context, login string) ([]*model.Session, error)
+	TouchSession(ctx context.Context, sessionID string, lastSeen time.Time) error
+	RevokeSession(ctx context.Context, sessionID string) error
+	RevokeUserSession(ctx context.Context, login string, sessionID string) (bool, error)
+	RevokeUserSessions(ctx context.Context, login string) error
+	SetTwoFactorSecret(ctx context.Context, login string, secret string, recoveryCodeHashes []string) error
+	GetTwoFactor(ctx context.Context, login string) (*model.TwoFactor, error)
+	EnableTwoFactor(ctx context.Context, login string) error
+	DisableTwoFactor(ctx context.Context, login string) error
+	UseTwoFactorCounter(ctx context.Context, login string, counter int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, login string, codeHash string) (bool, error)
+	AddAPIKey(ctx context.Context, key *model.APIKey) error
+	GetAPIKeys(ctx context.Context, login string) ([]*model.APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*model.APIKey, error)
+	TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error
+	RevokeAPIKey(ctx context.Context, login string, id string) (bool, error)
+	AddAuditRecord(ctx context.Context, record *model.AuditRecord) error
 	UploadOrder(ctx context.Context, orderID string, user *model.User) (model.EndPointStatus, error)
+	GetOrder(ctx context.Context, orderID string) (*model.Order, error)
 	GetAllOrders(ctx context.Context, user *model.User) ([]*model.Order, error)
 	GetBalance(ctx context.Context, user *model.User) (*model.Balance, error)
+	GetLedgerTotals(ctx context.Context, user *model.User) (map[string]money.Amount, error)
 	RequestWithdrawal(ctx context.Context, withdrawalInfo *model.Withdrawal) (model.EndPointStatus, error)
 	GetAllWithdrawals(ctx context.Context, user *model.User) ([]*model.Withdrawal, error)
-	GetOrdersForUpdate(ctx context.Context) ([]model.Order, error)
-	UpdateBatchOrders(ctx context.Context, orders []model.Order) error
+	AddAdjustment(ctx context.Context, adjustment *model.Adjustment) error
+	GetAllAdjustments(ctx context.Context, user *model.User) ([]*model.Adjustment, error)
+	GetOrdersForUpdate(ctx context.Context, worker string, limit int, leaseTime time.Duration) ([]model.Order, error)
+	LeaseOrder(ctx context.Context, orderID string, worker string, leaseTime time.Duration) (*model.Order, error)
+	UpdateBatchOrders(ctx context.Context, worker string, orders []model.Order) ([]model.Order, error)
 }
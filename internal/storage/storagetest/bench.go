@@ -0,0 +1,181 @@
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+const (
+	// число заказов по умолчанию; для замеров на большой базе
+	// размер задаётся в BENCH_ORDERS, например BENCH_ORDERS=1000000
+	benchDefaultOrders = 10_000
+	// заказов у одного пользователя
+	benchOrdersPerUser = 100
+	// из них обработано и начислено
+	benchProcessedPerUser = 10
+	// списаний у одного пользователя
+	benchWithdrawalsPerUser = 3
+)
+
+// Bench заполняет хранилище и замеряет запросы, которые выполняют
+// обработчики списков и баланса пользователя. Кроме среднего времени
+// каждый замер показывает 50-й и 99-й перцентили задержки. analyze, если
+// задан, обновляет статистику планировщика после заполнения
+func Bench(b *testing.B, st storage.Storage, analyze func() error) {
+	orders := benchDefaultOrders
+	if value := os.Getenv("BENCH_ORDERS"); value != "" {
+		var err error
+		if orders, err = strconv.Atoi(value); err != nil || orders < benchOrdersPerUser {
+			b.Fatalf("BENCH_ORDERS = %q, want a number not less than %v", value, benchOrdersPerUser)
+		}
+	}
+	users := orders / benchOrdersPerUser
+
+	start := time.Now()
+	seed(b, st, users)
+	b.Logf("seeded %v users and %v orders in %v", users, users*benchOrdersPerUser, time.Since(start))
+	if analyze != nil {
+		if err := analyze(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		query func(user *model.User, order string) error
+	}{
+		{
+			// GET /api/user/orders
+			name: "get_orders",
+			query: func(user *model.User, order string) error {
+				_, err := st.GetAllOrders(ctx, user)
+				return err
+			},
+		},
+		{
+			// GET /api/user/withdrawals
+			name: "get_withdrawals",
+			query: func(user *model.User, order string) error {
+				_, err := st.GetAllWithdrawals(ctx, user)
+				return err
+			},
+		},
+		{
+			// GET /api/user/balance
+			name: "get_balance",
+			query: func(user *model.User, order string) error {
+				_, err := st.GetBalance(ctx, user)
+				return err
+			},
+		},
+		{
+			// POST /api/user/orders: повторная загрузка только ищет заказ по номеру
+			name: "upload_order",
+			query: func(user *model.User, order string) error {
+				_, err := st.UploadOrder(ctx, order, user)
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			random := rand.New(rand.NewSource(1))
+			latencies := make([]time.Duration, 0, b.N)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				user := random.Intn(users)
+				order := benchOrderID(user, random.Intn(benchOrdersPerUser))
+
+				started := time.Now()
+				if err := tt.query(&model.User{Login: benchLogin(user)}, order); err != nil {
+					b.Fatal(err)
+				}
+				latencies = append(latencies, time.Since(started))
+			}
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool {
+				return latencies[i] < latencies[j]
+			})
+			b.ReportMetric(float64(percentile(latencies, 50).Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(percentile(latencies, 99).Nanoseconds()), "p99-ns")
+		})
+	}
+}
+
+// seed создаёт пользователей с заказами, начислениями и списаниями
+func seed(b *testing.B, st storage.Storage, users int) {
+	ctx := context.Background()
+	for user := 0; user < users; user++ {
+		login := benchLogin(user)
+		if err := st.AddUser(ctx, &model.User{Login: login, Password: "hash"}); err != nil {
+			b.Fatalf("AddUser(%v) error = %v", login, err)
+		}
+
+		processed := map[string]bool{}
+		for i := 0; i < benchOrdersPerUser; i++ {
+			orderID := benchOrderID(user, i)
+			if _, err := st.UploadOrder(ctx, orderID, &model.User{Login: login}); err != nil {
+				b.Fatalf("UploadOrder(%v) error = %v", orderID, err)
+			}
+			processed[orderID] = i < benchProcessedPerUser
+		}
+		// обновлять можно только арендованные заказы; необработанные
+		// откладываются, чтобы не попасть в аренду следующего пользователя
+		orders, err := st.GetOrdersForUpdate(ctx, "bench", benchOrdersPerUser, time.Minute)
+		if err != nil {
+			b.Fatalf("GetOrdersForUpdate(%v) error = %v", login, err)
+		}
+		for i, el := range orders {
+			if processed[el.ID] {
+				orders[i].Status = model.OrderStatusProcessed
+				orders[i].Bonus = 100 * money.Scale
+			} else {
+				orders[i].RetryAfter = 24 * time.Hour
+			}
+		}
+		if _, err := st.UpdateBatchOrders(ctx, "bench", orders); err != nil {
+			b.Fatalf("UpdateBatchOrders(%v) error = %v", login, err)
+		}
+
+		for i := 0; i < benchWithdrawalsPerUser; i++ {
+			status, err := st.RequestWithdrawal(ctx, &model.Withdrawal{
+				OrderID:       fmt.Sprintf("w%v-%v", user, i),
+				Sum:           10 * money.Scale,
+				ProcessedDate: time.Now(),
+				User:          login,
+			})
+			if err != nil || status != model.WithdrawalAccepted {
+				b.Fatalf("RequestWithdrawal(%v) = %v, %v", login, status, err)
+			}
+		}
+	}
+}
+
+func benchLogin(user int) string {
+	return fmt.Sprintf("user%v", user)
+}
+
+func benchOrderID(user int, order int) string {
+	return fmt.Sprintf("%010d", user*benchOrdersPerUser+order)
+}
+
+// percentile возвращает p-й перцентиль отсортированных задержек
+func percentile(latencies []time.Duration, p int) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	return latencies[(len(latencies)-1)*p/100]
+}
@@ -0,0 +1,1012 @@
+// Package storagetest содержит общие проверки реализаций storage.Storage.
+// Каждая реализация должна проходить их одинаково
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kvvPro/gophermart/internal/model"
+	"github.com/kvvPro/gophermart/internal/money"
+	"github.com/kvvPro/gophermart/internal/storage"
+)
+
+// Run запускает проверки. newStorage возвращает пустое хранилище
+// и вызывается для каждой проверки заново
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, st storage.Storage)
+	}{
+		{name: "users", test: testUsers},
+		{name: "search_users", test: testSearchUsers},
+		{name: "identities", test: testIdentities},
+		{name: "oidc_states", test: testOIDCStates},
+		{name: "sessions", test: testSessions},
+		{name: "refresh_tokens", test: testRefreshTokens},
+		{name: "two_factor", test: testTwoFactor},
+		{name: "api_keys", test: testAPIKeys},
+		{name: "orders", test: testOrders},
+		{name: "orders_for_update", test: testOrdersForUpdate},
+		{name: "lease_order", test: testLeaseOrder},
+		{name: "withdrawals", test: testWithdrawals},
+		{name: "concurrent_withdrawals", test: testConcurrentWithdrawals},
+		{name: "adjustments", test: testAdjustments},
+		{name: "ledger_totals", test: testLedgerTotals},
+		{name: "delete_user", test: testDeleteUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func addUser(t *testing.T, st storage.Storage, login string) {
+	t.Helper()
+	if err := st.AddUser(context.Background(), &model.User{Login: login, Password: "hash-" + login}); err != nil {
+		t.Fatalf("AddUser(%v) error = %v", login, err)
+	}
+}
+
+// addBonus начисляет пользователю баллы по обработанному заказу. Обновлять
+// можно только арендованные заказы, поэтому ожидающие заказы берутся в
+// аренду, а остальные из них возвращаются без изменений
+func addBonus(t *testing.T, st storage.Storage, login string, orderID string, bonus money.Amount) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := st.UploadOrder(ctx, orderID, &model.User{Login: login}); err != nil {
+		t.Fatalf("UploadOrder(%v) error = %v", orderID, err)
+	}
+	orders, err := st.GetOrdersForUpdate(ctx, "test", 1000, time.Minute)
+	if err != nil {
+		t.Fatalf("GetOrdersForUpdate() error = %v", err)
+	}
+	for i, el := range orders {
+		if el.ID == orderID {
+			orders[i].Status = model.OrderStatusProcessed
+			orders[i].Bonus = bonus
+		}
+	}
+	if _, err := st.UpdateBatchOrders(ctx, "test", orders); err != nil {
+		t.Fatalf("UpdateBatchOrders(%v) error = %v", orderID, err)
+	}
+}
+
+func checkBalance(t *testing.T, st storage.Storage, login string, current money.Amount, withdrawn money.Amount) {
+	t.Helper()
+	balance, err := st.GetBalance(context.Background(), &model.User{Login: login})
+	if err != nil {
+		t.Fatalf("GetBalance(%v) error = %v", login, err)
+	}
+	if balance.Current != current || balance.Withdrawn != withdrawn {
+		t.Errorf("GetBalance(%v) = %+v, want current %v withdrawn %v", login, balance, current, withdrawn)
+	}
+}
+
+func testUsers(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	addUser(t, st, "Ivan")
+
+	if err := st.AddUser(ctx, &model.User{Login: "ivan", Password: "-"}); !errors.Is(err, storage.ErrDuplicateLogin) {
+		t.Errorf("AddUser() with same login in other case error = %v, want %v", err, storage.ErrDuplicateLogin)
+	}
+
+	userInfo, err := st.GetUser(ctx, &model.User{Login: "IVAN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo == nil || userInfo.Login != "Ivan" || userInfo.Password != "hash-Ivan" ||
+		userInfo.Role != model.RoleUser || userInfo.Blocked {
+		t.Fatalf("GetUser() = %+v", userInfo)
+	}
+
+	if userInfo, err := st.GetUser(ctx, &model.User{Login: "petr"}); err != nil || userInfo != nil {
+		t.Errorf("GetUser() of unknown user = %+v, %v", userInfo, err)
+	}
+
+	if err := st.SetUserRole(ctx, "ivan", model.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetUserBlocked(ctx, "ivan", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdatePassword(ctx, "Ivan", "new-hash"); err != nil {
+		t.Fatal(err)
+	}
+	userInfo, _ = st.GetUser(ctx, &model.User{Login: "Ivan"})
+	if userInfo.Role != model.RoleAdmin || !userInfo.Blocked || userInfo.Password != "new-hash" {
+		t.Errorf("GetUser() after update = %+v", userInfo)
+	}
+
+	if err := st.SetUserRole(ctx, "petr", model.RoleAdmin); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("SetUserRole() of unknown user error = %v, want %v", err, storage.ErrNotFound)
+	}
+	if err := st.SetUserBlocked(ctx, "petr", true); err == nil {
+		t.Error("SetUserBlocked() of unknown user succeeded")
+	}
+	if err := st.UpdatePassword(ctx, "petr", "-"); err == nil {
+		t.Error("UpdatePassword() of unknown user succeeded")
+	}
+}
+
+func testSearchUsers(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	for _, login := range []string{"anna", "ivan_1", "ivanov", "petr", "sivan"} {
+		addUser(t, st, login)
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		limit   int
+		want    []string
+	}{
+		{name: "substring", pattern: "VAN", limit: 10, want: []string{"ivan_1", "ivanov", "sivan"}},
+		{name: "limit", pattern: "ivan", limit: 2, want: []string{"ivan_1", "ivanov"}},
+		{name: "underscore_is_literal", pattern: "_", limit: 10, want: []string{"ivan_1"}},
+		{name: "no_match", pattern: "%", limit: 10, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := st.SearchUsers(ctx, tt.pattern, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, el := range users {
+				if el.Password != "" {
+					t.Errorf("SearchUsers() returned password of %v", el.Login)
+				}
+				got = append(got, el.Login)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("SearchUsers(%q) = %v, want %v", tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
+
+func testIdentities(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	identity := &model.Identity{
+		Issuer:    "https://issuer.example.com",
+		Subject:   "42",
+		Email:     "ivan@example.com",
+		CreatedAt: time.Now(),
+	}
+
+	err := st.AddUserWithIdentity(ctx, &model.User{Login: "ivan", Password: "-"}, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userInfo, err := st.GetUserByIdentity(ctx, identity.Issuer, identity.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo == nil || userInfo.Login != "ivan" || userInfo.Role != model.RoleUser {
+		t.Errorf("GetUserByIdentity() = %+v", userInfo)
+	}
+	if userInfo, err := st.GetUserByIdentity(ctx, identity.Issuer, "43"); err != nil || userInfo != nil {
+		t.Errorf("GetUserByIdentity() of unknown subject = %+v, %v", userInfo, err)
+	}
+
+	// повторная привязка той же учётной записи провайдера
+	err = st.AddUserWithIdentity(ctx, &model.User{Login: "ivan-2", Password: "-"}, identity)
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("AddUserWithIdentity() with linked identity error = %v, want %v", err, storage.ErrConflict)
+	}
+	// пользователь не создаётся без привязки
+	if userInfo, _ := st.GetUser(ctx, &model.User{Login: "ivan-2"}); userInfo != nil {
+		t.Errorf("AddUserWithIdentity() left user %+v after error", userInfo)
+	}
+
+	// занятый логин
+	identity.Subject = "43"
+	err = st.AddUserWithIdentity(ctx, &model.User{Login: "IVAN", Password: "-"}, identity)
+	if !errors.Is(err, storage.ErrDuplicateLogin) {
+		t.Errorf("AddUserWithIdentity() with taken login error = %v, want %v", err, storage.ErrDuplicateLogin)
+	}
+	if userInfo, _ := st.GetUserByIdentity(ctx, identity.Issuer, identity.Subject); userInfo != nil {
+		t.Errorf("AddUserWithIdentity() left identity after error: %+v", userInfo)
+	}
+}
+
+func testOIDCStates(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	// база хранит время с точностью до микросекунд
+	now := time.Now().Truncate(time.Microsecond)
+
+	expired := &model.OIDCState{State: "s1", Nonce: "n1", CodeVerifier: "v1",
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+	actual := &model.OIDCState{State: "s2", Nonce: "n2", CodeVerifier: "v2",
+		CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+	if err := st.AddOIDCState(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AddOIDCState(ctx, actual); err != nil {
+		t.Fatal(err)
+	}
+
+	stateInfo, err := st.TakeOIDCState(ctx, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stateInfo == nil || stateInfo.Nonce != "n2" || stateInfo.CodeVerifier != "v2" ||
+		!stateInfo.ExpiresAt.Equal(actual.ExpiresAt) {
+		t.Errorf("TakeOIDCState() = %+v", stateInfo)
+	}
+
+	// state выдаётся один раз
+	if stateInfo, err := st.TakeOIDCState(ctx, "s2"); err != nil || stateInfo != nil {
+		t.Errorf("second TakeOIDCState() = %+v, %v", stateInfo, err)
+	}
+	// просроченный state удалён при добавлении нового
+	if stateInfo, err := st.TakeOIDCState(ctx, "s1"); err != nil || stateInfo != nil {
+		t.Errorf("TakeOIDCState() of expired state = %+v, %v", stateInfo, err)
+	}
+}
+
+func newSession(id string, login string, now time.Time) (*model.Session, *model.RefreshToken) {
+	session := &model.Session{
+		ID:        id,
+		User:      login,
+		UserAgent: "test",
+		IP:        "127.0.0.1",
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	token := &model.RefreshToken{
+		Hash:      "token-" + id,
+		SessionID: id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	return session, token
+}
+
+func testSessions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	addUser(t, st, "ivan")
+
+	for i, id := range []string{"phone", "laptop", "tablet"} {
+		session, token := newSession(id, "ivan", now.Add(time.Duration(i)*time.Second))
+		if err := st.AddSession(ctx, session, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session, token := newSession("ghost", "petr", now)
+	if err := st.AddSession(ctx, session, token); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("AddSession() of unknown user error = %v, want %v", err, storage.ErrNotFound)
+	}
+
+	session, err := st.GetSession(ctx, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session == nil || session.User != "ivan" || session.UserAgent != "test" ||
+		session.IP != "127.0.0.1" || session.RevokedAt != nil {
+		t.Fatalf("GetSession() = %+v", session)
+	}
+	if session, err := st.GetSession(ctx, "ghost"); err != nil || session != nil {
+		t.Errorf("GetSession() of unknown session = %+v, %v", session, err)
+	}
+
+	// время последнего обращения не уходит назад
+	if err := st.TouchSession(ctx, "phone", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.TouchSession(ctx, "phone", now); err != nil {
+		t.Fatal(err)
+	}
+	session, _ = st.GetSession(ctx, "phone")
+	if !session.LastSeenAt.After(now.Add(59 * time.Second)) {
+		t.Errorf("LastSeenAt = %v, want %v", session.LastSeenAt, now.Add(time.Minute))
+	}
+
+	revoked, err := st.RevokeUserSession(ctx, "petr", "laptop")
+	if err != nil || revoked {
+		t.Errorf("RevokeUserSession() of other user = %v, %v", revoked, err)
+	}
+	revoked, err = st.RevokeUserSession(ctx, "ivan", "laptop")
+	if err != nil || !revoked {
+		t.Errorf("RevokeUserSession() = %v, %v", revoked, err)
+	}
+	revoked, _ = st.RevokeUserSession(ctx, "ivan", "laptop")
+	if revoked {
+		t.Error("RevokeUserSession() revoked session twice")
+	}
+
+	// действующие сеансы, последний использованный первым
+	sessions, err := st.GetUserSessions(ctx, "ivan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, el := range sessions {
+		got = append(got, el.ID)
+	}
+	if fmt.Sprint(got) != "[phone tablet]" {
+		t.Errorf("GetUserSessions() = %v, want [phone tablet]", got)
+	}
+
+	if err := st.RevokeSession(ctx, "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RevokeUserSessions(ctx, "ivan"); err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = st.GetUserSessions(ctx, "ivan")
+	if len(sessions) != 0 {
+		t.Errorf("GetUserSessions() after revoke = %v sessions", len(sessions))
+	}
+}
+
+func testRefreshTokens(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	addUser(t, st, "ivan")
+
+	session, token := newSession("phone", "ivan", now)
+	if err := st.AddSession(ctx, session, token); err != nil {
+		t.Fatal(err)
+	}
+
+	newToken := &model.RefreshToken{Hash: "token-2", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	rotated, status, err := st.RotateRefreshToken(ctx, token.Hash, newToken)
+	if err != nil || status != model.RefreshTokenRotated {
+		t.Fatalf("RotateRefreshToken() = %v, %v", status, err)
+	}
+	if rotated.ID != "phone" || rotated.User != "ivan" || newToken.SessionID != "phone" {
+		t.Errorf("RotateRefreshToken() session = %+v, token session %v", rotated, newToken.SessionID)
+	}
+
+	_, status, err = st.RotateRefreshToken(ctx, "unknown", &model.RefreshToken{Hash: "token-3", CreatedAt: now})
+	if err != nil || status != model.RefreshTokenInvalid {
+		t.Errorf("RotateRefreshToken() of unknown token = %v, %v", status, err)
+	}
+
+	// повторное использование отзывает сеанс вместе с новым токеном
+	reused, status, err := st.RotateRefreshToken(ctx, token.Hash,
+		&model.RefreshToken{Hash: "token-4", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil || status != model.RefreshTokenReused || reused == nil || reused.ID != "phone" {
+		t.Fatalf("RotateRefreshToken() of used token = %+v, %v, %v", reused, status, err)
+	}
+	session, _ = st.GetSession(ctx, "phone")
+	if session.RevokedAt == nil {
+		t.Error("session is not revoked after token reuse")
+	}
+	_, status, err = st.RotateRefreshToken(ctx, newToken.Hash,
+		&model.RefreshToken{Hash: "token-5", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil || status != model.RefreshTokenInvalid {
+		t.Errorf("RotateRefreshToken() in revoked session = %v, %v", status, err)
+	}
+
+	// просроченный токен
+	session, token = newSession("laptop", "ivan", now.Add(-2*time.Hour))
+	if err := st.AddSession(ctx, session, token); err != nil {
+		t.Fatal(err)
+	}
+	_, status, err = st.RotateRefreshToken(ctx, token.Hash,
+		&model.RefreshToken{Hash: "token-6", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil || status != model.RefreshTokenInvalid {
+		t.Errorf("RotateRefreshToken() of expired token = %v, %v", status, err)
+	}
+}
+
+func testTwoFactor(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	addUser(t, st, "ivan")
+
+	if twoFactor, err := st.GetTwoFactor(ctx, "ivan"); err != nil || twoFactor != nil {
+		t.Errorf("GetTwoFactor() before enrollment = %+v, %v", twoFactor, err)
+	}
+	if err := st.EnableTwoFactor(ctx, "ivan"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("EnableTwoFactor() before enrollment error = %v, want %v", err, storage.ErrNotFound)
+	}
+
+	if err := st.SetTwoFactorSecret(ctx, "ivan", "secret", []string{"code-1", "code-2"}); err != nil {
+		t.Fatal(err)
+	}
+	twoFactor, err := st.GetTwoFactor(ctx, "ivan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twoFactor == nil || twoFactor.Secret != "secret" || twoFactor.Enabled || twoFactor.LastCounter != 0 {
+		t.Fatalf("GetTwoFactor() = %+v", twoFactor)
+	}
+
+	if err := st.EnableTwoFactor(ctx, "ivan"); err != nil {
+		t.Fatal(err)
+	}
+
+	// код периода принимается один раз
+	tests := []struct {
+		counter int64
+		want    bool
+	}{
+		{counter: 10, want: true},
+		{counter: 10, want: false},
+		{counter: 9, want: false},
+		{counter: 11, want: true},
+	}
+	for _, tt := range tests {
+		used, err := st.UseTwoFactorCounter(ctx, "ivan", tt.counter)
+		if err != nil || used != tt.want {
+			t.Errorf("UseTwoFactorCounter(%v) = %v, %v, want %v", tt.counter, used, err, tt.want)
+		}
+	}
+
+	used, err := st.UseRecoveryCode(ctx, "ivan", "code-1")
+	if err != nil || !used {
+		t.Errorf("UseRecoveryCode() = %v, %v", used, err)
+	}
+	if used, _ := st.UseRecoveryCode(ctx, "ivan", "code-1"); used {
+		t.Error("UseRecoveryCode() accepted used code")
+	}
+	if used, _ := st.UseRecoveryCode(ctx, "ivan", "code-3"); used {
+		t.Error("UseRecoveryCode() accepted unknown code")
+	}
+
+	// новый секрет сбрасывает подтверждение и коды восстановления
+	if err := st.SetTwoFactorSecret(ctx, "ivan", "secret-2", []string{"code-3"}); err != nil {
+		t.Fatal(err)
+	}
+	twoFactor, _ = st.GetTwoFactor(ctx, "ivan")
+	if twoFactor.Secret != "secret-2" || twoFactor.Enabled || twoFactor.LastCounter != 0 {
+		t.Errorf("GetTwoFactor() after new secret = %+v", twoFactor)
+	}
+	if used, _ := st.UseRecoveryCode(ctx, "ivan", "code-2"); used {
+		t.Error("UseRecoveryCode() accepted code of previous secret")
+	}
+
+	if err := st.DisableTwoFactor(ctx, "ivan"); err != nil {
+		t.Fatal(err)
+	}
+	if twoFactor, _ := st.GetTwoFactor(ctx, "ivan"); twoFactor != nil {
+		t.Errorf("GetTwoFactor() after disable = %+v", twoFactor)
+	}
+	if used, _ := st.UseRecoveryCode(ctx, "ivan", "code-3"); used {
+		t.Error("UseRecoveryCode() accepted code after disable")
+	}
+}
+
+func testAPIKeys(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	addUser(t, st, "ivan")
+	addUser(t, st, "petr")
+
+	keys := []*model.APIKey{
+		{ID: "k1", User: "ivan", Name: "shop", Prefix: "gm_1", Hash: "hash-1",
+			Scopes: []string{model.ScopeOrdersRead}, CreatedAt: now},
+		{ID: "k2", User: "ivan", Name: "report", Prefix: "gm_2", Hash: "hash-2",
+			Scopes: []string{model.ScopeBalanceRead, model.ScopeWithdrawalsRead}, CreatedAt: now.Add(time.Second)},
+	}
+	for _, el := range keys {
+		if err := st.AddAPIKey(ctx, el); err != nil {
+			t.Fatal(err)
+		}
+	}
+	duplicate := &model.APIKey{ID: "k3", User: "petr", Name: "copy", Prefix: "gm_3", Hash: "hash-1", CreatedAt: now}
+	if err := st.AddAPIKey(ctx, duplicate); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("AddAPIKey() with same hash error = %v, want %v", err, storage.ErrConflict)
+	}
+
+	key, err := st.GetAPIKeyByHash(ctx, "hash-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == nil || key.ID != "k2" || key.User != "ivan" || len(key.Scopes) != 2 ||
+		key.LastUsedAt != nil || key.RevokedAt != nil {
+		t.Fatalf("GetAPIKeyByHash() = %+v", key)
+	}
+	if key, err := st.GetAPIKeyByHash(ctx, "hash-3"); err != nil || key != nil {
+		t.Errorf("GetAPIKeyByHash() of unknown key = %+v, %v", key, err)
+	}
+
+	if err := st.TouchAPIKey(ctx, "k2", now); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := st.RevokeAPIKey(ctx, "petr", "k1"); revoked {
+		t.Error("RevokeAPIKey() revoked key of other user")
+	}
+	if revoked, err := st.RevokeAPIKey(ctx, "ivan", "k1"); err != nil || !revoked {
+		t.Errorf("RevokeAPIKey() = %v, %v", revoked, err)
+	}
+	if revoked, _ := st.RevokeAPIKey(ctx, "ivan", "k1"); revoked {
+		t.Error("RevokeAPIKey() revoked key twice")
+	}
+
+	// отозванные ключи остаются в списке
+	list, err := st.GetAPIKeys(ctx, "ivan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "k1" || list[0].RevokedAt == nil ||
+		list[1].ID != "k2" || list[1].LastUsedAt == nil {
+		t.Errorf("GetAPIKeys() = %+v", list)
+	}
+}
+
+func testOrders(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	addUser(t, st, "ivan")
+	addUser(t, st, "petr")
+
+	tests := []struct {
+		name    string
+		orderID string
+		user    string
+		want    model.EndPointStatus
+	}{
+		{name: "new", orderID: "12345678903", user: "ivan", want: model.OrderAcceptedToProcessing},
+		{name: "second", orderID: "2377225624", user: "ivan", want: model.OrderAcceptedToProcessing},
+		{name: "same_user", orderID: "12345678903", user: "ivan", want: model.OrderAlreadyUploaded},
+		{name: "other_user", orderID: "12345678903", user: "petr", want: model.OrderAlreadyUploadedByAnotherUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := st.UploadOrder(ctx, tt.orderID, &model.User{Login: tt.user})
+			if err != nil || status != tt.want {
+				t.Errorf("UploadOrder() = %v, %v, want %v", status, err, tt.want)
+			}
+		})
+	}
+
+	orderInfo, err := st.GetOrder(ctx, "12345678903")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orderInfo == nil || orderInfo.Owner != "ivan" || orderInfo.Status != model.OrderStatusNew ||
+		orderInfo.Bonus != 0 || orderInfo.UploadDate.IsZero() {
+		t.Fatalf("GetOrder() = %+v", orderInfo)
+	}
+	if orderInfo, err := st.GetOrder(ctx, "79927398713"); err != nil || orderInfo != nil {
+		t.Errorf("GetOrder() of unknown order = %+v, %v", orderInfo, err)
+	}
+
+	orders, err := st.GetAllOrders(ctx, &model.User{Login: "ivan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[0].ID != "12345678903" || orders[1].ID != "2377225624" {
+		t.Errorf("GetAllOrders() = %+v", orders)
+	}
+	if orders, _ := st.GetAllOrders(ctx, &model.User{Login: "petr"}); len(orders) != 0 {
+		t.Errorf("GetAllOrders() of user without orders = %+v", orders)
+	}
+}
+
+func testOrdersForUpdate(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	addUser(t, st, "ivan")
+
+	statuses := map[string]string{
+		"1": model.OrderStatusNew,
+		"2": model.OrderStatusProcessing,
+		"3": model.BonusStatusNew,
+		"4": model.OrderStatusInvalid,
+		"5": model.OrderStatusProcessed,
+	}
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := st.UploadOrder(ctx, id, &model.User{Login: "ivan"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update, err := st.GetOrdersForUpdate(ctx, "w0", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, el := range update {
+		update[i].Status = statuses[el.ID]
+	}
+	if _, err := st.UpdateBatchOrders(ctx, "w0", update); err != nil {
+		t.Fatal(err)
+	}
+
+	claim := func(worker string, limit int, leaseTime time.Duration, want string, wantAttempts int) {
+		t.Helper()
+		orders, err := st.GetOrdersForUpdate(ctx, worker, limit, leaseTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, el := range orders {
+			if el.Owner != "ivan" || el.Attempts != wantAttempts {
+				t.Errorf("GetOrdersForUpdate() order %v owner = %v, attempts = %v, want %v",
+					el.ID, el.Owner, el.Attempts, wantAttempts)
+			}
+			got = append(got, el.ID)
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("GetOrdersForUpdate(%v) = %v, want %v", worker, got, want)
+		}
+	}
+
+	claim("w1", 2, time.Minute, "[1 2]", 2)
+	// заказы в аренде другим исполнителям не выдаются
+	claim("w2", 10, 0, "[3]", 2)
+	// аренда нулевой длины сразу истекает, как у остановившегося экземпляра
+	claim("w3", 10, time.Minute, "[3]", 3)
+	claim("w1", 10, time.Minute, "[]", 0)
+
+	// обновление снимает аренду: обработанный заказ уходит из очереди,
+	// отложенный вернётся в неё через RetryAfter
+	changed, err := st.UpdateBatchOrders(ctx, "w1", []model.Order{
+		{ID: "1", Owner: "ivan", Status: model.OrderStatusNew},
+		{ID: "2", Owner: "ivan", Status: model.OrderStatusProcessed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// возвращаются только заказы с новым статусом или начислением
+	if got := orderIDs(changed); got != "[2]" {
+		t.Errorf("UpdateBatchOrders() changed = %v, want [2]", got)
+	}
+	_, err = st.UpdateBatchOrders(ctx, "w3", []model.Order{
+		{ID: "1", Owner: "ivan", Status: model.OrderStatusNew},
+		{ID: "2", Owner: "ivan", Status: model.OrderStatusProcessed},
+		{ID: "3", Owner: "ivan", Status: model.BonusStatusNew, RetryAfter: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// время опроса отсчитывается хранилищем от момента обновления
+	deferred, err := st.LeaseOrder(ctx, "3", "w3", 0)
+	if err != nil || deferred == nil || deferred.NextAttemptAt == nil ||
+		deferred.NextAttemptAt.Before(time.Now().Add(59*time.Minute)) ||
+		deferred.NextAttemptAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("LeaseOrder() of deferred order = %+v, %v", deferred, err)
+	}
+	claim("w2", 10, time.Minute, "[1]", 3)
+
+	// при отсутствии заказа пакет не обновляется целиком
+	_, err = st.UpdateBatchOrders(ctx, "w2", []model.Order{
+		{ID: "1", Owner: "ivan", Status: model.OrderStatusProcessed, Bonus: 5 * money.Scale},
+		{ID: "6", Owner: "ivan", Status: model.OrderStatusProcessed, Bonus: 5 * money.Scale},
+	})
+	if err == nil {
+		t.Error("UpdateBatchOrders() with unknown order succeeded")
+	}
+	if orderInfo, _ := st.GetOrder(ctx, "1"); orderInfo.Status != model.OrderStatusNew {
+		t.Errorf("UpdateBatchOrders() partially applied: %+v", orderInfo)
+	}
+	checkBalance(t, st, "ivan", 0, 0)
+
+	// обновление снимает аренду, поэтому повторное обновление того же
+	// заказа пропускается и не начисляет баллы дважды
+	processed := []model.Order{{ID: "1", Owner: "ivan", Status: model.OrderStatusProcessed, Bonus: 729_98}}
+	for _, want := range []string{"[1]", "[]"} {
+		changed, err := st.UpdateBatchOrders(ctx, "w2", processed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := orderIDs(changed); got != want {
+			t.Errorf("UpdateBatchOrders() changed = %v, want %v", got, want)
+		}
+	}
+	checkBalance(t, st, "ivan", 729_98, 0)
+
+	// аренда w4 истекла, заказ забрал и обработал w5: запоздавший ответ
+	// w4 не должен перезаписать результат
+	if _, err := st.UploadOrder(ctx, "6", &model.User{Login: "ivan"}); err != nil {
+		t.Fatal(err)
+	}
+	claim("w4", 10, 0, "[6]", 1)
+	claim("w5", 10, time.Minute, "[6]", 2)
+	for _, tt := range []struct {
+		worker string
+		bonus  money.Amount
+		want   string
+	}{
+		{worker: "w5", bonus: 10 * money.Scale, want: "[6]"},
+		{worker: "w4", bonus: 20 * money.Scale, want: "[]"},
+	} {
+		changed, err := st.UpdateBatchOrders(ctx, tt.worker, []model.Order{
+			{ID: "6", Owner: "ivan", Status: model.OrderStatusProcessed, Bonus: tt.bonus},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := orderIDs(changed); got != tt.want {
+			t.Errorf("UpdateBatchOrders(%v) changed = %v, want %v", tt.worker, got, tt.want)
+		}
+	}
+	if orderInfo, _ := st.GetOrder(ctx, "6"); orderInfo.Bonus != 10*money.Scale {
+		t.Errorf("late update overwrote order: %+v", orderInfo)
+	}
+	checkBalance(t, st, "ivan", 739_98, 0)
+}
+
+func testLeaseOrder(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	addUser(t, st, "ivan")
+	for _, id := range []string{"1", "2"} {
+		if _, err := st.UploadOrder(ctx, id, &model.User{Login: "ivan"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orderInfo, err := st.LeaseOrder(ctx, "1", "admin", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orderInfo == nil || orderInfo.ID != "1" || orderInfo.Owner != "ivan" || orderInfo.Attempts != 0 {
+		t.Fatalf("LeaseOrder() = %+v", orderInfo)
+	}
+	// арендованный заказ не выдаётся ни опросу, ни повторной аренде
+	if orders, _ := st.GetOrdersForUpdate(ctx, "w1", 10, time.Minute); orderIDs(orders) != "[2]" {
+		t.Errorf("GetOrdersForUpdate() = %v, want [2]", orderIDs(orders))
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if orderInfo, err := st.LeaseOrder(ctx, id, "admin", time.Minute); err != nil || orderInfo != nil {
+			t.Errorf("LeaseOrder(%v) = %+v, %v, want nil", id, orderInfo, err)
+		}
+	}
+
+	changed, err := st.UpdateBatchOrders(ctx, "admin", []model.Order{
+		{ID: "1", Owner: "ivan", Status: model.OrderStatusProcessed, Bonus: 5 * money.Scale},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := orderIDs(changed); got != "[1]" {
+		t.Errorf("UpdateBatchOrders() changed = %v, want [1]", got)
+	}
+
+	// заказ в окончательном статусе тоже можно взять в аренду и пересчитать
+	orderInfo, err = st.LeaseOrder(ctx, "1", "admin", time.Minute)
+	if err != nil || orderInfo == nil || orderInfo.Status != model.OrderStatusProcessed {
+		t.Fatalf("LeaseOrder() of processed order = %+v, %v", orderInfo, err)
+	}
+	if _, err := st.UpdateBatchOrders(ctx, "admin", []model.Order{
+		{ID: "1", Owner: "ivan", Status: model.OrderStatusProcessed, Bonus: 7 * money.Scale},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, st, "ivan", 7*money.Scale, 0)
+}
+
+func orderIDs(orders []model.Order) string {
+	ids := []string{}
+	for _, el := range orders {
+		ids = append(ids, el.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+func testWithdrawals(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	addUser(t, st, "ivan")
+	addUser(t, st, "petr")
+
+	if _, err := st.RequestWithdrawal(ctx, &model.Withdrawal{
+		OrderID: "1", Sum: 1, ProcessedDate: now, User: "ghost"}); err == nil {
+		t.Error("RequestWithdrawal() of unknown user succeeded")
+	}
+
+	addBonus(t, st, "ivan", "100", 500*money.Scale)
+
+	tests := []struct {
+		name  string
+		user  string
+		order string
+		sum   money.Amount
+		want  model.EndPointStatus
+	}{
+		{name: "no_bonuses", user: "petr", order: "2", sum: 1 * money.Scale, want: model.WithdrawalNoBonuses},
+		{name: "not_enough", user: "ivan", order: "2", sum: 500*money.Scale + 1, want: model.WithdrawalNotEnoughBonuses},
+		{name: "accepted", user: "ivan", order: "2", sum: 100_50, want: model.WithdrawalAccepted},
+		{name: "same_order", user: "ivan", order: "2", sum: 1 * money.Scale, want: model.WithdrawalAlreadyRequested},
+		{name: "same_order_other_user", user: "petr", order: "2", sum: 1 * money.Scale, want: model.WithdrawalAlreadyRequested},
+		{name: "whole_balance", user: "ivan", order: "3", sum: 399_50, want: model.WithdrawalAccepted},
+		{name: "empty_balance", user: "ivan", order: "4", sum: 1, want: model.WithdrawalNotEnoughBonuses},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := st.RequestWithdrawal(ctx, &model.Withdrawal{
+				OrderID:       tt.order,
+				Sum:           tt.sum,
+				ProcessedDate: now.Add(time.Duration(i) * time.Second),
+				User:          tt.user,
+			})
+			if err != nil || status != tt.want {
+				t.Errorf("RequestWithdrawal() = %v, %v, want %v", status, err, tt.want)
+			}
+		})
+	}
+
+	checkBalance(t, st, "ivan", 0, 500*money.Scale)
+	checkBalance(t, st, "petr", 0, 0)
+
+	withdrawals, err := st.GetAllWithdrawals(ctx, &model.User{Login: "ivan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withdrawals) != 2 || withdrawals[0].OrderID != "2" || withdrawals[0].Sum != 100_50 ||
+		withdrawals[1].OrderID != "3" || withdrawals[1].Sum != 399_50 {
+		t.Errorf("GetAllWithdrawals() = %+v", withdrawals)
+	}
+	if withdrawals, _ := st.GetAllWithdrawals(ctx, &model.User{Login: "petr"}); len(withdrawals) != 0 {
+		t.Errorf("GetAllWithdrawals() of user without withdrawals = %+v", withdrawals)
+	}
+}
+
+// testConcurrentWithdrawals проверяет, что одновременные списания
+// не уводят баланс в минус
+func testConcurrentWithdrawals(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	addUser(t, st, "ivan")
+	addBonus(t, st, "ivan", "100", 100*money.Scale)
+
+	const count = 10
+	statuses := make([]model.EndPointStatus, count)
+	errs := make([]error, count)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i], errs[i] = st.RequestWithdrawal(ctx, &model.Withdrawal{
+				OrderID:       fmt.Sprint(200 + i),
+				Sum:           30 * money.Scale,
+				ProcessedDate: time.Now(),
+				User:          "ivan",
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := 0
+	for i, el := range statuses {
+		if errs[i] != nil {
+			t.Errorf("RequestWithdrawal() error = %v", errs[i])
+		}
+		if el == model.WithdrawalAccepted {
+			accepted++
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("accepted withdrawals = %v, want 3", accepted)
+	}
+	checkBalance(t, st, "ivan", 10*money.Scale, 90*money.Scale)
+}
+
+func testAdjustments(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	addUser(t, st, "ivan")
+
+	adjustments := []*model.Adjustment{
+		{User: "ivan", Amount: 10 * money.Scale, Reason: "goodwill", Operator: "admin", ProcessedDate: now},
+		// списание может увести баланс в минус
+		{User: "ivan", Amount: -15 * money.Scale, Reason: "chargeback", Operator: "admin", ProcessedDate: now.Add(time.Second)},
+	}
+	for _, el := range adjustments {
+		if err := st.AddAdjustment(ctx, el); err != nil {
+			t.Fatal(err)
+		}
+		if el.ID == 0 {
+			t.Error("AddAdjustment() didn't set ID")
+		}
+	}
+	if adjustments[0].ID == adjustments[1].ID {
+		t.Errorf("AddAdjustment() set same ID %v twice", adjustments[0].ID)
+	}
+	checkBalance(t, st, "ivan", -5*money.Scale, 0)
+
+	list, err := st.GetAllAdjustments(ctx, &model.User{Login: "ivan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Reason != "goodwill" || list[1].Amount != -15*money.Scale ||
+		list[1].Operator != "admin" || list[1].User != "ivan" {
+		t.Errorf("GetAllAdjustments() = %+v", list)
+	}
+}
+
+// testLedgerTotals проверяет суммы журнала по видам операций:
+// списания проводятся по счёту пользователя с минусом
+func testLedgerTotals(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	addUser(t, st, "ivan")
+	addUser(t, st, "petr")
+
+	addBonus(t, st, "ivan", "100", 500*money.Scale)
+	addBonus(t, st, "ivan", "101", 20*money.Scale)
+	for _, amount := range []money.Amount{10 * money.Scale, -15 * money.Scale} {
+		err := st.AddAdjustment(ctx, &model.Adjustment{
+			User: "ivan", Amount: amount, Reason: "goodwill", Operator: "admin", ProcessedDate: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, err := st.RequestWithdrawal(ctx, &model.Withdrawal{
+		OrderID: "2", Sum: 100_50, ProcessedDate: now, User: "ivan"})
+	if err != nil || status != model.WithdrawalAccepted {
+		t.Fatalf("RequestWithdrawal() = %v, %v", status, err)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		want map[string]money.Amount
+	}{
+		{name: "all_kinds", user: "ivan", want: map[string]money.Amount{
+			model.LedgerAccrual:    520 * money.Scale,
+			model.LedgerAdjustment: -5 * money.Scale,
+			model.LedgerWithdrawal: -100_50,
+		}},
+		{name: "no_entries", user: "petr", want: map[string]money.Amount{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			totals, err := st.GetLedgerTotals(ctx, &model.User{Login: tt.user})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(totals) != fmt.Sprint(tt.want) {
+				t.Errorf("GetLedgerTotals() = %v, want %v", totals, tt.want)
+			}
+		})
+	}
+	checkBalance(t, st, "ivan", 414_50, 100_50)
+}
+
+func testDeleteUser(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	addUser(t, st, "ivan")
+	addBonus(t, st, "ivan", "100", 50*money.Scale)
+	status, err := st.RequestWithdrawal(ctx, &model.Withdrawal{
+		OrderID: "200", Sum: 20 * money.Scale, ProcessedDate: now, User: "ivan"})
+	if err != nil || status != model.WithdrawalAccepted {
+		t.Fatalf("RequestWithdrawal() = %v, %v", status, err)
+	}
+	session, token := newSession("phone", "ivan", now)
+	if err := st.AddSession(ctx, session, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetTwoFactorSecret(ctx, "ivan", "secret", []string{"code"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.DeleteUser(ctx, "petr", "deleted-1"); err == nil {
+		t.Error("DeleteUser() of unknown user succeeded")
+	}
+	if err := st.DeleteUser(ctx, "ivan", "deleted-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if userInfo, _ := st.GetUser(ctx, &model.User{Login: "ivan"}); userInfo != nil {
+		t.Errorf("GetUser() after delete = %+v", userInfo)
+	}
+	if session, _ := st.GetSession(ctx, "phone"); session != nil {
+		t.Errorf("GetSession() after delete = %+v", session)
+	}
+	if twoFactor, _ := st.GetTwoFactor(ctx, "ivan"); twoFactor != nil {
+		t.Errorf("GetTwoFactor() after delete = %+v", twoFactor)
+	}
+
+	// заказы, списания и баланс остаются за обезличенным владельцем
+	if orderInfo, _ := st.GetOrder(ctx, "100"); orderInfo == nil || orderInfo.Owner != "deleted-2" {
+		t.Errorf("GetOrder() after delete = %+v", orderInfo)
+	}
+	if withdrawals, _ := st.GetAllWithdrawals(ctx, &model.User{Login: "deleted-2"}); len(withdrawals) != 1 {
+		t.Errorf("GetAllWithdrawals() of anonymized user = %+v", withdrawals)
+	}
+	checkBalance(t, st, "deleted-2", 30*money.Scale, 20*money.Scale)
+	checkBalance(t, st, "ivan", 0, 0)
+
+	// логин снова свободен
+	addUser(t, st, "ivan")
+}
@@ -0,0 +1,132 @@
+// Package totp реализует одноразовые пароли по времени (RFC 6238),
+// совместимые с Google Authenticator и аналогичными приложениями
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period — время действия одного кода
+	Period = 30 * time.Second
+	// Digits — число цифр в коде
+	Digits = 6
+	// Skew — сколько соседних периодов принимается, чтобы учесть
+	// расхождение часов сервера и устройства пользователя
+	Skew = 1
+
+	secretLength = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret генерирует секрет в кодировке base32
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// Counter возвращает номер периода для момента времени t
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code вычисляет код для номера периода counter
+func Code(secret string, counter int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// динамическое усечение, RFC 4226 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
+
+// Validate проверяет код на момент now. Возвращает номер периода, которому
+// соответствует код: вызывающий должен запомнить его и не принимать коды
+// этого и предыдущих периодов повторно
+func Validate(code string, secret string, now time.Time) (bool, int64) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return false, 0
+	}
+
+	current := Counter(now)
+	for i := -Skew; i <= Skew; i++ {
+		expected, err := Code(secret, current+int64(i))
+		if err != nil {
+			return false, 0
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return true, current + int64(i)
+		}
+	}
+
+	return false, 0
+}
+
+// URI возвращает ссылку otpauth:// для добавления секрета в приложение
+func URI(issuer string, account string, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// RecoveryCodeCount — сколько кодов восстановления выдаётся при подключении
+const RecoveryCodeCount = 10
+
+// GenerateRecoveryCodes генерирует одноразовые коды восстановления на случай
+// потери устройства
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(raw))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode вычисляет хеш кода восстановления для хранения в базе.
+// Регистр, пробелы и дефисы при вводе не учитываются
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,78 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// секрет из тестовых векторов RFC 6238
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		name string
+		time int64
+		want string
+	}{
+		// последние 6 цифр значений из приложения B RFC 6238 для SHA1
+		{name: "59", time: 59, want: "287082"},
+		{name: "1111111109", time: 1111111109, want: "081804"},
+		{name: "1234567890", time: 1234567890, want: "005924"},
+		{name: "2000000000", time: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Code(rfcSecret, Counter(time.Unix(tt.time, 0)))
+			if err != nil {
+				t.Fatalf("Code() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Code() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	previous, _ := Code(secret, Counter(now)-1)
+	if ok, counter := Validate(previous, secret, now); !ok || counter != Counter(now)-1 {
+		t.Errorf("Validate() previous period = %v, %v", ok, counter)
+	}
+
+	old, _ := Code(secret, Counter(now)-5)
+	if ok, _ := Validate(old, secret, now); ok {
+		t.Errorf("Validate() accepted expired code")
+	}
+
+	if ok, _ := Validate("12345", secret, now); ok {
+		t.Errorf("Validate() accepted short code")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Gophermart", "user1", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/Gophermart:user1?") || !strings.Contains(uri, "secret=ABC") {
+		t.Errorf("URI() = %v", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(codes[0]) != 11 {
+		t.Fatalf("GenerateRecoveryCodes() = %v", codes)
+	}
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))) {
+		t.Errorf("HashRecoveryCode() depends on case or dashes")
+	}
+}
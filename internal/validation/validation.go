@@ -0,0 +1,213 @@
+// Package validation проверяет учётные данные пользователя и приводит логин
+// к каноническому виду
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	LoginMinLength = 3
+	// совпадает с размером колонки public.users.login
+	LoginMaxLength = 50
+	// argon2 принимает пароль любой длины, ограничение защищает от слишком долгого хеширования
+	PasswordMaxLength = 256
+)
+
+// Policy — требования к паролю
+type Policy struct {
+	PasswordMinLength int
+	// PasswordMinClasses — сколько разных классов символов (буквы, цифры,
+	// прочие символы) должно быть в пароле
+	PasswordMinClasses int
+}
+
+var DefaultPolicy = Policy{
+	PasswordMinLength:  8,
+	PasswordMinClasses: 2,
+}
+
+// FieldError — ошибка в конкретном поле запроса
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors — список ошибок по полям, возвращается клиенту в теле ответа
+type Errors struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *Errors) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, el := range e.Errors {
+		messages = append(messages, el.Field+": "+el.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *Errors) add(field string, message string) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: message})
+}
+
+// NormalizeLogin приводит логин к нормальной форме NFKC и нижнему регистру,
+// чтобы логины, отличающиеся только регистром или способом записи символов, совпадали
+func NormalizeLogin(login string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(login)))
+}
+
+// NormalizePassword приводит пароль к нормальной форме NFKC, чтобы один и тот же
+// пароль, набранный на разных устройствах, давал одинаковый хеш
+func NormalizePassword(password string) string {
+	return norm.NFKC.String(password)
+}
+
+// ValidateLogin проверяет длину и допустимые символы нормализованного логина
+func ValidateLogin(login string) *Errors {
+	errs := &Errors{}
+
+	length := utf8.RuneCountInString(login)
+	if length < LoginMinLength || length > LoginMaxLength {
+		errs.add("login", fmt.Sprintf("длина логина должна быть от %d до %d символов", LoginMinLength, LoginMaxLength))
+	}
+
+	for i, r := range login {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			continue
+		}
+		if i > 0 && (r == '.' || r == '_' || r == '-') {
+			continue
+		}
+		errs.add("login", "логин может содержать только буквы, цифры и символы . _ - и должен начинаться с буквы или цифры")
+		break
+	}
+
+	if len(errs.Errors) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// SuggestLogin строит допустимый логин из имени пользователя у внешнего
+// провайдера: недопустимые символы заменяются на "-", длина обрезается так,
+// чтобы осталось место для суффикса. Возвращает "", если логин построить нельзя
+func SuggestLogin(name string, suffixLength int) string {
+	name = NormalizeLogin(name)
+
+	var builder strings.Builder
+	length := 0
+	for _, r := range name {
+		if length >= LoginMaxLength-suffixLength {
+			break
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '_' {
+			r = '-'
+		}
+		if length == 0 && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			continue
+		}
+		builder.WriteRune(r)
+		length++
+	}
+
+	login := strings.TrimRight(builder.String(), ".-_")
+	if ValidateLogin(login) != nil {
+		return ""
+	}
+	return login
+}
+
+// ValidatePassword проверяет сложность нормализованного пароля
+func ValidatePassword(password string, login string, policy Policy) *Errors {
+	errs := &Errors{}
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.PasswordMinLength {
+		errs.add("password", fmt.Sprintf("пароль должен содержать не менее %d символов", policy.PasswordMinLength))
+	}
+	if length > PasswordMaxLength {
+		errs.add("password", fmt.Sprintf("пароль должен содержать не более %d символов", PasswordMaxLength))
+	}
+
+	var letters, digits, others int
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letters = 1
+		case unicode.IsDigit(r):
+			digits = 1
+		default:
+			others = 1
+		}
+	}
+	if letters+digits+others < policy.PasswordMinClasses {
+		errs.add("password", fmt.Sprintf("пароль должен содержать символы не менее %d типов: буквы, цифры, прочие символы", policy.PasswordMinClasses))
+	}
+
+	if login != "" && strings.EqualFold(password, login) {
+		errs.add("password", "пароль не должен совпадать с логином")
+	}
+
+	if len(errs.Errors) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// APIKeyNameMaxLength — максимальная длина названия ключа API
+const APIKeyNameMaxLength = 100
+
+// ValidateAPIKey проверяет название ключа API и запрошенные права.
+// known — права, которые можно выдать ключу
+func ValidateAPIKey(name string, scopes []string, known []string) *Errors {
+	errs := &Errors{}
+
+	if utf8.RuneCountInString(name) > APIKeyNameMaxLength {
+		errs.add("name", fmt.Sprintf("название ключа должно содержать не более %d символов", APIKeyNameMaxLength))
+	}
+
+	if len(scopes) == 0 {
+		errs.add("scopes", "ключу нужно выдать хотя бы одно право")
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, el := range known {
+			if scope == el {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			errs.add("scopes", "неизвестное право: "+scope)
+		}
+	}
+
+	if len(errs.Errors) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ValidateCredentials нормализует и проверяет логин и пароль при регистрации
+func ValidateCredentials(login string, password string, policy Policy) (string, string, *Errors) {
+	login = NormalizeLogin(login)
+	password = NormalizePassword(password)
+
+	errs := &Errors{}
+	if loginErrs := ValidateLogin(login); loginErrs != nil {
+		errs.Errors = append(errs.Errors, loginErrs.Errors...)
+	}
+	if passwordErrs := ValidatePassword(password, login, policy); passwordErrs != nil {
+		errs.Errors = append(errs.Errors, passwordErrs.Errors...)
+	}
+
+	if len(errs.Errors) == 0 {
+		return login, password, nil
+	}
+	return login, password, errs
+}
@@ -0,0 +1,180 @@
+package validation
+
+import "testing"
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		login      string
+		password   string
+		wantLogin  string
+		wantFields []string
+	}{
+		{
+			name:      "ok",
+			login:     "User.Name_1",
+			password:  "password1",
+			wantLogin: "user.name_1",
+		},
+		{
+			name:      "unicode_normalization",
+			login:     "Ｐｅｔｒ",
+			password:  "пароль-123",
+			wantLogin: "petr",
+		},
+		{
+			name:      "cyrillic_login",
+			login:     "Пётр",
+			password:  "password1",
+			wantLogin: "пётр",
+		},
+		{
+			name:       "empty",
+			login:      "",
+			password:   "",
+			wantLogin:  "",
+			wantFields: []string{"login", "password", "password"},
+		},
+		{
+			name:       "too_long_login",
+			login:      "abcdefghijabcdefghijabcdefghijabcdefghijabcdefghijk",
+			password:   "password1",
+			wantLogin:  "abcdefghijabcdefghijabcdefghijabcdefghijabcdefghijk",
+			wantFields: []string{"login"},
+		},
+		{
+			name:       "invalid_characters",
+			login:      "user name",
+			password:   "password1",
+			wantLogin:  "user name",
+			wantFields: []string{"login"},
+		},
+		{
+			name:       "starts_with_dot",
+			login:      ".user",
+			password:   "password1",
+			wantLogin:  ".user",
+			wantFields: []string{"login"},
+		},
+		{
+			name:       "one_class_password",
+			login:      "user1",
+			password:   "passwordpassword",
+			wantLogin:  "user1",
+			wantFields: []string{"password"},
+		},
+		{
+			name:       "password_equals_login",
+			login:      "user12345",
+			password:   "USER12345",
+			wantLogin:  "user12345",
+			wantFields: []string{"password"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, _, errs := ValidateCredentials(tt.login, tt.password, DefaultPolicy)
+			if login != tt.wantLogin {
+				t.Errorf("ValidateCredentials() login = %v, want %v", login, tt.wantLogin)
+			}
+			var fields []string
+			if errs != nil {
+				for _, el := range errs.Errors {
+					fields = append(fields, el.Field)
+				}
+			}
+			if len(fields) != len(tt.wantFields) {
+				t.Fatalf("ValidateCredentials() errors = %v, want fields %v", errs, tt.wantFields)
+			}
+			for i := range fields {
+				if fields[i] != tt.wantFields[i] {
+					t.Errorf("ValidateCredentials() errors = %v, want fields %v", errs, tt.wantFields)
+				}
+			}
+		})
+	}
+}
+
+func TestSuggestLogin(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		suffixLength int
+		want         string
+	}{
+		{
+			name:  "username",
+			value: "Ivan.Petrov",
+			want:  "ivan.petrov",
+		},
+		{
+			name:  "invalid_characters",
+			value: "@ivan petrov!",
+			want:  "ivan-petrov",
+		},
+		{
+			name:         "too_long",
+			value:        "abcdefghijabcdefghijabcdefghijabcdefghijabcdefghijabcdefghij",
+			suffixLength: 4,
+			want:         "abcdefghijabcdefghijabcdefghijabcdefghijabcdef",
+		},
+		{
+			name:  "too_short",
+			value: "++",
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SuggestLogin(tt.value, tt.suffixLength); got != tt.want {
+				t.Errorf("SuggestLogin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	known := []string{"orders:read", "orders:write"}
+	tests := []struct {
+		name       string
+		keyName    string
+		scopes     []string
+		wantFields []string
+	}{
+		{
+			name:    "ok",
+			keyName: "pos terminal",
+			scopes:  []string{"orders:write"},
+		},
+		{
+			name:       "no_scopes",
+			keyName:    "pos terminal",
+			wantFields: []string{"scopes"},
+		},
+		{
+			name:       "unknown_scope",
+			keyName:    "pos terminal",
+			scopes:     []string{"orders:write", "admin"},
+			wantFields: []string{"scopes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateAPIKey(tt.keyName, tt.scopes, known)
+			var fields []string
+			if errs != nil {
+				for _, el := range errs.Errors {
+					fields = append(fields, el.Field)
+				}
+			}
+			if len(fields) != len(tt.wantFields) {
+				t.Fatalf("ValidateAPIKey() errors = %v, want fields %v", errs, tt.wantFields)
+			}
+			for i := range fields {
+				if fields[i] != tt.wantFields[i] {
+					t.Errorf("ValidateAPIKey() errors = %v, want fields %v", errs, tt.wantFields)
+				}
+			}
+		})
+	}
+}